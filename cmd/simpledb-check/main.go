@@ -0,0 +1,101 @@
+// Command simpledb-check checks the consistency of a database and prints a report in JSON.
+//
+//	simpledb-check -dir <dir> -log <name> [-blksize <size>] [-keyfile <file>] [-tablespace <name>=<dir>]...
+//
+// The report lists every problem the check finds; see table.CheckDatabase for what the check covers. The command
+// only reads the database, so stop the database, or run the command against a copy of it. The command exits with 0
+// when the database has no problem, with 1 when the report lists problems, and with 2 when the check cannot run.
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/nihei9/simple-db/storage"
+	"github.com/nihei9/simple-db/table"
+)
+
+// tablespaceFlags collects -tablespace flags.
+type tablespaceFlags map[string]string
+
+func (f tablespaceFlags) String() string {
+	var s []string
+	for name, dir := range f {
+		s = append(s, name+"="+dir)
+	}
+	return strings.Join(s, ",")
+}
+
+func (f tablespaceFlags) Set(v string) error {
+	i := strings.Index(v, "=")
+	if i <= 0 {
+		return fmt.Errorf("a tablespace must be in the form <name>=<dir>: %v", v)
+	}
+	f[v[:i]] = v[i+1:]
+	return nil
+}
+
+func main() {
+	dir := flag.String("dir", "", "a database directory")
+	logFileName := flag.String("log", "", "the name of the log file of the database")
+	blkSize := flag.Int("blksize", 4096, "the block size of the database")
+	bufSize := flag.Int("bufsize", 100, "the number of buffers to use during the check")
+	keyFile := flag.String("keyfile", "", "a file holding the hex-encoded encryption key of the database")
+	tablespaces := tablespaceFlags{}
+	flag.Var(tablespaces, "tablespace", "a tablespace of the database in the form <name>=<dir> (repeatable)")
+	flag.Parse()
+
+	r, err := run(*dir, *logFileName, *blkSize, *bufSize, *keyFile, tablespaces)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "simpledb-check: %v\n", err)
+		os.Exit(2)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	err = enc.Encode(r)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "simpledb-check: %v\n", err)
+		os.Exit(2)
+	}
+	if !r.OK() {
+		os.Exit(1)
+	}
+}
+
+func run(dir string, logFileName string, blkSize int, bufSize int, keyFile string, tablespaces map[string]string) (*table.CheckReport, error) {
+	if dir == "" || logFileName == "" {
+		return nil, fmt.Errorf("-dir and -log are required")
+	}
+	// A check must not create a database in a wrong directory.
+	s, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !s.IsDir() {
+		return nil, fmt.Errorf("not a directory: %v", dir)
+	}
+	var key []byte
+	if keyFile != "" {
+		b, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		key, err = hex.DecodeString(strings.TrimSpace(string(b)))
+		if err != nil {
+			return nil, fmt.Errorf("invalid encryption key: %w", err)
+		}
+	}
+	return table.CheckDatabase(context.Background(), &storage.StorageConfig{
+		DirPath:       dir,
+		LogFileName:   logFileName,
+		BlkSize:       blkSize,
+		BufSize:       bufSize,
+		EncryptionKey: key,
+		Tablespaces:   tablespaces,
+	})
+}
@@ -0,0 +1,195 @@
+// Command simpledb-inspect prints the on-disk layout of a database for debugging.
+//
+//	simpledb-inspect -dir <dir> -log <name> -table <table> -block <num> [options]
+//	simpledb-inspect -dir <dir> -log <name> -mode log [options]
+//
+// In the page mode, the default, the command decodes a block of a table using the layout in the catalogs and
+// prints the header of the page, every slot with its used/free flag and the offset it holds, and the fields of
+// records with their offsets in the page, raw values, and decoded values. In the log mode, it prints every log
+// record in the order they were written. The command prints JSON instead of text with -json. The command only
+// reads the database, so stop the database, or run the command against a copy of it.
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/nihei9/simple-db/storage"
+	"github.com/nihei9/simple-db/table"
+)
+
+// tablespaceFlags collects -tablespace flags.
+type tablespaceFlags map[string]string
+
+func (f tablespaceFlags) String() string {
+	var s []string
+	for name, dir := range f {
+		s = append(s, name+"="+dir)
+	}
+	return strings.Join(s, ",")
+}
+
+func (f tablespaceFlags) Set(v string) error {
+	i := strings.Index(v, "=")
+	if i <= 0 {
+		return fmt.Errorf("a tablespace must be in the form <name>=<dir>: %v", v)
+	}
+	f[v[:i]] = v[i+1:]
+	return nil
+}
+
+func main() {
+	dir := flag.String("dir", "", "a database directory")
+	logFileName := flag.String("log", "", "the name of the log file of the database")
+	blkSize := flag.Int("blksize", 4096, "the block size of the database")
+	keyFile := flag.String("keyfile", "", "a file holding the hex-encoded encryption key of the database")
+	tablespaces := tablespaceFlags{}
+	flag.Var(tablespaces, "tablespace", "a tablespace of the database in the form <name>=<dir> (repeatable)")
+	mode := flag.String("mode", "page", "what to print: page or log")
+	tableName := flag.String("table", "", "the table to inspect in the page mode")
+	blkNum := flag.Int("block", 0, "the number of the block to inspect in the page mode")
+	asJSON := flag.Bool("json", false, "print JSON instead of text")
+	flag.Parse()
+
+	err := run(os.Stdout, *mode, *asJSON, *tableName, *blkNum, *dir, *logFileName, *blkSize, *keyFile, tablespaces)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "simpledb-inspect: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(w io.Writer, mode string, asJSON bool, tableName string, blkNum int, dir string, logFileName string, blkSize int, keyFile string, tablespaces map[string]string) error {
+	if dir == "" || logFileName == "" {
+		return fmt.Errorf("-dir and -log are required")
+	}
+	// An inspection must not create a database in a wrong directory.
+	s, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !s.IsDir() {
+		return fmt.Errorf("not a directory: %v", dir)
+	}
+	var key []byte
+	if keyFile != "" {
+		b, err := os.ReadFile(keyFile)
+		if err != nil {
+			return err
+		}
+		key, err = hex.DecodeString(strings.TrimSpace(string(b)))
+		if err != nil {
+			return fmt.Errorf("invalid encryption key: %w", err)
+		}
+	}
+	config := &storage.StorageConfig{
+		DirPath:       dir,
+		LogFileName:   logFileName,
+		BlkSize:       blkSize,
+		BufSize:       10,
+		EncryptionKey: key,
+		Tablespaces:   tablespaces,
+	}
+
+	ctx := context.Background()
+	var v interface{}
+	switch mode {
+	case "page":
+		if tableName == "" {
+			return fmt.Errorf("-table is required in the page mode")
+		}
+		v, err = table.InspectBlock(ctx, config, tableName, blkNum)
+	case "log":
+		var st *storage.Storage
+		st, err = storage.InitStorage(ctx, config)
+		if err != nil {
+			return err
+		}
+		defer st.Close()
+		v, err = st.InspectLog()
+	default:
+		return fmt.Errorf("unknown mode: %v", mode)
+	}
+	if err != nil {
+		return err
+	}
+
+	if asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	switch v := v.(type) {
+	case *table.PageDump:
+		printPage(tw, v)
+	case []*storage.LogRecordDump:
+		printLog(tw, v)
+	}
+	return tw.Flush()
+}
+
+func printPage(w io.Writer, d *table.PageDump) {
+	fmt.Fprintf(w, "table: %v, file: %v, block: %v\n", d.Table, d.File, d.BlkNum)
+	fmt.Fprintf(w, "slot count: %v, free space end: %v, fragmented bytes: %v\n", d.SlotCount, d.FreeSpaceEnd, d.FragmentedBytes)
+	if d.Error != "" {
+		fmt.Fprintf(w, "error: %v\n", d.Error)
+		return
+	}
+	for _, s := range d.Slots {
+		state := "free"
+		if s.Used {
+			state = "used"
+		}
+		fmt.Fprintf(w, "slot %v\t%v\tentry: %v\trecord: %v", s.Slot, state, s.EntryOffset, s.RecordOffset)
+		if s.Error != "" {
+			fmt.Fprintf(w, "\terror: %v", s.Error)
+		}
+		fmt.Fprintln(w)
+		for _, f := range s.Fields {
+			fmt.Fprintf(w, "  %v\t%v\toffset: %v\traw: %v\t", f.Name, f.Type, f.Offset, f.Raw)
+			if f.Error != "" {
+				fmt.Fprintf(w, "error: %v\n", f.Error)
+				continue
+			}
+			if str, ok := f.Value.(string); ok {
+				fmt.Fprintf(w, "value: %q\n", str)
+				continue
+			}
+			fmt.Fprintf(w, "value: %v\n", f.Value)
+		}
+	}
+}
+
+func printLog(w io.Writer, dumps []*storage.LogRecordDump) {
+	for _, d := range dumps {
+		fmt.Fprintf(w, "%v:%v\t", d.LogBlkNum, d.LogOffset)
+		if d.Error != "" {
+			fmt.Fprintf(w, "error: %v\n", d.Error)
+			continue
+		}
+		fmt.Fprintf(w, "%v\ttx: %v", d.Op, d.TxNum)
+		if d.FileName != "" {
+			fmt.Fprintf(w, "\tfile: %v", d.FileName)
+		}
+		if d.BlkNum != nil {
+			fmt.Fprintf(w, "\tblock: %v", *d.BlkNum)
+		}
+		if d.Offset != nil {
+			fmt.Fprintf(w, "\toffset: %v", *d.Offset)
+		}
+		if d.Value != "" {
+			fmt.Fprintf(w, "\tvalue: %v", d.Value)
+		}
+		if d.Time != "" {
+			fmt.Fprintf(w, "\ttime: %v", d.Time)
+		}
+		fmt.Fprintln(w)
+	}
+}
@@ -0,0 +1,65 @@
+// Command simpledb-pitr rolls a backup forward to a point in time by replaying an archived log.
+//
+//	simpledb-pitr -backup <dir> -archive <dir> -log <name> -target <time> [-keyfile <file>]
+//
+// The command modifies the backup directory in place, so run it against a copy of the backup. The target time is
+// in RFC 3339 format, such as 2021-05-01T12:00:00+09:00. When the original database encrypts its files, pass
+// the key with -keyfile.
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/nihei9/simple-db/storage"
+)
+
+func main() {
+	backupDir := flag.String("backup", "", "a backup directory that Storage.Backup made")
+	archiveDir := flag.String("archive", "", "an archive directory of the original database")
+	logFileName := flag.String("log", "", "the name of the log file of the original database")
+	blkSize := flag.Int("blksize", 4096, "the block size of the original database")
+	bufSize := flag.Int("bufsize", 100, "the number of buffers to use during the recovery")
+	target := flag.String("target", "", "a target time in RFC 3339 format")
+	keyFile := flag.String("keyfile", "", "a file holding the hex-encoded encryption key of the original database")
+	flag.Parse()
+
+	err := run(*backupDir, *archiveDir, *logFileName, *blkSize, *bufSize, *target, *keyFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "simpledb-pitr: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(backupDir string, archiveDir string, logFileName string, blkSize int, bufSize int, target string, keyFile string) error {
+	if backupDir == "" || archiveDir == "" || logFileName == "" || target == "" {
+		return fmt.Errorf("-backup, -archive, -log, and -target are required")
+	}
+	t, err := time.Parse(time.RFC3339Nano, target)
+	if err != nil {
+		return fmt.Errorf("invalid target time: %w", err)
+	}
+	var key []byte
+	if keyFile != "" {
+		b, err := os.ReadFile(keyFile)
+		if err != nil {
+			return err
+		}
+		key, err = hex.DecodeString(strings.TrimSpace(string(b)))
+		if err != nil {
+			return fmt.Errorf("invalid encryption key: %w", err)
+		}
+	}
+	return storage.RecoverBackupToTime(context.Background(), &storage.StorageConfig{
+		DirPath:       backupDir,
+		LogFileName:   logFileName,
+		BlkSize:       blkSize,
+		BufSize:       bufSize,
+		EncryptionKey: key,
+	}, archiveDir, t)
+}
@@ -39,17 +39,17 @@ func TestPlanner(t *testing.T) {
 		}
 	}
 
-	st, err := storage.InitStorage(context.Background(), &storage.StorageConfig{
+	st, err := storage.InitStorage(context.Background(), storage.TestConfig(&storage.StorageConfig{
 		DirPath:     testDir,
 		LogFileName: logFileName,
 		BlkSize:     1000,
 		BufSize:     10,
-	})
+	}))
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	tx, err := st.NewTransaction()
+	tx, err := st.NewTransaction(context.Background())
 	if err != nil {
 		t.Fatal(err)
 	}
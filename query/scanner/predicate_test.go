@@ -129,12 +129,12 @@ func TestPredicate(t *testing.T) {
 		tmpTableName = strings.TrimSuffix(filepath.Base(dbFilePath), ".tbl")
 	}
 
-	st, err := storage.InitStorage(context.Background(), &storage.StorageConfig{
+	st, err := storage.InitStorage(context.Background(), storage.TestConfig(&storage.StorageConfig{
 		DirPath:     testDir,
 		LogFileName: logFileName,
 		BlkSize:     400,
 		BufSize:     10,
-	})
+	}))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -144,7 +144,7 @@ func TestPredicate(t *testing.T) {
 
 	la := table.NewLayout(sc)
 
-	tx, err := st.NewTransaction()
+	tx, err := st.NewTransaction(context.Background())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -30,12 +30,12 @@ func TestTableScanner(t *testing.T) {
 		tmpTableName = strings.TrimSuffix(filepath.Base(dbFilePath), ".tbl")
 	}
 
-	st, err := storage.InitStorage(context.Background(), &storage.StorageConfig{
+	st, err := storage.InitStorage(context.Background(), storage.TestConfig(&storage.StorageConfig{
 		DirPath:     testDir,
 		LogFileName: logFileName,
 		BlkSize:     400,
 		BufSize:     10,
-	})
+	}))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -47,7 +47,7 @@ func TestTableScanner(t *testing.T) {
 
 	la := table.NewLayout(sc)
 
-	tx, err := st.NewTransaction()
+	tx, err := st.NewTransaction(context.Background())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -192,12 +192,12 @@ func TestSelectScanner(t *testing.T) {
 		tmpTableName = strings.TrimSuffix(filepath.Base(dbFilePath), ".tbl")
 	}
 
-	st, err := storage.InitStorage(context.Background(), &storage.StorageConfig{
+	st, err := storage.InitStorage(context.Background(), storage.TestConfig(&storage.StorageConfig{
 		DirPath:     testDir,
 		LogFileName: logFileName,
 		BlkSize:     400,
 		BufSize:     10,
-	})
+	}))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -207,7 +207,7 @@ func TestSelectScanner(t *testing.T) {
 
 	la := table.NewLayout(sc)
 
-	tx, err := st.NewTransaction()
+	tx, err := st.NewTransaction(context.Background())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -317,12 +317,12 @@ func TestProjectScanner(t *testing.T) {
 		tmpTableName = strings.TrimSuffix(filepath.Base(dbFilePath), ".tbl")
 	}
 
-	st, err := storage.InitStorage(context.Background(), &storage.StorageConfig{
+	st, err := storage.InitStorage(context.Background(), storage.TestConfig(&storage.StorageConfig{
 		DirPath:     testDir,
 		LogFileName: logFileName,
 		BlkSize:     400,
 		BufSize:     10,
-	})
+	}))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -333,7 +333,7 @@ func TestProjectScanner(t *testing.T) {
 
 	la := table.NewLayout(sc)
 
-	tx, err := st.NewTransaction()
+	tx, err := st.NewTransaction(context.Background())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -525,12 +525,12 @@ func TestProductScanner(t *testing.T) {
 		}
 	}
 
-	st, err := storage.InitStorage(context.Background(), &storage.StorageConfig{
+	st, err := storage.InitStorage(context.Background(), storage.TestConfig(&storage.StorageConfig{
 		DirPath:     testDir,
 		LogFileName: logFileName,
 		BlkSize:     400,
 		BufSize:     10,
-	})
+	}))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -543,7 +543,7 @@ func TestProductScanner(t *testing.T) {
 
 		la := table.NewLayout(sc)
 
-		tx, err := st.NewTransaction()
+		tx, err := st.NewTransaction(context.Background())
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -601,7 +601,7 @@ func TestProductScanner(t *testing.T) {
 
 		la := table.NewLayout(sc)
 
-		tx, err := st.NewTransaction()
+		tx, err := st.NewTransaction(context.Background())
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -0,0 +1,489 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// archiving reports whether the log manager archives the log.
+func (m *logManager) archiving() bool {
+	return m.archiveDirPath != ""
+}
+
+// archiveSegmentName returns the name of the file holding an archived log block.
+func archiveSegmentName(logFileName string, blkNum int) string {
+	return fmt.Sprintf("%v.%010d", logFileName, blkNum)
+}
+
+// archive copies the current log page into the archive directory. The log manager calls this function whenever it
+// writes the page, so an archived block is never older than the block on a disk. The caller must hold the lock.
+func (m *logManager) archive() error {
+	if !m.archiving() {
+		return nil
+	}
+	// We write a temporary file and rename it, so that a replica reading the archive never sees a half-written
+	// block.
+	path := filepath.Join(m.archiveDirPath, archiveSegmentName(m.logFileName, m.currentBlk.BlkNum))
+	f, err := os.OpenFile(path+".tmp", os.O_CREATE|os.O_WRONLY|os.O_TRUNC|os.O_SYNC, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open an archive file: %w", err)
+	}
+	b, err := m.fm.sealBlock(m.currentBlk, m.logPage)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	_, err = f.Write(b)
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to archive a log block: %w", err)
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// readArchivedLogBlocks returns the log blocks of a backup brought up to date with an archive. The archive holds
+// newer copies of log blocks than the backup, so a block in the archive takes the place of the same block in
+// the backup. `c` decrypts the blocks when the original database encrypts its files.
+func readArchivedLogBlocks(blkSize int, c *blockCipher, backupDirPath string, logFileName string, archiveDirPath string) ([][]byte, error) {
+	var blks [][]byte
+	{
+		b, err := os.ReadFile(filepath.Join(backupDirPath, logFileName))
+		if err != nil {
+			return nil, err
+		}
+		size := blkSize + c.overhead()
+		for i := 0; i+size <= len(b); i += size {
+			blk, err := openArchivedLogBlock(blkSize, c, logFileName, i/size, b[i:i+size])
+			if err != nil {
+				return nil, err
+			}
+			blks = append(blks, blk)
+		}
+	}
+	entries, err := os.ReadDir(archiveDirPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasPrefix(e.Name(), logFileName+".") {
+			continue
+		}
+		blkNum, err := strconv.Atoi(strings.TrimPrefix(e.Name(), logFileName+"."))
+		if err != nil || blkNum < 0 {
+			continue
+		}
+		b, err := readArchivedLogBlock(blkSize, c, archiveDirPath, logFileName, blkNum)
+		if err != nil {
+			return nil, err
+		}
+		for len(blks) <= blkNum {
+			blks = append(blks, nil)
+		}
+		blks[blkNum] = b
+	}
+	for blkNum, b := range blks {
+		if b == nil {
+			return nil, fmt.Errorf("a log block is missing: %v", blkNum)
+		}
+	}
+	return blks, nil
+}
+
+// readArchivedLogBlock reads a log block from an archive. When the archive doesn't have the block yet,
+// readArchivedLogBlock returns nil.
+func readArchivedLogBlock(blkSize int, c *blockCipher, archiveDirPath string, logFileName string, blkNum int) ([]byte, error) {
+	b, err := os.ReadFile(filepath.Join(archiveDirPath, archiveSegmentName(logFileName, blkNum)))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if len(b) != blkSize+c.overhead() {
+		return nil, fmt.Errorf("an archive file has an invalid size: block: %v, size: %v byte", blkNum, len(b))
+	}
+	return openArchivedLogBlock(blkSize, c, logFileName, blkNum, b)
+}
+
+// openArchivedLogBlock returns the contents of a log block from the bytes in a file.
+func openArchivedLogBlock(blkSize int, c *blockCipher, logFileName string, blkNum int, data []byte) ([]byte, error) {
+	p, err := newPage(blkSize)
+	if err != nil {
+		return nil, err
+	}
+	err = c.open(NewBlockID(logFileName, blkNum), data, p.buf)
+	if err != nil {
+		return nil, err
+	}
+	return p.buf, nil
+}
+
+// parseLogBlock returns the log records of a log block in the order they were written.
+func parseLogBlock(b []byte) ([]*logRecord, error) {
+	p := &page{
+		buf: b,
+	}
+	boundary, _, err := p.readInt64(0)
+	if err != nil {
+		return nil, err
+	}
+	// A log block holds its records from the newest one, so we reverse them.
+	var recs []*logRecord
+	for offset := int(boundary); offset < len(b); {
+		rec, n, err := p.read(offset)
+		if err != nil {
+			return nil, err
+		}
+		offset += n
+		r := &logRecord{}
+		err = r.unmarshalBytes(rec)
+		if err != nil {
+			return nil, err
+		}
+		recs = append(recs, r)
+	}
+	for i, j := 0, len(recs)-1; i < j; i, j = i+1, j-1 {
+		recs[i], recs[j] = recs[j], recs[i]
+	}
+	return recs, nil
+}
+
+// readBackupLabel returns the label of a backup.
+func readBackupLabel(dirPath string) (string, error) {
+	b, err := os.ReadFile(filepath.Join(dirPath, backupLabelFileName))
+	if err != nil {
+		return "", fmt.Errorf("failed to read a backup label: %w", err)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// findReplayStart returns the index of the log record to replay from and the marker of a backup. We replay a log
+// from the last checkpoint before the backup. A recovery wrote the checkpoint after all transactions before it had
+// finished, so the history after the checkpoint describes the database completely.
+func findReplayStart(recs []*logRecord, label string) (int, *logRecord, error) {
+	marker := -1
+	for i, r := range recs {
+		if r.Op == opBackup && r.FileName == label {
+			marker = i
+			break
+		}
+	}
+	if marker < 0 {
+		return 0, nil, fmt.Errorf("an archive doesn't contain a backup: %v", label)
+	}
+	for i := marker; i >= 0; i-- {
+		if recs[i].Op == opCheckPoint {
+			return i + 1, recs[marker], nil
+		}
+	}
+	return 0, recs[marker], nil
+}
+
+// RecoverBackupToTime restores a backup that Storage.Backup made and rolls it forward to `target` by replaying
+// the log archived in `archiveDirPath`. The database ends up holding the transactions that committed by `target`.
+// The original database must have archived its log since it last recovered, so that the archive holds after-images
+// of all modifications. Log sequence numbers restart whenever a storage opens, so a time identifies the point.
+// A prepared transaction that hadn't committed by `target` is rolled back.
+//
+// `config.DirPath` is the backup directory, and `config.ArchiveDirPath` is ignored. This function modifies
+// the backup in place; when it fails, the backup cannot be used anymore, so keep a copy of the backup.
+func RecoverBackupToTime(ctx context.Context, config *StorageConfig, archiveDirPath string, target time.Time) error {
+	c := *config
+	c.ArchiveDirPath = ""
+	config = &c
+
+	label, err := readBackupLabel(config.DirPath)
+	if err != nil {
+		return err
+	}
+	var recs []*logRecord
+	{
+		c, err := newBlockCipherFromConfig(config)
+		if err != nil {
+			return err
+		}
+		blks, err := readArchivedLogBlocks(config.BlkSize, c, config.DirPath, filepath.Base(config.LogFileName), archiveDirPath)
+		if err != nil {
+			return fmt.Errorf("failed to read an archived log: %w", err)
+		}
+		for _, b := range blks {
+			rs, err := parseLogBlock(b)
+			if err != nil {
+				return fmt.Errorf("failed to read an archived log: %w", err)
+			}
+			recs = append(recs, rs...)
+		}
+	}
+	from, marker, err := findReplayStart(recs, label)
+	if err != nil {
+		return err
+	}
+	if target.UnixNano() < marker.time() {
+		return fmt.Errorf("a target time must not be before a backup: target: %v, backup: %v", target, time.Unix(0, marker.time()))
+	}
+
+	err = RestoreBackup(ctx, config)
+	if err != nil {
+		return err
+	}
+
+	st, err := InitStorage(ctx, config)
+	if err != nil {
+		return err
+	}
+	r := newReplayer(ctx, st)
+	for _, rec := range recs[from:] {
+		if rec.Op == opCommit && rec.time() > target.UnixNano() {
+			break
+		}
+		err := r.apply(rec)
+		if err != nil {
+			st.Close()
+			return fmt.Errorf("failed to replay a log: %w", err)
+		}
+	}
+	err = r.undoUnfinished()
+	if err != nil {
+		st.Close()
+		return fmt.Errorf("failed to replay a log: %w", err)
+	}
+	return st.Close()
+}
+
+// replayer repeats the history that the log records of another database describe. Besides applying after-images,
+// a replayer undoes the modifications of transactions where they rolled back, or where a recovery undid them,
+// as the other database did. A replayer runs a transaction for each transaction of the other database, so that
+// transactions reading the storage don't see modifications that haven't committed yet.
+type replayer struct {
+	ctx context.Context
+	st  *Storage
+
+	// serials maps the numbers of the transactions of the other database to serial numbers. Transaction numbers
+	// restart whenever the other database opens, so the replayer identifies the transactions by serial numbers.
+	serials    map[transactionNum]int
+	nextSerial int
+
+	// txs holds the transactions replaying unfinished transactions of the other database.
+	txs map[int]*Transaction
+
+	// gids holds the global IDs of the prepared transactions.
+	gids map[int]string
+
+	// undoRecs holds the log records unfinished transactions may undo, per transaction. nextSeq numbers the records
+	// in the order they were written.
+	undoRecs map[int][]*replayedLogRecord
+	nextSeq  int
+	fileOps  map[int][]*logRecord
+}
+
+type replayedLogRecord struct {
+	seq int
+	rec *logRecord
+}
+
+func newReplayer(ctx context.Context, st *Storage) *replayer {
+	return &replayer{
+		ctx:      ctx,
+		st:       st,
+		serials:  map[transactionNum]int{},
+		txs:      map[int]*Transaction{},
+		gids:     map[int]string{},
+		undoRecs: map[int][]*replayedLogRecord{},
+		fileOps:  map[int][]*logRecord{},
+	}
+}
+
+// serial returns the serial number of a transaction of the other database.
+func (r *replayer) serial(txNum transactionNum) int {
+	if s, ok := r.serials[txNum]; ok {
+		return s
+	}
+	return r.newSerial(txNum)
+}
+
+func (r *replayer) newSerial(txNum transactionNum) int {
+	r.nextSerial++
+	r.serials[txNum] = r.nextSerial
+	return r.nextSerial
+}
+
+// transaction returns the transaction replaying a transaction of the other database.
+func (r *replayer) transaction(serial int) (*Transaction, error) {
+	if tx, ok := r.txs[serial]; ok {
+		return tx, nil
+	}
+	// Replaying must wait for transactions reading the storage as long as it takes.
+	tx, err := r.st.NewTransaction(r.ctx, WithLockTimeout(0))
+	if err != nil {
+		return nil, err
+	}
+	r.txs[serial] = tx
+	return tx, nil
+}
+
+func (r *replayer) finish(serial int) {
+	delete(r.txs, serial)
+	delete(r.gids, serial)
+	delete(r.undoRecs, serial)
+	delete(r.fileOps, serial)
+}
+
+func (r *replayer) apply(rec *logRecord) error {
+	switch rec.Op {
+	case opStart:
+		// A transaction having the same number may have been running when the other database stopped. It stays
+		// unfinished until the next checkpoint.
+		r.newSerial(rec.TxNum)
+	case opCheckPoint:
+		// A checkpoint lists the prepared transactions that keep running after it.
+		txNums, _ := rec.Val.([]int)
+		keep := map[int]struct{}{}
+		for _, n := range txNums {
+			keep[r.serial(transactionNum(n))] = struct{}{}
+		}
+		return r.undoUnfinishedExcept(keep)
+	case opCommit:
+		serial := r.serial(rec.TxNum)
+		tx, ok := r.txs[serial]
+		if !ok {
+			return nil
+		}
+		for _, op := range r.fileOps[serial] {
+			*tx.fileOps = append(*tx.fileOps, op)
+		}
+		r.finish(serial)
+		return tx.Commit()
+	case opRollBack:
+		serial := r.serial(rec.TxNum)
+		tx, ok := r.txs[serial]
+		if !ok {
+			return nil
+		}
+		rs := r.undoRecs[serial]
+		for i := len(rs) - 1; i >= 0; i-- {
+			err := tx.rm.undo(tx, rs[i].rec)
+			if err != nil {
+				return err
+			}
+		}
+		r.finish(serial)
+		return tx.Rollback()
+	case opPrepare:
+		return r.prepare(r.serial(rec.TxNum), rec.Val.(string))
+	case opDropFile, opTruncateFile:
+		serial := r.serial(rec.TxNum)
+		_, err := r.transaction(serial)
+		if err != nil {
+			return err
+		}
+		r.fileOps[serial] = append(r.fileOps[serial], rec)
+	case opSetInt64, opSetUint64, opSetString, opSetBytes, opSetHintBytes:
+		serial := r.serial(rec.TxNum)
+		_, err := r.transaction(serial)
+		if err != nil {
+			return err
+		}
+		r.nextSeq++
+		r.undoRecs[serial] = append(r.undoRecs[serial], &replayedLogRecord{
+			seq: r.nextSeq,
+			rec: rec,
+		})
+	case opRedoBytes:
+		tx, err := r.transaction(r.serial(rec.TxNum))
+		if err != nil {
+			return err
+		}
+		return tx.rm.redo(tx, rec)
+	}
+	return nil
+}
+
+// prepare marks a transaction prepared. When a recovery of the other database wrote a prepared transaction again,
+// the transaction that replayed the original one takes over, so that its modifications stay in place.
+func (r *replayer) prepare(serial int, gid string) error {
+	for s, g := range r.gids {
+		if g != gid || s == serial {
+			continue
+		}
+		orig, ok := r.txs[s]
+		if !ok {
+			break
+		}
+		// The log records written again contain only before-images, so the transaction replaying them hasn't
+		// modified anything.
+		if tx, ok := r.txs[serial]; ok {
+			err := tx.Rollback()
+			if err != nil {
+				return err
+			}
+		}
+		r.finish(s)
+		r.txs[serial] = orig
+		break
+	}
+	_, err := r.transaction(serial)
+	if err != nil {
+		return err
+	}
+	r.gids[serial] = gid
+	return nil
+}
+
+// undoUnfinished undoes the modifications of unfinished transactions as a recovery does, and rolls back
+// the transactions replaying them. Prepared transactions are rolled back as well.
+func (r *replayer) undoUnfinished() error {
+	return r.undoUnfinishedExcept(nil)
+}
+
+// undoUnfinishedExcept undoes unfinished transactions except the transactions `keep` holds.
+func (r *replayer) undoUnfinishedExcept(keep map[int]struct{}) error {
+	type undoRec struct {
+		tx *Transaction
+		*replayedLogRecord
+	}
+	var undoRecs []undoRec
+	for serial, rs := range r.undoRecs {
+		if _, ok := keep[serial]; ok {
+			continue
+		}
+		tx, ok := r.txs[serial]
+		if !ok {
+			continue
+		}
+		for _, u := range rs {
+			undoRecs = append(undoRecs, undoRec{tx: tx, replayedLogRecord: u})
+		}
+	}
+	// Undo the records in the reverse order they were written, across transactions.
+	sort.Slice(undoRecs, func(i, j int) bool {
+		return undoRecs[i].seq > undoRecs[j].seq
+	})
+	for _, u := range undoRecs {
+		// Like rolling back, undoing must not be interrupted.
+		err := u.tx.rm.undo(u.tx.WithContext(context.Background()), u.rec)
+		if err != nil {
+			return err
+		}
+	}
+	for serial, tx := range r.txs {
+		if _, ok := keep[serial]; ok {
+			continue
+		}
+		r.finish(serial)
+		err := tx.Rollback()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
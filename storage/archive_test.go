@@ -0,0 +1,377 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func copyTestDir(t *testing.T, src string, dst string) {
+	t.Helper()
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Mkdir(dst, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		b, err := os.ReadFile(filepath.Join(src, e.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(filepath.Join(dst, e.Name()), b, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRecoverBackupToTime(t *testing.T) {
+	testDir, err := MakeTestDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+
+	dbDir := filepath.Join(testDir, "db")
+	err = os.Mkdir(dbDir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logFilePath, err := MakeTestLogFile(dbDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logFileName := filepath.Base(logFilePath)
+	dbFilePath, err := MakeTestTableFile(dbDir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbFileName := filepath.Base(dbFilePath)
+	archiveDir := filepath.Join(testDir, "archive")
+	backupDir := filepath.Join(testDir, "backup")
+
+	ctx := context.Background()
+	config := TestConfig(&StorageConfig{
+		DirPath:        dbDir,
+		LogFileName:    logFileName,
+		BlkSize:        400,
+		BufSize:        2,
+		ArchiveDirPath: archiveDir,
+	})
+	st, err := InitStorage(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write := func(st *Storage, vals map[int]int64) *Transaction {
+		t.Helper()
+		tx, err := st.NewTransaction(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// We visit the blocks in order so that allocating a block gives the block number we expect.
+		var blkNums []int
+		for blkNum := range vals {
+			blkNums = append(blkNums, blkNum)
+		}
+		sort.Ints(blkNums)
+		for _, blkNum := range blkNums {
+			v := vals[blkNum]
+			c, err := tx.BlockCount(dbFileName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			blk := NewBlockID(dbFileName, blkNum)
+			if blkNum >= c {
+				blk, err = tx.AllocBlock(dbFileName)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			err = tx.Pin(blk)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = tx.WriteInt64(blk.Hash, 0, v, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// A modification without an undo record must be replayed as well.
+			err = tx.WriteInt64(blk.Hash, 100, v+1, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = tx.Unpin(blk)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return tx
+	}
+	commit := func(tx *Transaction) time.Time {
+		t.Helper()
+		err := tx.Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The next commit gets a later timestamp.
+		time.Sleep(time.Millisecond)
+		return time.Now()
+	}
+
+	{
+		tx, err := st.NewTransaction(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tx.Recover()
+		if err != nil {
+			t.Fatal(err)
+		}
+		commit(tx)
+	}
+	commit(write(st, map[int]int64{0: 100, 1: 100}))
+
+	// tx2 begins before the backup and commits after that.
+	tx2 := write(st, map[int]int64{0: 200})
+	err = st.bm.flushAll(tx2.txNum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = st.Backup(backupDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	afterTx2 := commit(tx2)
+	afterTx3 := commit(write(st, map[int]int64{1: 300, 2: 301}))
+	{
+		tx := write(st, map[int]int64{0: 400})
+		err := tx.Rollback()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	afterTx5 := commit(write(st, map[int]int64{1: 500}))
+
+	// A crash interrupts tx6, and a recovery undoes it after a restart.
+	{
+		tx6 := write(st, map[int]int64{0: 600})
+		err := st.bm.flushAll(tx6.txNum)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = st.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	st, err = InitStorage(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	{
+		tx, err := st.NewTransaction(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tx.Recover()
+		if err != nil {
+			t.Fatal(err)
+		}
+		commit(tx)
+	}
+	afterTx7 := commit(write(st, map[int]int64{1: 700}))
+	err = st.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		caption string
+		target  time.Time
+		vals    []int64
+	}{
+		{
+			// tx3 allocated a block before the target. Like a recovery, undoing tx3 leaves the block in the file.
+			caption: "a backup rolled forward to a time contains a transaction that began before the backup",
+			target:  afterTx2,
+			vals:    []int64{200, 100, 0},
+		},
+		{
+			caption: "a backup rolled forward to a time contains blocks allocated after the backup",
+			target:  afterTx3,
+			vals:    []int64{200, 300, 301},
+		},
+		{
+			caption: "a backup rolled forward to a time doesn't contain rolled-back modifications",
+			target:  afterTx5,
+			vals:    []int64{200, 500, 301},
+		},
+		{
+			caption: "a backup rolled forward across a restart doesn't contain modifications a recovery undid",
+			target:  afterTx7,
+			vals:    []int64{200, 700, 301},
+		},
+	}
+	for i, tt := range tests {
+		t.Run(tt.caption, func(t *testing.T) {
+			dir := filepath.Join(testDir, "pitr", string(rune('a'+i)))
+			err := os.MkdirAll(filepath.Dir(dir), 0700)
+			if err != nil {
+				t.Fatal(err)
+			}
+			copyTestDir(t, backupDir, dir)
+			rconfig := TestConfig(&StorageConfig{
+				DirPath:     dir,
+				LogFileName: logFileName,
+				BlkSize:     400,
+				BufSize:     2,
+			})
+			err = RecoverBackupToTime(ctx, rconfig, archiveDir, tt.target)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rst, err := InitStorage(ctx, rconfig)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rst.Close()
+			tx, err := rst.NewReadOnlyTransaction(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tx.Commit()
+			c, err := tx.BlockCount(dbFileName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c != len(tt.vals) {
+				t.Fatalf("unexpected block count: want: %v, got: %v", len(tt.vals), c)
+			}
+			for blkNum, want := range tt.vals {
+				blk := NewBlockID(dbFileName, blkNum)
+				err := tx.Pin(blk)
+				if err != nil {
+					t.Fatal(err)
+				}
+				v, err := tx.ReadInt64(blk.Hash, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				u, err := tx.ReadInt64(blk.Hash, 100)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if v != want {
+					t.Fatalf("unexpected value: block: %v, want: %v, got: %v", blkNum, want, v)
+				}
+				// Rolling back doesn't undo a modification without an undo record.
+				if u < want+1 {
+					t.Fatalf("unexpected value written without an undo record: block: %v, got: %v", blkNum, u)
+				}
+				err = tx.Unpin(blk)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			_, err = os.Stat(filepath.Join(dir, backupLabelFileName))
+			if !os.IsNotExist(err) {
+				t.Fatalf("a restored backup must not have a label: %v", err)
+			}
+		})
+	}
+
+	t.Run("a backup cannot be rolled back to a time before the backup", func(t *testing.T) {
+		dir := filepath.Join(testDir, "pitr", "before")
+		copyTestDir(t, backupDir, dir)
+		err := RecoverBackupToTime(ctx, TestConfig(&StorageConfig{
+			DirPath:     dir,
+			LogFileName: logFileName,
+			BlkSize:     400,
+			BufSize:     2,
+		}), archiveDir, afterTx2.Add(-time.Hour))
+		if err == nil {
+			t.Fatal("a recovery to a time before a backup must fail")
+		}
+	})
+}
+
+func TestReplayer_apply(t *testing.T) {
+	testDir, err := MakeTestDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+	logFilePath, err := MakeTestLogFile(testDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbFilePath, err := MakeTestTableFile(testDir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbFileName := filepath.Base(dbFilePath)
+
+	ctx := context.Background()
+	st, err := InitStorage(ctx, TestConfig(&StorageConfig{
+		DirPath:     testDir,
+		LogFileName: filepath.Base(logFilePath),
+		BlkSize:     400,
+		BufSize:     2,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	var blk *BlockID
+	{
+		tx, err := st.NewTransaction(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blk, err = tx.AllocBlock(dbFileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tx.Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("finished transactions don't leave their undo records behind", func(t *testing.T) {
+		r := newReplayer(ctx, st)
+		for i := 0; i < 100; i++ {
+			txNum := transactionNum(i + 1)
+			end := newCommitLogRecord(txNum)
+			if i%2 == 1 {
+				end = newRollbackLogRecord(txNum)
+			}
+			for _, rec := range []*logRecord{
+				newStartLogRecord(txNum),
+				newSetBytesLogRecord(txNum, blk, 0, []byte{0, 0, 0, 0}),
+				newSetBytesLogRecord(txNum, blk, 8, []byte{0, 0, 0, 0}),
+				end,
+			} {
+				err := r.apply(rec)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if len(r.undoRecs) != 0 {
+				t.Fatalf("unexpected undo records: want: 0 transactions, got: %v transactions", len(r.undoRecs))
+			}
+		}
+		err := r.undoUnfinished()
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
@@ -0,0 +1,343 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// backupLabelFileName is the name of the file identifying a backup. RestoreBackup removes the file, so that a restored
+// backup isn't rolled forward again.
+const backupLabelFileName = "backup_label"
+
+// Backup copies the database into a directory `dirPath` while transactions continue. Transactions keep reading,
+// writing, committing, and rolling back during the copy; only applying a file operation, such as dropping a file,
+// waits until the copy finishes. The directory must be empty or must not exist.
+//
+// A backup may contain modifications of transactions that were running during the copy, and the log in the backup
+// holds the records to undo them, as well as the after-images of modifications made during the copy. Call
+// RestoreBackup to bring the backup into a consistent state before using it.
+func (s *Storage) Backup(dirPath string) error {
+	if s.ctx.Err() != nil {
+		return fmt.Errorf("storage is closed: %w", s.ctx.Err())
+	}
+	{
+		entries, err := os.ReadDir(dirPath)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if len(entries) > 0 {
+			return fmt.Errorf("a backup directory must be empty: %v", dirPath)
+		}
+		err = os.MkdirAll(dirPath, 0700)
+		if err != nil {
+			return err
+		}
+	}
+
+	atomic.AddInt32(&s.lm.backups, 1)
+	defer atomic.AddInt32(&s.lm.backups, -1)
+	label, logBlkNum, err := s.startBackup(dirPath)
+	if err != nil {
+		return err
+	}
+	err = s.copyFiles(dirPath)
+	if err != nil {
+		return err
+	}
+	return s.finishBackup(dirPath, label, logBlkNum)
+}
+
+// startBackup writes all modified buffers out to a disk and a backup log record marking the point the backup
+// starts from, and copies the log up to the marker. The caller must count the backup in `backups` beforehand, so that
+// every modification either reaches a disk here or writes an after-image. startBackup returns the label of
+// the backup and the number of the log block the marker is in; the blocks before it never change.
+func (s *Storage) startBackup(dirPath string) (string, int, error) {
+	// No transaction is in the middle of ending while we write the buffers out, so every transaction that ended before
+	// the marker has all of its modifications in the files.
+	s.lm.endGate.Lock()
+	defer s.lm.endGate.Unlock()
+
+	err := s.bm.flushAllModified()
+	if err != nil {
+		return "", 0, err
+	}
+	// The marker also tells RecoverBackupToTime where the backup is in an archived log.
+	label := time.Now().UTC().Format(time.RFC3339Nano)
+	rec, err := newBackupLogRecord(label).marshalBytes()
+	if err != nil {
+		return "", 0, err
+	}
+	lsn, err := s.lm.appendLog(rec)
+	if err != nil {
+		return "", 0, err
+	}
+	err = s.lm.flush(lsn)
+	if err != nil {
+		return "", 0, err
+	}
+	s.lm.mu.Lock()
+	logBlkNum := s.lm.currentBlk.BlkNum
+	s.lm.mu.Unlock()
+	err = s.fm.copyFile(s.lm.logFileName, dirPath)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to back up the log: %w", err)
+	}
+	return label, logBlkNum, nil
+}
+
+// copyFiles copies the files of the database except the log. A block copied here holds the state at the marker or
+// a later one, and the after-images in the log tail bring it up to date.
+func (s *Storage) copyFiles(dirPath string) error {
+	// Files don't disappear or shrink during the copy.
+	s.lm.fileGate.Lock()
+	defer s.lm.fileGate.Unlock()
+
+	entries, err := os.ReadDir(s.fm.dirPath)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		name := e.Name()
+		// copyFile copies the page map of a compressed file along with the file.
+		if e.IsDir() || strings.HasPrefix(name, TempFilePrefix) || strings.HasSuffix(name, pageMapSuffix) || name == s.lm.logFileName || name == backupLabelFileName {
+			continue
+		}
+		if name == encodingFileName || name == encryptionFileName {
+			b, err := os.ReadFile(filepath.Join(s.fm.dirPath, name))
+			if err != nil {
+				return err
+			}
+			err = os.WriteFile(filepath.Join(dirPath, name), b, 0600)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		err := s.fm.copyFile(name, dirPath)
+		if err != nil {
+			return fmt.Errorf("failed to back up a file: %v: %w", name, err)
+		}
+	}
+
+	// A backup holds a tablespace in the subdirectory having the name of the tablespace.
+	for _, tablespace := range s.fm.tablespaceNames() {
+		entries, err := os.ReadDir(s.fm.tablespaceDir(tablespace))
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			name := e.Name()
+			if e.IsDir() || strings.HasPrefix(name, TempFilePrefix) || strings.HasSuffix(name, pageMapSuffix) {
+				continue
+			}
+			err := s.fm.copyFile(TablespaceFileName(tablespace, name), dirPath)
+			if err != nil {
+				return fmt.Errorf("failed to back up a file: %v: %w", TablespaceFileName(tablespace, name), err)
+			}
+		}
+	}
+	return nil
+}
+
+// finishBackup copies the log written since the log block `logBlkNum` and labels the backup. The log tail holds
+// the after-images of the modifications made during the copy and the commit log records of the transactions that
+// made them.
+func (s *Storage) finishBackup(dirPath string, label string, logBlkNum int) error {
+	err := s.lm.flushAll()
+	if err != nil {
+		return err
+	}
+	err = s.fm.copyBlocks(s.lm.logFileName, dirPath, logBlkNum)
+	if err != nil {
+		return fmt.Errorf("failed to back up the log: %w", err)
+	}
+	// We write the label last, so a directory having the label holds a complete backup.
+	return os.WriteFile(filepath.Join(dirPath, backupLabelFileName), []byte(label+"\n"), 0600)
+}
+
+// backingUp reports whether a backup is in progress. Transactions write after-images while it is.
+func (m *logManager) backingUp() bool {
+	return atomic.LoadInt32(&m.backups) > 0
+}
+
+// copyFile copies the blocks of a file into a directory `dirPath`. copyFile reads a block at a time through
+// the file manager, so it never sees a block that is half written. A backup keeps blocks encrypted and compressed as
+// the database does.
+func (m *fileManager) copyFile(fileName string, dirPath string) error {
+	dst := m.withDir(dirPath)
+	defer dst.closeAll()
+	err := dst.remove(fileName)
+	if err != nil {
+		return err
+	}
+	return m.copyBlocks(fileName, dirPath, 0)
+}
+
+// copyBlocks copies the blocks of a file from `from` into a directory `dirPath`, overwriting the blocks the copy
+// already has.
+func (m *fileManager) copyBlocks(fileName string, dirPath string, from int) error {
+	c, err := m.blockCount(fileName)
+	if err != nil {
+		return err
+	}
+	p, err := newPage(m.blkSize)
+	if err != nil {
+		return err
+	}
+	dst := m.withDir(dirPath)
+	defer dst.closeAll()
+	// A file without blocks is copied as an empty file.
+	_, err = dst.open(fileName)
+	if err != nil {
+		return err
+	}
+	for i := from; i < c; i++ {
+		blk := NewBlockID(fileName, i)
+		err := m.read(blk, p)
+		if err != nil {
+			return err
+		}
+		err = dst.write(blk, p)
+		if err != nil {
+			return err
+		}
+	}
+	// Files are opened with O_SYNC, so closing them is enough to make the copy durable.
+	return dst.closeAll()
+}
+
+// RestoreBackup brings a backup that Storage.Backup made into a consistent state. It redoes the modifications of
+// transactions that committed during the copy, and undoes the modifications of transactions that rolled back during
+// the copy or hadn't finished when the backup was made, so the database holds exactly the transactions that
+// had committed. `config.DirPath` is the backup directory, and `config.LogFileName` must be the name of the log
+// file of the original database.
+func RestoreBackup(ctx context.Context, config *StorageConfig) error {
+	// The restored database is a new database, so it must not write to the archive of the original one.
+	c := *config
+	c.ArchiveDirPath = ""
+	config = &c
+
+	// RestoreBackup removes the label, so a backup restored once has nothing to roll forward.
+	label, err := readBackupLabel(config.DirPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	st, err := InitStorage(ctx, config)
+	if err != nil {
+		return err
+	}
+	tx, err := st.NewTransaction(ctx)
+	if err != nil {
+		st.Close()
+		return err
+	}
+	if label != "" {
+		err = tx.rm.rollForwardBackup(tx, label)
+		if err != nil {
+			tx.Rollback()
+			st.Close()
+			return fmt.Errorf("failed to roll a backup forward: %w", err)
+		}
+	}
+	err = tx.Recover()
+	if err != nil {
+		tx.Rollback()
+		st.Close()
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		st.Close()
+		return err
+	}
+	err = st.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Remove(filepath.Join(config.DirPath, backupLabelFileName))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// rollForwardBackup brings the blocks a backup copied to the state at the end of the log in the backup. A block
+// holds the state at the backup log record marking `label` or a later one, so we undo the transactions that rolled
+// back after the marker, from their beginning, and then redo the after-images of the transactions that committed or
+// prepared after the marker in the order they were written. Locks kept the transactions from modifying the same data
+// at the same time, so the undoing doesn't overwrite the redone modifications. A recovery takes care of unfinished
+// transactions afterward.
+func (m *recoveryManager) rollForwardBackup(tx *Transaction, label string) error {
+	marked := false
+	// ended holds the last end log record of each transaction that ended after the marker.
+	ended := map[transactionNum]operator{}
+	// rolledBack holds the transactions rolling back after the marker whose beginning we haven't read yet.
+	rolledBack := map[transactionNum]struct{}{}
+	var undoRecs []*logRecord
+	var redoRecs []*logRecord
+	err := m.lm.apply(func(rec []byte) (bool, error) {
+		r := &logRecord{}
+		err := r.unmarshalBytes(rec)
+		if err != nil {
+			return false, err
+		}
+		if r.Op == opBackup && r.FileName == label {
+			marked = true
+			return len(rolledBack) == 0, nil
+		}
+		if !marked {
+			switch r.Op {
+			case opCommit, opPrepare, opRollBack:
+				if _, ok := ended[r.TxNum]; ok {
+					break
+				}
+				ended[r.TxNum] = r.Op
+				if r.Op == opRollBack {
+					rolledBack[r.TxNum] = struct{}{}
+				}
+			case opRedoBytes:
+				if op, ok := ended[r.TxNum]; ok && op != opRollBack {
+					redoRecs = append(redoRecs, r)
+				}
+			}
+		}
+		if _, ok := rolledBack[r.TxNum]; !ok {
+			return false, nil
+		}
+		if r.Op == opStart {
+			delete(rolledBack, r.TxNum)
+			return marked && len(rolledBack) == 0, nil
+		}
+		if isSetOperator(r.Op) {
+			undoRecs = append(undoRecs, r)
+		}
+		return false, nil
+	})
+	if err != nil {
+		return err
+	}
+	if !marked {
+		return fmt.Errorf("a log doesn't contain a backup: %v", label)
+	}
+
+	// `apply` reads log records from the newest one, so the undo records are already in the order to undo them.
+	for _, r := range undoRecs {
+		err := m.undo(tx, r)
+		if err != nil {
+			return err
+		}
+	}
+	for i := len(redoRecs) - 1; i >= 0; i-- {
+		err := m.redo(tx, redoRecs[i])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
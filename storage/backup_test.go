@@ -0,0 +1,364 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestStorage_Backup(t *testing.T) {
+	testDir, err := MakeTestDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+
+	dbDir := filepath.Join(testDir, "db")
+	err = os.Mkdir(dbDir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logFilePath, err := MakeTestLogFile(dbDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logFileName := filepath.Base(logFilePath)
+	dbFilePath, err := MakeTestTableFile(dbDir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbFileName := filepath.Base(dbFilePath)
+
+	ctx := context.Background()
+	st, err := InitStorage(ctx, TestConfig(&StorageConfig{
+		DirPath:     dbDir,
+		LogFileName: logFileName,
+		BlkSize:     400,
+		BufSize:     10,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	var blks []*BlockID
+	{
+		tx, err := st.NewTransaction(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2; i++ {
+			blk, err := tx.AllocBlock(dbFileName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = tx.Pin(blk)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = tx.WriteInt64(blk.Hash, 0, 100, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			blks = append(blks, blk)
+		}
+		err = tx.Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	readBackup := func(t *testing.T, dirPath string) (int, []int64) {
+		t.Helper()
+		err := RestoreBackup(ctx, TestConfig(&StorageConfig{
+			DirPath:     dirPath,
+			LogFileName: logFileName,
+			BlkSize:     400,
+			BufSize:     10,
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		bst, err := InitStorage(ctx, TestConfig(&StorageConfig{
+			DirPath:     dirPath,
+			LogFileName: logFileName,
+			BlkSize:     400,
+			BufSize:     10,
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer bst.Close()
+		tx, err := bst.NewReadOnlyTransaction(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tx.Commit()
+		c, err := tx.BlockCount(dbFileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var vals []int64
+		for _, blk := range blks {
+			err := tx.Pin(blk)
+			if err != nil {
+				t.Fatal(err)
+			}
+			v, err := tx.ReadInt64(blk.Hash, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			vals = append(vals, v)
+		}
+		return c, vals
+	}
+
+	t.Run("a backup doesn't contain modifications of unfinished transactions", func(t *testing.T) {
+		tx, err := st.NewTransaction(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tx.Pin(blks[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tx.WriteInt64(blks[0].Hash, 0, 200, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		newBlk, err := tx.AllocBlock(dbFileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tx.Pin(newBlk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tx.WriteInt64(newBlk.Hash, 0, 300, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The uncommitted modifications reach the files as if the buffers were evicted.
+		err = st.bm.flushAll(tx.txNum)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		backupDir := filepath.Join(testDir, "backup1")
+		err = st.Backup(backupDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tx.Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c, vals := readBackup(t, backupDir)
+		if c != 3 {
+			t.Fatalf("unexpected block count: want: %v, got: %v", 3, c)
+		}
+		if vals[0] != 100 || vals[1] != 100 {
+			t.Fatalf("unexpected values: want: %v, got: %v", []int64{100, 100}, vals)
+		}
+	})
+
+	t.Run("a backup can be restored even if it lacks blocks allocated during the copy", func(t *testing.T) {
+		tx, err := st.NewTransaction(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		newBlk, err := tx.AllocBlock(dbFileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tx.Pin(newBlk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tx.WriteInt64(newBlk.Hash, 0, 400, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = st.bm.flushAll(tx.txNum)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		backupDir := filepath.Join(testDir, "backup2")
+		err = st.Backup(backupDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tx.Rollback()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// We make the backup look as if it copied the file before the transaction allocated the block.
+		bfm := st.fm.withDir(backupDir)
+		err = bfm.truncate(dbFileName, newBlk.BlkNum)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = bfm.closeAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c, _ := readBackup(t, backupDir)
+		if c != newBlk.BlkNum {
+			t.Fatalf("unexpected block count: want: %v, got: %v", newBlk.BlkNum, c)
+		}
+	})
+
+	t.Run("a backup made while transactions commit is consistent", func(t *testing.T) {
+		// Each transaction writes the same value to both blocks, so a consistent backup has the same values.
+		writeBoth := func(v int64) (*Transaction, error) {
+			tx, err := st.NewTransaction(ctx)
+			if err != nil {
+				return nil, err
+			}
+			for _, blk := range blks {
+				err := tx.Pin(blk)
+				if err == nil {
+					err = tx.WriteInt64(blk.Hash, 0, v, true)
+				}
+				if err != nil {
+					tx.Rollback()
+					return nil, err
+				}
+			}
+			return tx, nil
+		}
+		{
+			tx, err := writeBoth(500)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = tx.Commit()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		var wg sync.WaitGroup
+		errs := make(chan error, 20)
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func(v int64) {
+				defer wg.Done()
+				tx, err := writeBoth(v)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if v%2 == 0 {
+					errs <- tx.Rollback()
+				} else {
+					errs <- tx.Commit()
+				}
+			}(int64(1000 + i))
+		}
+
+		backupDir := filepath.Join(testDir, "backup3")
+		err := st.Backup(backupDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		_, vals := readBackup(t, backupDir)
+		if vals[0] != vals[1] {
+			t.Fatalf("a backup must be consistent: %v", vals)
+		}
+		if vals[0] != 500 && vals[0]%2 == 0 {
+			t.Fatalf("a backup must not contain rolled-back values: %v", vals)
+		}
+	})
+
+	t.Run("a backup holds the transactions that end while it copies files", func(t *testing.T) {
+		write := func(t *testing.T, tx *Transaction, blk *BlockID, v int64) {
+			t.Helper()
+			err := tx.Pin(blk)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = tx.WriteInt64(blk.Hash, 0, v, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		// The transactions modify the blocks partly before the copy and partly after it.
+		committed, err := st.NewTransaction(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		write(t, committed, blks[0], 600)
+		rolledBack, err := st.NewTransaction(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		write(t, rolledBack, blks[1], 700)
+
+		backupDir := filepath.Join(testDir, "backup4")
+		err = os.Mkdir(backupDir, 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+		atomic.AddInt32(&st.lm.backups, 1)
+		defer atomic.AddInt32(&st.lm.backups, -1)
+		label, logBlkNum, err := st.startBackup(backupDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		write(t, committed, blks[0], 800)
+		err = st.copyFiles(backupDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The copied files hold the values written before the backup started, which the transactions write out
+		// when they end.
+		newBlk, err := committed.AllocBlock(dbFileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		write(t, committed, newBlk, 900)
+		err = committed.Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = rolledBack.Rollback()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = st.finishBackup(backupDir, label, logBlkNum)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c, vals := readBackup(t, backupDir)
+		if c != newBlk.BlkNum+1 {
+			t.Fatalf("unexpected block count: want: %v, got: %v", newBlk.BlkNum+1, c)
+		}
+		if vals[0] != 800 || vals[1] == 700 {
+			t.Fatalf("unexpected values: want: %v and not %v, got: %v", 800, 700, vals)
+		}
+	})
+
+	t.Run("a backup directory must be empty", func(t *testing.T) {
+		backupDir := filepath.Join(testDir, "backup1")
+		err := st.Backup(backupDir)
+		if err == nil {
+			t.Fatal("a backup to a non-empty directory must fail")
+		}
+	})
+}
@@ -1,8 +1,11 @@
 package storage
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -16,6 +19,11 @@ var (
 )
 
 type buffer struct {
+	// latch protects the contents and the modification state (modified, txNum, and lsn) of the buffer. A transaction
+	// holds it only while it reads or writes the contents, whereas a lock on the block lasts until the transaction
+	// ends.
+	latch sync.RWMutex
+
 	fm       *fileManager
 	lm       *logManager
 	contents *page
@@ -24,6 +32,17 @@ type buffer struct {
 	txNum    transactionNum
 	lsn      logSeqNum
 	pins     int
+
+	// readAhead is true while a block read ahead stays unpinned.
+	readAhead bool
+
+	// referenced is the reference bit of the clock replacement. Pinning a block sets it, and the clock hand clears it
+	// when it passes the buffer, so a buffer is evicted only when no one has pinned it for a full turn.
+	referenced bool
+
+	// pins, readAhead, and referenced are protected by the lock of the partition of the buffer table holding
+	// the block, and blk changes only while the buffer manager is locked and the buffer is unpinned.
+	// See bufferTable.
 }
 
 func newBuffer(fm *fileManager, lm *logManager) (*buffer, error) {
@@ -73,6 +92,8 @@ func (b *buffer) assign(blk *BlockID) error {
 		return err
 	}
 	b.pins = 0
+	b.readAhead = false
+	b.referenced = false
 	return nil
 }
 
@@ -93,11 +114,23 @@ func (b *buffer) flush() error {
 	return nil
 }
 
+// discard detaches a buffer from its block without writing the contents out to a disk.
+func (b *buffer) discard() {
+	b.blk = nil
+	b.modified = false
+	b.txNum = transactionNumNil
+	b.lsn = lsnNil
+	b.readAhead = false
+	b.referenced = false
+}
+
 func (b *buffer) pin() error {
 	if b.blk == nil {
 		return fmt.Errorf("failed to pin: %w", errBufferUnassigned)
 	}
 	b.pins++
+	b.readAhead = false
+	b.referenced = true
 	return nil
 }
 
@@ -112,10 +145,73 @@ func (b *buffer) unpin() error {
 	return nil
 }
 
+// ErrBufferPoolExhausted is returned when a transaction cannot get a buffer before its deadline because all buffers
+// are pinned.
+var ErrBufferPoolExhausted = fmt.Errorf("buffer pool exhausted")
+
+// bufferTablePartitions is the number of partitions of a buffer table. Pins of blocks in different partitions don't
+// contend with each other.
+const bufferTablePartitions = 16
+
+type bufferTablePartition struct {
+	mu   sync.Mutex
+	bufs map[BlockIDHash]*buffer
+}
+
+// bufferTable maps blocks to the buffers holding them. The table is split into partitions by block so that pins
+// finding their blocks in the pool, which are the majority, lock only a partition. The lock of a partition also
+// protects the pin counts and the read-ahead orders of the buffers in it.
+type bufferTable struct {
+	partitions [bufferTablePartitions]bufferTablePartition
+}
+
+func newBufferTable() *bufferTable {
+	t := &bufferTable{}
+	for i := range t.partitions {
+		t.partitions[i].bufs = map[BlockIDHash]*buffer{}
+	}
+	return t
+}
+
+func (t *bufferTable) partition(blk BlockIDHash) *bufferTablePartition {
+	return &t.partitions[blk[0]%bufferTablePartitions]
+}
+
 type bufferManager struct {
-	pool         []*buffer
-	freeBufCount int
-	mu           sync.Mutex
+	stats bufferCounters
+
+	// freeBufCount is accessed atomically.
+	freeBufCount int64
+
+	fm    *fileManager
+	pool  []*buffer
+	table *bufferTable
+
+	// free holds unassigned buffers. Replacement takes a buffer from it before evicting a block.
+	free []*buffer
+
+	// hand is the index of the buffer the clock hand points to.
+	hand int
+
+	// mu serializes assigning blocks to buffers, that is, misses, read-ahead, and discarding blocks. It also
+	// serializes flushing buffers. mu must be acquired before the lock of a partition or a latch.
+	mu sync.Mutex
+
+	// unpinned is closed when a buffer becomes unpinned while goroutines are waiting for a buffer. waiters is the
+	// number of such goroutines and is accessed atomically.
+	unpinned   chan struct{}
+	unpinnedMu sync.Mutex
+	waiters    int32
+
+	// readAheadCh passes read-ahead requests to the read-ahead worker. readAheadCh is nil when read-ahead is
+	// disabled. readAheadN is the number of blocks read ahead for each request.
+	readAheadCh chan *BlockID
+	readAheadN  int
+
+	// readAheadPos maps a file name to the latest block number passed to requestReadAhead.
+	readAheadPos sync.Map
+
+	ev *eventDispatcher
 }
 
 func newBufferManager(fm *fileManager, lm *logManager, bufSize int) (*bufferManager, error) {
@@ -127,9 +223,15 @@ func newBufferManager(fm *fileManager, lm *logManager, bufSize int) (*bufferMana
 			return nil, err
 		}
 	}
+	free := make([]*buffer, bufSize)
+	copy(free, pool)
 	return &bufferManager{
+		freeBufCount: int64(bufSize),
+		fm:           fm,
 		pool:         pool,
-		freeBufCount: bufSize,
+		table:        newBufferTable(),
+		free:         free,
+		unpinned:     make(chan struct{}),
 	}, nil
 }
 
@@ -138,10 +240,10 @@ func (m *bufferManager) flushAll(txNum transactionNum) error {
 	defer m.mu.Unlock()
 
 	for _, buf := range m.pool {
-		if buf.txNum != txNum {
-			continue
-		}
-		err := buf.flush()
+		// Nothing reads temporary files after a transaction ends, so they don't need to be written out.
+		err := m.flushIf(buf, func() bool {
+			return buf.txNum == txNum && !IsTempFile(buf.blk.fileName)
+		})
 		if err != nil {
 			return err
 		}
@@ -149,44 +251,133 @@ func (m *bufferManager) flushAll(txNum transactionNum) error {
 	return nil
 }
 
-func (m *bufferManager) pin(blk *BlockID) (*buffer, error) {
+// flushAllModified writes out the modified buffers of all transactions.
+func (m *bufferManager) flushAllModified() error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	w := time.NewTimer(10 * time.Second)
-	t := time.NewTicker(10 * time.Millisecond)
-	defer t.Stop()
+	for _, buf := range m.pool {
+		err := m.flushIf(buf, func() bool {
+			return !IsTempFile(buf.blk.fileName)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flushIf writes a buffer out to a disk when `cond` holds. `cond` runs while the latch of the buffer is held.
+// The caller must lock the buffer manager.
+func (m *bufferManager) flushIf(buf *buffer, cond func() bool) error {
+	if buf.blk == nil {
+		return nil
+	}
+	buf.latch.RLock()
+	defer buf.latch.RUnlock()
+	if !cond() {
+		return nil
+	}
+	return buf.flush()
+}
+
+// pin assigns a block to a buffer and pins it. When all buffers are pinned, this function waits until another
+// goroutine unpins a buffer or `ctx` is done.
+func (m *bufferManager) pin(ctx context.Context, blk *BlockID) (*buffer, error) {
+	return m.pinInRing(ctx, blk, nil)
+}
+
+// pinInRing works like pin, but it assigns a block that isn't in the pool to a buffer of `ring` unless `ring` is nil.
+func (m *bufferManager) pinInRing(ctx context.Context, blk *BlockID, ring *BufferRing) (*buffer, error) {
+	buf, err := m.tryToPin(blk, ring)
+	if buf != nil || err != nil {
+		return buf, err
+	}
+
+	// We register as a waiter before trying again so that an unpin happening in between wakes us up.
+	atomic.AddInt32(&m.waiters, 1)
+	defer atomic.AddInt32(&m.waiters, -1)
 	for {
+		m.unpinnedMu.Lock()
+		unpinned := m.unpinned
+		m.unpinnedMu.Unlock()
+
+		buf, err := m.tryToPin(blk, ring)
+		if buf != nil || err != nil {
+			return buf, err
+		}
+
+		atomic.AddUint64(&m.stats.pinWaits, 1)
 		select {
-		case <-w.C:
-			return nil, fmt.Errorf("pinning timed out")
-		case <-t.C:
-			buf, err := m.tryToPin(blk)
-			if err != nil {
-				return nil, err
+		case <-unpinned:
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				atomic.AddUint64(&m.stats.pinTimeouts, 1)
+				return nil, fmt.Errorf("failed to pin a block: file: %v, block: %v: %w", blk.fileName, blk.BlkNum, ErrBufferPoolExhausted)
 			}
-			if buf == nil {
-				continue
-			}
-			return buf, nil
+			return nil, fmt.Errorf("pinning is canceled: %w", ctx.Err())
 		}
 	}
 }
 
-func (m *bufferManager) tryToPin(blk *BlockID) (*buffer, error) {
-	buf := m.findAssignedBuffer(blk)
-	if buf == nil {
-		buf = m.chooseUnpinnedBuffer()
-		if buf == nil {
-			return nil, nil
-		}
-		err := buf.assign(blk)
-		if err != nil {
-			return nil, err
+// tryToPin pins a block. It returns nil when all buffers are pinned.
+func (m *bufferManager) tryToPin(blk *BlockID, ring *BufferRing) (*buffer, error) {
+	buf, err := m.pinAssigned(blk)
+	if buf != nil || err != nil {
+		return buf, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Another goroutine may have read the block while we were waiting for the lock.
+	buf, err = m.pinAssigned(blk)
+	if buf != nil || err != nil {
+		return buf, err
+	}
+	buf = m.takeVictim(func() *buffer {
+		if ring != nil {
+			return ring.choose(m, blk)
 		}
+		return m.chooseUnpinnedBuffer()
+	})
+	if buf == nil {
+		return nil, nil
+	}
+	atomic.AddUint64(&m.stats.misses, 1)
+	err = m.assign(buf, blk)
+	if err != nil {
+		return nil, err
+	}
+
+	p := m.table.partition(blk.Hash)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	err = buf.pin()
+	if err != nil {
+		return nil, err
+	}
+	p.bufs[blk.Hash] = buf
+	atomic.AddInt64(&m.freeBufCount, -1)
+	return buf, nil
+}
+
+// pinAssigned pins a block when it is in the pool. It returns nil when the block isn't in the pool.
+func (m *bufferManager) pinAssigned(blk *BlockID) (*buffer, error) {
+	p := m.table.partition(blk.Hash)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	buf, ok := p.bufs[blk.Hash]
+	if !ok {
+		return nil, nil
+	}
+	atomic.AddUint64(&m.stats.hits, 1)
+	if buf.readAhead {
+		atomic.AddUint64(&m.stats.readAheadHits, 1)
 	}
 	if !buf.pinned() {
-		m.freeBufCount--
+		atomic.AddInt64(&m.freeBufCount, -1)
 	}
 	err := buf.pin()
 	if err != nil {
@@ -195,48 +386,184 @@ func (m *bufferManager) tryToPin(blk *BlockID) (*buffer, error) {
 	return buf, nil
 }
 
-func (m *bufferManager) findAssignedBuffer(blk *BlockID) *buffer {
-	for _, buf := range m.pool {
-		// A block may not be assigned yet.
+// assign assigns a block to a buffer taken by takeVictim, evicting the block the buffer held. The caller must lock
+// the buffer manager and add the buffer to the buffer table.
+func (m *bufferManager) assign(buf *buffer, blk *BlockID) error {
+	evicted := buf.blk
+	modifiedBy := buf.txNum
+	start := time.Now()
+	err := buf.assign(blk)
+	if err != nil {
+		// The buffer is no longer in the buffer table, so we leave it unassigned.
+		buf.discard()
+		m.free = append(m.free, buf)
+		return err
+	}
+	if evicted != nil {
+		atomic.AddUint64(&m.stats.evictions, 1)
+		m.ev.bufferEvicted(&BufferEvictionEvent{
+			FileName: evicted.fileName,
+			BlkNum:   evicted.BlkNum,
+			TxNum:    int(modifiedBy),
+			Duration: time.Since(start),
+		})
+	}
+	return nil
+}
+
+// takeVictim removes a buffer that `choose` chooses from the buffer table so that no goroutine can pin it. A
+// buffer may be pinned after `choose` chooses it, and then this function asks `choose` again. It returns nil when
+// `choose` returns nil. The caller must lock the buffer manager.
+func (m *bufferManager) takeVictim(choose func() *buffer) *buffer {
+	for {
+		buf := choose()
+		if buf == nil {
+			return nil
+		}
 		if buf.blk == nil {
+			return buf
+		}
+		p := m.table.partition(buf.blk.Hash)
+		p.mu.Lock()
+		if buf.pinned() {
+			p.mu.Unlock()
 			continue
 		}
+		delete(p.bufs, buf.blk.Hash)
+		buf.readAhead = false
+		p.mu.Unlock()
+		return buf
+	}
+}
 
-		if buf.blk.equal(blk) {
+func (m *bufferManager) findAssignedBuffer(blk *BlockID) *buffer {
+	p := m.table.partition(blk.Hash)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.bufs[blk.Hash]
+}
+
+// chooseUnpinnedBuffer chooses a buffer to assign a new block to. An unassigned buffer is chosen first so that no
+// block is evicted while the pool has room. The caller must lock the buffer manager.
+func (m *bufferManager) chooseUnpinnedBuffer() *buffer {
+	return m.chooseBuffer(nil)
+}
+
+// chooseBuffer takes an unassigned buffer from the free list, or it sweeps the pool with the clock hand and chooses
+// the first unpinned buffer whose reference bit is clear. The hand clears the reference bits it passes, so a sweep
+// finishes within two turns. When `skip` isn't nil, buffers for which `skip` returns true are never chosen.
+// chooseBuffer returns nil when no buffer can be chosen. The caller must lock the buffer manager.
+func (m *bufferManager) chooseBuffer(skip func(buf *buffer) bool) *buffer {
+	for len(m.free) > 0 {
+		buf := m.free[0]
+		m.free = m.free[1:]
+		// A buffer of a ring may have been assigned again after it was discarded.
+		if buf.blk == nil {
 			return buf
 		}
 	}
-	return nil
-}
 
-func (m *bufferManager) chooseUnpinnedBuffer() *buffer {
-	for _, buf := range m.pool {
-		if !buf.pinned() {
+	for i := 0; i < 2*len(m.pool); i++ {
+		buf := m.pool[m.hand]
+		m.hand = (m.hand + 1) % len(m.pool)
+		if buf.blk == nil {
 			return buf
 		}
+		if skip != nil && skip(buf) {
+			continue
+		}
+		p := m.table.partition(buf.blk.Hash)
+		p.mu.Lock()
+		if buf.pinned() {
+			p.mu.Unlock()
+			continue
+		}
+		if buf.referenced {
+			buf.referenced = false
+			p.mu.Unlock()
+			continue
+		}
+		p.mu.Unlock()
+		return buf
 	}
 	return nil
 }
 
-func (m *bufferManager) unpin(buf *buffer) error {
+// pinned reports whether a buffer is pinned. The caller must lock the buffer manager.
+func (m *bufferManager) pinned(buf *buffer) bool {
+	if buf.blk == nil {
+		return false
+	}
+	p := m.table.partition(buf.blk.Hash)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return buf.pinned()
+}
+
+// discard detaches the buffers assigned to the blocks of a file whose block numbers are `blkNum` or greater and then
+// calls `remove` to remove the blocks from a disk. The contents of the buffers are thrown away. When one of
+// the buffers is pinned, discard changes nothing and returns an error. `remove` runs while the buffer manager is
+// locked so that read-ahead cannot bring the blocks back into the pool in between.
+func (m *bufferManager) discard(fileName string, blkNum int, remove func() error) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
+	for i := range m.table.partitions {
+		m.table.partitions[i].mu.Lock()
+	}
+	var bufs []*buffer
+	for _, buf := range m.pool {
+		if buf.blk == nil || buf.blk.fileName != fileName || buf.blk.BlkNum < blkNum {
+			continue
+		}
+		if buf.pinned() {
+			for i := range m.table.partitions {
+				m.table.partitions[i].mu.Unlock()
+			}
+			return fmt.Errorf("a pinned block cannot be discarded: file: %v, block: %v", fileName, buf.blk.BlkNum)
+		}
+		bufs = append(bufs, buf)
+	}
+	for _, buf := range bufs {
+		delete(m.table.partition(buf.blk.Hash).bufs, buf.blk.Hash)
+		buf.discard()
+		m.free = append(m.free, buf)
+	}
+	for i := range m.table.partitions {
+		m.table.partitions[i].mu.Unlock()
+	}
+	return remove()
+}
+
+func (m *bufferManager) unpin(buf *buffer) error {
+	if buf.blk == nil {
+		return fmt.Errorf("failed to unpin: %w", errBufferUnassigned)
+	}
+
+	// A pinned buffer keeps its block, so we can read `buf.blk` without the lock of the buffer manager.
+	p := m.table.partition(buf.blk.Hash)
+	p.mu.Lock()
 	err := buf.unpin()
+	pinned := buf.pinned()
+	p.mu.Unlock()
 	if err != nil {
 		return err
 	}
-	if buf.pinned() {
+	if pinned {
+		return nil
+	}
+
+	atomic.AddInt64(&m.freeBufCount, 1)
+	if atomic.LoadInt32(&m.waiters) == 0 {
 		return nil
 	}
-	m.freeBufCount++
+	m.unpinnedMu.Lock()
+	close(m.unpinned)
+	m.unpinned = make(chan struct{})
+	m.unpinnedMu.Unlock()
 	return nil
 }
 
-//nolint:unused
 func (m *bufferManager) availableBufferCount() int {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-
-	return m.freeBufCount
+	return int(atomic.LoadInt64(&m.freeBufCount))
 }
@@ -1,12 +1,16 @@
 package storage
 
 import (
-	"bytes"
+	"context"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
+
+	"golang.org/x/sync/errgroup"
 )
 
 func TestBuffer(t *testing.T) {
@@ -209,7 +213,7 @@ func TestBufferManager(t *testing.T) {
 			if err != nil {
 				t.Fatal(err)
 			}
-			buf1, err = bm.pin(blk1)
+			buf1, err = bm.pin(context.Background(), blk1)
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -218,7 +222,7 @@ func TestBufferManager(t *testing.T) {
 			if err != nil {
 				t.Fatal(err)
 			}
-			buf2, err = bm.pin(blk2)
+			buf2, err = bm.pin(context.Background(), blk2)
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -308,8 +312,17 @@ func TestBufferManager(t *testing.T) {
 	})
 }
 
+// newTestFileManager returns a file manager that encrypts blocks when tests run with TestEncryptionKeyEnv.
+func newTestFileManager(dir string, blkSize int) (*fileManager, error) {
+	key, err := testEncryptionKey()
+	if err != nil {
+		return nil, err
+	}
+	return newFileManager(dir, blkSize, key)
+}
+
 func newTestFileManagerAndLogManager(dir string, blkSize int) (*fileManager, *logManager, error) {
-	fm, err := newFileManager(dir, blkSize)
+	fm, err := newTestFileManager(dir, blkSize)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -325,17 +338,18 @@ func newTestFileManagerAndLogManager(dir string, blkSize int) (*fileManager, *lo
 	return fm, lm, nil
 }
 
+// loadOntoPage reads a block from a disk bypassing buffers.
 func loadOntoPage(filePath string, blkNum int, blkSize int) (*page, error) {
-	b, err := ioutil.ReadFile(filePath)
+	fm, err := newTestFileManager(filepath.Dir(filePath), blkSize)
 	if err != nil {
 		return nil, err
 	}
+	defer fm.closeAll()
 	p, err := newPage(blkSize)
 	if err != nil {
 		return nil, err
 	}
-	offset := blkNum * blkSize
-	err = p.load(bytes.NewReader(b[offset:]))
+	err = fm.read(NewBlockID(filepath.Base(filePath), blkNum), p)
 	if err != nil {
 		return nil, err
 	}
@@ -353,3 +367,414 @@ func readString(filePath string, blkNum int, blkSize int) (string, error) {
 	}
 	return s, nil
 }
+
+func TestBufferManager_pin(t *testing.T) {
+	testDir, err := MakeTestDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+
+	fm, lm, err := newTestFileManagerAndLogManager(testDir, 400)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbFilePath, err := MakeTestTableFile(testDir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbFileName := filepath.Base(dbFilePath)
+	blk1, err := fm.alloc(dbFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blk2, err := fm.alloc(dbFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bm, err := newBufferManager(fm, lm, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf1, err := bm.pin(context.Background(), blk1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("pin fails with ErrBufferPoolExhausted when all buffers remain pinned until a deadline", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		_, err := bm.pin(ctx, blk2)
+		if !errors.Is(err, ErrBufferPoolExhausted) {
+			t.Fatalf("expected error didn't occur: want: %v, got: %v", ErrBufferPoolExhausted, err)
+		}
+	})
+
+	t.Run("pin fails with context.Canceled when a context is canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := bm.pin(ctx, blk2)
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected error didn't occur: want: %v, got: %v", context.Canceled, err)
+		}
+	})
+
+	t.Run("pin waits until another goroutine unpins a buffer", func(t *testing.T) {
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			bm.unpin(buf1)
+		}()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		buf2, err := bm.pin(ctx, blk2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !buf2.blk.equal(blk2) {
+			t.Fatalf("unexpected block: want: %v, got: %v", blk2.BlkNum, buf2.blk.BlkNum)
+		}
+	})
+}
+
+func TestBufferManager_discard(t *testing.T) {
+	testDir, err := MakeTestDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+
+	fm, lm, err := newTestFileManagerAndLogManager(testDir, 400)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbFilePath, err := MakeTestTableFile(testDir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbFileName := filepath.Base(dbFilePath)
+	var blks []*BlockID
+	for i := 0; i < 3; i++ {
+		blk, err := fm.alloc(dbFileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blks = append(blks, blk)
+	}
+
+	bm, err := newBufferManager(fm, lm, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var bufs []*buffer
+	for _, blk := range blks {
+		buf, err := bm.pin(context.Background(), blk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bufs = append(bufs, buf)
+	}
+	// Only the last block stays pinned.
+	for _, buf := range bufs[:2] {
+		err := bm.unpin(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("a file having a pinned block is left as it is", func(t *testing.T) {
+		removed := false
+		err := bm.discard(dbFileName, 0, func() error {
+			removed = true
+			return nil
+		})
+		if err == nil {
+			t.Fatal("discard must fail")
+		}
+		if removed {
+			t.Fatal("a file must not be removed")
+		}
+		for _, blk := range blks {
+			if bm.findAssignedBuffer(blk) == nil {
+				t.Fatalf("a buffer must keep its block: %v", blk.BlkNum)
+			}
+		}
+	})
+
+	t.Run("a file having no pinned block is discarded", func(t *testing.T) {
+		err := bm.unpin(bufs[2])
+		if err != nil {
+			t.Fatal(err)
+		}
+		removed := false
+		err = bm.discard(dbFileName, 1, func() error {
+			removed = true
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !removed {
+			t.Fatal("a file must be removed")
+		}
+		if bm.findAssignedBuffer(blks[0]) == nil {
+			t.Fatal("a buffer must keep a block before a truncation point")
+		}
+		for _, blk := range blks[1:] {
+			if bm.findAssignedBuffer(blk) != nil {
+				t.Fatalf("a buffer must be discarded: %v", blk.BlkNum)
+			}
+		}
+	})
+}
+
+func TestBufferManager_concurrency(t *testing.T) {
+	testDir, err := MakeTestDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+
+	fm, lm, err := newTestFileManagerAndLogManager(testDir, 400)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbFilePath, err := MakeTestTableFile(testDir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbFileName := filepath.Base(dbFilePath)
+
+	// Each block holds its own block number.
+	var blks []*BlockID
+	for i := 0; i < 20; i++ {
+		blk, err := fm.alloc(dbFileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := newPage(400)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = DefaultEncoding.writeInt64(p, 0, int64(blk.BlkNum))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = fm.write(blk, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blks = append(blks, blk)
+	}
+
+	t.Run("concurrent pins get buffers holding the right blocks", func(t *testing.T) {
+		bm, err := newBufferManager(fm, lm, 8)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var eg errgroup.Group
+		for i := 0; i < 8; i++ {
+			i := i
+			eg.Go(func() error {
+				for j := 0; j < 200; j++ {
+					blk := blks[(i*7+j)%len(blks)]
+					buf, err := bm.pin(context.Background(), blk)
+					if err != nil {
+						return err
+					}
+					buf.latch.RLock()
+					v, _, err := DefaultEncoding.readInt64(buf.contents, 0)
+					buf.latch.RUnlock()
+					if err != nil {
+						return err
+					}
+					if !buf.blk.equal(blk) || v != int64(blk.BlkNum) {
+						return fmt.Errorf("unexpected buffer: want: %v, got: %v (%v)", blk.BlkNum, buf.blk.BlkNum, v)
+					}
+					err = bm.unpin(buf)
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+		}
+		err = eg.Wait()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := bm.availableBufferCount(); n != 8 {
+			t.Fatalf("all buffers must be unpinned: want: %v, got: %v", 8, n)
+		}
+	})
+
+	t.Run("latches let readers and a writer share a buffer", func(t *testing.T) {
+		bm, err := newBufferManager(fm, lm, 8)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lockTab := newLockTable()
+		ctx := context.Background()
+		txNumC := runTransactionNumIssuer(ctx)
+		blk := blks[0]
+
+		writer, err := newTransaction(ctx, <-txNumC, fm, lm, bm, lockTab, DefaultEncoding, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = writer.Pin(blk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var eg errgroup.Group
+		for i := 0; i < 4; i++ {
+			eg.Go(func() error {
+				// Readers skip locks, so only latches keep them from reading a page in the middle of a write.
+				tx, err := newTransaction(ctx, <-txNumC, fm, lm, bm, lockTab, DefaultEncoding, nil, withReadOnly(), WithReadUncommitted())
+				if err != nil {
+					return err
+				}
+				err = tx.Pin(blk)
+				if err != nil {
+					return err
+				}
+				for j := 0; j < 100; j++ {
+					_, err := tx.ReadString(blk.Hash, 100)
+					if err != nil {
+						return err
+					}
+				}
+				return tx.Commit()
+			})
+		}
+		for j := 0; j < 100; j++ {
+			err := writer.WriteString(blk.Hash, 100, fmt.Sprintf("value-%v", j), false)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = eg.Wait()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = writer.Rollback()
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func BenchmarkBufferManager_pinParallel(b *testing.B) {
+	testDir, err := MakeTestDir()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+
+	fm, lm, err := newTestFileManagerAndLogManager(testDir, 400)
+	if err != nil {
+		b.Fatal(err)
+	}
+	dbFilePath, err := MakeTestTableFile(testDir, "")
+	if err != nil {
+		b.Fatal(err)
+	}
+	dbFileName := filepath.Base(dbFilePath)
+	var blks []*BlockID
+	for i := 0; i < 64; i++ {
+		blk, err := fm.alloc(dbFileName)
+		if err != nil {
+			b.Fatal(err)
+		}
+		blks = append(blks, blk)
+	}
+	bm, err := newBufferManager(fm, lm, 128)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	// All blocks stay in the pool, so the benchmark measures the cost of hits. Run it with -cpu 1,2,4,8 to see how
+	// pins scale.
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			buf, err := bm.pin(context.Background(), blks[i%len(blks)])
+			if err != nil {
+				b.Fatal(err)
+			}
+			err = bm.unpin(buf)
+			if err != nil {
+				b.Fatal(err)
+			}
+			i++
+		}
+	})
+}
+
+func BenchmarkBufferManager_pin(b *testing.B) {
+	for _, bufSize := range []int{100, 10000, 100000} {
+		b.Run(fmt.Sprintf("hits with %v buffers", bufSize), func(b *testing.B) {
+			benchmarkBufferManagerPin(b, bufSize, bufSize/2)
+		})
+		b.Run(fmt.Sprintf("misses with %v buffers", bufSize), func(b *testing.B) {
+			benchmarkBufferManagerPin(b, bufSize, bufSize*2)
+		})
+	}
+}
+
+// benchmarkBufferManagerPin pins `blkCount` blocks in turn. When `blkCount` is greater than `bufSize`, every pin
+// evicts a block.
+func benchmarkBufferManagerPin(b *testing.B, bufSize int, blkCount int) {
+	testDir, err := MakeTestDir()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+
+	fm, lm, err := newTestFileManagerAndLogManager(testDir, 400)
+	if err != nil {
+		b.Fatal(err)
+	}
+	dbFilePath, err := MakeTestTableFile(testDir, "")
+	if err != nil {
+		b.Fatal(err)
+	}
+	dbFileName := filepath.Base(dbFilePath)
+	// Extending the file is much faster than allocating the blocks one by one, but an encrypted block must be
+	// written through the file manager.
+	if fm.cipher == nil {
+		err = os.Truncate(dbFilePath, int64(blkCount*400))
+		if err != nil {
+			b.Fatal(err)
+		}
+	} else {
+		for i := 0; i < blkCount; i++ {
+			_, err := fm.alloc(dbFileName)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	blks := make([]*BlockID, blkCount)
+	for i := range blks {
+		blks[i] = NewBlockID(dbFileName, i)
+	}
+	bm, err := newBufferManager(fm, lm, bufSize)
+	if err != nil {
+		b.Fatal(err)
+	}
+	ctx := context.Background()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf, err := bm.pin(ctx, blks[i%blkCount])
+		if err != nil {
+			b.Fatal(err)
+		}
+		err = bm.unpin(buf)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package storage
+
+import (
+	"fmt"
+	"sync"
+)
+
+// ChangeListeners delivers the change records that transactions write with LogChange. A change record describes
+// a logical modification, such as an insertion of a record into a table, in a form that the layer above the storage
+// defines. Change records are part of the log, so they reach a disk with the commit record of a transaction, and
+// a prepared transaction keeps them across a restart. Recovery ignores them.
+//
+// A storage has one ChangeListeners, and its transactions share it.
+type ChangeListeners struct {
+	mu        sync.Mutex
+	listeners map[string]map[*changeListener]struct{}
+}
+
+type changeListener struct {
+	f func(payloads [][]byte)
+}
+
+func newChangeListeners() *ChangeListeners {
+	return &ChangeListeners{
+		listeners: map[string]map[*changeListener]struct{}{},
+	}
+}
+
+// Listen registers a function `f` receiving the payloads of the change records that a transaction wrote for
+// `source`. The storage reads the records from the log when the transaction commits, and it calls `f` with
+// the payloads in the order the transaction wrote them. `f` is called after the commit record has reached a disk
+// and before the transaction releases its locks, so transactions modifying the same data reach `f` in the order
+// they committed. `f` must not block or begin transactions. Listen returns a function removing the listener.
+func (l *ChangeListeners) Listen(source string, f func(payloads [][]byte)) func() {
+	cl := &changeListener{
+		f: f,
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.listeners[source] == nil {
+		l.listeners[source] = map[*changeListener]struct{}{}
+	}
+	l.listeners[source][cl] = struct{}{}
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		delete(l.listeners[source], cl)
+		if len(l.listeners[source]) == 0 {
+			delete(l.listeners, source)
+		}
+	}
+}
+
+// listening reports whether a source has listeners.
+func (l *ChangeListeners) listening(source string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.listeners[source]) > 0
+}
+
+// notify calls the listeners of the sources in `payloads`. A listener may remove listeners, so notify doesn't hold
+// the lock while calling them.
+func (l *ChangeListeners) notify(payloads map[string][][]byte) {
+	for source, ps := range payloads {
+		var fs []func(payloads [][]byte)
+		l.mu.Lock()
+		for cl := range l.listeners[source] {
+			fs = append(fs, cl.f)
+		}
+		l.mu.Unlock()
+		for _, f := range fs {
+			f(ps)
+		}
+	}
+}
+
+// ChangeListeners returns the listeners of the change records of the storage.
+func (s *Storage) ChangeListeners() *ChangeListeners {
+	return s.lm.changes
+}
+
+// ChangeListeners returns the listeners of the change records of the storage the transaction belongs to.
+func (t *Transaction) ChangeListeners() *ChangeListeners {
+	return t.changes
+}
+
+// CapturesChanges reports whether a source has listeners. A writer skips making change records for a source that
+// nobody listens to.
+func (t *Transaction) CapturesChanges(source string) bool {
+	return !t.opts.readOnly && t.changes.listening(source)
+}
+
+// LogChange writes a change record holding `payload` for `source` to the log. A payload that doesn't fit in
+// a log block is split into several records.
+func (t *Transaction) LogChange(source string, payload []byte) error {
+	if t.opts.readOnly {
+		return fmt.Errorf("failed to log a change: %w", ErrReadOnlyTransaction)
+	}
+	if *t.gid != "" {
+		return fmt.Errorf("failed to log a change: %w", ErrTransactionPrepared)
+	}
+	return t.rm.logChange(source, payload)
+}
+
+func (m *recoveryManager) logChange(source string, payload []byte) error {
+	// The Offset field of a change record is 1 when the next record continues the payload.
+	empty, err := newChangeLogRecord(m.txNum, source, []byte{}, true).marshalBytes()
+	if err != nil {
+		return err
+	}
+	chunkSize := m.lm.maxRecordSize() - len(empty) - logRecordMargin
+	if chunkSize <= 0 {
+		return fmt.Errorf("a log block is too small for a change record: source: %v", source)
+	}
+	for {
+		chunk := payload
+		if len(chunk) > chunkSize {
+			chunk = chunk[:chunkSize]
+		}
+		payload = payload[len(chunk):]
+		rec, err := newChangeLogRecord(m.txNum, source, chunk, len(payload) > 0).marshalBytes()
+		if err != nil {
+			return err
+		}
+		_, err = m.lm.appendLog(rec)
+		if err != nil {
+			return err
+		}
+		if len(payload) == 0 {
+			break
+		}
+	}
+	m.changesLogged = true
+	return nil
+}
+
+// changes reads the change records of the transaction from the log and returns their payloads by source.
+func (m *recoveryManager) changes() (map[string][][]byte, error) {
+	var recs []*logRecord
+	err := m.lm.apply(func(rec []byte) (bool, error) {
+		r := &logRecord{}
+		err := r.unmarshalBytes(rec)
+		if err != nil {
+			return false, err
+		}
+		if r.TxNum != m.txNum {
+			return false, nil
+		}
+		switch r.Op {
+		case opStart:
+			return true, nil
+		case opChange:
+			recs = append(recs, r)
+		}
+		return false, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// `apply` reads log records from the newest one.
+	payloads := map[string][][]byte{}
+	var payload []byte
+	for i := len(recs) - 1; i >= 0; i-- {
+		r := recs[i]
+		chunk, _ := r.Val.([]byte)
+		payload = append(payload, chunk...)
+		if r.Offset == 1 {
+			continue
+		}
+		payloads[r.FileName] = append(payloads[r.FileName], payload)
+		payload = nil
+	}
+	return payloads, nil
+}
@@ -0,0 +1,162 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestTransaction_LogChange(t *testing.T) {
+	testDir, err := MakeTestDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+
+	logFilePath, err := MakeTestLogFile(testDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	config := TestConfig(&StorageConfig{
+		DirPath:     testDir,
+		LogFileName: filepath.Base(logFilePath),
+		BlkSize:     400,
+		BufSize:     10,
+	})
+	st, err := InitStorage(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	var got [][]byte
+	cancel := st.ChangeListeners().Listen("t", func(payloads [][]byte) {
+		got = append(got, payloads...)
+	})
+	defer cancel()
+
+	// A payload larger than a log block is split into several change records.
+	large := bytes.Repeat([]byte("0123456789"), 100)
+	payloads := [][]byte{[]byte("first"), large, []byte("last")}
+	logChanges := func(t *testing.T, tx *Transaction) {
+		t.Helper()
+		if !tx.CapturesChanges("t") || tx.CapturesChanges("u") {
+			t.Fatal("a transaction must capture only the changes of a source having listeners")
+		}
+		for _, p := range payloads {
+			err := tx.LogChange("t", p)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		// Another transaction writing change records in between doesn't mix its records into them.
+		other, err := st.NewTransaction(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = other.LogChange("t", []byte("other"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = other.Rollback()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("listeners receive the change records of a committed transaction from the log", func(t *testing.T) {
+		got = nil
+		tx, err := st.NewTransaction(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		logChanges(t, tx)
+		if len(got) != 0 {
+			t.Fatalf("listeners must not receive changes before a transaction commits: %q", got)
+		}
+		err = tx.Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, payloads) {
+			t.Fatalf("unexpected payloads: want: %q, got: %q", payloads, got)
+		}
+	})
+
+	t.Run("listeners don't receive the change records of a rolled-back transaction", func(t *testing.T) {
+		got = nil
+		tx, err := st.NewTransaction(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		logChanges(t, tx)
+		err = tx.Rollback()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 0 {
+			t.Fatalf("unexpected payloads: %q", got)
+		}
+	})
+
+	t.Run("a prepared transaction keeps its change records across a restart", func(t *testing.T) {
+		tx, err := st.NewTransaction(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		logChanges(t, tx)
+		err = tx.Prepare("gid-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Transaction numbers restart in the new storage, so the numbers of the transactions before the restart
+		// don't identify the prepared transaction.
+		st2, err := InitStorage(ctx, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer st2.Close()
+		for i := 0; i < 3; i++ {
+			tx, err := st2.NewTransaction(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if i == 0 {
+				err = tx.Recover()
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			err = tx.LogChange("t", []byte(fmt.Sprintf("after the restart #%v", i)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = tx.Rollback()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		var got2 [][]byte
+		cancel := st2.ChangeListeners().Listen("t", func(payloads [][]byte) {
+			got2 = append(got2, payloads...)
+		})
+		defer cancel()
+		ptx, ok := st2.PreparedTransaction("gid-1")
+		if !ok {
+			t.Fatal("a prepared transaction was not found")
+		}
+		err = ptx.CommitPrepared()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got2, payloads) {
+			t.Fatalf("unexpected payloads: want: %q, got: %q", payloads, got2)
+		}
+	})
+}
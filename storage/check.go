@@ -0,0 +1,100 @@
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+)
+
+// LogProblem is a part of the log that cannot be read.
+type LogProblem struct {
+	BlkNum int `json:"block"`
+
+	// Offset is the offset of a log record in the block. Offset is -1 when the whole block cannot be read.
+	Offset  int    `json:"offset"`
+	Message string `json:"message"`
+}
+
+// LogCheckResult is the result of Storage.CheckLog.
+type LogCheckResult struct {
+	Blocks   int           `json:"blocks"`
+	Records  int           `json:"records"`
+	Problems []*LogProblem `json:"problems"`
+}
+
+// CheckLog reads all log records from the first block of the log and reports the blocks and the records that cannot
+// be read. A block fails to be read when its header is broken or, in an encrypted database, when it fails
+// authentication. A record fails to be read when it doesn't decode into a log record of a known kind. CheckLog
+// doesn't stop at a problem, so the result reports all of them.
+func (s *Storage) CheckLog() (*LogCheckResult, error) {
+	err := s.lm.flushAll()
+	if err != nil {
+		return nil, err
+	}
+	c, err := s.fm.blockCount(s.lm.logFileName)
+	if err != nil {
+		return nil, err
+	}
+	res := &LogCheckResult{
+		Blocks:   c,
+		Problems: []*LogProblem{},
+	}
+	p, err := newPage(s.fm.blkSize)
+	if err != nil {
+		return nil, err
+	}
+	for blkNum := 0; blkNum < c; blkNum++ {
+		report := func(offset int, format string, a ...interface{}) {
+			res.Problems = append(res.Problems, &LogProblem{
+				BlkNum:  blkNum,
+				Offset:  offset,
+				Message: fmt.Sprintf(format, a...),
+			})
+		}
+
+		err := s.fm.read(NewBlockID(s.lm.logFileName, blkNum), p)
+		if err != nil {
+			report(-1, "%v", err)
+			continue
+		}
+		boundary, _, err := p.readInt64(0)
+		if err != nil {
+			report(-1, "failed to read the boundary: %v", err)
+			continue
+		}
+		if boundary < binary.MaxVarintLen64 || boundary > int64(s.fm.blkSize) {
+			report(-1, "the boundary is out of range: %v", boundary)
+			continue
+		}
+		for offset := int(boundary); offset < s.fm.blkSize; {
+			b, n, err := p.read(offset)
+			if err != nil {
+				report(offset, "%v", err)
+				break
+			}
+			r := &logRecord{}
+			err = r.unmarshalBytes(b)
+			if err != nil {
+				report(offset, "failed to decode a log record: %v", err)
+			} else if r.Op < opCheckPoint || r.Op > opSetHintBytes {
+				report(offset, "unknown log record: op: %v", r.Op)
+			} else {
+				res.Records++
+			}
+			offset += n
+		}
+	}
+	return res, nil
+}
+
+// FileExists reports whether a file exists. `fileName` may name a file in a tablespace.
+func (s *Storage) FileExists(fileName string) (bool, error) {
+	_, err := os.Stat(s.fm.path(fileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
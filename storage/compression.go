@@ -0,0 +1,296 @@
+package storage
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// pageMapSuffix is the suffix of the file holding the page map of a compressed file.
+const pageMapSuffix = ".pagemap"
+
+// pageMapEntrySize is the size of an entry of a page map. An entry consists of the offset of an extent in 8 bytes,
+// the length of the data in the extent in 4 bytes, and the capacity of the extent in 4 bytes, in little-endian.
+const pageMapEntrySize = 16
+
+// extentAlign is the unit of the capacity of an extent, so that an extent a block freed fits blocks of similar
+// sizes.
+const extentAlign = 128
+
+// compressible reports whether a file may be stored in the compressed format. Only table files are compressed;
+// the log keeps fixed-size blocks because archiving and replicas read it directly.
+func compressible(fileName string) bool {
+	return strings.HasSuffix(fileName, ".tbl")
+}
+
+// extent is a range of a compressed file holding a block.
+type extent struct {
+	offset   int64
+	length   int
+	capacity int
+}
+
+// compressedFile stores blocks in variable-size extents. The page map, which is a separate file, maps the number
+// of a block to the extent holding it. Writing a block always moves the block to a free extent, and the old extent
+// becomes free after the page map points to the new one, so a crash leaves the page map pointing to a complete
+// extent.
+type compressedFile struct {
+	data    *os.File
+	pageMap *os.File
+	extents []extent
+
+	// free holds the ranges no block uses. It is rebuilt from the page map when the file opens.
+	free []extent
+	end  int64
+}
+
+// openCompressedFile opens a file in the compressed format. When `readOnly` is true, the file must exist and is
+// opened only for reading.
+func openCompressedFile(path string, readOnly bool) (*compressedFile, error) {
+	flag := os.O_CREATE | os.O_RDWR | os.O_SYNC
+	if readOnly {
+		flag = os.O_RDONLY
+	}
+	data, err := os.OpenFile(path, flag, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open a new file: %w", err)
+	}
+	pageMap, err := os.OpenFile(path+pageMapSuffix, flag, 0600)
+	if err != nil {
+		data.Close()
+		return nil, fmt.Errorf("failed to open a page map: %w", err)
+	}
+	f := &compressedFile{
+		data:    data,
+		pageMap: pageMap,
+	}
+	b, err := io.ReadAll(pageMap)
+	if err != nil {
+		f.close()
+		return nil, fmt.Errorf("failed to read a page map: %w", err)
+	}
+	for i := 0; i+pageMapEntrySize <= len(b); i += pageMapEntrySize {
+		f.extents = append(f.extents, extent{
+			offset:   int64(binary.LittleEndian.Uint64(b[i:])),
+			length:   int(binary.LittleEndian.Uint32(b[i+8:])),
+			capacity: int(binary.LittleEndian.Uint32(b[i+12:])),
+		})
+	}
+	f.rebuildFreeList()
+	return f, nil
+}
+
+// rebuildFreeList finds the ranges between the extents blocks use.
+func (f *compressedFile) rebuildFreeList() {
+	used := append([]extent{}, f.extents...)
+	sort.Slice(used, func(i, j int) bool {
+		return used[i].offset < used[j].offset
+	})
+	f.free = nil
+	var pos int64
+	for _, e := range used {
+		if e.capacity == 0 {
+			continue
+		}
+		if e.offset > pos {
+			f.free = append(f.free, extent{
+				offset:   pos,
+				capacity: int(e.offset - pos),
+			})
+		}
+		if end := e.offset + int64(e.capacity); end > pos {
+			pos = end
+		}
+	}
+	f.end = pos
+}
+
+func (f *compressedFile) blockCount() int {
+	return len(f.extents)
+}
+
+func (f *compressedFile) read(blkNum int) ([]byte, error) {
+	if blkNum < 0 || blkNum >= len(f.extents) {
+		return nil, fmt.Errorf("a block doesn't exist: %v", blkNum)
+	}
+	e := f.extents[blkNum]
+	b := make([]byte, e.length)
+	_, err := f.data.ReadAt(b, e.offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read an extent: %w", err)
+	}
+	return b, nil
+}
+
+// write writes data of a block. Writing the block following the last one extends the file.
+func (f *compressedFile) write(blkNum int, b []byte) error {
+	if blkNum < 0 || blkNum > len(f.extents) {
+		return fmt.Errorf("a block doesn't exist: %v", blkNum)
+	}
+	var old extent
+	if blkNum < len(f.extents) {
+		old = f.extents[blkNum]
+	}
+	e := f.allocate((len(b) + extentAlign - 1) / extentAlign * extentAlign)
+	_, err := f.data.WriteAt(b, e.offset)
+	if err != nil {
+		f.release(e)
+		return err
+	}
+	e.length = len(b)
+	err = f.writeEntry(blkNum, e)
+	if err != nil {
+		f.release(e)
+		return err
+	}
+	if blkNum == len(f.extents) {
+		f.extents = append(f.extents, e)
+		return nil
+	}
+	f.extents[blkNum] = e
+	f.release(old)
+	return nil
+}
+
+// allocate returns a free extent of `capacity` bytes. When no free range is large enough, the extent is placed at
+// the end of the file.
+func (f *compressedFile) allocate(capacity int) extent {
+	for i, r := range f.free {
+		if r.capacity < capacity {
+			continue
+		}
+		if r.capacity == capacity {
+			f.free = append(f.free[:i], f.free[i+1:]...)
+		} else {
+			f.free[i] = extent{
+				offset:   r.offset + int64(capacity),
+				capacity: r.capacity - capacity,
+			}
+		}
+		return extent{
+			offset:   r.offset,
+			capacity: capacity,
+		}
+	}
+	e := extent{
+		offset:   f.end,
+		capacity: capacity,
+	}
+	f.end += int64(capacity)
+	return e
+}
+
+// release frees an extent, merging it with adjacent free ranges.
+func (f *compressedFile) release(e extent) {
+	if e.capacity == 0 {
+		return
+	}
+	r := extent{
+		offset:   e.offset,
+		capacity: e.capacity,
+	}
+	i := sort.Search(len(f.free), func(i int) bool {
+		return f.free[i].offset > r.offset
+	})
+	if i < len(f.free) && r.offset+int64(r.capacity) == f.free[i].offset {
+		r.capacity += f.free[i].capacity
+		f.free = append(f.free[:i], f.free[i+1:]...)
+	}
+	if i > 0 && f.free[i-1].offset+int64(f.free[i-1].capacity) == r.offset {
+		f.free[i-1].capacity += r.capacity
+		return
+	}
+	f.free = append(f.free, extent{})
+	copy(f.free[i+1:], f.free[i:])
+	f.free[i] = r
+}
+
+func (f *compressedFile) writeEntry(blkNum int, e extent) error {
+	b := make([]byte, pageMapEntrySize)
+	binary.LittleEndian.PutUint64(b, uint64(e.offset))
+	binary.LittleEndian.PutUint32(b[8:], uint32(e.length))
+	binary.LittleEndian.PutUint32(b[12:], uint32(e.capacity))
+	_, err := f.pageMap.WriteAt(b, int64(blkNum*pageMapEntrySize))
+	if err != nil {
+		return fmt.Errorf("failed to write a page map: %w", err)
+	}
+	return nil
+}
+
+// truncate keeps the first `blkCount` blocks and releases the extents of the others.
+func (f *compressedFile) truncate(blkCount int) error {
+	if blkCount >= len(f.extents) {
+		return nil
+	}
+	err := f.pageMap.Truncate(int64(blkCount * pageMapEntrySize))
+	if err != nil {
+		return fmt.Errorf("failed to truncate a page map: %w", err)
+	}
+	f.extents = f.extents[:blkCount]
+	f.rebuildFreeList()
+	err = f.data.Truncate(f.end)
+	if err != nil {
+		return fmt.Errorf("failed to truncate a file: %w", err)
+	}
+	return nil
+}
+
+func (f *compressedFile) close() error {
+	err := f.data.Close()
+	if err != nil {
+		f.pageMap.Close()
+		return err
+	}
+	return f.pageMap.Close()
+}
+
+var (
+	flateWriters = sync.Pool{
+		New: func() interface{} {
+			w, _ := flate.NewWriter(nil, flate.BestSpeed)
+			return w
+		},
+	}
+)
+
+// compressBlock returns the compressed contents of a block. When compressing doesn't make the contents smaller,
+// compressBlock returns the contents as they are; decompressBlock tells them apart by their size.
+func compressBlock(contents []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := flateWriters.Get().(*flate.Writer)
+	defer flateWriters.Put(w)
+	w.Reset(&buf)
+	_, err := w.Write(contents)
+	if err != nil {
+		return nil, err
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+	if buf.Len() >= len(contents) {
+		return contents, nil
+	}
+	return buf.Bytes(), nil
+}
+
+// decompressBlock restores the contents of a block into `dst`.
+func decompressBlock(data []byte, dst []byte) error {
+	if len(data) == len(dst) {
+		copy(dst, data)
+		return nil
+	}
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+	_, err := io.ReadFull(r, dst)
+	if err != nil {
+		return fmt.Errorf("failed to decompress a block: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,239 @@
+package storage
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileManager_compression(t *testing.T) {
+	testDir, err := MakeTestDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+
+	const blkSize = 400
+	newFM := func(t *testing.T) *fileManager {
+		t.Helper()
+		fm, err := newTestFileManager(testDir, blkSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fm.compressTables = true
+		return fm
+	}
+	// makeContents makes contents beginning with `randomSize` random bytes. The random bytes don't compress,
+	// so the size of the compressed contents grows with `randomSize`.
+	makeContents := func(seed int64, randomSize int) []byte {
+		b := make([]byte, blkSize)
+		copy(b, bytes.Repeat([]byte{byte(seed)}, 50))
+		rand.New(rand.NewSource(seed)).Read(b[:randomSize])
+		return b
+	}
+	write := func(t *testing.T, fm *fileManager, blk *BlockID, contents []byte) {
+		t.Helper()
+		p, err := newPage(blkSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		copy(p.buf, contents)
+		err = fm.write(blk, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectContents := func(t *testing.T, fm *fileManager, blk *BlockID, want []byte) {
+		t.Helper()
+		p, err := newPage(blkSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = fm.read(blk, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(p.buf, want) {
+			t.Fatalf("unexpected contents: block: %v", blk.BlkNum)
+		}
+	}
+
+	const fileName = "compressed.tbl"
+	fm := newFM(t)
+	want := make([][]byte, 4)
+	for i := range want {
+		blk, err := fm.alloc(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if blk.BlkNum != i {
+			t.Fatalf("unexpected block number: want: %v, got: %v", i, blk.BlkNum)
+		}
+		want[i] = makeContents(int64(i), 0)
+		write(t, fm, blk, want[i])
+	}
+
+	t.Run("a compressed file is smaller than its blocks", func(t *testing.T) {
+		s, err := os.Stat(filepath.Join(testDir, fileName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.Size() >= int64(len(want)*blkSize) {
+			t.Fatalf("a file was not compressed: size: %v byte", s.Size())
+		}
+		c, err := fm.blockCount(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c != len(want) {
+			t.Fatalf("unexpected block count: want: %v, got: %v", len(want), c)
+		}
+		for i, w := range want {
+			expectContents(t, fm, NewBlockID(fileName, i), w)
+		}
+	})
+
+	t.Run("a block that grows moves to another extent, and its old extent is reused", func(t *testing.T) {
+		size := func(t *testing.T) int64 {
+			t.Helper()
+			s, err := os.Stat(filepath.Join(testDir, fileName))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return s.Size()
+		}
+
+		// The block moves to an extent of 256 bytes and then to an extent of 512 bytes, which frees the extent of
+		// 256 bytes.
+		want[1] = makeContents(1, 150)
+		write(t, fm, NewBlockID(fileName, 1), want[1])
+		want[1] = makeContents(1, blkSize)
+		write(t, fm, NewBlockID(fileName, 1), want[1])
+		s := size(t)
+
+		// Another block growing to 256 bytes takes the free extent.
+		want[2] = makeContents(2, 150)
+		write(t, fm, NewBlockID(fileName, 2), want[2])
+		if size(t) != s {
+			t.Fatalf("a file must not grow: want: %v byte, got: %v byte", s, size(t))
+		}
+		for i, w := range want {
+			expectContents(t, fm, NewBlockID(fileName, i), w)
+		}
+	})
+
+	t.Run("overwriting a block leaves its old extent in place until the page map points to the new one", func(t *testing.T) {
+		cf := fm.compressedFiles[fileName]
+		old := cf.extents[3]
+		want[3] = makeContents(4, 0)
+		write(t, fm, NewBlockID(fileName, 3), want[3])
+		if cf.extents[3].offset == old.offset {
+			t.Fatalf("a block must move to another extent: offset: %v", old.offset)
+		}
+		freed := false
+		for _, r := range cf.free {
+			if r.offset <= old.offset && old.offset+int64(old.capacity) <= r.offset+int64(r.capacity) {
+				freed = true
+			}
+		}
+		if !freed {
+			t.Fatalf("the old extent must be free: offset: %v", old.offset)
+		}
+		for i, w := range want {
+			expectContents(t, fm, NewBlockID(fileName, i), w)
+		}
+	})
+
+	t.Run("a compressed file keeps its blocks after reopening", func(t *testing.T) {
+		err := fm.closeAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		fm = newFM(t)
+		for i, w := range want {
+			expectContents(t, fm, NewBlockID(fileName, i), w)
+		}
+		// The free space is rebuilt from the page map.
+		want[0] = makeContents(3, blkSize)
+		write(t, fm, NewBlockID(fileName, 0), want[0])
+		for i, w := range want {
+			expectContents(t, fm, NewBlockID(fileName, i), w)
+		}
+	})
+
+	t.Run("truncating a compressed file drops the last blocks", func(t *testing.T) {
+		err := fm.truncate(fileName, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := fm.blockCount(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c != 2 {
+			t.Fatalf("unexpected block count: want: %v, got: %v", 2, c)
+		}
+		for i, w := range want[:2] {
+			expectContents(t, fm, NewBlockID(fileName, i), w)
+		}
+		blk, err := fm.alloc(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if blk.BlkNum != 2 {
+			t.Fatalf("unexpected block number: want: %v, got: %v", 2, blk.BlkNum)
+		}
+		expectContents(t, fm, blk, make([]byte, blkSize))
+	})
+
+	t.Run("removing a compressed file removes its page map", func(t *testing.T) {
+		err := fm.remove(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{fileName, fileName + pageMapSuffix} {
+			_, err := os.Stat(filepath.Join(testDir, name))
+			if !os.IsNotExist(err) {
+				t.Fatalf("a file remains: %v", name)
+			}
+		}
+	})
+
+	t.Run("a file holding blocks keeps the plain format", func(t *testing.T) {
+		const plainFileName = "plain.tbl"
+		plain, err := newTestFileManager(testDir, blkSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blk, err := plain.alloc(plainFileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := makeContents(1, 0)
+		write(t, plain, blk, w)
+		err = plain.closeAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		blk, err = fm.alloc(plainFileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if blk.BlkNum != 1 {
+			t.Fatalf("unexpected block number: want: %v, got: %v", 1, blk.BlkNum)
+		}
+		_, err = os.Stat(filepath.Join(testDir, plainFileName+pageMapSuffix))
+		if !os.IsNotExist(err) {
+			t.Fatal("a file holding blocks must not be compressed")
+		}
+		expectContents(t, fm, NewBlockID(plainFileName, 0), w)
+	})
+
+	err = fm.closeAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
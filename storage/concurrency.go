@@ -2,25 +2,45 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// ErrLockWaitTimeout is returned when a transaction cannot acquire a lock before its deadline.
+var ErrLockWaitTimeout = fmt.Errorf("lock wait timeout")
+
+// lockWaitError converts the reason why a context is done into an error.
+func lockWaitError(ctx context.Context, lock string) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%v: %w", lock, ErrLockWaitTimeout)
+	}
+	return fmt.Errorf("%v is canceled: %w", lock, ctx.Err())
+}
+
 type lockEntry struct {
 	exclusive chan struct{}
 	shared    int
+
+	// released is closed and replaced whenever a shared lock is released.
+	released chan struct{}
 }
 
 func newLockEntry() *lockEntry {
 	e := &lockEntry{
 		exclusive: make(chan struct{}, 1),
 		shared:    0,
+		released:  make(chan struct{}),
 	}
 	e.exclusive <- struct{}{}
 	return e
 }
 
 type lockTable struct {
+	stats lockCounters
+
 	locks *sync.Map
 	mu    sync.Mutex
 }
@@ -32,7 +52,8 @@ func newLockTable() *lockTable {
 	}
 }
 
-func (t *lockTable) sLock(ctx context.Context, blk BlockIDHash) error {
+// sLock acquires a shared lock. The first return value is the time the caller waited for the lock.
+func (t *lockTable) sLock(ctx context.Context, blk BlockIDHash) (time.Duration, error) {
 	var e *lockEntry
 	{
 		v, ok := t.locks.Load(blk)
@@ -42,17 +63,23 @@ func (t *lockTable) sLock(ctx context.Context, blk BlockIDHash) error {
 			e = v.(*lockEntry)
 		}
 	}
-	select {
-	case <-e.exclusive:
-		e.shared++
-	case <-ctx.Done():
-		return fmt.Errorf("sLock is canceled: %w", ctx.Err())
+	waited, err := e.acquire(ctx, "sLock")
+	t.countAcquisition(false, waited, err)
+	if err != nil {
+		return waited, err
 	}
+	// sUnlock decrements the counter without the token, so we update it under the lock of the table.
+	t.mu.Lock()
+	e.shared++
+	t.mu.Unlock()
 	e.exclusive <- struct{}{}
-	return nil
+	return waited, nil
 }
 
-func (t *lockTable) xLock(ctx context.Context, blk BlockIDHash) error {
+// xLock acquires an exclusive lock and waits until no other transaction holds a shared lock on the block. `holdsShared`
+// tells that the caller already holds a shared lock; otherwise, xLock takes one along with the exclusive lock.
+// The first return value is the time the caller waited for the lock.
+func (t *lockTable) xLock(ctx context.Context, blk BlockIDHash, holdsShared bool) (time.Duration, error) {
 	var e *lockEntry
 	{
 		v, ok := t.locks.Load(blk)
@@ -62,12 +89,89 @@ func (t *lockTable) xLock(ctx context.Context, blk BlockIDHash) error {
 			e = v.(*lockEntry)
 		}
 	}
+	waited, err := e.acquire(ctx, "xLock")
+	if err != nil {
+		t.countAcquisition(true, waited, err)
+		return waited, err
+	}
+	t.mu.Lock()
+	if !holdsShared {
+		e.shared++
+	}
+	t.mu.Unlock()
+	w, err := t.waitForSharedLocks(ctx, e)
+	waited += w
+	if err != nil {
+		t.mu.Lock()
+		if !holdsShared {
+			e.shared--
+		}
+		t.mu.Unlock()
+		e.exclusive <- struct{}{}
+	}
+	t.countAcquisition(true, waited, err)
+	return waited, err
+}
+
+// waitForSharedLocks waits until only the caller holds a shared lock on an entry. The caller holds the token, so
+// no transaction acquires a new shared lock in the meantime.
+func (t *lockTable) waitForSharedLocks(ctx context.Context, e *lockEntry) (time.Duration, error) {
+	var start time.Time
+	for {
+		t.mu.Lock()
+		if e.shared <= 1 {
+			t.mu.Unlock()
+			if start.IsZero() {
+				return 0, nil
+			}
+			return time.Since(start), nil
+		}
+		released := e.released
+		t.mu.Unlock()
+		if start.IsZero() {
+			start = time.Now()
+		}
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return time.Since(start), lockWaitError(ctx, "xLock")
+		}
+	}
+}
+
+func (t *lockTable) countAcquisition(exclusive bool, waited time.Duration, err error) {
+	if waited > 0 {
+		atomic.AddUint64(&t.stats.waits, 1)
+		atomic.AddInt64(&t.stats.waitTime, int64(waited))
+	}
+	if err != nil {
+		if errors.Is(err, ErrLockWaitTimeout) {
+			atomic.AddUint64(&t.stats.timeouts, 1)
+		}
+		return
+	}
+	if exclusive {
+		atomic.AddUint64(&t.stats.exclusiveAcquired, 1)
+	} else {
+		atomic.AddUint64(&t.stats.sharedAcquired, 1)
+	}
+}
+
+// acquire takes the token of an entry. When the token is not available, acquire waits until it becomes available
+// or `ctx` is done.
+func (e *lockEntry) acquire(ctx context.Context, lock string) (time.Duration, error) {
+	select {
+	case <-e.exclusive:
+		return 0, nil
+	default:
+	}
+	start := time.Now()
 	select {
 	case <-e.exclusive:
+		return time.Since(start), nil
 	case <-ctx.Done():
-		return fmt.Errorf("xLock is canceled: %w", ctx.Err())
+		return time.Since(start), lockWaitError(ctx, lock)
 	}
-	return nil
 }
 
 func (t *lockTable) sUnlock(blk BlockIDHash) {
@@ -85,6 +189,8 @@ func (t *lockTable) sUnlock(blk BlockIDHash) {
 	}
 	if e.shared > 0 {
 		e.shared--
+		close(e.released)
+		e.released = make(chan struct{})
 	}
 	if len(e.exclusive) > 0 && e.shared == 0 {
 		t.locks.Delete(blk)
@@ -128,12 +234,16 @@ func (t *lockTable) addEntry(blk BlockIDHash) *lockEntry {
 type concurrencyManager struct {
 	lockTab *lockTable
 	locks   map[BlockIDHash]string
+	txNum   transactionNum
+	ev      *eventDispatcher
 }
 
-func newConcurrencyManager(lockTab *lockTable) *concurrencyManager {
+func newConcurrencyManager(lockTab *lockTable, txNum transactionNum, ev *eventDispatcher) *concurrencyManager {
 	return &concurrencyManager{
 		lockTab: lockTab,
 		locks:   map[BlockIDHash]string{},
+		txNum:   txNum,
+		ev:      ev,
 	}
 }
 
@@ -142,7 +252,8 @@ func (m *concurrencyManager) sLock(ctx context.Context, blk BlockIDHash) error {
 	if ok {
 		return nil
 	}
-	err := m.lockTab.sLock(ctx, blk)
+	waited, err := m.lockTab.sLock(ctx, blk)
+	m.lockWaited(blk, false, waited, err)
 	if err != nil {
 		return err
 	}
@@ -154,11 +265,11 @@ func (m *concurrencyManager) xLock(ctx context.Context, blk BlockIDHash) error {
 	if m.xLocked(blk) {
 		return nil
 	}
-	err := m.sLock(ctx, blk)
-	if err != nil {
-		return err
-	}
-	err = m.lockTab.xLock(ctx, blk)
+	// A transaction that doesn't read the block first takes both locks at once, so two such transactions don't
+	// deadlock upgrading their shared locks.
+	_, holdsShared := m.locks[blk]
+	waited, err := m.lockTab.xLock(ctx, blk, holdsShared)
+	m.lockWaited(blk, true, waited, err)
 	if err != nil {
 		return err
 	}
@@ -166,6 +277,19 @@ func (m *concurrencyManager) xLock(ctx context.Context, blk BlockIDHash) error {
 	return nil
 }
 
+func (m *concurrencyManager) lockWaited(blk BlockIDHash, exclusive bool, waited time.Duration, err error) {
+	if waited == 0 {
+		return
+	}
+	m.ev.lockWaited(&LockWaitEvent{
+		TxNum:     int(m.txNum),
+		Block:     blk,
+		Exclusive: exclusive,
+		Duration:  waited,
+		Err:       err,
+	})
+}
+
 func (m *concurrencyManager) release() {
 	for blk, l := range m.locks {
 		if l == "s" {
@@ -0,0 +1,191 @@
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Encoding determines how pages encode integers and strings. A database directory uses a single encoding, which
+// is recorded in the encoding file of the directory.
+type Encoding int
+
+const (
+	// EncodingVarint encodes a value as a varint or bytes following a length header of binary.MaxVarintLen64
+	// bytes.
+	EncodingVarint Encoding = iota + 1
+
+	// EncodingFixed encodes an integer in 8 bytes in little-endian and a string with a 2-byte length prefix.
+	EncodingFixed
+
+	// EncodingLegacy is the encoding of databases created before the encoding file was introduced. Pages encode
+	// values in the same way as EncodingVarint, but the table files of such a database hold records in fixed-size
+	// slots instead of slotted pages. Only a migration reads them; see table.MigrateDatabase.
+	EncodingLegacy
+)
+
+// DefaultEncoding is the encoding that a new database uses.
+const DefaultEncoding = EncodingFixed
+
+var errInvalidEncoding = fmt.Errorf("invalid encoding")
+
+func (e Encoding) String() string {
+	switch e {
+	case EncodingVarint:
+		return "varint"
+	case EncodingFixed:
+		return "fixed"
+	case EncodingLegacy:
+		return "legacy"
+	}
+	return fmt.Sprintf("Encoding(%d)", int(e))
+}
+
+func parseEncoding(s string) (Encoding, error) {
+	switch s {
+	case EncodingVarint.String():
+		return EncodingVarint, nil
+	case EncodingFixed.String():
+		return EncodingFixed, nil
+	case EncodingLegacy.String():
+		return EncodingLegacy, nil
+	}
+	return 0, fmt.Errorf("%w: %v", errInvalidEncoding, s)
+}
+
+// Int64Size returns the maximum number of bytes an int64 occupies.
+func (e Encoding) Int64Size() int {
+	if e == EncodingFixed {
+		return FixedIntSize
+	}
+	return CalcBytesNeeded(binary.MaxVarintLen64)
+}
+
+// Uint64Size returns the maximum number of bytes a uint64 occupies.
+func (e Encoding) Uint64Size() int {
+	return e.Int64Size()
+}
+
+// StringSize returns the number of bytes a string of `n` bytes occupies.
+func (e Encoding) StringSize(n int) int {
+	if e == EncodingFixed {
+		return ShortStringHeaderSize + n
+	}
+	return CalcBytesNeeded(n)
+}
+
+// MaxStringSize returns the maximum number of bytes a string can hold. The block size also limits the size.
+func (e Encoding) MaxStringSize() int {
+	if e == EncodingFixed {
+		return MaxShortStringSize
+	}
+	return int(^uint(0) >> 1)
+}
+
+func (e Encoding) readInt64(p *page, offset int) (int64, int, error) {
+	if e == EncodingFixed {
+		return p.readFixedInt64(offset)
+	}
+	return p.readInt64(offset)
+}
+
+func (e Encoding) writeInt64(p *page, offset int, v int64) (int, error) {
+	if e == EncodingFixed {
+		return p.writeFixedInt64(offset, v)
+	}
+	return p.writeInt64(offset, v)
+}
+
+func (e Encoding) readUint64(p *page, offset int) (uint64, int, error) {
+	if e == EncodingFixed {
+		return p.readFixedUint64(offset)
+	}
+	return p.readUint64(offset)
+}
+
+func (e Encoding) writeUint64(p *page, offset int, v uint64) (int, error) {
+	if e == EncodingFixed {
+		return p.writeFixedUint64(offset, v)
+	}
+	return p.writeUint64(offset, v)
+}
+
+func (e Encoding) readString(p *page, offset int) (string, int, error) {
+	if e == EncodingFixed {
+		return p.readShortString(offset)
+	}
+	return p.readString(offset)
+}
+
+func (e Encoding) writeString(p *page, offset int, v string) (int, error) {
+	if e == EncodingFixed {
+		return p.writeShortString(offset, v)
+	}
+	return p.writeString(offset, v)
+}
+
+const encodingFileName = "encoding"
+
+// loadEncoding returns the encoding recorded in a database directory. When the directory doesn't record its
+// encoding, loadEncoding records one; a directory having data already is regarded as a legacy database using
+// EncodingLegacy, and an empty directory uses `preferred`. When `readOnly` is true, loadEncoding records nothing,
+// and an empty directory is an error.
+func loadEncoding(dirPath string, preferred Encoding, readOnly bool) (Encoding, error) {
+	path := filepath.Join(dirPath, encodingFileName)
+	b, err := os.ReadFile(path)
+	if err == nil {
+		return parseEncoding(strings.TrimSpace(string(b)))
+	}
+	if !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	enc := preferred
+	if enc == 0 {
+		enc = DefaultEncoding
+	}
+	ok, err := hasData(dirPath)
+	if err != nil {
+		return 0, err
+	}
+	if ok {
+		enc = EncodingLegacy
+	}
+	if _, err := parseEncoding(enc.String()); err != nil {
+		return 0, err
+	}
+	if readOnly {
+		if !ok {
+			return 0, fmt.Errorf("not a database: %v", dirPath)
+		}
+		return enc, nil
+	}
+	err = os.WriteFile(path, []byte(enc.String()+"\n"), 0600)
+	if err != nil {
+		return 0, err
+	}
+	return enc, nil
+}
+
+// hasData reports whether a database directory has data other than the files recording its format.
+func hasData(dirPath string) (bool, error) {
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		return false, err
+	}
+	for _, e := range entries {
+		if e.IsDir() || e.Name() == encodingFileName || e.Name() == encryptionFileName {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return false, err
+		}
+		if info.Size() > 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,69 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadEncoding(t *testing.T) {
+	t.Run("an empty directory uses a preferred encoding and keeps it", func(t *testing.T) {
+		testDir, err := MakeTestDir()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(testDir)
+
+		enc, err := loadEncoding(testDir, 0, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if enc != DefaultEncoding {
+			t.Fatalf("unexpected encoding: want: %v, got: %v", DefaultEncoding, enc)
+		}
+		enc, err = loadEncoding(testDir, EncodingVarint, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if enc != DefaultEncoding {
+			t.Fatalf("a directory must keep its encoding: want: %v, got: %v", DefaultEncoding, enc)
+		}
+	})
+
+	t.Run("a directory having data but no encoding file is regarded as a legacy database", func(t *testing.T) {
+		testDir, err := MakeTestDir()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(testDir)
+
+		err = os.WriteFile(filepath.Join(testDir, "t.tbl"), make([]byte, 400), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		enc, err := loadEncoding(testDir, EncodingFixed, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if enc != EncodingLegacy {
+			t.Fatalf("unexpected encoding: want: %v, got: %v", EncodingLegacy, enc)
+		}
+	})
+
+	t.Run("an invalid encoding file causes an error", func(t *testing.T) {
+		testDir, err := MakeTestDir()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(testDir)
+
+		err = os.WriteFile(filepath.Join(testDir, encodingFileName), []byte("foo\n"), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = loadEncoding(testDir, 0, false)
+		if err == nil {
+			t.Fatal("an error must occur")
+		}
+	})
+}
@@ -0,0 +1,152 @@
+package storage
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrBlockAuthenticationFailed is returned when an encrypted block fails authentication. Either the block was
+// modified outside the storage, or the storage opened the file with a wrong key.
+var ErrBlockAuthenticationFailed = errors.New("a block failed authentication")
+
+// ErrEncryptionKeyMismatch is returned when a storage opens a database with a key that doesn't match the encryption
+// file of the database: a key for an unencrypted database, no key for an encrypted one, or a wrong key.
+var ErrEncryptionKeyMismatch = errors.New("an encryption key doesn't match the database")
+
+// blockCipher encrypts blocks with AES-GCM. A block on a disk consists of a nonce, the encrypted contents, and
+// an authentication tag. Every write encrypts a block with a new random nonce. The hash of the block ID is
+// authenticated as additional data, so a block copied to another place fails authentication as well as a modified
+// block. A nil blockCipher stores blocks as they are.
+type blockCipher struct {
+	aead cipher.AEAD
+}
+
+// newBlockCipher returns a cipher using `key`, which must be 16, 24, or 32 bytes to select AES-128, AES-192, or
+// AES-256. When `key` is empty, newBlockCipher returns nil.
+func newBlockCipher(key []byte) (*blockCipher, error) {
+	if len(key) == 0 {
+		return nil, nil
+	}
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption key: %w", err)
+	}
+	aead, err := cipher.NewGCM(b)
+	if err != nil {
+		return nil, err
+	}
+	return &blockCipher{
+		aead: aead,
+	}, nil
+}
+
+// overhead returns the number of bytes a block occupies on a disk in addition to its contents.
+func (c *blockCipher) overhead() int {
+	if c == nil {
+		return 0
+	}
+	return c.aead.NonceSize() + c.aead.Overhead()
+}
+
+// seal returns the bytes representing a block on a disk.
+func (c *blockCipher) seal(blk *BlockID, contents []byte) ([]byte, error) {
+	if c == nil {
+		return contents, nil
+	}
+	nonce := make([]byte, c.aead.NonceSize(), c.aead.NonceSize()+len(contents)+c.aead.Overhead())
+	_, err := io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate a nonce: %w", err)
+	}
+	return c.aead.Seal(nonce, nonce, contents, blk.Hash[:]), nil
+}
+
+// open restores the contents of a block from the bytes on a disk into `dst`.
+func (c *blockCipher) open(blk *BlockID, data []byte, dst []byte) error {
+	if c == nil {
+		copy(dst, data)
+		return nil
+	}
+	n := c.aead.NonceSize()
+	if len(data) != n+len(dst)+c.aead.Overhead() {
+		return fmt.Errorf("%w: file: %v, block: %v, invalid size: %v byte", ErrBlockAuthenticationFailed, blk.fileName, blk.BlkNum, len(data))
+	}
+	_, err := c.aead.Open(dst[:0], data[:n], data[n:], blk.Hash[:])
+	if err != nil {
+		return fmt.Errorf("%w: file: %v, block: %v", ErrBlockAuthenticationFailed, blk.fileName, blk.BlkNum)
+	}
+	return nil
+}
+
+const (
+	encryptionFileName = "encryption"
+
+	// encryptionNone is the contents of the encryption file of an unencrypted database. The encryption file of
+	// an encrypted database holds "aes-gcm" and the key check value of the key.
+	encryptionNone   = "none"
+	encryptionAESGCM = "aes-gcm"
+)
+
+// keyCheckValue returns a value identifying a key without revealing it.
+func keyCheckValue(key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("simple-db key check"))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// loadEncryption checks that a key matches the encryption file of a database directory, so that a storage fails to
+// open instead of misreading the files. When the directory doesn't have the file, loadEncryption records whether
+// the database is encrypted; a directory having data already is regarded as an unencrypted database because it
+// predates encryption. When `readOnly` is true, loadEncryption records nothing.
+func loadEncryption(dirPath string, key []byte, readOnly bool) error {
+	path := filepath.Join(dirPath, encryptionFileName)
+	b, err := os.ReadFile(path)
+	if err == nil {
+		fields := strings.Fields(string(b))
+		switch {
+		case len(fields) == 1 && fields[0] == encryptionNone:
+			if len(key) > 0 {
+				return fmt.Errorf("%w: the database isn't encrypted, but a key is given", ErrEncryptionKeyMismatch)
+			}
+			return nil
+		case len(fields) == 2 && fields[0] == encryptionAESGCM:
+			if len(key) == 0 {
+				return fmt.Errorf("%w: the database is encrypted, but no key is given", ErrEncryptionKeyMismatch)
+			}
+			if !hmac.Equal([]byte(fields[1]), []byte(keyCheckValue(key))) {
+				return fmt.Errorf("%w: a wrong key is given", ErrEncryptionKeyMismatch)
+			}
+			return nil
+		}
+		return fmt.Errorf("invalid encryption file: %v", path)
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+
+	v := encryptionNone
+	if len(key) > 0 {
+		ok, err := hasData(dirPath)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return fmt.Errorf("%w: the database isn't encrypted, but a key is given", ErrEncryptionKeyMismatch)
+		}
+		v = encryptionAESGCM + " " + keyCheckValue(key)
+	}
+	if readOnly {
+		return nil
+	}
+	return os.WriteFile(path, []byte(v+"\n"), 0600)
+}
@@ -0,0 +1,215 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStorage_encryption(t *testing.T) {
+	testDir, err := MakeTestDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+
+	logFilePath, err := MakeTestLogFile(testDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logFileName := filepath.Base(logFilePath)
+	dbFilePath, err := MakeTestTableFile(testDir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbFileName := filepath.Base(dbFilePath)
+
+	key := bytes.Repeat([]byte{0x5a}, 32)
+	ctx := context.Background()
+	open := func(key []byte) (*Storage, error) {
+		return InitStorage(ctx, TestConfig(&StorageConfig{
+			DirPath:       testDir,
+			LogFileName:   logFileName,
+			BlkSize:       400,
+			BufSize:       10,
+			EncryptionKey: key,
+		}))
+	}
+	read := func(st *Storage, blkNum int) (string, error) {
+		tx, err := st.NewReadOnlyTransaction(ctx)
+		if err != nil {
+			return "", err
+		}
+		defer tx.Commit()
+		blk := NewBlockID(dbFileName, blkNum)
+		err = tx.Pin(blk)
+		if err != nil {
+			return "", err
+		}
+		return tx.ReadString(blk.Hash, 0)
+	}
+
+	const secret = "top secret"
+	{
+		st, err := open(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tx, err := st.NewTransaction(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2; i++ {
+			blk, err := tx.AllocBlock(dbFileName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = tx.Pin(blk)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = tx.WriteString(blk.Hash, 0, secret, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = tx.Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = st.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("files don't contain plaintext", func(t *testing.T) {
+		for _, name := range []string{dbFileName, logFileName} {
+			b, err := os.ReadFile(filepath.Join(testDir, name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Contains(b, []byte(secret)) {
+				t.Fatalf("a file contains plaintext: %v", name)
+			}
+		}
+	})
+
+	t.Run("a storage with the key reads encrypted blocks", func(t *testing.T) {
+		st, err := open(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer st.Close()
+		c, err := st.fm.blockCount(dbFileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c != 2 {
+			t.Fatalf("unexpected block count: want: %v, got: %v", 2, c)
+		}
+		v, err := read(st, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != secret {
+			t.Fatalf("unexpected value: want: %v, got: %v", secret, v)
+		}
+	})
+
+	t.Run("a storage fails to open an encrypted database without the key", func(t *testing.T) {
+		for _, key := range [][]byte{bytes.Repeat([]byte{0xa5}, 32), nil} {
+			_, err := open(key)
+			if !errors.Is(err, ErrEncryptionKeyMismatch) {
+				t.Fatalf("expected error didn't occur: want: %v, got: %v", ErrEncryptionKeyMismatch, err)
+			}
+		}
+	})
+
+	t.Run("a storage fails to open an unencrypted database with a key", func(t *testing.T) {
+		plainDir := filepath.Join(testDir, "plain")
+		config := &StorageConfig{
+			DirPath:     plainDir,
+			LogFileName: logFileName,
+			BlkSize:     400,
+			BufSize:     10,
+		}
+		st, err := InitStorage(ctx, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = st.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.EncryptionKey = key
+		_, err = InitStorage(ctx, config)
+		if !errors.Is(err, ErrEncryptionKeyMismatch) {
+			t.Fatalf("expected error didn't occur: want: %v, got: %v", ErrEncryptionKeyMismatch, err)
+		}
+	})
+
+	t.Run("tampering is detected", func(t *testing.T) {
+		orig, err := os.ReadFile(dbFilePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.WriteFile(dbFilePath, orig, 0600)
+		size := len(orig) / 2
+		// The last block ends at the end of the file unless the file is compressed, in which case the page map tells
+		// where the block ends.
+		last := len(orig) - 1
+		if pageMap, err := os.ReadFile(dbFilePath + pageMapSuffix); err == nil {
+			e := pageMap[len(pageMap)-pageMapEntrySize:]
+			last = int(binary.LittleEndian.Uint64(e)) + int(binary.LittleEndian.Uint32(e[8:])) - 1
+		}
+
+		tests := []struct {
+			caption string
+			tamper  func(b []byte) []byte
+		}{
+			{
+				caption: "a modified byte",
+				tamper: func(b []byte) []byte {
+					b[last] ^= 0x01
+					return b
+				},
+			},
+			{
+				caption: "blocks swapped",
+				tamper: func(b []byte) []byte {
+					return append(append([]byte{}, b[size:]...), b[:size]...)
+				},
+			},
+		}
+		for _, tt := range tests {
+			t.Run(tt.caption, func(t *testing.T) {
+				b := tt.tamper(append([]byte{}, orig...))
+				err := os.WriteFile(dbFilePath, b, 0600)
+				if err != nil {
+					t.Fatal(err)
+				}
+				st, err := open(key)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer st.Close()
+				_, err = read(st, 1)
+				if !errors.Is(err, ErrBlockAuthenticationFailed) {
+					t.Fatalf("expected error didn't occur: want: %v, got: %v", ErrBlockAuthenticationFailed, err)
+				}
+			})
+		}
+	})
+
+	t.Run("a key must have a valid size", func(t *testing.T) {
+		_, err := open([]byte("short"))
+		if err == nil {
+			t.Fatal("an invalid key must be rejected")
+		}
+	})
+}
@@ -0,0 +1,217 @@
+package storage
+
+import (
+	"time"
+)
+
+// Logger receives log messages from a storage. *log.Logger satisfies this interface.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// TransactionEvent describes the beginning, the preparation, or the end of a transaction.
+type TransactionEvent struct {
+	TxNum int
+
+	// GID is the global ID of a prepared transaction. GID is empty except for the preparation.
+	GID string
+
+	// Duration is the time the operation, such as committing, took. Duration and Elapsed are zero for
+	// the beginning.
+	Duration time.Duration
+
+	// Elapsed is the time from the beginning of the transaction to the end of the operation.
+	Elapsed time.Duration
+}
+
+// LockWaitEvent describes a wait for a lock. A storage emits this event only when a transaction actually waits.
+type LockWaitEvent struct {
+	TxNum     int
+	Block     BlockIDHash
+	Exclusive bool
+	Duration  time.Duration
+
+	// Err is the reason why the transaction gave up the lock, such as ErrLockWaitTimeout. Err is nil when
+	// the transaction acquired the lock.
+	Err error
+}
+
+// BufferEvictionEvent describes that a block is evicted from a buffer to make room for another block.
+type BufferEvictionEvent struct {
+	FileName string
+	BlkNum   int
+
+	// TxNum is the transaction that modified the evicted block last. TxNum is 0 when the block was not modified.
+	TxNum int
+
+	// Duration is the time writing out the evicted block and reading the new block took.
+	Duration time.Duration
+}
+
+// CheckpointEvent describes a checkpoint that a recovery writes.
+type CheckpointEvent struct {
+	TxNum    int
+	Duration time.Duration
+}
+
+// Hooks receives events from a storage. A storage calls hooks synchronously, so hooks must return quickly and
+// must not call methods of the storage or its transactions. Embed NopHooks to implement only some of the methods.
+type Hooks interface {
+	TransactionBegan(e *TransactionEvent)
+	TransactionPrepared(e *TransactionEvent)
+	TransactionCommitted(e *TransactionEvent)
+	TransactionRolledBack(e *TransactionEvent)
+	LockWaited(e *LockWaitEvent)
+	BufferEvicted(e *BufferEvictionEvent)
+	Checkpointed(e *CheckpointEvent)
+}
+
+// NopHooks ignores all events.
+type NopHooks struct{}
+
+func (NopHooks) TransactionBegan(e *TransactionEvent)      {}
+func (NopHooks) TransactionPrepared(e *TransactionEvent)   {}
+func (NopHooks) TransactionCommitted(e *TransactionEvent)  {}
+func (NopHooks) TransactionRolledBack(e *TransactionEvent) {}
+func (NopHooks) LockWaited(e *LockWaitEvent)               {}
+func (NopHooks) BufferEvicted(e *BufferEvictionEvent)      {}
+func (NopHooks) Checkpointed(e *CheckpointEvent)           {}
+
+// eventDispatcher passes events to a logger and hooks. A nil dispatcher discards events.
+type eventDispatcher struct {
+	logger Logger
+	hooks  Hooks
+}
+
+func newEventDispatcher(logger Logger, hooks Hooks) *eventDispatcher {
+	if logger == nil && hooks == nil {
+		return nil
+	}
+	return &eventDispatcher{
+		logger: logger,
+		hooks:  hooks,
+	}
+}
+
+func (d *eventDispatcher) transactionBegan(e *TransactionEvent) {
+	if d == nil {
+		return
+	}
+	if d.logger != nil {
+		d.logger.Printf("event=transaction_began tx=%v", e.TxNum)
+	}
+	if d.hooks != nil {
+		d.hooks.TransactionBegan(e)
+	}
+}
+
+func (d *eventDispatcher) transactionPrepared(e *TransactionEvent) {
+	if d == nil {
+		return
+	}
+	if d.logger != nil {
+		d.logger.Printf("event=transaction_prepared tx=%v gid=%q duration=%v elapsed=%v", e.TxNum, e.GID, e.Duration, e.Elapsed)
+	}
+	if d.hooks != nil {
+		d.hooks.TransactionPrepared(e)
+	}
+}
+
+func (d *eventDispatcher) transactionCommitted(e *TransactionEvent) {
+	if d == nil {
+		return
+	}
+	if d.logger != nil {
+		d.logger.Printf("event=transaction_committed tx=%v duration=%v elapsed=%v", e.TxNum, e.Duration, e.Elapsed)
+	}
+	if d.hooks != nil {
+		d.hooks.TransactionCommitted(e)
+	}
+}
+
+func (d *eventDispatcher) transactionRolledBack(e *TransactionEvent) {
+	if d == nil {
+		return
+	}
+	if d.logger != nil {
+		d.logger.Printf("event=transaction_rolled_back tx=%v duration=%v elapsed=%v", e.TxNum, e.Duration, e.Elapsed)
+	}
+	if d.hooks != nil {
+		d.hooks.TransactionRolledBack(e)
+	}
+}
+
+func (d *eventDispatcher) lockWaited(e *LockWaitEvent) {
+	if d == nil {
+		return
+	}
+	if d.logger != nil {
+		if e.Err != nil {
+			d.logger.Printf("event=lock_waited tx=%v block=%x exclusive=%v duration=%v error=%q", e.TxNum, e.Block, e.Exclusive, e.Duration, e.Err)
+		} else {
+			d.logger.Printf("event=lock_waited tx=%v block=%x exclusive=%v duration=%v", e.TxNum, e.Block, e.Exclusive, e.Duration)
+		}
+	}
+	if d.hooks != nil {
+		d.hooks.LockWaited(e)
+	}
+}
+
+func (d *eventDispatcher) bufferEvicted(e *BufferEvictionEvent) {
+	if d == nil {
+		return
+	}
+	if d.logger != nil {
+		d.logger.Printf("event=buffer_evicted file=%v block=%v tx=%v duration=%v", e.FileName, e.BlkNum, e.TxNum, e.Duration)
+	}
+	if d.hooks != nil {
+		d.hooks.BufferEvicted(e)
+	}
+}
+
+func (d *eventDispatcher) checkpointed(e *CheckpointEvent) {
+	if d == nil {
+		return
+	}
+	if d.logger != nil {
+		d.logger.Printf("event=checkpointed tx=%v duration=%v", e.TxNum, e.Duration)
+	}
+	if d.hooks != nil {
+		d.hooks.Checkpointed(e)
+	}
+}
+
+// backgroundWriteFailed reports an error of the background writer. The writer retries in the next round, so this
+// event only goes to a logger.
+func (d *eventDispatcher) backgroundWriteFailed(err error) {
+	if d == nil || d.logger == nil {
+		return
+	}
+	d.logger.Printf("event=background_write_failed error=%q", err)
+}
+
+// fileOperationDeferred reports that a file operation of a committed transaction failed to be applied. The storage
+// retries it before a transaction uses the file, so this event only goes to a logger.
+func (d *eventDispatcher) fileOperationDeferred(fileName string, err error) {
+	if d == nil || d.logger == nil {
+		return
+	}
+	d.logger.Printf("event=file_operation_deferred file=%v error=%q", fileName, err)
+}
+
+// readAheadFailed reports an error of read-ahead. Read-ahead is only a hint, so this event only goes to a logger.
+func (d *eventDispatcher) readAheadFailed(err error) {
+	if d == nil || d.logger == nil {
+		return
+	}
+	d.logger.Printf("event=read_ahead_failed error=%q", err)
+}
+
+// replicationFailed reports an error that stopped a replica. The replica returns the error from Replica.Close as well,
+// so this event only goes to a logger.
+func (d *eventDispatcher) replicationFailed(err error) {
+	if d == nil || d.logger == nil {
+		return
+	}
+	d.logger.Printf("event=replication_failed error=%q", err)
+}
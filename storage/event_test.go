@@ -0,0 +1,251 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordingHooks struct {
+	NopHooks
+	mu          sync.Mutex
+	began       []*TransactionEvent
+	prepared    []*TransactionEvent
+	committed   []*TransactionEvent
+	rolledBack  []*TransactionEvent
+	lockWaits   []*LockWaitEvent
+	evictions   []*BufferEvictionEvent
+	checkpoints []*CheckpointEvent
+}
+
+func (h *recordingHooks) TransactionBegan(e *TransactionEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.began = append(h.began, e)
+}
+
+func (h *recordingHooks) TransactionPrepared(e *TransactionEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.prepared = append(h.prepared, e)
+}
+
+func (h *recordingHooks) TransactionCommitted(e *TransactionEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.committed = append(h.committed, e)
+}
+
+func (h *recordingHooks) TransactionRolledBack(e *TransactionEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.rolledBack = append(h.rolledBack, e)
+}
+
+func (h *recordingHooks) LockWaited(e *LockWaitEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lockWaits = append(h.lockWaits, e)
+}
+
+func (h *recordingHooks) BufferEvicted(e *BufferEvictionEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.evictions = append(h.evictions, e)
+}
+
+func (h *recordingHooks) Checkpointed(e *CheckpointEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.checkpoints = append(h.checkpoints, e)
+}
+
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestStorage_events(t *testing.T) {
+	testDir, err := MakeTestDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+
+	logFilePath, err := MakeTestLogFile(testDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbFilePath, err := MakeTestTableFile(testDir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbFileName := filepath.Base(dbFilePath)
+
+	hooks := &recordingHooks{}
+	var logBuf syncBuffer
+	st, err := InitStorage(context.Background(), TestConfig(&StorageConfig{
+		DirPath:     testDir,
+		LogFileName: filepath.Base(logFilePath),
+		BlkSize:     400,
+		BufSize:     1,
+		Logger:      log.New(&logBuf, "", 0),
+		Hooks:       hooks,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx1, err := st.NewTransaction(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	blk1, err := tx1.AllocBlock(dbFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blk2, err := tx1.AllocBlock(dbFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, blk := range []*BlockID{blk1, blk2} {
+		err := tx1.Pin(blk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tx1.WriteInt64(blk.Hash, 0, 100, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tx1.Unpin(blk)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = tx1.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// tx2 holds an exclusive lock on blk1, so tx3 waits for the lock until tx2 rolls back.
+	tx2, err := st.NewTransaction(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx2.Pin(blk1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx2.WriteInt64(blk1.Hash, 0, 200, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx3, err := st.NewTransaction(context.Background(), WithLockTimeout(20*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tx3.ReadInt64(blk1.Hash, 0)
+	if !errors.Is(err, ErrLockWaitTimeout) {
+		t.Fatalf("expected error didn't occur: want: %v, got: %v", ErrLockWaitTimeout, err)
+	}
+	err = tx3.Rollback()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx2.Rollback()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx4, err := st.NewTransaction(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx4.Recover()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx4.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx5, err := st.NewTransaction(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx5.Prepare("gid-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx5.RollbackPrepared()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hooks.mu.Lock()
+	defer hooks.mu.Unlock()
+	if len(hooks.began) != 5 {
+		t.Fatalf("unexpected number of began events: want: %v, got: %v", 5, len(hooks.began))
+	}
+	for _, e := range hooks.began {
+		if e.Duration != 0 || e.Elapsed != 0 {
+			t.Fatalf("a began event must not have durations: %+v", e)
+		}
+	}
+	if len(hooks.prepared) != 1 || hooks.prepared[0].TxNum != int(tx5.txNum) || hooks.prepared[0].GID != "gid-1" {
+		t.Fatalf("unexpected prepared events: %+v", hooks.prepared)
+	}
+	if len(hooks.committed) != 2 || hooks.committed[0].TxNum != int(tx1.txNum) || hooks.committed[1].TxNum != int(tx4.txNum) {
+		t.Fatalf("unexpected committed events: %+v", hooks.committed)
+	}
+	if len(hooks.rolledBack) != 3 || hooks.rolledBack[0].TxNum != int(tx3.txNum) || hooks.rolledBack[1].TxNum != int(tx2.txNum) || hooks.rolledBack[2].TxNum != int(tx5.txNum) {
+		t.Fatalf("unexpected rolled-back events: %+v", hooks.rolledBack)
+	}
+	for _, e := range hooks.committed {
+		if e.Elapsed < e.Duration {
+			t.Fatalf("elapsed time must not be less than duration: %+v", e)
+		}
+	}
+	if len(hooks.lockWaits) != 1 {
+		t.Fatalf("unexpected number of lock wait events: want: %v, got: %v", 1, len(hooks.lockWaits))
+	}
+	if w := hooks.lockWaits[0]; w.TxNum != int(tx3.txNum) || w.Block != blk1.Hash || w.Exclusive || !errors.Is(w.Err, ErrLockWaitTimeout) || w.Duration <= 0 {
+		t.Fatalf("unexpected lock wait event: %+v", w)
+	}
+	if len(hooks.evictions) == 0 {
+		t.Fatal("a buffer pool having one buffer must evict blocks")
+	}
+	if e := hooks.evictions[0]; e.FileName != dbFileName || e.BlkNum != blk1.BlkNum || e.TxNum != int(tx1.txNum) {
+		t.Fatalf("unexpected eviction event: %+v", e)
+	}
+	if len(hooks.checkpoints) != 1 || hooks.checkpoints[0].TxNum != int(tx4.txNum) {
+		t.Fatalf("unexpected checkpoint events: %+v", hooks.checkpoints)
+	}
+
+	logs := logBuf.String()
+	for _, ev := range []string{"transaction_began", "transaction_prepared", "transaction_committed", "transaction_rolled_back", "lock_waited", "buffer_evicted", "checkpointed"} {
+		if !strings.Contains(logs, "event="+ev) {
+			t.Fatalf("a log must contain an event: %v\n%v", ev, logs)
+		}
+	}
+}
@@ -3,12 +3,12 @@ package storage
 import (
 	"crypto/sha256"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"os"
-	"path/filepath"
-	"strings"
 	"sync"
+	"sync/atomic"
 )
 
 type BlockIDHash [32]byte
@@ -39,6 +39,10 @@ func NewBlockID(fileName string, blkNum int) *BlockID {
 	}
 }
 
+func (id *BlockID) FileName() string {
+	return id.fileName
+}
+
 func (id *BlockID) equal(a *BlockID) bool {
 	if id.fileName == a.fileName && id.BlkNum == a.BlkNum {
 		return true
@@ -146,6 +150,94 @@ func (p *page) writeString(offset int, v string) (int, error) {
 	return n, nil
 }
 
+// FixedIntSize is the number of bytes a fixed-width integer occupies.
+const FixedIntSize = 8
+
+// ShortStringHeaderSize is the number of bytes of the length prefix of a short string.
+const ShortStringHeaderSize = 2
+
+// MaxShortStringSize is the maximum number of bytes a short string can hold.
+const MaxShortStringSize = 1<<(8*ShortStringHeaderSize) - 1
+
+func (p *page) readFixedInt64(offset int) (int64, int, error) {
+	v, n, err := p.readFixedUint64(offset)
+	if err != nil {
+		return 0, 0, err
+	}
+	return int64(v), n, nil
+}
+
+func (p *page) writeFixedInt64(offset int, v int64) (int, error) {
+	return p.writeFixedUint64(offset, uint64(v))
+}
+
+func (p *page) readFixedUint64(offset int) (uint64, int, error) {
+	if offset < 0 || offset+FixedIntSize > len(p.buf) {
+		return 0, 0, fmt.Errorf("failed to read a fixed-width integer: %w: block size: %v byte, offset: %v", errPageOffsetOutOfRange, len(p.buf), offset)
+	}
+	return binary.LittleEndian.Uint64(p.buf[offset:]), FixedIntSize, nil
+}
+
+func (p *page) writeFixedUint64(offset int, v uint64) (int, error) {
+	if offset < 0 || offset+FixedIntSize > len(p.buf) {
+		return 0, fmt.Errorf("failed to write a fixed-width integer: %w: block size: %v byte, offset: %v", errPageOffsetOutOfRange, len(p.buf), offset)
+	}
+	binary.LittleEndian.PutUint64(p.buf[offset:], v)
+	return FixedIntSize, nil
+}
+
+func (p *page) readShortString(offset int) (string, int, error) {
+	if offset < 0 || offset+ShortStringHeaderSize > len(p.buf) {
+		return "", 0, fmt.Errorf("failed to read a string: %w: block size: %v byte, offset: %v", errPageOffsetOutOfRange, len(p.buf), offset)
+	}
+	size := int(binary.LittleEndian.Uint16(p.buf[offset:]))
+	dataOffset := offset + ShortStringHeaderSize
+	if dataOffset+size > len(p.buf) {
+		return "", 0, fmt.Errorf("failed to read a string: %w: block size: %v byte, offset: %v, data size: %v byte", errPageDataOutOfRange, len(p.buf), offset, size)
+	}
+	return string(p.buf[dataOffset : dataOffset+size]), ShortStringHeaderSize + size, nil
+}
+
+func (p *page) writeShortString(offset int, v string) (int, error) {
+	if offset < 0 || offset >= len(p.buf) {
+		return 0, fmt.Errorf("failed to write a string: %w: block size: %v byte, offset: %v", errPageOffsetOutOfRange, len(p.buf), offset)
+	}
+	if len(v) > MaxShortStringSize || offset+ShortStringHeaderSize+len(v) > len(p.buf) {
+		return 0, fmt.Errorf("failed to write a string: %w: block size: %v byte, offset: %v, data size: %v byte", errPageTooBigData, len(p.buf), offset, len(v))
+	}
+	binary.LittleEndian.PutUint16(p.buf[offset:], uint16(len(v)))
+	copy(p.buf[offset+ShortStringHeaderSize:], v)
+	return ShortStringHeaderSize + len(v), nil
+}
+
+// readRaw returns a copy of `size` bytes from `offset`, cut at the end of the page.
+func (p *page) readRaw(offset int, size int) ([]byte, error) {
+	if offset < 0 || offset >= len(p.buf) {
+		return nil, fmt.Errorf("%w: block size: %v byte, offset: %v", errPageOffsetOutOfRange, len(p.buf), offset)
+	}
+	if size < 0 {
+		return nil, fmt.Errorf("%w: size: %v", errPageNegativeDataSize, size)
+	}
+	end := offset + size
+	if end > len(p.buf) {
+		end = len(p.buf)
+	}
+	b := make([]byte, end-offset)
+	copy(b, p.buf[offset:end])
+	return b, nil
+}
+
+func (p *page) writeRaw(offset int, data []byte) error {
+	if offset < 0 || offset >= len(p.buf) {
+		return fmt.Errorf("%w: block size: %v byte, offset: %v", errPageOffsetOutOfRange, len(p.buf), offset)
+	}
+	if offset+len(data) > len(p.buf) {
+		return fmt.Errorf("%w: block size: %v byte, offset: %v, data size: %v byte", errPageTooBigData, len(p.buf), offset, len(data))
+	}
+	copy(p.buf[offset:], data)
+	return nil
+}
+
 func (p *page) read(offset int) ([]byte, int, error) {
 	if offset < 0 || offset >= len(p.buf) {
 		return nil, 0, fmt.Errorf("%w: block size: %v byte, offset: %v", errPageOffsetOutOfRange, len(p.buf), offset)
@@ -221,13 +313,30 @@ func decodeToUint64(b []byte) (uint64, error) {
 }
 
 type fileManager struct {
+	stats fileCounters
+
 	dirPath   string
 	blkSize   int
 	openFiles map[string]*os.File
 	mu        sync.Mutex
+
+	cipher          *blockCipher
+	tablespaces     map[string]string
+	compressTables  bool
+	compressedFiles map[string]*compressedFile
+	tempSeq         int
+	readOnly        bool
 }
 
-func newFileManager(dirPath string, blkSize int) (*fileManager, error) {
+// ErrReadOnlyStorage means that a storage opened with StorageConfig.ReadOnly was asked to modify a database.
+var ErrReadOnlyStorage = errors.New("a read-only storage cannot modify a database")
+
+func newFileManager(dirPath string, blkSize int, key []byte) (*fileManager, error) {
+	c, err := newBlockCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
 	s, err := os.Stat(dirPath)
 	if err != nil {
 		if !os.IsNotExist(err) {
@@ -242,69 +351,187 @@ func newFileManager(dirPath string, blkSize int) (*fileManager, error) {
 			return nil, fmt.Errorf("not a directory: %v", dirPath)
 		}
 
-		entries, err := os.ReadDir(dirPath)
+		err = removeTempFiles(dirPath)
 		if err != nil {
 			return nil, err
 		}
-		for _, e := range entries {
-			if !strings.HasPrefix(e.Name(), "tmp_") {
-				continue
-			}
-			err := os.Remove(filepath.Join(dirPath, e.Name()))
-			if err != nil {
-				return nil, err
-			}
-		}
 	}
 
 	return &fileManager{
-		dirPath:   dirPath,
-		blkSize:   blkSize,
-		openFiles: map[string]*os.File{},
+		dirPath:         dirPath,
+		blkSize:         blkSize,
+		openFiles:       map[string]*os.File{},
+		cipher:          c,
+		compressedFiles: map[string]*compressedFile{},
+	}, nil
+}
+
+func newReadOnlyFileManager(dirPath string, blkSize int, key []byte) (*fileManager, error) {
+	c, err := newBlockCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := os.Stat(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	if !s.IsDir() {
+		return nil, fmt.Errorf("not a directory: %v", dirPath)
+	}
+
+	return &fileManager{
+		dirPath:         dirPath,
+		blkSize:         blkSize,
+		openFiles:       map[string]*os.File{},
+		cipher:          c,
+		compressedFiles: map[string]*compressedFile{},
+		readOnly:        true,
 	}, nil
 }
 
+func (m *fileManager) withDir(dirPath string) *fileManager {
+	return &fileManager{
+		dirPath:         dirPath,
+		blkSize:         m.blkSize,
+		openFiles:       map[string]*os.File{},
+		cipher:          m.cipher,
+		compressTables:  m.compressTables,
+		compressedFiles: map[string]*compressedFile{},
+	}
+}
+
+func (m *fileManager) blockSizeOnDisk() int {
+	return m.blkSize + m.cipher.overhead()
+}
+
+func (m *fileManager) sealBlock(blk *BlockID, p *page) ([]byte, error) {
+	return m.cipher.seal(blk, p.buf)
+}
+
+func (m *fileManager) openBlock(blk *BlockID, data []byte, p *page) error {
+	return m.cipher.open(blk, data, p.buf)
+}
+
 // read reads the contents of a block into a page.
 func (m *fileManager) read(blk *BlockID, p *page) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
+	cf, err := m.openCompressedNoLock(blk.fileName)
+	if err != nil {
+		return err
+	}
+	if cf != nil {
+		err := m.readCompressedNoLock(cf, blk, p)
+		if err != nil {
+			return err
+		}
+		atomic.AddUint64(&m.stats.blocksRead, 1)
+		return nil
+	}
 	f, err := m.openNoLock(blk.fileName)
 	if err != nil {
 		return err
 	}
-	_, err = f.Seek(int64(blk.BlkNum*m.blkSize), 0)
+	_, err = f.Seek(int64(blk.BlkNum*m.blockSizeOnDisk()), 0)
+	if err != nil {
+		return err
+	}
+	if m.cipher == nil {
+		err = p.load(f)
+	} else {
+		data := &page{
+			buf: make([]byte, m.blockSizeOnDisk()),
+		}
+		err = data.load(f)
+		if err == nil {
+			err = m.openBlock(blk, data.buf, p)
+		}
+	}
 	if err != nil {
 		return err
 	}
-	return p.load(f)
+	atomic.AddUint64(&m.stats.blocksRead, 1)
+	return nil
 }
 
 // write writes the contents of a page to a block on a disk.
 func (m *fileManager) write(blk *BlockID, p *page) error {
+	if m.readOnly {
+		return fmt.Errorf("failed to write a block: %w", ErrReadOnlyStorage)
+	}
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
+	cf, err := m.openCompressedNoLock(blk.fileName)
+	if err != nil {
+		return err
+	}
+	if cf != nil {
+		// Fill the blocks in between with zeros as a plain file does.
+		for n := cf.blockCount(); n < blk.BlkNum; n++ {
+			z, err := newPage(m.blkSize)
+			if err != nil {
+				return err
+			}
+			err = m.writeCompressedNoLock(cf, NewBlockID(blk.fileName, n), z)
+			if err != nil {
+				return err
+			}
+		}
+		err := m.writeCompressedNoLock(cf, blk, p)
+		if err != nil {
+			return err
+		}
+		atomic.AddUint64(&m.stats.blocksWritten, 1)
+		return nil
+	}
 	f, err := m.openNoLock(blk.fileName)
 	if err != nil {
 		return err
 	}
-	_, err = f.Seek(int64(blk.BlkNum*m.blkSize), 0)
+	data, err := m.sealBlock(blk, p)
+	if err != nil {
+		return err
+	}
+	_, err = f.Seek(int64(blk.BlkNum*m.blockSizeOnDisk()), 0)
 	if err != nil {
 		return err
 	}
-	_, err = f.Write(p.buf)
+	_, err = f.Write(data)
 	if err != nil {
 		return err
 	}
+	atomic.AddUint64(&m.stats.blocksWritten, 1)
 
 	return nil
 }
 
 func (m *fileManager) alloc(fileName string) (*BlockID, error) {
+	if m.readOnly {
+		return nil, fmt.Errorf("failed to allocate a block: %w", ErrReadOnlyStorage)
+	}
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
+	cf, err := m.openCompressedNoLock(fileName)
+	if err != nil {
+		return nil, err
+	}
+	if cf != nil {
+		blk := NewBlockID(fileName, cf.blockCount())
+		p, err := newPage(m.blkSize)
+		if err != nil {
+			return nil, err
+		}
+		err = m.writeCompressedNoLock(cf, blk, p)
+		if err != nil {
+			return nil, err
+		}
+		atomic.AddUint64(&m.stats.blocksAllocated, 1)
+		return blk, nil
+	}
 	f, err := m.openNoLock(fileName)
 	if err != nil {
 		return nil, err
@@ -313,24 +540,101 @@ func (m *fileManager) alloc(fileName string) (*BlockID, error) {
 	if err != nil {
 		return nil, err
 	}
-	_, err = f.Seek(int64(blkNum*m.blkSize), 0)
+	blk := NewBlockID(fileName, blkNum)
+	// Even an unwritten encrypted block must pass authentication.
+	p, err := newPage(m.blkSize)
+	if err != nil {
+		return nil, err
+	}
+	data, err := m.sealBlock(blk, p)
+	if err != nil {
+		return nil, err
+	}
+	_, err = f.Seek(int64(blkNum*m.blockSizeOnDisk()), 0)
 	if err != nil {
 		return nil, err
 	}
-	_, err = f.WriteAt(make([]byte, m.blkSize), int64(blkNum*m.blkSize))
+	_, err = f.WriteAt(data, int64(blkNum*m.blockSizeOnDisk()))
 	if err != nil {
 		return nil, err
 	}
+	atomic.AddUint64(&m.stats.blocksAllocated, 1)
 
-	return NewBlockID(fileName, blkNum), nil
+	return blk, nil
 }
 
 func (m *fileManager) blockCount(fileName string) (int, error) {
-	s, err := os.Stat(filepath.Join(m.dirPath, fileName))
+	s, err := os.Stat(m.path(fileName) + pageMapSuffix)
+	if err == nil {
+		return int(s.Size()) / pageMapEntrySize, nil
+	}
+	if !os.IsNotExist(err) {
+		return 0, err
+	}
+	s, err = os.Stat(m.path(fileName))
 	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
 		return 0, err
 	}
-	return int(s.Size()) / m.blkSize, nil
+	return int(s.Size()) / m.blockSizeOnDisk(), nil
+}
+
+func (m *fileManager) remove(fileName string) error {
+	if m.readOnly {
+		return fmt.Errorf("failed to remove a file: %w", ErrReadOnlyStorage)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	err := m.closeNoLock(fileName)
+	if err != nil {
+		return err
+	}
+	for _, path := range []string{m.path(fileName), m.path(fileName) + pageMapSuffix} {
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove a file: %w", err)
+		}
+	}
+	return nil
+}
+
+func (m *fileManager) truncate(fileName string, blkCount int) error {
+	if blkCount < 0 {
+		return fmt.Errorf("a block count must be >=0: %v", blkCount)
+	}
+	if m.readOnly {
+		return fmt.Errorf("failed to truncate a file: %w", ErrReadOnlyStorage)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	c, err := m.blockCount(fileName)
+	if err != nil {
+		return err
+	}
+	if c <= blkCount {
+		return nil
+	}
+	cf, err := m.openCompressedNoLock(fileName)
+	if err != nil {
+		return err
+	}
+	if cf != nil {
+		return cf.truncate(blkCount)
+	}
+	f, err := m.openNoLock(fileName)
+	if err != nil {
+		return err
+	}
+	err = f.Truncate(int64(blkCount * m.blockSizeOnDisk()))
+	if err != nil {
+		return fmt.Errorf("failed to truncate a file: %w", err)
+	}
+	return nil
 }
 
 func (m *fileManager) open(fileName string) (*os.File, error) {
@@ -346,7 +650,19 @@ func (m *fileManager) openNoLock(fileName string) (*os.File, error) {
 		return f, nil
 	}
 
-	f, err := os.OpenFile(filepath.Join(m.dirPath, fileName), os.O_CREATE|os.O_RDWR|os.O_SYNC, 0600)
+	if m.readOnly {
+		f, err := os.Open(m.path(fileName))
+		if err != nil {
+			return nil, fmt.Errorf("failed to open a file: %w", err)
+		}
+		m.openFiles[fileName] = f
+		return f, nil
+	}
+	err := m.makeDir(fileName)
+	if err != nil {
+		return nil, err
+	}
+	f, err = os.OpenFile(m.path(fileName), os.O_CREATE|os.O_RDWR|os.O_SYNC, 0600)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open a new file: %w", err)
 	}
@@ -354,3 +670,121 @@ func (m *fileManager) openNoLock(fileName string) (*os.File, error) {
 
 	return f, nil
 }
+
+func (m *fileManager) closeAll() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for fileName := range m.openFiles {
+		err := m.closeNoLock(fileName)
+		if err != nil {
+			return err
+		}
+	}
+	for fileName := range m.compressedFiles {
+		err := m.closeNoLock(fileName)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *fileManager) closeNoLock(fileName string) error {
+	if cf, ok := m.compressedFiles[fileName]; ok {
+		delete(m.compressedFiles, fileName)
+		err := cf.close()
+		if err != nil {
+			return fmt.Errorf("failed to close a file: %w", err)
+		}
+		return nil
+	}
+	f, ok := m.openFiles[fileName]
+	if !ok {
+		return nil
+	}
+	delete(m.openFiles, fileName)
+	err := f.Close()
+	if err != nil {
+		return fmt.Errorf("failed to close a file: %w", err)
+	}
+	return nil
+}
+
+// openCompressedNoLock returns nil when the file is stored in the plain format.
+func (m *fileManager) openCompressedNoLock(fileName string) (*compressedFile, error) {
+	if cf, ok := m.compressedFiles[fileName]; ok {
+		return cf, nil
+	}
+	if _, ok := m.openFiles[fileName]; ok || !compressible(fileName) {
+		return nil, nil
+	}
+	ok, err := m.storedCompressed(fileName)
+	if err != nil || !ok {
+		return nil, err
+	}
+	if !m.readOnly {
+		err = m.makeDir(fileName)
+		if err != nil {
+			return nil, err
+		}
+	}
+	cf, err := openCompressedFile(m.path(fileName), m.readOnly)
+	if err != nil {
+		return nil, err
+	}
+	m.compressedFiles[fileName] = cf
+	return cf, nil
+}
+
+// storedCompressed reports whether a file has a page map, or is an empty table file to be compressed.
+func (m *fileManager) storedCompressed(fileName string) (bool, error) {
+	path := m.path(fileName)
+	_, err := os.Stat(path + pageMapSuffix)
+	if err == nil {
+		return true, nil
+	}
+	if !os.IsNotExist(err) {
+		return false, err
+	}
+	if !m.compressTables {
+		return false, nil
+	}
+	s, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return true, nil
+		}
+		return false, err
+	}
+	return s.Size() == 0, nil
+}
+
+func (m *fileManager) readCompressedNoLock(cf *compressedFile, blk *BlockID, p *page) error {
+	data, err := cf.read(blk.BlkNum)
+	if err != nil {
+		return err
+	}
+	n := len(data) - m.cipher.overhead()
+	if n <= 0 {
+		return fmt.Errorf("%w: file: %v, block: %v, invalid size: %v byte", ErrBlockAuthenticationFailed, blk.fileName, blk.BlkNum, len(data))
+	}
+	contents := make([]byte, n)
+	err = m.cipher.open(blk, data, contents)
+	if err != nil {
+		return err
+	}
+	return decompressBlock(contents, p.buf)
+}
+
+func (m *fileManager) writeCompressedNoLock(cf *compressedFile, blk *BlockID, p *page) error {
+	contents, err := compressBlock(p.buf)
+	if err != nil {
+		return fmt.Errorf("failed to compress a block: %w", err)
+	}
+	data, err := m.cipher.seal(blk, contents)
+	if err != nil {
+		return err
+	}
+	return cf.write(blk.BlkNum, data)
+}
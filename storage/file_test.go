@@ -6,6 +6,7 @@ import (
 	"errors"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -445,6 +446,93 @@ func TestPage_string(t *testing.T) {
 	})
 }
 
+func TestPage_fixedWidth(t *testing.T) {
+	t.Run("readFixedInt64/writeFixedInt64 can read/write the minimum and maximum values of int64 in 8 bytes", func(t *testing.T) {
+		p, err := newPage(100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, v := range []int64{minInt64, maxInt64, 0, -1} {
+			n, err := p.writeFixedInt64(10, v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != FixedIntSize {
+				t.Fatalf("unexpected size: want: %v, got: %v", FixedIntSize, n)
+			}
+			a, _, err := p.readFixedInt64(10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if a != v {
+				t.Fatalf("unexpected value: want: %v, got: %v", v, a)
+			}
+		}
+	})
+
+	t.Run("readFixedUint64/writeFixedUint64 can read/write the maximum value of uint64", func(t *testing.T) {
+		p, err := newPage(100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = p.writeFixedUint64(92, maxUint64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, _, err := p.readFixedUint64(92)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != maxUint64 {
+			t.Fatalf("unexpected value: want: %v, got: %v", maxUint64, v)
+		}
+	})
+
+	t.Run("writeFixedUint64 cannot write a value running off the end of a page", func(t *testing.T) {
+		p, err := newPage(100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = p.writeFixedUint64(93, maxUint64)
+		if !errors.Is(err, errPageOffsetOutOfRange) {
+			t.Fatalf("expected error didn't occur: want: %v, got: %v", errPageOffsetOutOfRange, err)
+		}
+	})
+
+	t.Run("readShortString can read a string written by writeShortString as it is", func(t *testing.T) {
+		p, err := newPage(100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		text := "I want to believe."
+		n, err := p.writeShortString(0, text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != ShortStringHeaderSize+len(text) {
+			t.Fatalf("unexpected size: want: %v, got: %v", ShortStringHeaderSize+len(text), n)
+		}
+		v, _, err := p.readShortString(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != text {
+			t.Fatalf("unexpected value: want: %v, got: %v", text, v)
+		}
+	})
+
+	t.Run("writeShortString cannot write a string that doesn't fit in a page", func(t *testing.T) {
+		p, err := newPage(100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = p.writeShortString(0, strings.Repeat("x", 99))
+		if !errors.Is(err, errPageTooBigData) {
+			t.Fatalf("expected error didn't occur: want: %v, got: %v", errPageTooBigData, err)
+		}
+	})
+}
+
 func TestFileManager(t *testing.T) {
 	testDir, err := MakeTestDir()
 	if err != nil {
@@ -452,7 +540,7 @@ func TestFileManager(t *testing.T) {
 	}
 	defer os.RemoveAll(testDir)
 
-	fm, err := newFileManager(filepath.Join(testDir, "db"), 400)
+	fm, err := newTestFileManager(filepath.Join(testDir, "db"), 400)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -0,0 +1,161 @@
+package storage
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+var operatorNames = map[operator]string{
+	opCheckPoint:   "checkpoint",
+	opStart:        "start",
+	opCommit:       "commit",
+	opRollBack:     "rollback",
+	opSetInt64:     "set_int64",
+	opSetUint64:    "set_uint64",
+	opSetString:    "set_string",
+	opDropFile:     "drop_file",
+	opTruncateFile: "truncate_file",
+	opSetBytes:     "set_bytes",
+	opBackup:       "backup",
+	opRedoBytes:    "redo_bytes",
+	opPrepare:      "prepare",
+	opChange:       "change",
+	opSetHintBytes: "set_hint_bytes",
+}
+
+func (op operator) String() string {
+	if name, ok := operatorNames[op]; ok {
+		return name
+	}
+	return fmt.Sprintf("operator(%d)", int(op))
+}
+
+// LogRecordDump is a decoded log record. The fields that don't apply to a record are omitted from its JSON form.
+type LogRecordDump struct {
+	// LogBlkNum and LogOffset locate the record in the log file.
+	LogBlkNum int `json:"log_block"`
+	LogOffset int `json:"log_offset"`
+
+	Op       string `json:"op,omitempty"`
+	TxNum    int    `json:"tx"`
+	FileName string `json:"file,omitempty"`
+
+	// BlkNum is the number of the block a record modifies. In a truncate_file record, it is the number of blocks
+	// the file keeps.
+	BlkNum *int `json:"block,omitempty"`
+	Offset *int `json:"offset,omitempty"`
+
+	// Value is the value a record holds: an image of bytes in hex, the label of a backup, the global ID of
+	// a prepared transaction, or the numbers of prepared transactions of a checkpoint.
+	Value string `json:"value,omitempty"`
+	Time  string `json:"time,omitempty"`
+
+	// Error is set when a record cannot be decoded. The other fields except the location are empty then.
+	Error string `json:"error,omitempty"`
+}
+
+// InspectLog decodes all log records from the first block of the log. It returns the records in the order they
+// were written. A block or a record that cannot be read doesn't stop InspectLog; the dump of it holds an error
+// instead.
+func (s *Storage) InspectLog() ([]*LogRecordDump, error) {
+	err := s.lm.flushAll()
+	if err != nil {
+		return nil, err
+	}
+	c, err := s.fm.blockCount(s.lm.logFileName)
+	if err != nil {
+		return nil, err
+	}
+	p, err := newPage(s.fm.blkSize)
+	if err != nil {
+		return nil, err
+	}
+	dumps := []*LogRecordDump{}
+	for blkNum := 0; blkNum < c; blkNum++ {
+		fail := func(offset int, format string, a ...interface{}) {
+			dumps = append(dumps, &LogRecordDump{
+				LogBlkNum: blkNum,
+				LogOffset: offset,
+				Error:     fmt.Sprintf(format, a...),
+			})
+		}
+
+		err := s.fm.read(NewBlockID(s.lm.logFileName, blkNum), p)
+		if err != nil {
+			fail(-1, "%v", err)
+			continue
+		}
+		boundary, _, err := p.readInt64(0)
+		if err != nil {
+			fail(-1, "failed to read the boundary: %v", err)
+			continue
+		}
+		if boundary < binary.MaxVarintLen64 || boundary > int64(s.fm.blkSize) {
+			fail(-1, "the boundary is out of range: %v", boundary)
+			continue
+		}
+		// A log manager writes records from the end of a block toward its head, so the records of a block are
+		// reversed to put them in the order they were written.
+		var blkDumps []*LogRecordDump
+		for offset := int(boundary); offset < s.fm.blkSize; {
+			b, n, err := p.read(offset)
+			if err != nil {
+				blkDumps = append(blkDumps, &LogRecordDump{
+					LogBlkNum: blkNum,
+					LogOffset: offset,
+					Error:     err.Error(),
+				})
+				break
+			}
+			blkDumps = append(blkDumps, dumpLogRecord(blkNum, offset, b))
+			offset += n
+		}
+		for i := len(blkDumps) - 1; i >= 0; i-- {
+			dumps = append(dumps, blkDumps[i])
+		}
+	}
+	return dumps, nil
+}
+
+func dumpLogRecord(blkNum int, offset int, b []byte) *LogRecordDump {
+	d := &LogRecordDump{
+		LogBlkNum: blkNum,
+		LogOffset: offset,
+	}
+	r := &logRecord{}
+	err := r.unmarshalBytes(b)
+	if err != nil {
+		d.Error = fmt.Sprintf("failed to decode a log record: %v", err)
+		return d
+	}
+	d.Op = r.Op.String()
+	d.TxNum = int(r.TxNum)
+	d.FileName = r.FileName
+	if isSetOperator(r.Op) || r.Op == opRedoBytes {
+		blkNum := r.BlkNum
+		offset := r.Offset
+		d.BlkNum = &blkNum
+		d.Offset = &offset
+	} else if r.Op == opTruncateFile {
+		blkNum := r.BlkNum
+		d.BlkNum = &blkNum
+	}
+	if r.Op == opBackup {
+		d.FileName = ""
+		d.Value = r.FileName
+	}
+	if t := r.time(); t != 0 {
+		d.Time = time.Unix(0, t).UTC().Format(time.RFC3339Nano)
+		return d
+	}
+	switch v := r.Val.(type) {
+	case nil:
+	case []byte:
+		d.Value = hex.EncodeToString(v)
+	default:
+		d.Value = fmt.Sprint(v)
+	}
+	return d
+}
@@ -0,0 +1,88 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStorage_InspectLog(t *testing.T) {
+	testDir, err := MakeTestDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+
+	logFilePath, err := MakeTestLogFile(testDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	st, err := InitStorage(ctx, TestConfig(&StorageConfig{
+		DirPath:     testDir,
+		LogFileName: filepath.Base(logFilePath),
+		BlkSize:     400,
+		BufSize:     10,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	tx, err := st.NewTransaction(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blk, err := tx.AllocBlock("test.tbl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.Pin(blk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Enough records to fill more than one log block
+	for i := 0; i < 20; i++ {
+		err = tx.WriteInt64(blk.Hash, 8*i, int64(i), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dumps, err := st.InspectLog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ops []string
+	for _, d := range dumps {
+		if d.Error != "" {
+			t.Fatalf("unexpected error: log block: %v, log offset: %v: %v", d.LogBlkNum, d.LogOffset, d.Error)
+		}
+		if d.TxNum != tx.TxNum() {
+			continue
+		}
+		ops = append(ops, d.Op)
+		if d.Op != "set_bytes" {
+			continue
+		}
+		if d.FileName != "test.tbl" || d.BlkNum == nil || *d.BlkNum != 0 || d.Offset == nil {
+			t.Fatalf("unexpected set_bytes record: %+v", d)
+		}
+	}
+	if len(ops) != 22 || ops[0] != "start" || ops[1] != "set_bytes" || ops[21] != "commit" {
+		t.Fatalf("log records are not in the order they were written: %v", ops)
+	}
+	if dumps[len(dumps)-1].LogBlkNum == 0 {
+		t.Fatal("the log must span more than one block")
+	}
+	for i, d := range ops[1:21] {
+		if d != "set_bytes" {
+			t.Fatalf("unexpected operator: #%v: %v", i+1, d)
+		}
+	}
+}
@@ -1,12 +1,23 @@
 package storage
 
-import "sync"
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrLogRecordTooLarge means that a log record doesn't fit in a log block.
+var ErrLogRecordTooLarge = errors.New("a log record doesn't fit in a log block")
 
 type logSeqNum int
 
 const lsnNil logSeqNum = 0
 
 type logManager struct {
+	stats logCounters
+
 	fm           *fileManager
 	logFileName  string
 	currentBlk   *BlockID
@@ -15,6 +26,27 @@ type logManager struct {
 	latestLSN    logSeqNum
 	lastSavedLSN logSeqNum
 	mu           sync.Mutex
+
+	// archiveDirPath is the directory where the log manager archives log blocks. The log manager doesn't archive
+	// the log when this field is empty.
+	archiveDirPath string
+
+	// changes holds the listeners of the change records in the log.
+	changes *ChangeListeners
+
+	// endGate is held shared by transactions committing, rolling back, or recovering, and exclusively by a backup
+	// while it writes the buffers out, so that no transaction is in the middle of ending at the start of the backup.
+	endGate sync.RWMutex
+
+	// fileGate is held shared by transactions applying file operations, and exclusively by a backup while it copies
+	// files.
+	fileGate sync.RWMutex
+
+	// backups is the number of backups in progress. It is accessed atomically.
+	backups int32
+
+	// pendingOps holds the file operations of committed transactions that failed to be applied.
+	pendingOps *pendingFileOperations
 }
 
 func newLogManager(fm *fileManager, logFileName string) (*logManager, error) {
@@ -28,6 +60,8 @@ func newLogManager(fm *fileManager, logFileName string) (*logManager, error) {
 			fm:           fm,
 			logFileName:  logFileName,
 			logPage:      p,
+			changes:      newChangeListeners(),
+			pendingOps:   newPendingFileOperations(),
 			latestLSN:    lsnNil,
 			lastSavedLSN: lsnNil,
 		}
@@ -42,6 +76,9 @@ func newLogManager(fm *fileManager, logFileName string) (*logManager, error) {
 		return nil, err
 	}
 	if c == 0 {
+		if fm.readOnly {
+			return nil, fmt.Errorf("a log doesn't exist or is empty: %v", logFileName)
+		}
 		var err error
 		m.currentBlk, err = m.allocBlock()
 		if err != nil {
@@ -59,6 +96,13 @@ func newLogManager(fm *fileManager, logFileName string) (*logManager, error) {
 }
 
 func (m *logManager) appendLog(logRec []byte) (logSeqNum, error) {
+	if m.fm.readOnly {
+		return lsnNil, fmt.Errorf("failed to append a log record: %w", ErrReadOnlyStorage)
+	}
+	if len(logRec) > m.maxRecordSize() {
+		return lsnNil, fmt.Errorf("%w: size: %v byte, max: %v byte", ErrLogRecordTooLarge, len(logRec), m.maxRecordSize())
+	}
+
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
@@ -92,9 +136,17 @@ func (m *logManager) appendLog(logRec []byte) (logSeqNum, error) {
 		return lsnNil, err
 	}
 	m.latestLSN++
+	atomic.AddUint64(&m.stats.appends, 1)
+	atomic.AddUint64(&m.stats.appendedBytes, uint64(len(logRec)))
 	return m.latestLSN, nil
 }
 
+// maxRecordSize returns the size of the largest log record that fits in a log block. A log block begins with
+// the offset of its newest record, and every record follows its length.
+func (m *logManager) maxRecordSize() int {
+	return m.fm.blkSize - CalcBytesNeeded(binary.MaxVarintLen64) - CalcBytesNeeded(0)
+}
+
 func (m *logManager) allocBlock() (*BlockID, error) {
 	blk, err := m.fm.alloc(m.logFileName)
 	if err != nil {
@@ -120,12 +172,17 @@ func (m *logManager) flushAll() error {
 }
 
 func (m *logManager) flushAllNoLock() error {
+	// A read-only storage appends no log record, so the page holds what the disk holds.
+	if m.fm.readOnly {
+		return nil
+	}
 	err := m.fm.write(m.currentBlk, m.logPage)
 	if err != nil {
 		return err
 	}
+	atomic.AddUint64(&m.stats.flushes, 1)
 	m.lastSavedLSN = m.latestLSN
-	return nil
+	return m.archive()
 }
 
 func (m *logManager) flush(lsn logSeqNum) error {
@@ -139,15 +196,19 @@ func (m *logManager) flush(lsn logSeqNum) error {
 }
 
 func (m *logManager) apply(f func(rec []byte) (bool, error)) error {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-
-	err := m.flushAllNoLock()
-	if err != nil {
-		return err
+	// We don't hold the lock while calling `f` because `f` may flush the log. For instance, undoing a log record
+	// may make a buffer manager write out a modified buffer, and then the buffer flushes the log.
+	var blk *BlockID
+	{
+		m.mu.Lock()
+		err := m.flushAllNoLock()
+		blk = m.currentBlk
+		m.mu.Unlock()
+		if err != nil {
+			return err
+		}
 	}
 
-	blk := m.currentBlk
 	p, err := newPage(m.fm.blkSize)
 	if err != nil {
 		return err
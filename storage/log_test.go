@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -14,7 +15,7 @@ func TestLogManager(t *testing.T) {
 	}
 	defer os.RemoveAll(testDir)
 
-	fm, err := newFileManager(filepath.Join(testDir, "log"), 400)
+	fm, err := newTestFileManager(filepath.Join(testDir, "log"), 400)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -57,4 +58,15 @@ func TestLogManager(t *testing.T) {
 	if n != 0 {
 		t.Fatalf("%v records remain", n)
 	}
+
+	t.Run("a log record larger than a log block is rejected", func(t *testing.T) {
+		_, err := lm.appendLog(make([]byte, lm.maxRecordSize()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = lm.appendLog(make([]byte, lm.maxRecordSize()+1))
+		if !errors.Is(err, ErrLogRecordTooLarge) {
+			t.Fatalf("unexpected error: want: %v, got: %v", ErrLogRecordTooLarge, err)
+		}
+	})
 }
@@ -0,0 +1,162 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrTransactionPrepared is returned when a prepared transaction is asked to do anything other than
+// CommitPrepared or RollbackPrepared.
+var ErrTransactionPrepared = errors.New("a prepared transaction can only be finished with CommitPrepared or RollbackPrepared")
+
+// ErrTransactionNotPrepared is returned when CommitPrepared or RollbackPrepared is called on a transaction that
+// isn't prepared.
+var ErrTransactionNotPrepared = errors.New("a transaction is not prepared")
+
+// preparedTable holds the prepared transactions of a storage by their global IDs.
+type preparedTable struct {
+	mu  sync.Mutex
+	txs map[string]*Transaction
+
+	// begin begins a transaction taking over a prepared transaction that a recovery found.
+	begin func() (*Transaction, error)
+}
+
+func newPreparedTable(begin func() (*Transaction, error)) *preparedTable {
+	return &preparedTable{
+		txs:   map[string]*Transaction{},
+		begin: begin,
+	}
+}
+
+func (t *preparedTable) add(gid string, tx *Transaction) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.txs[gid]; ok {
+		return fmt.Errorf("a global transaction ID is already used: %v", gid)
+	}
+	t.txs[gid] = tx
+	return nil
+}
+
+func (t *preparedTable) remove(gid string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.txs, gid)
+}
+
+func (t *preparedTable) get(gid string) (*Transaction, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tx, ok := t.txs[gid]
+	return tx, ok
+}
+
+func (t *preparedTable) gids() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	gids := make([]string, 0, len(t.txs))
+	for gid := range t.txs {
+		gids = append(gids, gid)
+	}
+	sort.Strings(gids)
+	return gids
+}
+
+// PreparedTransactions returns the global IDs of the prepared transactions that haven't finished yet, including
+// the ones a recovery restored.
+func (s *Storage) PreparedTransactions() []string {
+	return s.prepared.gids()
+}
+
+// PreparedTransaction returns the prepared transaction having a global ID `gid`. A coordinator uses this function to
+// finish a transaction that was prepared before a restart.
+func (s *Storage) PreparedTransaction(gid string) (*Transaction, bool) {
+	return s.prepared.get(gid)
+}
+
+// Prepare is the first phase of two-phase commit. It writes the modifications of the transaction and a prepare log
+// record out to a disk, so the transaction can still commit after a crash. The transaction keeps its exclusive locks
+// until CommitPrepared or RollbackPrepared finishes it. `gid` is the global ID identifying the transaction among
+// all the databases a coordinator writes to, and must be unique among the prepared transactions of the storage.
+//
+// A recovery doesn't undo a prepared transaction that hasn't finished. It restores the transaction with its locks,
+// and Storage.PreparedTransaction returns it.
+func (t *Transaction) Prepare(gid string) error {
+	if t.opts.readOnly {
+		return fmt.Errorf("failed to prepare: %w", ErrReadOnlyTransaction)
+	}
+	if *t.gid != "" {
+		return fmt.Errorf("failed to prepare: %w", ErrTransactionPrepared)
+	}
+	if gid == "" {
+		return fmt.Errorf("failed to prepare: a global transaction ID must not be empty")
+	}
+	if t.prepared == nil {
+		return fmt.Errorf("failed to prepare: a transaction must begin through a storage")
+	}
+	start := time.Now()
+	t.rm.lm.endGate.RLock()
+	defer t.rm.lm.endGate.RUnlock()
+	err := t.prepared.add(gid, t)
+	if err != nil {
+		return fmt.Errorf("failed to prepare: %w", err)
+	}
+	err = t.prepare(gid)
+	if err != nil {
+		t.prepared.remove(gid)
+		return err
+	}
+	t.ev.transactionPrepared(&TransactionEvent{
+		TxNum:    int(t.txNum),
+		GID:      gid,
+		Duration: time.Since(start),
+		Elapsed:  time.Since(t.began),
+	})
+	return nil
+}
+
+// prepare writes a prepare log record and releases the buffers. The transaction doesn't read blocks anymore.
+func (t *Transaction) prepare(gid string) error {
+	err := t.rm.prepare(gid)
+	if err != nil {
+		return err
+	}
+	*t.gid = gid
+	return t.bl.unpinAll()
+}
+
+// Prepared reports whether the transaction is prepared.
+func (t *Transaction) Prepared() bool {
+	return *t.gid != ""
+}
+
+// CommitPrepared commits a prepared transaction. When it fails before the transaction commits, the transaction
+// stays prepared.
+func (t *Transaction) CommitPrepared() error {
+	if *t.gid == "" {
+		return fmt.Errorf("failed to commit: %w", ErrTransactionNotPrepared)
+	}
+	return t.commit()
+}
+
+// RollbackPrepared rolls back a prepared transaction. When it fails before the transaction rolls back,
+// the transaction stays prepared.
+func (t *Transaction) RollbackPrepared() error {
+	if *t.gid == "" {
+		return fmt.Errorf("failed to roll back: %w", ErrTransactionNotPrepared)
+	}
+	return t.rollback()
+}
+
+// finishPrepared forgets the global ID once the commit or rollback log record is written.
+func (t *Transaction) finishPrepared() {
+	if *t.gid == "" {
+		return
+	}
+	t.prepared.remove(*t.gid)
+	*t.gid = ""
+}
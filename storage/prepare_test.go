@@ -0,0 +1,356 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTransaction_Prepare(t *testing.T) {
+	testDir, err := MakeTestDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+
+	logFilePath, err := MakeTestLogFile(testDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logFileName := filepath.Base(logFilePath)
+	dbFilePath, err := MakeTestTableFile(testDir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbFileName := filepath.Base(dbFilePath)
+
+	ctx := context.Background()
+	config := TestConfig(&StorageConfig{
+		DirPath:     testDir,
+		LogFileName: logFileName,
+		BlkSize:     400,
+		BufSize:     10,
+	})
+	// open opens the storage and recovers it as a restart after a crash does.
+	open := func(t *testing.T) *Storage {
+		t.Helper()
+		st, err := InitStorage(ctx, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tx, err := st.NewTransaction(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tx.Recover()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tx.Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return st
+	}
+	write := func(t *testing.T, st *Storage, blkNum int, v int64) *Transaction {
+		t.Helper()
+		tx, err := st.NewTransaction(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blk := NewBlockID(dbFileName, blkNum)
+		err = tx.Pin(blk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tx.WriteInt64(blk.Hash, 0, v, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tx
+	}
+	read := func(st *Storage, blkNum int, opts ...TransactionOption) (int64, error) {
+		tx, err := st.NewReadOnlyTransaction(ctx, opts...)
+		if err != nil {
+			return 0, err
+		}
+		defer tx.Commit()
+		blk := NewBlockID(dbFileName, blkNum)
+		err = tx.Pin(blk)
+		if err != nil {
+			return 0, err
+		}
+		return tx.ReadInt64(blk.Hash, 0)
+	}
+	expectValue := func(t *testing.T, st *Storage, blkNum int, want int64) {
+		t.Helper()
+		v, err := read(st, blkNum, WithLockTimeout(100*time.Millisecond))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != want {
+			t.Fatalf("unexpected value: block: %v, want: %v, got: %v", blkNum, want, v)
+		}
+	}
+	// expectLocked checks that a prepared transaction keeps its lock and its uncommitted value.
+	expectLocked := func(t *testing.T, st *Storage, blkNum int, uncommitted int64) {
+		t.Helper()
+		_, err := read(st, blkNum, WithLockTimeout(20*time.Millisecond))
+		if !errors.Is(err, ErrLockWaitTimeout) {
+			t.Fatalf("expected error didn't occur: want: %v, got: %v", ErrLockWaitTimeout, err)
+		}
+		v, err := read(st, blkNum, WithReadUncommitted())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != uncommitted {
+			t.Fatalf("unexpected uncommitted value: block: %v, want: %v, got: %v", blkNum, uncommitted, v)
+		}
+	}
+
+	st := open(t)
+	{
+		tx, err := st.NewTransaction(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 3; i++ {
+			blk, err := tx.AllocBlock(dbFileName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = tx.Pin(blk)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = tx.WriteInt64(blk.Hash, 0, 100, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = tx.Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("a prepared transaction keeps its locks until it finishes", func(t *testing.T) {
+		tx := write(t, st, 0, 200)
+		err := tx.Prepare("gid-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectLocked(t, st, 0, 200)
+
+		err = tx.WriteInt64(NewBlockID(dbFileName, 0).Hash, 0, 300, true)
+		if !errors.Is(err, ErrTransactionPrepared) {
+			t.Fatalf("expected error didn't occur: want: %v, got: %v", ErrTransactionPrepared, err)
+		}
+		err = tx.Commit()
+		if !errors.Is(err, ErrTransactionPrepared) {
+			t.Fatalf("expected error didn't occur: want: %v, got: %v", ErrTransactionPrepared, err)
+		}
+		{
+			dup := write(t, st, 1, 0)
+			err := dup.Prepare("gid-1")
+			if err == nil {
+				t.Fatal("a global transaction ID must be unique")
+			}
+			err = dup.Rollback()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		tx, ok := st.PreparedTransaction("gid-1")
+		if !ok {
+			t.Fatal("a prepared transaction was not found")
+		}
+		err = tx.CommitPrepared()
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectValue(t, st, 0, 200)
+		if gids := st.PreparedTransactions(); len(gids) != 0 {
+			t.Fatalf("unexpected prepared transactions: %v", gids)
+		}
+		err = tx.CommitPrepared()
+		if !errors.Is(err, ErrTransactionNotPrepared) {
+			t.Fatalf("expected error didn't occur: want: %v, got: %v", ErrTransactionNotPrepared, err)
+		}
+	})
+
+	t.Run("a recovery restores prepared transactions with their locks", func(t *testing.T) {
+		committed := write(t, st, 1, 400)
+		err := committed.Prepare("gid-2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		rolledBack := write(t, st, 2, 500)
+		err = rolledBack.Prepare("gid-3")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// A transaction that isn't prepared is undone.
+		unfinished := write(t, st, 0, 600)
+		err = st.bm.flushAll(unfinished.txNum)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// A crash stops the storage, and restarts restore the prepared transactions again and again.
+		for i := 0; i < 2; i++ {
+			err = st.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			st = open(t)
+			if gids := st.PreparedTransactions(); !reflect.DeepEqual(gids, []string{"gid-2", "gid-3"}) {
+				t.Fatalf("unexpected prepared transactions: want: %v, got: %v", []string{"gid-2", "gid-3"}, gids)
+			}
+			expectValue(t, st, 0, 200)
+			expectLocked(t, st, 1, 400)
+			expectLocked(t, st, 2, 500)
+		}
+
+		tx, ok := st.PreparedTransaction("gid-2")
+		if !ok {
+			t.Fatal("a prepared transaction was not found")
+		}
+		err = tx.CommitPrepared()
+		if err != nil {
+			t.Fatal(err)
+		}
+		tx, ok = st.PreparedTransaction("gid-3")
+		if !ok {
+			t.Fatal("a prepared transaction was not found")
+		}
+		err = tx.RollbackPrepared()
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectValue(t, st, 1, 400)
+		expectValue(t, st, 2, 100)
+
+		// The decisions survive another restart.
+		err = st.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		st = open(t)
+		if gids := st.PreparedTransactions(); len(gids) != 0 {
+			t.Fatalf("unexpected prepared transactions: %v", gids)
+		}
+		expectValue(t, st, 0, 200)
+		expectValue(t, st, 1, 400)
+		expectValue(t, st, 2, 100)
+	})
+
+	t.Run("a recovery restores the locks on the files a prepared transaction drops", func(t *testing.T) {
+		const fileName = "prepared.tbl"
+		{
+			tx, err := st.NewTransaction(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = tx.AllocBlock(fileName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = tx.Commit()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		tx, err := st.NewTransaction(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tx.DropFile(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tx.Prepare("gid-4")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = st.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		st = open(t)
+		pin := func() error {
+			tx, err := st.NewReadOnlyTransaction(ctx, WithLockTimeout(20*time.Millisecond))
+			if err != nil {
+				return err
+			}
+			defer tx.Commit()
+			return tx.Pin(NewBlockID(fileName, 0))
+		}
+		err = pin()
+		if !errors.Is(err, ErrLockWaitTimeout) {
+			t.Fatalf("expected error didn't occur: want: %v, got: %v", ErrLockWaitTimeout, err)
+		}
+
+		tx, ok := st.PreparedTransaction("gid-4")
+		if !ok {
+			t.Fatal("a prepared transaction was not found")
+		}
+		err = tx.RollbackPrepared()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = pin()
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("a prepared transaction that fails to commit stays prepared", func(t *testing.T) {
+		tx := write(t, st, 0, 700)
+		err := tx.Prepare("gid-5")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Closing the log file makes writing the commit log record fail.
+		st.lm.fm.mu.Lock()
+		logFile := st.lm.fm.openFiles[logFileName]
+		st.lm.fm.mu.Unlock()
+		err = logFile.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tx.CommitPrepared()
+		if err == nil {
+			t.Fatal("committing must fail")
+		}
+		if !tx.Prepared() {
+			t.Fatal("a transaction that failed to commit must stay prepared")
+		}
+		if gids := st.PreparedTransactions(); !reflect.DeepEqual(gids, []string{"gid-5"}) {
+			t.Fatalf("unexpected prepared transactions: want: %v, got: %v", []string{"gid-5"}, gids)
+		}
+
+		st.lm.fm.mu.Lock()
+		delete(st.lm.fm.openFiles, logFileName)
+		st.lm.fm.mu.Unlock()
+		err = tx.CommitPrepared()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if gids := st.PreparedTransactions(); len(gids) != 0 {
+			t.Fatalf("unexpected prepared transactions: %v", gids)
+		}
+		expectValue(t, st, 0, 700)
+	})
+
+	err = st.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
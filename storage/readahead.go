@@ -0,0 +1,120 @@
+package storage
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// readAheadQueueSize is the number of read-ahead requests that can wait for the worker. Requests beyond it are dropped.
+const readAheadQueueSize = 64
+
+// runReadAhead starts a goroutine that reads `n` blocks following each requested block into unpinned buffers. The
+// goroutine stops when `ctx` is done, and then the returned channel is closed.
+func runReadAhead(ctx context.Context, bm *bufferManager, n int) <-chan struct{} {
+	done := make(chan struct{})
+	bm.readAheadCh = make(chan *BlockID, readAheadQueueSize)
+	bm.readAheadN = n
+
+	go func() {
+		defer close(done)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case blk := <-bm.readAheadCh:
+				err := bm.readAhead(blk, n)
+				if err != nil {
+					bm.ev.readAheadFailed(err)
+				}
+			}
+		}
+	}()
+
+	return done
+}
+
+// requestReadAhead passes a block to the read-ahead worker. When the next block isn't in the pool, the caller reads
+// the blocks itself, so read-ahead works even when the worker rarely runs, as with GOMAXPROCS=1.
+func (m *bufferManager) requestReadAhead(blk *BlockID) {
+	if m.readAheadCh == nil {
+		return
+	}
+	m.readAheadPos.Store(blk.fileName, blk.BlkNum)
+	if m.findAssignedBuffer(NewBlockID(blk.fileName, blk.BlkNum+1)) == nil {
+		err := m.readAhead(blk, m.readAheadN)
+		if err != nil {
+			m.ev.readAheadFailed(err)
+		}
+		return
+	}
+	select {
+	case m.readAheadCh <- blk:
+	default:
+	}
+}
+
+// readAhead reads at most `n` blocks following `blk` into unpinned buffers without pinning them. Blocks already in
+// the pool are skipped, and so are blocks a scan has already passed; when the worker falls behind, a request may
+// refer to such blocks.
+//
+// Reading a block into the pool needs no lock because a buffer only caches the block; a transaction still acquires
+// a lock when it reads the buffer.
+func (m *bufferManager) readAhead(blk *BlockID, n int) error {
+	for i := 1; i <= n; i++ {
+		next := NewBlockID(blk.fileName, blk.BlkNum+i)
+		if pos, ok := m.readAheadPos.Load(next.fileName); ok && next.BlkNum <= pos.(int) {
+			continue
+		}
+		ok, err := m.readAheadBlock(next, blk.BlkNum+1, blk.BlkNum+n)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+	}
+	return nil
+}
+
+// readAheadBlock reads a block into an unpinned buffer. Blocks from `from` to `to` in the same file are being read
+// ahead, so their buffers are never chosen. It returns false when the block doesn't exist or no buffer is available.
+// We lock the buffer manager for each block so that pins don't wait for the whole read-ahead.
+func (m *bufferManager) readAheadBlock(blk *BlockID, from, to int) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Checking the block count while the buffer manager is locked ensures that a file being dropped or truncated
+	// doesn't come back into the pool. See discard.
+	c, err := m.fm.blockCount(blk.fileName)
+	if err != nil {
+		return false, err
+	}
+	if blk.BlkNum >= c {
+		return false, nil
+	}
+	if m.findAssignedBuffer(blk) != nil {
+		return true, nil
+	}
+	buf := m.takeVictim(func() *buffer {
+		return m.chooseBuffer(func(buf *buffer) bool {
+			return buf.blk.fileName == blk.fileName && buf.blk.BlkNum >= from && buf.blk.BlkNum <= to
+		})
+	})
+	if buf == nil {
+		return false, nil
+	}
+	err = m.assign(buf, blk)
+	if err != nil {
+		return false, err
+	}
+	// We set the reference bit so that the block survives a turn of the clock hand until a scan reaches it.
+	p := m.table.partition(blk.Hash)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	buf.readAhead = true
+	buf.referenced = true
+	p.bufs[blk.Hash] = buf
+	atomic.AddUint64(&m.stats.readAheads, 1)
+	return true, nil
+}
@@ -0,0 +1,226 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBufferManager_readAhead(t *testing.T) {
+	testDir, err := MakeTestDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+
+	fm, lm, err := newTestFileManagerAndLogManager(testDir, 400)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dbFileName string
+	{
+		dbFilePath, err := MakeTestTableFile(testDir, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		dbFileName = filepath.Base(dbFilePath)
+	}
+	var blks []*BlockID
+	for i := 0; i < 6; i++ {
+		blk, err := fm.alloc(dbFileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blks = append(blks, blk)
+	}
+	bm, err := newBufferManager(fm, lm, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	buf0, err := bm.pin(ctx, blks[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("read-ahead reads the following blocks into unpinned buffers", func(t *testing.T) {
+		err := bm.readAhead(blks[0], 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, blk := range blks[1:3] {
+			buf := bm.findAssignedBuffer(blk)
+			if buf == nil || !buf.readAhead || buf.pinned() {
+				t.Fatalf("a block must be read ahead: block: %v", blk.BlkNum)
+			}
+		}
+		if bm.stats.readAheads != 2 {
+			t.Fatalf("unexpected number of read-aheads: want: %v, got: %v", 2, bm.stats.readAheads)
+		}
+	})
+
+	t.Run("read-ahead doesn't evict the blocks it is reading ahead", func(t *testing.T) {
+		// Only one buffer holds neither a pinned block nor a block read ahead.
+		err := bm.readAhead(blks[0], 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, blk := range blks[1:4] {
+			if bm.findAssignedBuffer(blk) == nil {
+				t.Fatalf("a block must be in the pool: block: %v", blk.BlkNum)
+			}
+		}
+		for _, blk := range blks[4:] {
+			if bm.findAssignedBuffer(blk) != nil {
+				t.Fatalf("a block must not be in the pool: block: %v", blk.BlkNum)
+			}
+		}
+	})
+
+	t.Run("pinning a block read ahead is a hit and clears the flag", func(t *testing.T) {
+		hits := bm.stats.hits
+		buf, err := bm.pin(ctx, blks[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bm.stats.hits != hits+1 || bm.stats.readAheadHits != 1 {
+			t.Fatalf("unexpected stats: %+v", bm.stats)
+		}
+		if buf.readAhead {
+			t.Fatal("a pinned buffer must not be marked as read ahead")
+		}
+		err = bm.unpin(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("read-ahead reuses buffers holding blocks that a scan skipped", func(t *testing.T) {
+		// Blocks 1 and 2 are outside the range of this read-ahead, so the clock hand evicts them after clearing
+		// their reference bits.
+		err := bm.readAhead(blks[3], 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, blk := range blks[3:] {
+			if bm.findAssignedBuffer(blk) == nil {
+				t.Fatalf("a block must be in the pool: block: %v", blk.BlkNum)
+			}
+		}
+		for _, blk := range blks[1:3] {
+			if bm.findAssignedBuffer(blk) != nil {
+				t.Fatalf("a block must be evicted: block: %v", blk.BlkNum)
+			}
+		}
+	})
+
+	t.Run("read-ahead doesn't read blocks beyond the end of a file", func(t *testing.T) {
+		err := bm.unpin(buf0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = bm.discard(dbFileName, 2, func() error {
+			return fm.truncate(dbFileName, 2)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = bm.readAhead(blks[0], 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, blk := range blks[2:] {
+			if bm.findAssignedBuffer(blk) != nil {
+				t.Fatalf("a block must not be in the pool: block: %v", blk.BlkNum)
+			}
+		}
+	})
+}
+
+func TestStorage_readAhead(t *testing.T) {
+	testDir, err := MakeTestDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+
+	logFilePath, err := MakeTestLogFile(testDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbFilePath, err := MakeTestTableFile(testDir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbFileName := filepath.Base(dbFilePath)
+
+	st, err := InitStorage(context.Background(), TestConfig(&StorageConfig{
+		DirPath:     testDir,
+		LogFileName: filepath.Base(logFilePath),
+		BlkSize:     400,
+		BufSize:     8,
+		ReadAhead:   4,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	tx, err := st.NewReadOnlyTransaction(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var blks []*BlockID
+	for i := 0; i < 6; i++ {
+		blk, err := st.fm.alloc(dbFileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blks = append(blks, blk)
+	}
+	err = tx.Pin(blks[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The next block isn't in the pool, so the transaction reads the blocks itself without waiting for the worker.
+	tx.ReadAhead(blks[0])
+	if stats := st.Stats().Buffer; stats.ReadAheads != 4 {
+		t.Fatalf("unexpected number of read-aheads: want: %v, got: %v", 4, stats.ReadAheads)
+	}
+	for _, blk := range blks[1:5] {
+		err := tx.Pin(blk)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats := st.Stats().Buffer
+	if stats.ReadAheadHits != 4 || stats.Misses != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	// The next block is in the pool, so the worker reads the blocks asynchronously, and we wait for it.
+	tx.ReadAhead(blks[1])
+	deadline := time.Now().Add(5 * time.Second)
+	for st.Stats().Buffer.ReadAheads < 5 {
+		if time.Now().After(deadline) {
+			t.Fatalf("the storage didn't read blocks ahead: %+v", st.Stats().Buffer)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	err = tx.Pin(blks[5])
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats = st.Stats().Buffer
+	if stats.ReadAheadHits != 5 || stats.Misses != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+	err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
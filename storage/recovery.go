@@ -2,9 +2,10 @@ package storage
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/gob"
-	"errors"
 	"fmt"
+	"time"
 )
 
 type operator int
@@ -14,9 +15,18 @@ const (
 	opStart
 	opCommit
 	opRollBack
+	// opSetInt64, opSetUint64, and opSetString are kept only to undo logs written by older versions.
 	opSetInt64
 	opSetUint64
 	opSetString
+	opDropFile
+	opTruncateFile
+	opSetBytes
+	opBackup
+	opRedoBytes
+	opPrepare
+	opChange
+	opSetHintBytes
 )
 
 type logRecord struct {
@@ -28,6 +38,15 @@ type logRecord struct {
 	Val      interface{}
 }
 
+// time returns the Unix time in nanoseconds that a commit or a backup log record holds in Val, and 0 otherwise.
+func (r *logRecord) time() int64 {
+	if r.Op != opCommit && r.Op != opBackup {
+		return 0
+	}
+	t, _ := r.Val.(int64)
+	return t
+}
+
 func newStartLogRecord(txNum transactionNum) *logRecord {
 	return &logRecord{
 		Op:    opStart,
@@ -39,6 +58,7 @@ func newCommitLogRecord(txNum transactionNum) *logRecord {
 	return &logRecord{
 		Op:    opCommit,
 		TxNum: txNum,
+		Val:   time.Now().UnixNano(),
 	}
 }
 
@@ -49,42 +69,89 @@ func newRollbackLogRecord(txNum transactionNum) *logRecord {
 	}
 }
 
-func newCheckPointLogRecord() *logRecord {
+// newCheckPointLogRecord makes a checkpoint listing the prepared transactions written again just before it.
+func newCheckPointLogRecord(preparedTxNums []int) *logRecord {
+	var v interface{}
+	if len(preparedTxNums) > 0 {
+		v = preparedTxNums
+	}
+	return &logRecord{
+		Op:  opCheckPoint,
+		Val: v,
+	}
+}
+
+func newPrepareLogRecord(txNum transactionNum, gid string) *logRecord {
 	return &logRecord{
-		Op: opCheckPoint,
+		Op:    opPrepare,
+		TxNum: txNum,
+		Val:   gid,
 	}
 }
 
-func newSetInt64LogRecord(txNum transactionNum, blk *BlockID, offset int, val int64) *logRecord {
+func newSetBytesLogRecord(txNum transactionNum, blk *BlockID, offset int, img []byte) *logRecord {
 	return &logRecord{
-		Op:       opSetInt64,
+		Op:       opSetBytes,
 		TxNum:    txNum,
 		FileName: blk.fileName,
 		BlkNum:   blk.BlkNum,
 		Offset:   offset,
-		Val:      val,
+		Val:      img,
 	}
 }
 
-func newSetUint64LogRecord(txNum transactionNum, blk *BlockID, offset int, val uint64) *logRecord {
+func newSetHintBytesLogRecord(txNum transactionNum, blk *BlockID, offset int, img []byte) *logRecord {
+	r := newSetBytesLogRecord(txNum, blk, offset, img)
+	r.Op = opSetHintBytes
+	return r
+}
+
+func newRedoBytesLogRecord(txNum transactionNum, blk *BlockID, offset int, img []byte) *logRecord {
 	return &logRecord{
-		Op:       opSetUint64,
+		Op:       opRedoBytes,
 		TxNum:    txNum,
 		FileName: blk.fileName,
 		BlkNum:   blk.BlkNum,
 		Offset:   offset,
-		Val:      val,
+		Val:      img,
+	}
+}
+
+func newChangeLogRecord(txNum transactionNum, source string, chunk []byte, more bool) *logRecord {
+	r := &logRecord{
+		Op:       opChange,
+		TxNum:    txNum,
+		FileName: source,
+		Val:      chunk,
+	}
+	if more {
+		r.Offset = 1
+	}
+	return r
+}
+
+func newBackupLogRecord(label string) *logRecord {
+	return &logRecord{
+		Op:       opBackup,
+		FileName: label,
+		Val:      time.Now().UnixNano(),
 	}
 }
 
-func newSetStringLogRecord(txNum transactionNum, blk *BlockID, offset int, val string) *logRecord {
+func newDropFileLogRecord(txNum transactionNum, fileName string) *logRecord {
 	return &logRecord{
-		Op:       opSetString,
+		Op:       opDropFile,
 		TxNum:    txNum,
-		FileName: blk.fileName,
-		BlkNum:   blk.BlkNum,
-		Offset:   offset,
-		Val:      val,
+		FileName: fileName,
+	}
+}
+
+func newTruncateFileLogRecord(txNum transactionNum, fileName string, blkCount int) *logRecord {
+	return &logRecord{
+		Op:       opTruncateFile,
+		TxNum:    txNum,
+		FileName: fileName,
+		BlkNum:   blkCount,
 	}
 }
 
@@ -105,13 +172,17 @@ type recoveryManager struct {
 	lm    *logManager
 	bm    *bufferManager
 	txNum transactionNum
+	enc   Encoding
+
+	changesLogged bool
 }
 
-func newRecoveryManager(lm *logManager, bm *bufferManager, txNum transactionNum) (*recoveryManager, error) {
+func newRecoveryManager(lm *logManager, bm *bufferManager, txNum transactionNum, enc Encoding) (*recoveryManager, error) {
 	rm := &recoveryManager{
 		lm:    lm,
 		bm:    bm,
 		txNum: txNum,
+		enc:   enc,
 	}
 
 	rec, err := newStartLogRecord(txNum).marshalBytes()
@@ -147,6 +218,23 @@ func (m *recoveryManager) commit() error {
 	return m.lm.flush(lsn)
 }
 
+func (m *recoveryManager) prepare(gid string) error {
+	err := m.bm.flushAll(m.txNum)
+	if err != nil {
+		return err
+	}
+
+	rec, err := newPrepareLogRecord(m.txNum, gid).marshalBytes()
+	if err != nil {
+		return err
+	}
+	lsn, err := m.lm.appendLog(rec)
+	if err != nil {
+		return err
+	}
+	return m.lm.flush(lsn)
+}
+
 func (m *recoveryManager) rollback(tx *Transaction) error {
 	err := m.lm.apply(func(rec []byte) (bool, error) {
 		r := &logRecord{}
@@ -154,7 +242,10 @@ func (m *recoveryManager) rollback(tx *Transaction) error {
 		if err != nil {
 			return false, err
 		}
-		if r.TxNum != m.txNum || r.Op == opStart {
+		if r.TxNum != m.txNum {
+			return false, nil
+		}
+		if r.Op == opStart {
 			return true, nil
 		}
 		return false, m.undo(tx, r)
@@ -179,39 +270,135 @@ func (m *recoveryManager) rollback(tx *Transaction) error {
 	return m.lm.flush(lsn)
 }
 
+type preparedLogRecords struct {
+	gid  string
+	recs []*logRecord
+}
+
 func (m *recoveryManager) recover(tx *Transaction) error {
 	finishedTxs := map[transactionNum]struct{}{}
+	committedTxs := map[transactionNum]struct{}{}
+	// A crash may interrupt the file operations of committed transactions, so we apply them again unless the file
+	// was modified after the commit.
+	var fileOps []*logRecord
+	pos := 0
+	commitPos := map[transactionNum]int{}
+	lastWritePos := map[string]int{}
+	preparedTxs := map[transactionNum]*preparedLogRecords{}
+	var prepared []*preparedLogRecords
+	gids := map[string]struct{}{}
+	// waiting holds the prepared transactions the last checkpoint lists, whose records precede it.
+	var waiting map[transactionNum]struct{}
 	err := m.lm.apply(func(rec []byte) (bool, error) {
 		r := &logRecord{}
 		err := r.unmarshalBytes(rec)
 		if err != nil {
 			return false, err
 		}
+		pos++
+		if isSetOperator(r.Op) || r.Op == opRedoBytes {
+			if _, ok := lastWritePos[r.FileName]; !ok {
+				lastWritePos[r.FileName] = pos
+			}
+		}
+		if r.Op == opCheckPoint {
+			txNums, _ := r.Val.([]int)
+			if waiting != nil || len(txNums) == 0 {
+				return true, nil
+			}
+			waiting = map[transactionNum]struct{}{}
+			for _, n := range txNums {
+				waiting[transactionNum(n)] = struct{}{}
+			}
+			return false, nil
+		}
+		stop := false
+		if waiting != nil {
+			if _, ok := waiting[r.TxNum]; !ok {
+				return false, nil
+			}
+			if r.Op == opStart {
+				delete(waiting, r.TxNum)
+				stop = len(waiting) == 0
+			}
+		}
 		switch r.Op {
-		case opCheckPoint:
-			return true, nil
+		case opStart:
+			// Transaction numbers restart whenever a storage opens.
+			delete(finishedTxs, r.TxNum)
+			delete(committedTxs, r.TxNum)
+			delete(preparedTxs, r.TxNum)
+			delete(commitPos, r.TxNum)
 		case opCommit:
 			finishedTxs[r.TxNum] = struct{}{}
+			committedTxs[r.TxNum] = struct{}{}
+			commitPos[r.TxNum] = pos
 		case opRollBack:
 			finishedTxs[r.TxNum] = struct{}{}
+		case opPrepare:
+			if _, ok := finishedTxs[r.TxNum]; ok {
+				break
+			}
+			gid, _ := r.Val.(string)
+			if _, ok := gids[gid]; ok {
+				finishedTxs[r.TxNum] = struct{}{}
+				break
+			}
+			gids[gid] = struct{}{}
+			p := &preparedLogRecords{
+				gid: gid,
+			}
+			preparedTxs[r.TxNum] = p
+			prepared = append(prepared, p)
+		case opDropFile, opTruncateFile:
+			if _, ok := committedTxs[r.TxNum]; ok {
+				if w, ok := lastWritePos[r.FileName]; !ok || w > commitPos[r.TxNum] {
+					fileOps = append(fileOps, r)
+				}
+			} else if p, ok := preparedTxs[r.TxNum]; ok {
+				p.recs = append(p.recs, r)
+			}
 		default:
 			if _, ok := finishedTxs[r.TxNum]; ok {
-				return false, nil
+				return stop, nil
+			}
+			if p, ok := preparedTxs[r.TxNum]; ok {
+				if isSetOperator(r.Op) || r.Op == opChange {
+					p.recs = append(p.recs, r)
+				}
+				return stop, nil
 			}
-			return false, m.undo(tx, r)
+			return stop, m.undo(tx, r)
 		}
-		return false, nil
+		return stop, nil
 	})
 	if err != nil {
 		return err
 	}
 
+	for i := len(fileOps) - 1; i >= 0; i-- {
+		err := tx.applyFileOperation(fileOps[i])
+		if err != nil {
+			return err
+		}
+	}
+
 	err = m.bm.flushAll(m.txNum)
 	if err != nil {
 		return err
 	}
 
-	rec, err := newCheckPointLogRecord().marshalBytes()
+	// The checkpoint hides the records before it, so the prepared transactions are written again.
+	var preparedTxNums []int
+	for i := len(prepared) - 1; i >= 0; i-- {
+		ptx, err := m.restorePrepared(tx, prepared[i])
+		if err != nil {
+			return err
+		}
+		preparedTxNums = append(preparedTxNums, int(ptx.txNum))
+	}
+
+	rec, err := newCheckPointLogRecord(preparedTxNums).marshalBytes()
 	if err != nil {
 		return err
 	}
@@ -222,14 +409,80 @@ func (m *recoveryManager) recover(tx *Transaction) error {
 	return m.lm.flush(lsn)
 }
 
+// restorePrepared writes a prepared transaction again under a new transaction holding its locks and global ID.
+func (m *recoveryManager) restorePrepared(tx *Transaction, p *preparedLogRecords) (*Transaction, error) {
+	if tx.prepared == nil {
+		return nil, fmt.Errorf("a transaction must begin through a storage to restore a prepared transaction: %v", p.gid)
+	}
+	ptx, err := tx.prepared.begin()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := ptx.lockContext()
+	defer cancel()
+	for i := len(p.recs) - 1; i >= 0; i-- {
+		r := *p.recs[i]
+		r.TxNum = ptx.txNum
+		rec, err := r.marshalBytes()
+		if err != nil {
+			return nil, err
+		}
+		_, err = m.lm.appendLog(rec)
+		if err != nil {
+			return nil, err
+		}
+		if r.Op == opDropFile || r.Op == opTruncateFile {
+			for _, blkNum := range []int{-1, fileLockBlkNum} {
+				err := ptx.cm.xLock(ctx, NewBlockID(r.FileName, blkNum).Hash)
+				if err != nil {
+					return nil, err
+				}
+			}
+			*ptx.fileOps = append(*ptx.fileOps, &r)
+			continue
+		}
+		if r.Op == opChange {
+			ptx.rm.changesLogged = true
+			continue
+		}
+		err = ptx.cm.xLock(ctx, NewBlockID(r.FileName, r.BlkNum).Hash)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = tx.prepared.add(p.gid, ptx)
+	if err != nil {
+		return nil, err
+	}
+	err = ptx.prepare(p.gid)
+	if err != nil {
+		tx.prepared.remove(p.gid)
+		return nil, err
+	}
+	return ptx, nil
+}
+
+func isSetOperator(op operator) bool {
+	return op == opSetInt64 || op == opSetUint64 || op == opSetString || op == opSetBytes || op == opSetHintBytes
+}
+
 func (m *recoveryManager) undo(tx *Transaction, rec *logRecord) error {
-	if rec.Op != opSetInt64 && rec.Op != opSetUint64 && rec.Op != opSetString {
+	if !isSetOperator(rec.Op) {
+		return nil
+	}
+
+	// A backup may lack blocks that an uncommitted transaction allocated.
+	c, err := tx.fm.blockCount(rec.FileName)
+	if err != nil {
+		return err
+	}
+	if rec.BlkNum >= c {
 		return nil
 	}
 
 	blk := NewBlockID(rec.FileName, rec.BlkNum)
 
-	err := tx.Pin(blk)
+	err = tx.Pin(blk)
 	if err != nil {
 		return err
 	}
@@ -241,6 +494,10 @@ func (m *recoveryManager) undo(tx *Transaction, rec *logRecord) error {
 		err = tx.WriteUint64(blk.Hash, rec.Offset, rec.Val.(uint64), false)
 	case opSetString:
 		err = tx.WriteString(blk.Hash, rec.Offset, rec.Val.(string), false)
+	case opSetBytes:
+		err = tx.restoreBytes(blk.Hash, rec.Offset, rec.Val.([]byte))
+	case opSetHintBytes:
+		err = tx.restoreHintBytes(blk.Hash, rec.Offset, rec.Val.([]byte))
 	}
 	if err != nil {
 		return err
@@ -254,48 +511,120 @@ func (m *recoveryManager) undo(tx *Transaction, rec *logRecord) error {
 	return nil
 }
 
+// redo writes an after-image, extending the file when it lacks the block.
+func (m *recoveryManager) redo(tx *Transaction, rec *logRecord) error {
+	for {
+		c, err := tx.fm.blockCount(rec.FileName)
+		if err != nil {
+			return err
+		}
+		if rec.BlkNum < c {
+			break
+		}
+		_, err = tx.AllocBlock(rec.FileName)
+		if err != nil {
+			return err
+		}
+	}
+
+	blk := NewBlockID(rec.FileName, rec.BlkNum)
+
+	err := tx.Pin(blk)
+	if err != nil {
+		return err
+	}
+	err = tx.restoreBytes(blk.Hash, rec.Offset, rec.Val.([]byte))
+	if err != nil {
+		return err
+	}
+	return tx.Unpin(blk)
+}
+
+func (m *recoveryManager) dropFile(fileName string) (*logRecord, error) {
+	r := newDropFileLogRecord(m.txNum, fileName)
+	rec, err := r.marshalBytes()
+	if err != nil {
+		return nil, err
+	}
+	_, err = m.lm.appendLog(rec)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (m *recoveryManager) truncateFile(fileName string, blkCount int) (*logRecord, error) {
+	r := newTruncateFileLogRecord(m.txNum, fileName, blkCount)
+	rec, err := r.marshalBytes()
+	if err != nil {
+		return nil, err
+	}
+	_, err = m.lm.appendLog(rec)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
 func (m *recoveryManager) writeInt64(buf *buffer, offset int, val int64) (logSeqNum, error) {
-	oldVal, _, err := buf.contents.readInt64(offset)
+	return m.writeBytes(buf, offset, m.enc.Int64Size())
+}
+
+func (m *recoveryManager) writeUint64(buf *buffer, offset int, val uint64) (logSeqNum, error) {
+	return m.writeBytes(buf, offset, m.enc.Uint64Size())
+}
+
+func (m *recoveryManager) writeString(buf *buffer, offset int, val string) (logSeqNum, error) {
+	return m.writeBytes(buf, offset, m.enc.StringSize(len(val)))
+}
+
+// logRecordMargin covers the varint lengths that grow with the bytes a log record holds.
+const logRecordMargin = 2 * binary.MaxVarintLen64
+
+func (m *recoveryManager) maxImageSize(fileName string) (int, error) {
+	maxInt := int(^uint(0) >> 1)
+	empty, err := newSetBytesLogRecord(transactionNum(maxInt), NewBlockID(fileName, maxInt), maxInt, []byte{}).marshalBytes()
 	if err != nil {
-		if errors.Is(err, errPageNoData) {
-			return lsnNil, nil
-		} else {
-			return lsnNil, fmt.Errorf("failed to read the current contents: %w", err)
-		}
+		return 0, err
 	}
-	rec, err := newSetInt64LogRecord(m.txNum, buf.blk, offset, oldVal).marshalBytes()
+	return m.lm.maxRecordSize() - len(empty) - logRecordMargin, nil
+}
+
+func (m *recoveryManager) writeBytes(buf *buffer, offset int, size int) (logSeqNum, error) {
+	img, err := buf.contents.readRaw(offset, size)
+	if err != nil {
+		return lsnNil, fmt.Errorf("failed to read the current contents: %w", err)
+	}
+	rec, err := newSetBytesLogRecord(m.txNum, buf.blk, offset, img).marshalBytes()
 	if err != nil {
 		return lsnNil, err
 	}
 	return m.lm.appendLog(rec)
 }
 
-func (m *recoveryManager) writeUint64(buf *buffer, offset int, val uint64) (logSeqNum, error) {
-	oldVal, _, err := buf.contents.readUint64(offset)
+func (m *recoveryManager) writeHintBytes(buf *buffer, offset int, size int) (logSeqNum, error) {
+	img, err := buf.contents.readRaw(offset, size)
 	if err != nil {
-		if errors.Is(err, errPageNoData) {
-			return lsnNil, nil
-		} else {
-			return lsnNil, fmt.Errorf("failed to read the current contents: %w", err)
-		}
+		return lsnNil, fmt.Errorf("failed to read the current contents: %w", err)
 	}
-	rec, err := newSetUint64LogRecord(m.txNum, buf.blk, offset, oldVal).marshalBytes()
+	rec, err := newSetHintBytesLogRecord(m.txNum, buf.blk, offset, img).marshalBytes()
 	if err != nil {
 		return lsnNil, err
 	}
 	return m.lm.appendLog(rec)
 }
 
-func (m *recoveryManager) writeString(buf *buffer, offset int, val string) (logSeqNum, error) {
-	oldVal, _, err := buf.contents.readString(offset)
+// writeAfterImage writes an after-image only while the log is archived or a backup is made, and returns lsnNil
+// otherwise.
+func (m *recoveryManager) writeAfterImage(buf *buffer, offset int, size int) (logSeqNum, error) {
+	if (!m.lm.archiving() && !m.lm.backingUp()) || IsTempFile(buf.blk.fileName) {
+		return lsnNil, nil
+	}
+	img, err := buf.contents.readRaw(offset, size)
 	if err != nil {
-		if errors.Is(err, errPageNoData) {
-			return lsnNil, nil
-		} else {
-			return lsnNil, fmt.Errorf("failed to read the current contents: %w", err)
-		}
+		return lsnNil, fmt.Errorf("failed to read the current contents: %w", err)
 	}
-	rec, err := newSetStringLogRecord(m.txNum, buf.blk, offset, oldVal).marshalBytes()
+	rec, err := newRedoBytesLogRecord(m.txNum, buf.blk, offset, img).marshalBytes()
 	if err != nil {
 		return lsnNil, err
 	}
@@ -0,0 +1,198 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Replica is a read-only standby of a database. A replica starts from a backup of the database and keeps replaying
+// the log the database archives, so it follows the modifications of the database. The archive directory is
+// the transport between them; the database must archive its log with StorageConfig.ArchiveDirPath.
+//
+// A replica replays each transaction of the database in a transaction of its own, so transactions reading
+// the replica see only committed modifications. A replica doesn't survive a restart; make a new backup to start
+// a replica again.
+type Replica struct {
+	st *Storage
+	r  *replayer
+
+	archiveDirPath string
+	logFileName    string
+	blkSize        int
+	cipher         *blockCipher
+
+	// blkNum is the archived log block the replica reads, and applied is the number of log records in the block
+	// the replica has replayed.
+	blkNum  int
+	applied int
+
+	cancel    context.CancelFunc
+	done      chan struct{}
+	err       error
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// StartReplica starts a replica in `config.DirPath`, which holds a backup that Storage.Backup made. The replica
+// replays the log records already in `archiveDirPath` and then checks the archive for new records every `interval`.
+// `config.ArchiveDirPath` is ignored.
+func StartReplica(ctx context.Context, config *StorageConfig, archiveDirPath string, interval time.Duration) (*Replica, error) {
+	if interval <= 0 {
+		return nil, fmt.Errorf("an interval must be >0: %v", interval)
+	}
+	c := *config
+	c.ArchiveDirPath = ""
+	config = &c
+	logFileName := filepath.Base(config.LogFileName)
+
+	label, err := readBackupLabel(config.DirPath)
+	if err != nil {
+		return nil, err
+	}
+	cipher, err := newBlockCipherFromConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	blks, err := readArchivedLogBlocks(config.BlkSize, cipher, config.DirPath, logFileName, archiveDirPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read an archived log: %w", err)
+	}
+	var recs []*logRecord
+	var lastRecs []*logRecord
+	for _, b := range blks {
+		rs, err := parseLogBlock(b)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read an archived log: %w", err)
+		}
+		recs = append(recs, rs...)
+		lastRecs = rs
+	}
+	from, _, err := findReplayStart(recs, label)
+	if err != nil {
+		return nil, err
+	}
+
+	err = RestoreBackup(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	st, err := InitStorage(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	rctx, cancel := context.WithCancel(ctx)
+	rep := &Replica{
+		st:             st,
+		r:              newReplayer(rctx, st),
+		archiveDirPath: archiveDirPath,
+		logFileName:    logFileName,
+		blkSize:        config.BlkSize,
+		cipher:         cipher,
+		blkNum:         len(blks) - 1,
+		applied:        len(lastRecs),
+		cancel:         cancel,
+		done:           make(chan struct{}),
+	}
+	for _, rec := range recs[from:] {
+		err := rep.r.apply(rec)
+		if err != nil {
+			cancel()
+			rep.r.undoUnfinished()
+			st.Close()
+			return nil, fmt.Errorf("failed to replay a log: %w", err)
+		}
+	}
+
+	go func() {
+		defer close(rep.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-rctx.Done():
+				return
+			case <-ticker.C:
+				err := rep.catchUp()
+				if err != nil {
+					if rctx.Err() != nil {
+						return
+					}
+					rep.err = fmt.Errorf("failed to replay a log: %w", err)
+					st.ev.replicationFailed(rep.err)
+					return
+				}
+			}
+		}
+	}()
+
+	return rep, nil
+}
+
+// catchUp replays the log records that the database has archived since the last call.
+func (r *Replica) catchUp() error {
+	for {
+		// We check the next block before reading the current one. When the next block exists, the current one is
+		// complete, so we can move on after replaying it.
+		_, err := os.Stat(filepath.Join(r.archiveDirPath, archiveSegmentName(r.logFileName, r.blkNum+1)))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		complete := err == nil
+
+		b, err := readArchivedLogBlock(r.blkSize, r.cipher, r.archiveDirPath, r.logFileName, r.blkNum)
+		if err != nil {
+			return err
+		}
+		if b == nil {
+			return nil
+		}
+		recs, err := parseLogBlock(b)
+		if err != nil {
+			return err
+		}
+		for _, rec := range recs[r.applied:] {
+			err := r.r.apply(rec)
+			if err != nil {
+				return err
+			}
+			r.applied++
+		}
+		if !complete {
+			return nil
+		}
+		r.blkNum++
+		r.applied = 0
+	}
+}
+
+// NewReadOnlyTransaction begins a read-only transaction on the replica. See Storage.NewReadOnlyTransaction.
+func (r *Replica) NewReadOnlyTransaction(ctx context.Context, opts ...TransactionOption) (*Transaction, error) {
+	return r.st.NewReadOnlyTransaction(ctx, opts...)
+}
+
+// Close stops replaying and closes the storage of the replica. Close undoes the modifications of transactions that
+// the database hasn't finished yet, so the replica holds only committed modifications. When an error stopped
+// replaying, Close returns the error. Transactions reading the replica must finish before calling this function.
+func (r *Replica) Close() error {
+	r.closeOnce.Do(func() {
+		r.cancel()
+		<-r.done
+		err := r.r.undoUnfinished()
+		if err != nil {
+			r.st.Close()
+			r.closeErr = err
+			return
+		}
+		err = r.st.Close()
+		if err != nil {
+			r.closeErr = err
+			return
+		}
+		r.closeErr = r.err
+	})
+	return r.closeErr
+}
@@ -0,0 +1,328 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReplica(t *testing.T) {
+	testDir, err := MakeTestDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+
+	dbDir := filepath.Join(testDir, "db")
+	err = os.Mkdir(dbDir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logFilePath, err := MakeTestLogFile(dbDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logFileName := filepath.Base(logFilePath)
+	dbFilePath, err := MakeTestTableFile(dbDir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbFileName := filepath.Base(dbFilePath)
+	archiveDir := filepath.Join(testDir, "archive")
+	replicaDir := filepath.Join(testDir, "replica")
+
+	ctx := context.Background()
+	primaryConfig := TestConfig(&StorageConfig{
+		DirPath:        dbDir,
+		LogFileName:    logFileName,
+		BlkSize:        400,
+		BufSize:        10,
+		ArchiveDirPath: archiveDir,
+	})
+	primary, err := InitStorage(ctx, primaryConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		primary.Close()
+	}()
+
+	const blkCount = 4
+	write := func(tx *Transaction, blkNum int, v int64) error {
+		blk := NewBlockID(dbFileName, blkNum)
+		err := tx.Pin(blk)
+		if err != nil {
+			return err
+		}
+		err = tx.WriteInt64(blk.Hash, 0, v, true)
+		if err != nil {
+			return err
+		}
+		return tx.Unpin(blk)
+	}
+	{
+		tx, err := primary.NewTransaction(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tx.Recover()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < blkCount; i++ {
+			_, err := tx.AllocBlock(dbFileName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = write(tx, i, 100)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = tx.Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = primary.Backup(replicaDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replica, err := StartReplica(ctx, TestConfig(&StorageConfig{
+		DirPath:     replicaDir,
+		LogFileName: logFileName,
+		BlkSize:     400,
+		BufSize:     10,
+	}), archiveDir, 2*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replica.Close()
+
+	readReplica := func(blkNum int, opts ...TransactionOption) (int64, error) {
+		tx, err := replica.NewReadOnlyTransaction(ctx, opts...)
+		if err != nil {
+			return 0, err
+		}
+		defer tx.Commit()
+		blk := NewBlockID(dbFileName, blkNum)
+		err = tx.Pin(blk)
+		if err != nil {
+			return 0, err
+		}
+		return tx.ReadInt64(blk.Hash, 0)
+	}
+	waitForReplica := func(t *testing.T, want map[int]int64) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			converged := true
+			for blkNum, w := range want {
+				v, err := readReplica(blkNum, WithLockTimeout(10*time.Millisecond))
+				if err != nil && !errors.Is(err, ErrLockWaitTimeout) {
+					t.Fatal(err)
+				}
+				if err != nil || v != w {
+					converged = false
+					break
+				}
+			}
+			if converged {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("a replica didn't converge: want: %v", want)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	t.Run("a replica converges with a primary", func(t *testing.T) {
+		var wg sync.WaitGroup
+		errs := make(chan error, blkCount)
+		for i := 0; i < blkCount; i++ {
+			wg.Add(1)
+			go func(blkNum int) {
+				defer wg.Done()
+				for j := 1; j <= 10; j++ {
+					tx, err := primary.NewTransaction(ctx)
+					if err != nil {
+						errs <- err
+						return
+					}
+					err = write(tx, blkNum, int64(blkNum*1000+j))
+					if err != nil {
+						tx.Rollback()
+						errs <- err
+						return
+					}
+					// Rolled-back modifications must not reach the replica.
+					if j%3 == 0 {
+						err = tx.Rollback()
+					} else {
+						err = tx.Commit()
+					}
+					if err != nil {
+						errs <- err
+						return
+					}
+				}
+			}(i)
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Fatal(err)
+		}
+
+		want := map[int]int64{}
+		for i := 0; i < blkCount; i++ {
+			want[i] = int64(i*1000 + 10)
+		}
+		waitForReplica(t, want)
+	})
+
+	t.Run("a replica doesn't show uncommitted modifications", func(t *testing.T) {
+		tx1, err := primary.NewTransaction(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = write(tx1, 0, 999)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Committing tx2 writes the log records of tx1 out to the archive as well.
+		tx2, err := primary.NewTransaction(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = write(tx2, 1, 888)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tx2.Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+		waitForReplica(t, map[int]int64{1: 888})
+
+		_, err = readReplica(0, WithLockTimeout(20*time.Millisecond))
+		if !errors.Is(err, ErrLockWaitTimeout) {
+			t.Fatalf("expected error didn't occur: want: %v, got: %v", ErrLockWaitTimeout, err)
+		}
+		v, err := readReplica(0, WithReadUncommitted())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != 999 {
+			t.Fatalf("unexpected uncommitted value: want: %v, got: %v", 999, v)
+		}
+
+		err = tx1.Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+		waitForReplica(t, map[int]int64{0: 999})
+	})
+
+	t.Run("a replica keeps a prepared transaction across a restart of a primary", func(t *testing.T) {
+		tx, err := primary.NewTransaction(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = write(tx, 2, 777)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tx.Prepare("gid-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = primary.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		primary, err = InitStorage(ctx, primaryConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		{
+			tx, err := primary.NewTransaction(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = tx.Recover()
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = tx.Commit()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		{
+			tx, err := primary.NewTransaction(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = write(tx, 3, 333)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = tx.Commit()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		waitForReplica(t, map[int]int64{3: 333})
+
+		_, err = readReplica(2, WithLockTimeout(20*time.Millisecond))
+		if !errors.Is(err, ErrLockWaitTimeout) {
+			t.Fatalf("expected error didn't occur: want: %v, got: %v", ErrLockWaitTimeout, err)
+		}
+		v, err := readReplica(2, WithReadUncommitted())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != 777 {
+			t.Fatalf("unexpected uncommitted value: want: %v, got: %v", 777, v)
+		}
+
+		ptx, ok := primary.PreparedTransaction("gid-1")
+		if !ok {
+			t.Fatal("a prepared transaction was not found")
+		}
+		err = ptx.CommitPrepared()
+		if err != nil {
+			t.Fatal(err)
+		}
+		waitForReplica(t, map[int]int64{2: 777})
+	})
+
+	t.Run("a replica is read-only", func(t *testing.T) {
+		tx, err := replica.NewReadOnlyTransaction(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tx.Commit()
+		blk := NewBlockID(dbFileName, 0)
+		err = tx.Pin(blk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tx.WriteInt64(blk.Hash, 0, 1, true)
+		if !errors.Is(err, ErrReadOnlyTransaction) {
+			t.Fatalf("expected error didn't occur: want: %v, got: %v", ErrReadOnlyTransaction, err)
+		}
+	})
+
+	err = replica.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+)
+
+// BufferRing is a small set of buffers that a bulk operation, such as a full scan of a large table, reuses in turn.
+// Blocks the operation reads evict only the blocks in the ring, so the operation doesn't push frequently used blocks,
+// such as catalog blocks, out of the pool. A block already in the pool is used as it is and doesn't join the ring.
+//
+// A ring belongs to one transaction and must not be used by multiple goroutines at the same time.
+type BufferRing struct {
+	size int
+	bufs []ringBuffer
+	next int
+}
+
+// ringBuffer is a buffer of a ring and the block the ring assigned to it last.
+type ringBuffer struct {
+	buf *buffer
+	blk *BlockID
+}
+
+// NewBufferRing returns a ring of `size` buffers. The ring takes buffers from the pool when it needs them.
+func NewBufferRing(size int) (*BufferRing, error) {
+	if size <= 0 {
+		return nil, fmt.Errorf("the size of a buffer ring must be >=1: %v", size)
+	}
+	return &BufferRing{
+		size: size,
+	}, nil
+}
+
+// choose returns a buffer to assign `blk` to. The caller must lock the buffer manager. The ring reuses its buffers
+// in turn. While the ring has fewer buffers than its size, or when the next buffer is pinned, the ring takes
+// an unpinned buffer from the pool instead. The pool may have assigned the next buffer to another block since
+// the ring used it, and then the buffer no longer belongs to the ring, so the ring replaces it with a buffer from
+// the pool as well.
+func (r *BufferRing) choose(m *bufferManager, blk *BlockID) *buffer {
+	if len(r.bufs) == r.size {
+		rb := r.bufs[r.next]
+		if rb.buf.blk != nil && rb.buf.blk.Hash == rb.blk.Hash && !m.pinned(rb.buf) {
+			r.bufs[r.next].blk = blk
+			r.next = (r.next + 1) % r.size
+			return rb.buf
+		}
+	}
+
+	buf := m.chooseUnpinnedBuffer()
+	if buf == nil {
+		return nil
+	}
+	for i, rb := range r.bufs {
+		if rb.buf == buf {
+			r.bufs[i].blk = blk
+			return buf
+		}
+	}
+	rb := ringBuffer{
+		buf: buf,
+		blk: blk,
+	}
+	if len(r.bufs) < r.size {
+		r.bufs = append(r.bufs, rb)
+	} else {
+		r.bufs[r.next] = rb
+		r.next = (r.next + 1) % r.size
+	}
+	return buf
+}
+
+// PinInRing works like Pin, but when `blk` isn't in the pool, PinInRing reads it into a buffer of `ring`. When `ring`
+// is nil, PinInRing is the same as Pin.
+func (t *Transaction) PinInRing(blk *BlockID, ring *BufferRing) error {
+	err := t.lockFile(blk.fileName)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := t.pinContext()
+	defer cancel()
+	return t.bl.pinInRing(ctx, blk, ring)
+}
+
+func (l *bufferList) pinInRing(ctx context.Context, blk *BlockID, ring *BufferRing) error {
+	buf, err := l.bm.pinInRing(ctx, blk, ring)
+	if err != nil {
+		return err
+	}
+	l.add(blk, buf)
+	return nil
+}
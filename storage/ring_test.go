@@ -0,0 +1,189 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBufferManager_pinInRing(t *testing.T) {
+	testDir, err := MakeTestDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+
+	fm, lm, err := newTestFileManagerAndLogManager(testDir, 400)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dbFileName string
+	{
+		dbFilePath, err := MakeTestTableFile(testDir, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		dbFileName = filepath.Base(dbFilePath)
+	}
+	var blks []*BlockID
+	for i := 0; i < 10; i++ {
+		blk, err := fm.alloc(dbFileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blks = append(blks, blk)
+	}
+	bm, err := newBufferManager(fm, lm, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	// The first two blocks stand for blocks that many transactions use, such as catalog blocks.
+	hot := blks[:2]
+	{
+		var bufs []*buffer
+		for _, blk := range hot {
+			buf, err := bm.pin(ctx, blk)
+			if err != nil {
+				t.Fatal(err)
+			}
+			bufs = append(bufs, buf)
+		}
+		for _, buf := range bufs {
+			err := bm.unpin(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	ring, err := NewBufferRing(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, blk := range blks[2:] {
+		buf, err := bm.pinInRing(ctx, blk, ring)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = bm.unpin(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, blk := range hot {
+		if bm.findAssignedBuffer(blk) == nil {
+			t.Fatalf("a block used before the scan must stay in the pool: block: %v", blk.BlkNum)
+		}
+	}
+	scanned := 0
+	for _, blk := range blks[2:] {
+		if bm.findAssignedBuffer(blk) != nil {
+			scanned++
+		}
+	}
+	if scanned != 2 {
+		t.Fatalf("unexpected number of buffers the scan used: want: %v, got: %v", 2, scanned)
+	}
+
+	t.Run("a pinned buffer in a ring isn't reused", func(t *testing.T) {
+		ring, err := NewBufferRing(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf1, err := bm.pinInRing(ctx, blks[0], ring)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// blks[0] is already in the pool, so it doesn't join the ring.
+		if len(ring.bufs) != 0 {
+			t.Fatalf("a block in the pool must not join a ring: %v", len(ring.bufs))
+		}
+		buf2, err := bm.pinInRing(ctx, blks[9], ring)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf3, err := bm.pinInRing(ctx, blks[8], ring)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buf3 == buf2 || buf3 == buf1 {
+			t.Fatal("a pinned buffer must not be reused")
+		}
+		for _, buf := range []*buffer{buf1, buf2, buf3} {
+			err := bm.unpin(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+
+	t.Run("a ring doesn't reuse a buffer that the pool assigned to another block", func(t *testing.T) {
+		bm, err := newBufferManager(fm, lm, 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ring, err := NewBufferRing(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pin := func(t *testing.T, blk *BlockID) *buffer {
+			t.Helper()
+			buf, err := bm.pin(ctx, blk)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return buf
+		}
+		unpin := func(t *testing.T, bufs ...*buffer) {
+			t.Helper()
+			for _, buf := range bufs {
+				err := bm.unpin(buf)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+
+		ringBuf, err := bm.pinInRing(ctx, blks[2], ring)
+		if err != nil {
+			t.Fatal(err)
+		}
+		unpin(t, ringBuf)
+		// The pool evicts the block of the ring and assigns the buffer to blks[3] because the other buffers are
+		// pinned.
+		pinned := []*buffer{pin(t, blks[0]), pin(t, blks[1]), pin(t, blks[9])}
+		buf := pin(t, blks[3])
+		if buf != ringBuf {
+			t.Fatal("the pool must assign the buffer of the ring to another block")
+		}
+		unpin(t, buf)
+		unpin(t, pinned...)
+		// A free buffer lets the ring take a buffer from the pool without evicting blks[3].
+		err = bm.discard(dbFileName, 9, func() error {
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		buf, err = bm.pinInRing(ctx, blks[4], ring)
+		if err != nil {
+			t.Fatal(err)
+		}
+		unpin(t, buf)
+		if buf == ringBuf || bm.findAssignedBuffer(blks[3]) == nil {
+			t.Fatal("a ring must not evict a block that the pool assigned to its buffer")
+		}
+	})
+
+	t.Run("a ring must have at least one buffer", func(t *testing.T) {
+		_, err := NewBufferRing(0)
+		if err == nil {
+			t.Fatal("NewBufferRing must fail")
+		}
+	})
+}
@@ -0,0 +1,252 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Stats is a snapshot of the counters and the gauges of a storage. Counters, such as BufferStats.Hits, count events
+// since the storage was initialized.
+type Stats struct {
+	Buffer BufferStats
+	File   FileStats
+	Log    LogStats
+	Lock   LockStats
+}
+
+type BufferStats struct {
+	// Size is the number of buffers in the pool.
+	Size int
+
+	// Available is the number of unpinned buffers.
+	Available int
+
+	// Hits is the number of pins that found their blocks in the pool.
+	Hits uint64
+
+	// Misses is the number of pins that read their blocks from disks.
+	Misses uint64
+
+	// Evictions is the number of blocks evicted from the pool.
+	Evictions uint64
+
+	// PinWaits is the number of times pins waited because all buffers were pinned.
+	PinWaits uint64
+
+	// PinTimeouts is the number of pins that failed with ErrBufferPoolExhausted.
+	PinTimeouts uint64
+
+	// BackgroundWrites is the number of buffers the background writer wrote out to a disk.
+	BackgroundWrites uint64
+
+	// ReadAheads is the number of blocks read ahead into the pool.
+	ReadAheads uint64
+
+	// ReadAheadHits is the number of hits on blocks read ahead.
+	ReadAheadHits uint64
+}
+
+// HitRatio returns the ratio of hits to all pins. When no pin happened, HitRatio returns 0.
+func (s *BufferStats) HitRatio() float64 {
+	total := s.Hits + s.Misses
+	if total == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(total)
+}
+
+type FileStats struct {
+	// OpenFiles is the number of files the file manager keeps open.
+	OpenFiles int
+
+	BlocksRead      uint64
+	BlocksWritten   uint64
+	BlocksAllocated uint64
+}
+
+type LogStats struct {
+	// Appends is the number of log records appended to the log.
+	Appends uint64
+
+	// AppendedBytes is the number of bytes of the log records appended to the log.
+	AppendedBytes uint64
+
+	// Flushes is the number of times the log manager wrote its log page to a disk.
+	Flushes uint64
+
+	// LatestLSN is the log sequence number of the latest log record.
+	LatestLSN int
+
+	// LastSavedLSN is the log sequence number of the latest log record written to a disk.
+	LastSavedLSN int
+}
+
+type LockStats struct {
+	// Entries is the number of blocks that have locks.
+	Entries int
+
+	SharedAcquired    uint64
+	ExclusiveAcquired uint64
+
+	// Waits is the number of lock requests that had to wait.
+	Waits uint64
+
+	// Timeouts is the number of lock requests that failed with ErrLockWaitTimeout.
+	Timeouts uint64
+
+	// WaitTime is the total time lock requests waited.
+	WaitTime time.Duration
+}
+
+// Stats returns a snapshot of the counters and the gauges.
+func (s *Storage) Stats() *Stats {
+	st := &Stats{}
+	s.bm.readStats(&st.Buffer)
+	s.fm.readStats(&st.File)
+	s.lm.readStats(&st.Log)
+	s.lockTab.readStats(&st.Lock)
+	return st
+}
+
+func (m *bufferManager) readStats(s *BufferStats) {
+	s.Size = len(m.pool)
+	s.Available = m.availableBufferCount()
+	s.Hits = atomic.LoadUint64(&m.stats.hits)
+	s.Misses = atomic.LoadUint64(&m.stats.misses)
+	s.Evictions = atomic.LoadUint64(&m.stats.evictions)
+	s.PinWaits = atomic.LoadUint64(&m.stats.pinWaits)
+	s.PinTimeouts = atomic.LoadUint64(&m.stats.pinTimeouts)
+	s.BackgroundWrites = atomic.LoadUint64(&m.stats.backgroundWrites)
+	s.ReadAheads = atomic.LoadUint64(&m.stats.readAheads)
+	s.ReadAheadHits = atomic.LoadUint64(&m.stats.readAheadHits)
+}
+
+// The counters are updated atomically, so each manager holds them in its first field, which is 64-bit aligned even on
+// 32-bit platforms.
+type bufferCounters struct {
+	hits        uint64
+	misses      uint64
+	evictions   uint64
+	pinWaits    uint64
+	pinTimeouts uint64
+
+	backgroundWrites uint64
+	readAheads       uint64
+	readAheadHits    uint64
+}
+
+func (m *fileManager) readStats(s *FileStats) {
+	m.mu.Lock()
+	s.OpenFiles = len(m.openFiles) + len(m.compressedFiles)
+	m.mu.Unlock()
+	s.BlocksRead = atomic.LoadUint64(&m.stats.blocksRead)
+	s.BlocksWritten = atomic.LoadUint64(&m.stats.blocksWritten)
+	s.BlocksAllocated = atomic.LoadUint64(&m.stats.blocksAllocated)
+}
+
+type fileCounters struct {
+	blocksRead      uint64
+	blocksWritten   uint64
+	blocksAllocated uint64
+}
+
+func (m *logManager) readStats(s *LogStats) {
+	m.mu.Lock()
+	s.LatestLSN = int(m.latestLSN)
+	s.LastSavedLSN = int(m.lastSavedLSN)
+	m.mu.Unlock()
+	s.Appends = atomic.LoadUint64(&m.stats.appends)
+	s.AppendedBytes = atomic.LoadUint64(&m.stats.appendedBytes)
+	s.Flushes = atomic.LoadUint64(&m.stats.flushes)
+}
+
+type logCounters struct {
+	appends       uint64
+	appendedBytes uint64
+	flushes       uint64
+}
+
+func (t *lockTable) readStats(s *LockStats) {
+	t.locks.Range(func(_, _ interface{}) bool {
+		s.Entries++
+		return true
+	})
+	s.SharedAcquired = atomic.LoadUint64(&t.stats.sharedAcquired)
+	s.ExclusiveAcquired = atomic.LoadUint64(&t.stats.exclusiveAcquired)
+	s.Waits = atomic.LoadUint64(&t.stats.waits)
+	s.Timeouts = atomic.LoadUint64(&t.stats.timeouts)
+	s.WaitTime = time.Duration(atomic.LoadInt64(&t.stats.waitTime))
+}
+
+type lockCounters struct {
+	sharedAcquired    uint64
+	exclusiveAcquired uint64
+	waits             uint64
+	timeouts          uint64
+	waitTime          int64
+}
+
+type promMetric struct {
+	name  string
+	help  string
+	ty    string
+	value interface{}
+}
+
+// WritePrometheus writes the stats in the Prometheus text exposition format.
+func (s *Stats) WritePrometheus(w io.Writer) error {
+	metrics := []*promMetric{
+		{"simpledb_buffer_pool_size", "Number of buffers in the pool.", "gauge", s.Buffer.Size},
+		{"simpledb_buffer_pool_available", "Number of unpinned buffers.", "gauge", s.Buffer.Available},
+		{"simpledb_buffer_hits_total", "Number of pins that found their blocks in the pool.", "counter", s.Buffer.Hits},
+		{"simpledb_buffer_misses_total", "Number of pins that read their blocks from disks.", "counter", s.Buffer.Misses},
+		{"simpledb_buffer_hit_ratio", "Ratio of hits to all pins.", "gauge", s.Buffer.HitRatio()},
+		{"simpledb_buffer_evictions_total", "Number of blocks evicted from the pool.", "counter", s.Buffer.Evictions},
+		{"simpledb_buffer_pin_waits_total", "Number of times pins waited for an unpinned buffer.", "counter", s.Buffer.PinWaits},
+		{"simpledb_buffer_pin_timeouts_total", "Number of pins that failed because the pool was exhausted.", "counter", s.Buffer.PinTimeouts},
+		{"simpledb_buffer_background_writes_total", "Number of buffers the background writer wrote out.", "counter", s.Buffer.BackgroundWrites},
+		{"simpledb_buffer_read_aheads_total", "Number of blocks read ahead.", "counter", s.Buffer.ReadAheads},
+		{"simpledb_buffer_read_ahead_hits_total", "Number of hits on blocks read ahead.", "counter", s.Buffer.ReadAheadHits},
+		{"simpledb_file_open_files", "Number of open files.", "gauge", s.File.OpenFiles},
+		{"simpledb_file_blocks_read_total", "Number of blocks read from disks.", "counter", s.File.BlocksRead},
+		{"simpledb_file_blocks_written_total", "Number of blocks written to disks.", "counter", s.File.BlocksWritten},
+		{"simpledb_file_blocks_allocated_total", "Number of blocks allocated.", "counter", s.File.BlocksAllocated},
+		{"simpledb_log_appends_total", "Number of log records appended.", "counter", s.Log.Appends},
+		{"simpledb_log_appended_bytes_total", "Number of bytes of log records appended.", "counter", s.Log.AppendedBytes},
+		{"simpledb_log_flushes_total", "Number of times the log page was written to a disk.", "counter", s.Log.Flushes},
+		{"simpledb_log_latest_lsn", "Log sequence number of the latest log record.", "gauge", s.Log.LatestLSN},
+		{"simpledb_log_last_saved_lsn", "Log sequence number of the latest log record written to a disk.", "gauge", s.Log.LastSavedLSN},
+		{"simpledb_lock_entries", "Number of blocks that have locks.", "gauge", s.Lock.Entries},
+		{"simpledb_lock_shared_acquired_total", "Number of shared locks acquired.", "counter", s.Lock.SharedAcquired},
+		{"simpledb_lock_exclusive_acquired_total", "Number of exclusive locks acquired.", "counter", s.Lock.ExclusiveAcquired},
+		{"simpledb_lock_waits_total", "Number of lock requests that had to wait.", "counter", s.Lock.Waits},
+		{"simpledb_lock_timeouts_total", "Number of lock requests that timed out.", "counter", s.Lock.Timeouts},
+		{"simpledb_lock_wait_seconds_total", "Total time lock requests waited.", "counter", s.Lock.WaitTime.Seconds()},
+	}
+	for _, m := range metrics {
+		_, err := fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v %v\n%v %v\n", m.name, m.help, m.name, m.ty, m.name, m.value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MetricsHandler returns an HTTP handler that serves the stats of the storage in the Prometheus text exposition
+// format.
+func (s *Storage) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var b bytes.Buffer
+		err := s.Stats().WritePrometheus(&b)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		b.WriteTo(w)
+	})
+}
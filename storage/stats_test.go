@@ -0,0 +1,145 @@
+package storage
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStorage_Stats(t *testing.T) {
+	testDir, err := MakeTestDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+
+	logFilePath, err := MakeTestLogFile(testDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbFilePath, err := MakeTestTableFile(testDir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbFileName := filepath.Base(dbFilePath)
+
+	st, err := InitStorage(context.Background(), TestConfig(&StorageConfig{
+		DirPath:     testDir,
+		LogFileName: filepath.Base(logFilePath),
+		BlkSize:     400,
+		BufSize:     2,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx1, err := st.NewTransaction(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var blks []*BlockID
+	for i := 0; i < 3; i++ {
+		blk, err := tx1.AllocBlock(dbFileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blks = append(blks, blk)
+	}
+	for _, blk := range blks {
+		err := tx1.Pin(blk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tx1.WriteInt64(blk.Hash, 0, 100, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Pinning the same block again is a hit.
+		err = tx1.Pin(blk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tx1.Unpin(blk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tx1.Unpin(blk)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tx2, err := st.NewTransaction(context.Background(), WithLockTimeout(10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tx2.ReadInt64(blks[0].Hash, 0)
+	if err == nil {
+		t.Fatal("a read must time out because tx1 holds an exclusive lock")
+	}
+	err = tx2.Rollback()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx1.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats := st.Stats()
+	if stats.Buffer.Size != 2 || stats.Buffer.Available != 2 {
+		t.Fatalf("unexpected buffer gauges: %+v", stats.Buffer)
+	}
+	if stats.Buffer.Hits != 3 || stats.Buffer.Misses != 3 {
+		t.Fatalf("unexpected hits and misses: %+v", stats.Buffer)
+	}
+	if r := stats.Buffer.HitRatio(); r != 0.5 {
+		t.Fatalf("unexpected hit ratio: want: %v, got: %v", 0.5, r)
+	}
+	// A pool having two buffers must evict a block to hold three blocks.
+	if stats.Buffer.Evictions == 0 {
+		t.Fatalf("unexpected evictions: %+v", stats.Buffer)
+	}
+	if stats.File.BlocksAllocated < 3 || stats.File.BlocksRead < 3 || stats.File.BlocksWritten < 3 {
+		t.Fatalf("unexpected file stats: %+v", stats.File)
+	}
+	if stats.Log.Appends == 0 || stats.Log.Flushes == 0 || stats.Log.LatestLSN != stats.Log.LastSavedLSN {
+		t.Fatalf("unexpected log stats: %+v", stats.Log)
+	}
+	if stats.Lock.ExclusiveAcquired == 0 || stats.Lock.Waits != 1 || stats.Lock.Timeouts != 1 || stats.Lock.WaitTime <= 0 {
+		t.Fatalf("unexpected lock stats: %+v", stats.Lock)
+	}
+
+	t.Run("the metrics handler serves stats in the Prometheus text format", func(t *testing.T) {
+		srv := httptest.NewServer(st.MetricsHandler())
+		defer srv.Close()
+		res, err := srv.Client().Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body := string(b)
+		if !strings.HasPrefix(res.Header.Get("Content-Type"), "text/plain") {
+			t.Fatalf("unexpected content type: %v", res.Header.Get("Content-Type"))
+		}
+		for _, l := range []string{
+			"# TYPE simpledb_buffer_hits_total counter\nsimpledb_buffer_hits_total 3\n",
+			"# TYPE simpledb_buffer_pool_size gauge\nsimpledb_buffer_pool_size 2\n",
+			"simpledb_buffer_hit_ratio 0.5\n",
+			"simpledb_lock_timeouts_total 1\n",
+		} {
+			if !strings.Contains(body, l) {
+				t.Fatalf("metrics must contain %q:\n%v", l, body)
+			}
+		}
+	})
+}
@@ -2,7 +2,11 @@ package storage
 
 import (
 	"context"
+	"fmt"
+	"os"
 	"path/filepath"
+	"sync"
+	"time"
 )
 
 type StorageConfig struct {
@@ -10,6 +14,58 @@ type StorageConfig struct {
 	LogFileName string
 	BlkSize     int
 	BufSize     int
+
+	// Encoding is the encoding a new database uses. When this field is zero, the database uses DefaultEncoding.
+	// An existing database keeps the encoding it was created with.
+	Encoding Encoding
+
+	// Logger receives log messages. When this field is nil, the storage doesn't write any log message.
+	Logger Logger
+
+	// Hooks receives events, such as committing transactions and evicting buffers.
+	Hooks Hooks
+
+	// WriterInterval is the interval at which a background writer writes modified, unpinned buffers out to a disk.
+	// When this field is zero, the storage runs no background writer, and a buffer is written only when it is
+	// evicted or its transaction commits.
+	WriterInterval time.Duration
+
+	// WriterMaxPages is the maximum number of buffers the background writer writes in a round. When this field is
+	// zero, the writer writes all modified, unpinned buffers.
+	WriterMaxPages int
+
+	// ReadAhead is the number of blocks the storage reads ahead when a transaction calls Transaction.ReadAhead.
+	// When this field is zero, the storage doesn't read ahead.
+	ReadAhead int
+
+	// ArchiveDirPath is the directory where the storage archives its log. While the storage archives the log,
+	// transactions also write after-images of their modifications to the log, and RecoverBackupToTime can roll
+	// a backup forward with the archive. When this field is empty, the storage doesn't archive the log.
+	ArchiveDirPath string
+	// EncryptionKey is the key encrypting the blocks of the table files and the log with AES-GCM. The key must be
+	// 16, 24, or 32 bytes to select AES-128, AES-192, or AES-256. Reading a block that was modified outside
+	// the storage fails with ErrBlockAuthenticationFailed. A database must always be opened with the key it was
+	// created with, and backups and archived logs are encrypted with the same key. The database directory records
+	// a check value of the key, and opening the database with another key fails with ErrEncryptionKeyMismatch.
+	// When this field is empty, the storage doesn't encrypt files.
+	EncryptionKey []byte
+
+	// CompressTables makes the storage compress the blocks of new table files. A compressed file stores each block
+	// in an extent as small as its compressed contents, and a page map beside the file locates the extents. Reads
+	// through the buffer manager don't change. Existing files keep the format they were created with, whatever this
+	// field is.
+	CompressTables bool
+
+	// Tablespaces maps the names of tablespaces to the directories holding their files, so tables can be placed
+	// on different disks. A file in a tablespace is named with TablespaceFileName. A tablespace that this field
+	// doesn't list is the subdirectory of DirPath having the name of the tablespace; a backup holds tablespaces
+	// that way, so it opens without this field.
+	Tablespaces map[string]string
+
+	// ReadOnly opens an existing database without modifying it. The storage creates, modifies, and removes no file,
+	// and it begins only read-only transactions. InitStorage fails when the directory isn't a database, such as when
+	// the log doesn't exist.
+	ReadOnly bool
 }
 
 type Storage struct {
@@ -19,10 +75,42 @@ type Storage struct {
 	lm      *logManager
 	bm      *bufferManager
 	lockTab *lockTable
+	enc     Encoding
+
+	// prepared holds the prepared transactions that haven't finished.
+	prepared *preparedTable
+	ev       *eventDispatcher
+
+	// cancel stops the goroutines of the storage. writerDone and readAheadDone are closed when the background
+	// writer and the read-ahead worker stop, and they are nil when the storage doesn't run the goroutines.
+	cancel        context.CancelFunc
+	writerDone    <-chan struct{}
+	readAheadDone <-chan struct{}
+	closeOnce     sync.Once
+	closeErr      error
 }
 
 func InitStorage(ctx context.Context, config *StorageConfig) (*Storage, error) {
-	fm, err := newFileManager(config.DirPath, config.BlkSize)
+	var fm *fileManager
+	var err error
+	if config.ReadOnly {
+		fm, err = newReadOnlyFileManager(config.DirPath, config.BlkSize, config.EncryptionKey)
+	} else {
+		fm, err = newFileManager(config.DirPath, config.BlkSize, config.EncryptionKey)
+	}
+	if err != nil {
+		return nil, err
+	}
+	fm.compressTables = config.CompressTables
+	err = fm.setTablespaces(config.Tablespaces)
+	if err != nil {
+		return nil, err
+	}
+	err = loadEncryption(config.DirPath, config.EncryptionKey, config.ReadOnly)
+	if err != nil {
+		return nil, err
+	}
+	enc, err := loadEncoding(config.DirPath, config.Encoding, config.ReadOnly)
 	if err != nil {
 		return nil, err
 	}
@@ -30,22 +118,110 @@ func InitStorage(ctx context.Context, config *StorageConfig) (*Storage, error) {
 	if err != nil {
 		return nil, err
 	}
+	// A read-only storage appends no log record, so it has nothing to archive.
+	if config.ArchiveDirPath != "" && !config.ReadOnly {
+		err := os.MkdirAll(config.ArchiveDirPath, 0700)
+		if err != nil {
+			return nil, err
+		}
+		lm.archiveDirPath = config.ArchiveDirPath
+	}
 	bm, err := newBufferManager(fm, lm, config.BufSize)
 	if err != nil {
 		return nil, err
 	}
+	ev := newEventDispatcher(config.Logger, config.Hooks)
+	bm.ev = ev
+
+	ctx, cancel := context.WithCancel(ctx)
+	var writerDone <-chan struct{}
+	if config.WriterInterval > 0 {
+		writerDone = runBackgroundWriter(ctx, bm, config.WriterInterval, config.WriterMaxPages)
+	}
+	var readAheadDone <-chan struct{}
+	if config.ReadAhead > 0 {
+		readAheadDone = runReadAhead(ctx, bm, config.ReadAhead)
+	}
+
+	s := &Storage{
+		ctx:           ctx,
+		txNumCh:       runTransactionNumIssuer(ctx),
+		fm:            fm,
+		lm:            lm,
+		bm:            bm,
+		lockTab:       newLockTable(),
+		enc:           enc,
+		ev:            ev,
+		cancel:        cancel,
+		writerDone:    writerDone,
+		readAheadDone: readAheadDone,
+	}
+	s.prepared = newPreparedTable(func() (*Transaction, error) {
+		return s.NewTransaction(s.ctx)
+	})
+	return s, nil
+}
+
+func newBlockCipherFromConfig(config *StorageConfig) (*blockCipher, error) {
+	return newBlockCipher(config.EncryptionKey)
+}
+
+// Close stops the background writer, the read-ahead worker, and the other goroutines of the storage, writes the log
+// out to a disk, and closes the files. Transactions must finish before calling this function, and the storage cannot
+// begin transactions after that. Calling Close more than once returns the result of the first call.
+func (s *Storage) Close() error {
+	s.closeOnce.Do(func() {
+		s.cancel()
+		if s.writerDone != nil {
+			<-s.writerDone
+		}
+		if s.readAheadDone != nil {
+			<-s.readAheadDone
+		}
+		err := s.lm.flushAll()
+		if err != nil {
+			s.closeErr = err
+			return
+		}
+		s.closeErr = s.fm.closeAll()
+	})
+	return s.closeErr
+}
+
+// NewTransaction begins a transaction. The transaction uses `ctx` for all calls; when `ctx` is canceled or
+// its deadline is exceeded, calls waiting for a lock or a buffer return an error.
+func (s *Storage) NewTransaction(ctx context.Context, opts ...TransactionOption) (*Transaction, error) {
+	// The issuer may have buffered transaction numbers, so we check the storage itself first.
+	if s.ctx.Err() != nil {
+		return nil, fmt.Errorf("storage is closed: %w", s.ctx.Err())
+	}
+	var txNum transactionNum
+	select {
+	case n, ok := <-s.txNumCh:
+		if !ok {
+			return nil, fmt.Errorf("storage is closed: %w", s.ctx.Err())
+		}
+		txNum = n
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	tx, err := newTransaction(ctx, txNum, s.fm, s.lm, s.bm, s.lockTab, s.enc, s.ev, opts...)
+	if err != nil {
+		return nil, err
+	}
+	tx.prepared = s.prepared
+	return tx, nil
+}
 
-	return &Storage{
-		ctx:     ctx,
-		txNumCh: runTransactionNumIssuer(ctx),
-		fm:      fm,
-		lm:      lm,
-		bm:      bm,
-		lockTab: newLockTable(),
-	}, nil
+// NewReadOnlyTransaction begins a transaction that only reads a database. The transaction writes no log record
+// when it begins and ends, and its methods modifying a database, such as WriteInt64 and AllocBlock, return
+// ErrReadOnlyTransaction. The transaction still acquires shared locks on blocks unless `opts` contains
+// WithReadUncommitted.
+func (s *Storage) NewReadOnlyTransaction(ctx context.Context, opts ...TransactionOption) (*Transaction, error) {
+	return s.NewTransaction(ctx, append([]TransactionOption{withReadOnly()}, opts...)...)
 }
 
-func (s *Storage) NewTransaction() (*Transaction, error) {
-	txNum := <-s.txNumCh
-	return newTransaction(s.ctx, txNum, s.fm, s.lm, s.bm, s.lockTab)
+// Encoding returns the encoding the database uses.
+func (s *Storage) Encoding() Encoding {
+	return s.enc
 }
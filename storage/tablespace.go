@@ -0,0 +1,145 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// DefaultTablespace is the name of the tablespace whose directory is StorageConfig.DirPath. The log and the files
+// that don't specify a tablespace are in the default tablespace.
+const DefaultTablespace = ""
+
+// tablespaceSeparator separates the name of a tablespace from the name of a file in the tablespace.
+const tablespaceSeparator = "/"
+
+// TablespaceFileName returns the name identifying a file `fileName` in a tablespace. Transactions and the file
+// manager accept the name wherever they accept the name of a file, and the file manager resolves the directory of
+// the file through the tablespace.
+func TablespaceFileName(tablespace string, fileName string) string {
+	if tablespace == DefaultTablespace {
+		return fileName
+	}
+	return tablespace + tablespaceSeparator + fileName
+}
+
+// splitTablespaceFileName splits a name that TablespaceFileName returns into the name of a tablespace and the name
+// of a file.
+func splitTablespaceFileName(fileName string) (string, string) {
+	i := strings.Index(fileName, tablespaceSeparator)
+	if i < 0 {
+		return DefaultTablespace, fileName
+	}
+	return fileName[:i], fileName[i+len(tablespaceSeparator):]
+}
+
+// ValidateTablespaceName returns an error when `name` cannot be the name of a tablespace. A name must be a valid
+// name of a directory, because a tablespace that a config doesn't list is a subdirectory of the database directory.
+func ValidateTablespaceName(name string) error {
+	if name == DefaultTablespace {
+		return nil
+	}
+	if name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("invalid tablespace name: %v", name)
+	}
+	return nil
+}
+
+// setTablespaces makes the file manager store the files of the tablespaces in their directories. The directories
+// are created if they don't exist, except that a read-only file manager requires them to exist.
+func (m *fileManager) setTablespaces(tablespaces map[string]string) error {
+	m.tablespaces = map[string]string{}
+	for name, dirPath := range tablespaces {
+		if name == DefaultTablespace {
+			return fmt.Errorf("the default tablespace cannot have another directory: %v", dirPath)
+		}
+		err := ValidateTablespaceName(name)
+		if err != nil {
+			return err
+		}
+		if m.readOnly {
+			s, err := os.Stat(dirPath)
+			if err != nil {
+				return err
+			}
+			if !s.IsDir() {
+				return fmt.Errorf("not a directory: %v", dirPath)
+			}
+			m.tablespaces[name] = dirPath
+			continue
+		}
+		err = os.MkdirAll(dirPath, 0700)
+		if err != nil {
+			return err
+		}
+		err = removeTempFiles(dirPath)
+		if err != nil {
+			return err
+		}
+		m.tablespaces[name] = dirPath
+	}
+	return nil
+}
+
+// tablespaceNames returns the names of the tablespaces the file manager knows other than the default tablespace,
+// in ascending order.
+func (m *fileManager) tablespaceNames() []string {
+	names := make([]string, 0, len(m.tablespaces))
+	for name := range m.tablespaces {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// tablespaceDir returns the directory of a tablespace. The directory of a tablespace that the file manager doesn't
+// know is the subdirectory of the database directory having the name of the tablespace. That's how a backup holds
+// tablespaces, so a backup opens without listing them.
+func (m *fileManager) tablespaceDir(tablespace string) string {
+	if tablespace == DefaultTablespace {
+		return m.dirPath
+	}
+	if dirPath, ok := m.tablespaces[tablespace]; ok {
+		return dirPath
+	}
+	return filepath.Join(m.dirPath, tablespace)
+}
+
+// path returns the path of a file that a name TablespaceFileName returns identifies.
+func (m *fileManager) path(fileName string) string {
+	tablespace, name := splitTablespaceFileName(fileName)
+	return filepath.Join(m.tablespaceDir(tablespace), name)
+}
+
+// makeDir creates the directory of a file when the file is in a tablespace that doesn't have the directory yet.
+func (m *fileManager) makeDir(fileName string) error {
+	tablespace, _ := splitTablespaceFileName(fileName)
+	if tablespace == DefaultTablespace {
+		return nil
+	}
+	err := ValidateTablespaceName(tablespace)
+	if err != nil {
+		return err
+	}
+	return os.MkdirAll(m.tablespaceDir(tablespace), 0700)
+}
+
+// removeTempFiles removes the temporary files that a previous run left in a directory.
+func removeTempFiles(dirPath string) error {
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name(), TempFilePrefix) {
+			continue
+		}
+		err := os.Remove(filepath.Join(dirPath, e.Name()))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
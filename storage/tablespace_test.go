@@ -0,0 +1,140 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStorage_tablespaces(t *testing.T) {
+	testDir, err := MakeTestDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+
+	logFilePath, err := MakeTestLogFile(testDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logFileName := filepath.Base(logFilePath)
+	fastDir := filepath.Join(testDir, "fast_disk")
+	fileName := TablespaceFileName("fast", "hot.tbl")
+
+	ctx := context.Background()
+	open := func(t *testing.T, dirPath string, tablespaces map[string]string) *Storage {
+		t.Helper()
+		st, err := InitStorage(ctx, TestConfig(&StorageConfig{
+			DirPath:     dirPath,
+			LogFileName: logFileName,
+			BlkSize:     400,
+			BufSize:     10,
+			Tablespaces: tablespaces,
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return st
+	}
+	expectValue := func(t *testing.T, st *Storage, want string) {
+		t.Helper()
+		tx, err := st.NewReadOnlyTransaction(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tx.Commit()
+		blk := NewBlockID(fileName, 0)
+		err = tx.Pin(blk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, err := tx.ReadString(blk.Hash, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != want {
+			t.Fatalf("unexpected value: want: %v, got: %v", want, v)
+		}
+	}
+
+	st := open(t, testDir, map[string]string{
+		"fast": fastDir,
+	})
+	defer st.Close()
+	{
+		tx, err := st.NewTransaction(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blk, err := tx.AllocBlock(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tx.Pin(blk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tx.WriteString(blk.Hash, 0, "hello", true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tx.Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("a file in a tablespace is in the directory of the tablespace", func(t *testing.T) {
+		_, err := os.Stat(filepath.Join(fastDir, "hot.tbl"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = os.Stat(filepath.Join(testDir, "hot.tbl"))
+		if !os.IsNotExist(err) {
+			t.Fatal("a file in a tablespace must not be in the database directory")
+		}
+		expectValue(t, st, "hello")
+	})
+
+	t.Run("a backup holds a tablespace in a subdirectory and opens without listing it", func(t *testing.T) {
+		backupDir := filepath.Join(testDir, "backup")
+		err := st.Backup(backupDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = os.Stat(filepath.Join(backupDir, "fast", "hot.tbl"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = RestoreBackup(ctx, TestConfig(&StorageConfig{
+			DirPath:     backupDir,
+			LogFileName: logFileName,
+			BlkSize:     400,
+			BufSize:     10,
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		bst := open(t, backupDir, nil)
+		defer bst.Close()
+		expectValue(t, bst, "hello")
+	})
+
+	t.Run("a tablespace must have a valid name", func(t *testing.T) {
+		for _, name := range []string{".", "..", "a/b", `a\b`} {
+			_, err := InitStorage(ctx, TestConfig(&StorageConfig{
+				DirPath:     testDir,
+				LogFileName: logFileName,
+				BlkSize:     400,
+				BufSize:     10,
+				Tablespaces: map[string]string{
+					name: fastDir,
+				},
+			}))
+			if err == nil {
+				t.Fatalf("an invalid tablespace name must be rejected: %v", name)
+			}
+		}
+	})
+}
@@ -0,0 +1,64 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+)
+
+// TempFilePrefix is the prefix of the names of temporary files. A storage removes the temporary files that
+// a previous run left when it opens a database, and a backup doesn't copy them.
+const TempFilePrefix = "tmp_"
+
+// IsTempFile reports whether a file is temporary. Temporary files are always in the default tablespace.
+func IsTempFile(fileName string) bool {
+	ts, name := splitTablespaceFileName(fileName)
+	return ts == DefaultTablespace && strings.HasPrefix(name, TempFilePrefix)
+}
+
+// newTempName returns a name starting with TempFilePrefix that no other call in this run returns. The temporary
+// files of a previous run are gone by the time the file manager opens, so the name doesn't collide with them either.
+func (m *fileManager) newTempName() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tempSeq++
+	return fmt.Sprintf("%v%v", TempFilePrefix, m.tempSeq)
+}
+
+// NewTempName returns a unique name for temporary files. Files whose names start with the name are temporary; use
+// RegisterTempFile to remove them when the transaction ends.
+func (t *Transaction) NewTempName() string {
+	return t.fm.newTempName()
+}
+
+// RegisterTempFile makes the transaction remove a temporary file when it ends, whether it commits or rolls back.
+// The file doesn't have to exist yet.
+//
+// A transaction doesn't log the modifications of temporary files, and committing doesn't write them out to a disk,
+// because nothing reads the files after the transaction ends. A crash leaves the files behind, and the next run
+// removes them.
+func (t *Transaction) RegisterTempFile(fileName string) error {
+	if t.opts.readOnly {
+		return fmt.Errorf("failed to register a temporary file: %w", ErrReadOnlyTransaction)
+	}
+	if !IsTempFile(fileName) {
+		return fmt.Errorf("not a temporary file: %v", fileName)
+	}
+	*t.tempFiles = append(*t.tempFiles, fileName)
+	return nil
+}
+
+// dropTempFiles removes the temporary files registered with RegisterTempFile. The caller must unpin the buffers
+// of the transaction beforehand.
+func (t *Transaction) dropTempFiles() error {
+	fileNames := *t.tempFiles
+	*t.tempFiles = nil
+	for _, fileName := range fileNames {
+		err := t.bm.discard(fileName, 0, func() error {
+			return t.fm.remove(fileName)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
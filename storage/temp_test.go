@@ -0,0 +1,135 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTransaction_tempFiles(t *testing.T) {
+	testDir, err := MakeTestDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+
+	logFilePath, err := MakeTestLogFile(testDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	st, err := InitStorage(ctx, TestConfig(&StorageConfig{
+		DirPath:     testDir,
+		LogFileName: filepath.Base(logFilePath),
+		BlkSize:     400,
+		BufSize:     10,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	// writeTempFile writes a value to a new temporary file and returns the name of the file.
+	writeTempFile := func(t *testing.T, tx *Transaction) string {
+		t.Helper()
+		fileName := tx.NewTempName() + ".tbl"
+		err := tx.RegisterTempFile(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blk, err := tx.AllocBlock(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tx.Pin(blk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tx.WriteString(blk.Hash, 0, "temporary", true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, err := tx.ReadString(blk.Hash, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != "temporary" {
+			t.Fatalf("unexpected value: want: %v, got: %v", "temporary", v)
+		}
+		_, err = os.Stat(filepath.Join(testDir, fileName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fileName
+	}
+	expectRemoved := func(t *testing.T, fileName string) {
+		t.Helper()
+		_, err := os.Stat(filepath.Join(testDir, fileName))
+		if !os.IsNotExist(err) {
+			t.Fatalf("a temporary file must be removed: %v", fileName)
+		}
+	}
+
+	t.Run("committing removes temporary files without logging their modifications", func(t *testing.T) {
+		tx, err := st.NewTransaction(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fileName := writeTempFile(t, tx)
+		err = tx.Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectRemoved(t, fileName)
+
+		dumps, err := st.InspectLog()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, d := range dumps {
+			if strings.HasPrefix(d.FileName, TempFilePrefix) {
+				t.Fatalf("a modification of a temporary file must not be logged: %+v", d)
+			}
+		}
+	})
+
+	t.Run("rolling back removes temporary files", func(t *testing.T) {
+		tx, err := st.NewTransaction(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fileName := writeTempFile(t, tx)
+		err = tx.Rollback()
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectRemoved(t, fileName)
+	})
+
+	t.Run("temporary names are unique", func(t *testing.T) {
+		tx, err := st.NewTransaction(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tx.Commit()
+		if tx.NewTempName() == tx.NewTempName() {
+			t.Fatal("temporary names must be unique")
+		}
+	})
+
+	t.Run("only a temporary file can be registered", func(t *testing.T) {
+		tx, err := st.NewTransaction(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tx.Commit()
+		for _, fileName := range []string{"customers.tbl", TablespaceFileName("fast", "tmp_1.tbl")} {
+			err := tx.RegisterTempFile(fileName)
+			if err == nil {
+				t.Fatalf("a file must be rejected: %v", fileName)
+			}
+		}
+	})
+}
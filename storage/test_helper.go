@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"encoding/hex"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -39,3 +40,41 @@ func MakeTestTableFile(dirPath string, tableName string) (string, error) {
 	}
 	return tabFilePath, nil
 }
+
+// TestEncryptionKeyEnv is the environment variable that runs tests with encryption enabled. When the variable holds
+// a hex-encoded key, TestConfig makes storages whose StorageConfig.EncryptionKey is empty encrypt their files with
+// the key.
+const TestEncryptionKeyEnv = "SIMPLEDB_TEST_ENCRYPTION_KEY"
+
+// TestCompressionEnv is the environment variable that runs tests with compression enabled. When the variable is
+// set to a non-empty value, TestConfig makes storages compress new table files as StorageConfig.CompressTables does.
+const TestCompressionEnv = "SIMPLEDB_TEST_COMPRESSION"
+
+// TestConfig applies TestEncryptionKeyEnv and TestCompressionEnv to a config of a test and returns the config.
+// Tests build their configs with this function so that the whole test suite runs with the features enabled. It
+// panics when TestEncryptionKeyEnv doesn't hold a hex-encoded key.
+func TestConfig(config *StorageConfig) *StorageConfig {
+	key, err := testEncryptionKey()
+	if err != nil {
+		panic(err)
+	}
+	if len(config.EncryptionKey) == 0 {
+		config.EncryptionKey = key
+	}
+	if os.Getenv(TestCompressionEnv) != "" {
+		config.CompressTables = true
+	}
+	return config
+}
+
+func testEncryptionKey() ([]byte, error) {
+	v := os.Getenv(TestEncryptionKeyEnv)
+	if v == "" {
+		return nil, nil
+	}
+	key, err := hex.DecodeString(v)
+	if err != nil {
+		return nil, fmt.Errorf("%v must hold a hex-encoded key: %w", TestEncryptionKeyEnv, err)
+	}
+	return key, nil
+}
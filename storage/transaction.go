@@ -2,10 +2,15 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+var ErrReadOnlyTransaction = errors.New("a read-only transaction cannot modify a database")
+
 func runTransactionNumIssuer(ctx context.Context) <-chan transactionNum {
 	c := make(chan transactionNum, 1000)
 
@@ -26,6 +31,52 @@ func runTransactionNumIssuer(ctx context.Context) <-chan transactionNum {
 	return c
 }
 
+const (
+	defaultLockTimeout = 10 * time.Second
+	defaultPinTimeout  = 10 * time.Second
+)
+
+type transactionOptions struct {
+	lockTimeout     time.Duration
+	pinTimeout      time.Duration
+	readOnly        bool
+	readUncommitted bool
+}
+
+type TransactionOption func(o *transactionOptions)
+
+// WithLockTimeout sets how long a transaction waits for a lock. When the timeout is zero or negative,
+// the transaction waits until its context is done.
+func WithLockTimeout(d time.Duration) TransactionOption {
+	return func(o *transactionOptions) {
+		o.lockTimeout = d
+	}
+}
+
+// WithPinTimeout sets how long a transaction waits for a buffer to become available. When the timeout is zero or
+// negative, the transaction waits until its context is done.
+func WithPinTimeout(d time.Duration) TransactionOption {
+	return func(o *transactionOptions) {
+		o.pinTimeout = d
+	}
+}
+
+// WithReadUncommitted makes a read-only transaction read blocks without shared locks. The transaction never waits
+// for writers, but it may see modifications that other transactions haven't committed yet (dirty reads). It still
+// locks the files it pins, so it waits for a transaction dropping or truncating a file. Transactions that can modify
+// a database ignore this option.
+func WithReadUncommitted() TransactionOption {
+	return func(o *transactionOptions) {
+		o.readUncommitted = true
+	}
+}
+
+func withReadOnly() TransactionOption {
+	return func(o *transactionOptions) {
+		o.readOnly = true
+	}
+}
+
 type Transaction struct {
 	ctx   context.Context
 	txNum transactionNum
@@ -34,83 +85,303 @@ type Transaction struct {
 	bl    *bufferList
 	fm    *fileManager
 	bm    *bufferManager
+	enc   Encoding
+	opts  *transactionOptions
+	ev    *eventDispatcher
+
+	// began is the time when the transaction began.
+	began time.Time
+
+	// fileOps holds file operations, such as dropping a file, that are deferred until the transaction commits.
+	// Copies made by WithContext share the list.
+	fileOps *[]*logRecord
+
+	// onEnd holds the functions called when the transaction ends. Copies made by WithContext share the list.
+	onEnd *[]func(committed bool)
+
+	// tempFiles holds the temporary files removed when the transaction ends. Copies made by WithContext share
+	// the list.
+	tempFiles *[]string
+
+	// gid is the global ID of the transaction once it is prepared, and it is empty otherwise. Copies made by
+	// WithContext share it.
+	gid *string
+
+	// changes holds the listeners of the change records of the storage.
+	changes *ChangeListeners
+
+	// pendingOps holds the file operations of committed transactions that failed to be applied.
+	pendingOps *pendingFileOperations
+
+	// prepared holds the prepared transactions of the storage. It is nil when the transaction didn't begin through
+	// a storage, and then the transaction cannot be prepared.
+	prepared *preparedTable
 }
 
-func newTransaction(ctx context.Context, txNum transactionNum, fm *fileManager, lm *logManager, bm *bufferManager, lockTab *lockTable) (*Transaction, error) {
-	rm, err := newRecoveryManager(lm, bm, txNum)
-	if err != nil {
-		return nil, err
+func newTransaction(ctx context.Context, txNum transactionNum, fm *fileManager, lm *logManager, bm *bufferManager, lockTab *lockTable, enc Encoding, ev *eventDispatcher, opts ...TransactionOption) (*Transaction, error) {
+	o := &transactionOptions{
+		lockTimeout: defaultLockTimeout,
+		pinTimeout:  defaultPinTimeout,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if !o.readOnly {
+		o.readUncommitted = false
+		if fm.readOnly {
+			return nil, fmt.Errorf("failed to begin a transaction: %w", ErrReadOnlyStorage)
+		}
 	}
 
-	fmt.Printf("transaction #%v started\n", txNum)
+	began := time.Now()
+	// A read-only transaction has nothing to undo, so it doesn't need a recovery manager writing log records.
+	var rm *recoveryManager
+	if !o.readOnly {
+		var err error
+		rm, err = newRecoveryManager(lm, bm, txNum, enc)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ev.transactionBegan(&TransactionEvent{
+		TxNum: int(txNum),
+	})
 
 	return &Transaction{
-		ctx:   ctx,
-		txNum: txNum,
-		cm:    newConcurrencyManager(lockTab),
-		rm:    rm,
-		bl:    newBufferList(bm),
-		fm:    fm,
-		bm:    bm,
+		ctx:        ctx,
+		txNum:      txNum,
+		cm:         newConcurrencyManager(lockTab, txNum, ev),
+		rm:         rm,
+		bl:         newBufferList(bm),
+		fm:         fm,
+		bm:         bm,
+		enc:        enc,
+		opts:       o,
+		ev:         ev,
+		began:      began,
+		fileOps:    &[]*logRecord{},
+		onEnd:      &[]func(committed bool){},
+		tempFiles:  &[]string{},
+		gid:        new(string),
+		changes:    lm.changes,
+		pendingOps: lm.pendingOps,
 	}, nil
 }
 
+// WithContext returns a copy of the transaction that uses `ctx` instead of the context of the transaction.
+// The copy shares the state, such as locks and pinned buffers, with the original, so calls through the copy
+// are part of the same transaction. Use this function to give a deadline to individual calls.
+func (t *Transaction) WithContext(ctx context.Context) *Transaction {
+	c := *t
+	c.ctx = ctx
+	return &c
+}
+
+// lockContext returns a context that limits a wait for a lock.
+func (t *Transaction) lockContext() (context.Context, context.CancelFunc) {
+	if t.opts.lockTimeout <= 0 {
+		return context.WithCancel(t.ctx)
+	}
+	return context.WithTimeout(t.ctx, t.opts.lockTimeout)
+}
+
+// pinContext returns a context that limits a wait for a buffer.
+func (t *Transaction) pinContext() (context.Context, context.CancelFunc) {
+	if t.opts.pinTimeout <= 0 {
+		return context.WithCancel(t.ctx)
+	}
+	return context.WithTimeout(t.ctx, t.opts.pinTimeout)
+}
+
+// TxNum returns the number of the transaction. Numbers are unique among the transactions running in a storage,
+// but they restart whenever the storage opens.
+func (t *Transaction) TxNum() int {
+	return int(t.txNum)
+}
+
+// OnEnd registers a function `f` called when the transaction ends. When the transaction commits, f is called after
+// the commit record has reached a disk, so the modifications of the transaction survive a crash by then. f is
+// called with false when the transaction rolls back. The functions are called in the order they were registered.
+func (t *Transaction) OnEnd(f func(committed bool)) {
+	*t.onEnd = append(*t.onEnd, f)
+}
+
+// end calls the functions registered with OnEnd.
+func (t *Transaction) end(committed bool) {
+	fs := *t.onEnd
+	*t.onEnd = nil
+	for _, f := range fs {
+		f(committed)
+	}
+}
+
+// ReadOnly reports whether the transaction is read-only.
+func (t *Transaction) ReadOnly() bool {
+	return t.opts.readOnly
+}
+
 func (t *Transaction) Commit() error {
-	err := t.rm.commit()
-	if err != nil {
-		return err
+	if *t.gid != "" {
+		return fmt.Errorf("failed to commit: %w", ErrTransactionPrepared)
 	}
-	t.cm.release()
-	err = t.bl.unpinAll()
-	if err != nil {
-		return err
+	return t.commit()
+}
+
+func (t *Transaction) commit() error {
+	start := time.Now()
+	if !t.opts.readOnly {
+		// The file operations are part of committing, so we hold the gate until they are applied.
+		t.rm.lm.endGate.RLock()
+		defer t.rm.lm.endGate.RUnlock()
+		err := t.rm.commit()
+		if err != nil {
+			return err
+		}
+		t.finishPrepared()
+	}
+	// Once the commit log record is written, the transaction has committed, so the following steps run to the end
+	// even if one of them fails, and the transaction always releases its locks. We return the first error.
+	err := t.bl.unpinAll()
+	// We apply file operations while holding locks so that other transactions cannot see the files
+	// in the middle of the operations.
+	t.applyFileOperations(*t.fileOps)
+	*t.fileOps = nil
+	tmpErr := t.dropTempFiles()
+	if tmpErr != nil && err == nil {
+		err = tmpErr
+	}
+	// We deliver the changes before releasing the locks, so the listeners see the transactions modifying the same
+	// data in the order they committed.
+	if t.rm != nil && t.rm.changesLogged {
+		payloads, chErr := t.rm.changes()
+		if chErr != nil && err == nil {
+			err = fmt.Errorf("failed to read change records: %w", chErr)
+		}
+		t.changes.notify(payloads)
 	}
+	t.cm.release()
+	t.end(true)
 
-	fmt.Printf("transaction #%v committed\n", t.txNum)
+	t.ev.transactionCommitted(&TransactionEvent{
+		TxNum:    int(t.txNum),
+		Duration: time.Since(start),
+		Elapsed:  time.Since(t.began),
+	})
 
-	return nil
+	return err
 }
 
+// Rollback undoes the modifications of the transaction. Rolling back must not be interrupted, so this function
+// ignores the cancellation of the context of the transaction. The timeouts still apply.
 func (t *Transaction) Rollback() error {
-	err := t.rm.rollback(t)
-	if err != nil {
-		return err
+	if *t.gid != "" {
+		return fmt.Errorf("failed to roll back: %w", ErrTransactionPrepared)
+	}
+	return t.rollback()
+}
+
+func (t *Transaction) rollback() error {
+	start := time.Now()
+	if !t.opts.readOnly {
+		t.rm.lm.endGate.RLock()
+		defer t.rm.lm.endGate.RUnlock()
+		err := t.rm.rollback(t.WithContext(context.Background()))
+		if err != nil {
+			return err
+		}
+		t.finishPrepared()
 	}
+	*t.fileOps = nil
 	t.cm.release()
-	err = t.bl.unpinAll()
-	if err != nil {
-		return err
+	// Like committing, rolling back runs to the end once the rollback log record is written.
+	err := t.bl.unpinAll()
+	tmpErr := t.dropTempFiles()
+	if tmpErr != nil && err == nil {
+		err = tmpErr
 	}
+	t.end(false)
 
-	fmt.Printf("transaction #%v rolled back\n", t.txNum)
+	t.ev.transactionRolledBack(&TransactionEvent{
+		TxNum:    int(t.txNum),
+		Duration: time.Since(start),
+		Elapsed:  time.Since(t.began),
+	})
 
-	return nil
+	return err
 }
 
+// Recover undoes the modifications of unfinished transactions and writes a checkpoint.
 func (t *Transaction) Recover() error {
+	if t.opts.readOnly {
+		return fmt.Errorf("failed to recover: %w", ErrReadOnlyTransaction)
+	}
+	start := time.Now()
+	t.rm.lm.endGate.RLock()
+	defer t.rm.lm.endGate.RUnlock()
+	// A checkpoint hides the file operations before it from later recoveries, so no file operation may stay pending.
+	for _, fileName := range t.pendingOps.fileNames() {
+		err := t.applyPendingFileOperations(fileName)
+		if err != nil {
+			return err
+		}
+	}
 	err := t.bm.flushAll(t.txNum)
 	if err != nil {
 		return err
 	}
-	err = t.rm.recover(t)
+	err = t.rm.recover(t.WithContext(context.Background()))
 	if err != nil {
 		return err
 	}
+	t.ev.checkpointed(&CheckpointEvent{
+		TxNum:    int(t.txNum),
+		Duration: time.Since(start),
+	})
 	return nil
 }
 
+// fileLockBlkNum is the number of a dummy block whose lock stands for a whole file. Pinning a block takes a shared
+// lock on the dummy block of its file, and dropping or truncating the file takes an exclusive one, so no other
+// transaction has the blocks of the file pinned when the transaction applies the file operation.
+const fileLockBlkNum = -2
+
+// lockFile takes a shared lock on a file. A transaction reading uncommitted data skips the locks on blocks, but not
+// this one.
+func (t *Transaction) lockFile(fileName string) error {
+	ctx, cancel := t.lockContext()
+	defer cancel()
+	err := t.cm.sLock(ctx, NewBlockID(fileName, fileLockBlkNum).Hash)
+	if err != nil {
+		return err
+	}
+	return t.applyPendingFileOperations(fileName)
+}
+
 func (t *Transaction) Pin(blk *BlockID) error {
-	return t.bl.pin(blk)
+	err := t.lockFile(blk.fileName)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := t.pinContext()
+	defer cancel()
+	return t.bl.pin(ctx, blk)
 }
 
 func (t *Transaction) Unpin(blk *BlockID) error {
 	return t.bl.unpin(blk)
 }
 
+// ReadAhead tells the storage that the transaction is going to read the blocks following `blk` in order. The storage
+// reads some of them into unpinned buffers, so that the transaction finds them in the pool when it pins them.
+// The blocks are read in the background unless the next block isn't in the pool yet; then ReadAhead reads them
+// before returning. When read-ahead is disabled, ReadAhead does nothing.
+func (t *Transaction) ReadAhead(blk *BlockID) {
+	t.bm.requestReadAhead(blk)
+}
+
 func (t *Transaction) ReadInt64(blk BlockIDHash, offset int) (int64, error) {
-	ctx, cancel := context.WithTimeout(t.ctx, 10*time.Second)
-	defer cancel()
-	err := t.cm.sLock(ctx, blk)
+	err := t.sLock(blk)
 	if err != nil {
 		return 0, err
 	}
@@ -118,14 +389,14 @@ func (t *Transaction) ReadInt64(blk BlockIDHash, offset int) (int64, error) {
 	if err != nil {
 		return 0, err
 	}
-	v, _, err := buf.contents.readInt64(offset)
+	buf.latch.RLock()
+	defer buf.latch.RUnlock()
+	v, _, err := t.enc.readInt64(buf.contents, offset)
 	return v, err
 }
 
 func (t *Transaction) ReadUint64(blk BlockIDHash, offset int) (uint64, error) {
-	ctx, cancel := context.WithTimeout(t.ctx, 10*time.Second)
-	defer cancel()
-	err := t.cm.sLock(ctx, blk)
+	err := t.sLock(blk)
 	if err != nil {
 		return 0, err
 	}
@@ -133,14 +404,14 @@ func (t *Transaction) ReadUint64(blk BlockIDHash, offset int) (uint64, error) {
 	if err != nil {
 		return 0, err
 	}
-	v, _, err := buf.contents.readUint64(offset)
+	buf.latch.RLock()
+	defer buf.latch.RUnlock()
+	v, _, err := t.enc.readUint64(buf.contents, offset)
 	return v, err
 }
 
 func (t *Transaction) ReadString(blk BlockIDHash, offset int) (string, error) {
-	ctx, cancel := context.WithTimeout(t.ctx, 10*time.Second)
-	defer cancel()
-	err := t.cm.sLock(ctx, blk)
+	err := t.sLock(blk)
 	if err != nil {
 		return "", err
 	}
@@ -148,12 +419,20 @@ func (t *Transaction) ReadString(blk BlockIDHash, offset int) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	v, _, err := buf.contents.readString(offset)
+	buf.latch.RLock()
+	defer buf.latch.RUnlock()
+	v, _, err := t.enc.readString(buf.contents, offset)
 	return v, err
 }
 
 func (t *Transaction) WriteInt64(blk BlockIDHash, offset int, val int64, log bool) error {
-	ctx, cancel := context.WithTimeout(t.ctx, 10*time.Second)
+	if t.opts.readOnly {
+		return fmt.Errorf("failed to write a value: %w", ErrReadOnlyTransaction)
+	}
+	if *t.gid != "" {
+		return fmt.Errorf("failed to write a value: %w", ErrTransactionPrepared)
+	}
+	ctx, cancel := t.lockContext()
 	defer cancel()
 	err := t.cm.xLock(ctx, blk)
 	if err != nil {
@@ -163,23 +442,43 @@ func (t *Transaction) WriteInt64(blk BlockIDHash, offset int, val int64, log boo
 	if err != nil {
 		return err
 	}
+	buf.latch.Lock()
+	defer buf.latch.Unlock()
 	lsn := lsnNil
-	if log {
+	if log && !IsTempFile(buf.blk.fileName) {
 		var err error
 		lsn, err = t.rm.writeInt64(buf, offset, val)
 		if err != nil {
 			return fmt.Errorf("failed to write a log: %w", err)
 		}
 	}
-	_, err = buf.contents.writeInt64(offset, val)
+	return t.writeInt64(buf, offset, val, lsn)
+}
+
+// writeInt64 writes a value to a latched buffer. `lsn` is the log record of the before-image.
+func (t *Transaction) writeInt64(buf *buffer, offset int, val int64, lsn logSeqNum) error {
+	n, err := t.enc.writeInt64(buf.contents, offset, val)
 	if err != nil {
 		return fmt.Errorf("failed to write contents: %w", err)
 	}
+	redoLSN, err := t.rm.writeAfterImage(buf, offset, n)
+	if err != nil {
+		return fmt.Errorf("failed to write a log: %w", err)
+	}
+	if redoLSN > lsn {
+		lsn = redoLSN
+	}
 	return buf.modify(t.txNum, lsn)
 }
 
 func (t *Transaction) WriteUint64(blk BlockIDHash, offset int, val uint64, log bool) error {
-	ctx, cancel := context.WithTimeout(t.ctx, 10*time.Second)
+	if t.opts.readOnly {
+		return fmt.Errorf("failed to write a value: %w", ErrReadOnlyTransaction)
+	}
+	if *t.gid != "" {
+		return fmt.Errorf("failed to write a value: %w", ErrTransactionPrepared)
+	}
+	ctx, cancel := t.lockContext()
 	defer cancel()
 	err := t.cm.xLock(ctx, blk)
 	if err != nil {
@@ -189,23 +488,38 @@ func (t *Transaction) WriteUint64(blk BlockIDHash, offset int, val uint64, log b
 	if err != nil {
 		return err
 	}
+	buf.latch.Lock()
+	defer buf.latch.Unlock()
 	lsn := lsnNil
-	if log {
+	if log && !IsTempFile(buf.blk.fileName) {
 		var err error
 		lsn, err = t.rm.writeUint64(buf, offset, val)
 		if err != nil {
 			return fmt.Errorf("failed to write a log: %w", err)
 		}
 	}
-	_, err = buf.contents.writeUint64(offset, val)
+	n, err := t.enc.writeUint64(buf.contents, offset, val)
 	if err != nil {
 		return fmt.Errorf("failed to write contents: %w", err)
 	}
+	redoLSN, err := t.rm.writeAfterImage(buf, offset, n)
+	if err != nil {
+		return fmt.Errorf("failed to write a log: %w", err)
+	}
+	if redoLSN > lsn {
+		lsn = redoLSN
+	}
 	return buf.modify(t.txNum, lsn)
 }
 
 func (t *Transaction) WriteString(blk BlockIDHash, offset int, val string, log bool) error {
-	ctx, cancel := context.WithTimeout(t.ctx, 10*time.Second)
+	if t.opts.readOnly {
+		return fmt.Errorf("failed to write a value: %w", ErrReadOnlyTransaction)
+	}
+	if *t.gid != "" {
+		return fmt.Errorf("failed to write a value: %w", ErrTransactionPrepared)
+	}
+	ctx, cancel := t.lockContext()
 	defer cancel()
 	err := t.cm.xLock(ctx, blk)
 	if err != nil {
@@ -215,48 +529,341 @@ func (t *Transaction) WriteString(blk BlockIDHash, offset int, val string, log b
 	if err != nil {
 		return err
 	}
+	buf.latch.Lock()
+	defer buf.latch.Unlock()
 	lsn := lsnNil
-	if log {
+	if log && !IsTempFile(buf.blk.fileName) {
 		var err error
 		lsn, err = t.rm.writeString(buf, offset, val)
 		if err != nil {
 			return fmt.Errorf("failed to write a log: %w", err)
 		}
 	}
-	_, err = buf.contents.writeString(offset, val)
+	n, err := t.enc.writeString(buf.contents, offset, val)
 	if err != nil {
 		return fmt.Errorf("failed to write contents: %w", err)
 	}
+	redoLSN, err := t.rm.writeAfterImage(buf, offset, n)
+	if err != nil {
+		return fmt.Errorf("failed to write a log: %w", err)
+	}
+	if redoLSN > lsn {
+		lsn = redoLSN
+	}
 	return buf.modify(t.txNum, lsn)
 }
 
+// ReadHintInt64 reads a value written by WriteHintInt64. It takes no lock; the latch of the buffer alone keeps
+// the value from being torn.
+func (t *Transaction) ReadHintInt64(blk BlockIDHash, offset int) (int64, error) {
+	buf, err := t.bl.blockToBuffer(blk)
+	if err != nil {
+		return 0, err
+	}
+	buf.latch.RLock()
+	defer buf.latch.RUnlock()
+	v, _, err := t.enc.readInt64(buf.contents, offset)
+	return v, err
+}
+
+// WriteHintInt64 writes a hint, such as an entry of a free space map, without a lock. The write is logged and
+// undone without a lock, so readers of a hint must tolerate a value that is later undone.
+func (t *Transaction) WriteHintInt64(blk BlockIDHash, offset int, val int64) error {
+	if t.opts.readOnly {
+		return fmt.Errorf("failed to write a value: %w", ErrReadOnlyTransaction)
+	}
+	if *t.gid != "" {
+		return fmt.Errorf("failed to write a value: %w", ErrTransactionPrepared)
+	}
+	buf, err := t.bl.blockToBuffer(blk)
+	if err != nil {
+		return err
+	}
+	buf.latch.Lock()
+	defer buf.latch.Unlock()
+	lsn := lsnNil
+	if !IsTempFile(buf.blk.fileName) {
+		lsn, err = t.rm.writeHintBytes(buf, offset, t.enc.Int64Size())
+		if err != nil {
+			return fmt.Errorf("failed to write a log: %w", err)
+		}
+	}
+	return t.writeInt64(buf, offset, val, lsn)
+}
+
+// HintBlockCount returns the number of blocks of a file holding hints without locking the size of the file.
+func (t *Transaction) HintBlockCount(fileName string) (int, error) {
+	err := t.lockFile(fileName)
+	if err != nil {
+		return 0, err
+	}
+	return t.fm.blockCount(fileName)
+}
+
+// AllocHintBlock appends a block to a file holding hints without locking the size of the file.
+func (t *Transaction) AllocHintBlock(fileName string) (*BlockID, error) {
+	if t.opts.readOnly {
+		return nil, fmt.Errorf("failed to allocate a block: %w", ErrReadOnlyTransaction)
+	}
+	if *t.gid != "" {
+		return nil, fmt.Errorf("failed to allocate a block: %w", ErrTransactionPrepared)
+	}
+	err := t.lockFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	return t.fm.alloc(fileName)
+}
+
+// sLock acquires a shared lock on a block unless the transaction reads uncommitted data.
+func (t *Transaction) sLock(blk BlockIDHash) error {
+	if t.opts.readUncommitted {
+		return nil
+	}
+	ctx, cancel := t.lockContext()
+	defer cancel()
+	return t.cm.sLock(ctx, blk)
+}
+
+// restoreHintBytes works like restoreBytes without a lock.
+func (t *Transaction) restoreHintBytes(blk BlockIDHash, offset int, img []byte) error {
+	buf, err := t.bl.blockToBuffer(blk)
+	if err != nil {
+		return err
+	}
+	buf.latch.Lock()
+	defer buf.latch.Unlock()
+	err = buf.contents.writeRaw(offset, img)
+	if err != nil {
+		return fmt.Errorf("failed to write contents: %w", err)
+	}
+	return buf.modify(t.txNum, lsnNil)
+}
+
+// restoreBytes writes a before-image back to a block. This function is used to undo modifications, so it doesn't
+// write any log record.
+func (t *Transaction) restoreBytes(blk BlockIDHash, offset int, img []byte) error {
+	ctx, cancel := t.lockContext()
+	defer cancel()
+	err := t.cm.xLock(ctx, blk)
+	if err != nil {
+		return err
+	}
+	buf, err := t.bl.blockToBuffer(blk)
+	if err != nil {
+		return err
+	}
+	buf.latch.Lock()
+	defer buf.latch.Unlock()
+	err = buf.contents.writeRaw(offset, img)
+	if err != nil {
+		return fmt.Errorf("failed to write contents: %w", err)
+	}
+	return buf.modify(t.txNum, lsnNil)
+}
+
 //nolint:unused
 func (t *Transaction) BlockCount(fileName string) (int, error) {
-	ctx, cancel := context.WithTimeout(t.ctx, 10*time.Second)
-	defer cancel()
 	dummyBlk := NewBlockID(fileName, -1)
-	err := t.cm.sLock(ctx, dummyBlk.Hash)
+	err := t.sLock(dummyBlk.Hash)
+	if err != nil {
+		return 0, err
+	}
+	err = t.applyPendingFileOperations(fileName)
 	if err != nil {
 		return 0, err
 	}
 	return t.fm.blockCount(fileName)
 }
 
+// Encoding returns the encoding the database uses.
+func (t *Transaction) Encoding() Encoding {
+	return t.enc
+}
+
 func (t *Transaction) BlockSize() int {
 	return t.fm.blkSize
 }
 
+// MaxImageSize returns the number of bytes a write to a block of a file can change at most. A write logs
+// the before-image of the bytes it changes, and the log record must fit in a log block, so the size depends on
+// the block size and on the length of the file name.
+func (t *Transaction) MaxImageSize(fileName string) (int, error) {
+	if t.opts.readOnly {
+		return 0, fmt.Errorf("failed to compute the size of an image: %w", ErrReadOnlyTransaction)
+	}
+	return t.rm.maxImageSize(fileName)
+}
+
 func (t *Transaction) AllocBlock(fileName string) (*BlockID, error) {
-	ctx, cancel := context.WithTimeout(t.ctx, 10*time.Second)
+	if t.opts.readOnly {
+		return nil, fmt.Errorf("failed to allocate a block: %w", ErrReadOnlyTransaction)
+	}
+	if *t.gid != "" {
+		return nil, fmt.Errorf("failed to allocate a block: %w", ErrTransactionPrepared)
+	}
+	ctx, cancel := t.lockContext()
 	defer cancel()
 	dummyBlk := NewBlockID(fileName, -1)
 	err := t.cm.xLock(ctx, dummyBlk.Hash)
 	if err != nil {
 		return nil, err
 	}
+	err = t.applyPendingFileOperations(fileName)
+	if err != nil {
+		return nil, err
+	}
 	return t.fm.alloc(fileName)
 }
 
+// DropFile removes a file. The file is removed when the transaction commits, so rolling back the transaction
+// leaves the file intact.
+func (t *Transaction) DropFile(fileName string) error {
+	if t.opts.readOnly {
+		return fmt.Errorf("failed to drop a file: %w", ErrReadOnlyTransaction)
+	}
+	if *t.gid != "" {
+		return fmt.Errorf("failed to drop a file: %w", ErrTransactionPrepared)
+	}
+	ctx, cancel := t.lockContext()
+	defer cancel()
+	for _, blkNum := range []int{-1, fileLockBlkNum} {
+		err := t.cm.xLock(ctx, NewBlockID(fileName, blkNum).Hash)
+		if err != nil {
+			return err
+		}
+	}
+	op, err := t.rm.dropFile(fileName)
+	if err != nil {
+		return fmt.Errorf("failed to write a log: %w", err)
+	}
+	*t.fileOps = append(*t.fileOps, op)
+	return nil
+}
+
+// TruncateFile shrinks a file so that it contains only the first `blkCount` blocks. Like DropFile,
+// the file is truncated when the transaction commits.
+func (t *Transaction) TruncateFile(fileName string, blkCount int) error {
+	if t.opts.readOnly {
+		return fmt.Errorf("failed to truncate a file: %w", ErrReadOnlyTransaction)
+	}
+	if *t.gid != "" {
+		return fmt.Errorf("failed to truncate a file: %w", ErrTransactionPrepared)
+	}
+	if blkCount < 0 {
+		return fmt.Errorf("a block count must be >=0: %v", blkCount)
+	}
+
+	ctx, cancel := t.lockContext()
+	defer cancel()
+	for _, blkNum := range []int{-1, fileLockBlkNum} {
+		err := t.cm.xLock(ctx, NewBlockID(fileName, blkNum).Hash)
+		if err != nil {
+			return err
+		}
+	}
+	op, err := t.rm.truncateFile(fileName, blkCount)
+	if err != nil {
+		return fmt.Errorf("failed to write a log: %w", err)
+	}
+	*t.fileOps = append(*t.fileOps, op)
+	return nil
+}
+
+// pendingFileOperations holds the file operations of committed transactions that failed to be applied, by file.
+// A transaction applies the pending operations of a file before it uses the file, and a recovery applies them too.
+type pendingFileOperations struct {
+	mu  sync.Mutex
+	ops map[string][]*logRecord
+
+	// count is the number of the pending operations. It is accessed atomically.
+	count int32
+}
+
+func newPendingFileOperations() *pendingFileOperations {
+	return &pendingFileOperations{
+		ops: map[string][]*logRecord{},
+	}
+}
+
+func (p *pendingFileOperations) add(op *logRecord) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.ops[op.FileName] = append(p.ops[op.FileName], op)
+	atomic.AddInt32(&p.count, 1)
+}
+
+func (p *pendingFileOperations) fileNames() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	names := make([]string, 0, len(p.ops))
+	for name := range p.ops {
+		names = append(names, name)
+	}
+	return names
+}
+
+// applyFileOperations applies the file operations of a committed transaction. The transaction has already committed,
+// so an operation that fails doesn't fail the transaction; it stays pending along with the later operations on
+// the same file.
+func (t *Transaction) applyFileOperations(ops []*logRecord) {
+	for _, op := range ops {
+		err := t.applyPendingFileOperations(op.FileName)
+		if err == nil {
+			err = t.applyFileOperation(op)
+		}
+		if err != nil {
+			t.pendingOps.add(op)
+			t.ev.fileOperationDeferred(op.FileName, err)
+		}
+	}
+}
+
+// applyPendingFileOperations applies the pending file operations on a file in order. When one of them fails, it and
+// the later ones stay pending, and the transaction cannot use the file.
+func (t *Transaction) applyPendingFileOperations(fileName string) error {
+	p := t.pendingOps
+	if atomic.LoadInt32(&p.count) == 0 {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ops := p.ops[fileName]
+	if len(ops) == 0 {
+		return nil
+	}
+	if t.opts.readOnly {
+		return fmt.Errorf("a file has a file operation that is not applied yet: file: %v", fileName)
+	}
+	for len(ops) > 0 {
+		err := t.applyFileOperation(ops[0])
+		if err != nil {
+			p.ops[fileName] = ops
+			return fmt.Errorf("failed to apply a pending file operation: file: %v: %w", fileName, err)
+		}
+		ops = ops[1:]
+		atomic.AddInt32(&p.count, -1)
+	}
+	delete(p.ops, fileName)
+	return nil
+}
+
+func (t *Transaction) applyFileOperation(op *logRecord) error {
+	t.rm.lm.fileGate.RLock()
+	defer t.rm.lm.fileGate.RUnlock()
+	switch op.Op {
+	case opDropFile:
+		return t.bm.discard(op.FileName, 0, func() error {
+			return t.fm.remove(op.FileName)
+		})
+	case opTruncateFile:
+		return t.bm.discard(op.FileName, op.BlkNum, func() error {
+			return t.fm.truncate(op.FileName, op.BlkNum)
+		})
+	}
+	return fmt.Errorf("not a file operation: %v", op.Op)
+}
+
 //nolint:unused
 func (t *Transaction) AvailableBufferCount() int {
 	return t.bm.availableBufferCount()
@@ -284,18 +891,22 @@ func (l *bufferList) blockToBuffer(blk BlockIDHash) (*buffer, error) {
 	return buf, nil
 }
 
-func (l *bufferList) pin(blk *BlockID) error {
-	buf, err := l.bm.pin(blk)
+func (l *bufferList) pin(ctx context.Context, blk *BlockID) error {
+	buf, err := l.bm.pin(ctx, blk)
 	if err != nil {
 		return err
 	}
+	l.add(blk, buf)
+	return nil
+}
+
+func (l *bufferList) add(blk *BlockID, buf *buffer) {
 	l.buffers[blk.Hash] = buf
 	if pins, ok := l.pins[blk.Hash]; ok {
 		l.pins[blk.Hash] = pins + 1
 	} else {
 		l.pins[blk.Hash] = 1
 	}
-	return nil
 }
 
 func (l *bufferList) unpin(blk *BlockID) error {
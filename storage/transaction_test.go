@@ -2,10 +2,12 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"golang.org/x/sync/errgroup"
 )
@@ -52,7 +54,7 @@ func TestTransaction_commit(t *testing.T) {
 				}
 			}()
 
-			tx, err := newTransaction(ctx, txNum, fm, lm, bm, lockTab)
+			tx, err := newTransaction(ctx, txNum, fm, lm, bm, lockTab, DefaultEncoding, nil)
 			if err != nil {
 				return err
 			}
@@ -154,7 +156,7 @@ func TestTransaction_rollback(t *testing.T) {
 	var blk *BlockID
 	{
 		txNum := <-txNumC
-		tx, err := newTransaction(ctx, txNum, fm, lm, bm, lockTab)
+		tx, err := newTransaction(ctx, txNum, fm, lm, bm, lockTab, DefaultEncoding, nil)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -192,7 +194,7 @@ func TestTransaction_rollback(t *testing.T) {
 
 	{
 		txNum := <-txNumC
-		tx, err := newTransaction(ctx, txNum, fm, lm, bm, lockTab)
+		tx, err := newTransaction(ctx, txNum, fm, lm, bm, lockTab, DefaultEncoding, nil)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -225,7 +227,7 @@ func TestTransaction_rollback(t *testing.T) {
 
 	{
 		txNum := <-txNumC
-		tx, err := newTransaction(ctx, txNum, fm, lm, bm, lockTab)
+		tx, err := newTransaction(ctx, txNum, fm, lm, bm, lockTab, DefaultEncoding, nil)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -295,7 +297,7 @@ func TestTransaction_recover(t *testing.T) {
 	var blk *BlockID
 	{
 		txNum := <-txNumC
-		tx, err := newTransaction(ctx, txNum, fm, lm, bm, lockTab)
+		tx, err := newTransaction(ctx, txNum, fm, lm, bm, lockTab, DefaultEncoding, nil)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -333,7 +335,7 @@ func TestTransaction_recover(t *testing.T) {
 
 	{
 		txNum := <-txNumC
-		tx, err := newTransaction(ctx, txNum, fm, lm, bm, lockTab)
+		tx, err := newTransaction(ctx, txNum, fm, lm, bm, lockTab, DefaultEncoding, nil)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -368,7 +370,7 @@ func TestTransaction_recover(t *testing.T) {
 		lockTab := newLockTable()
 
 		txNum := <-txNumC
-		tx, err := newTransaction(ctx, txNum, fm, lm, bm, lockTab)
+		tx, err := newTransaction(ctx, txNum, fm, lm, bm, lockTab, DefaultEncoding, nil)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -408,3 +410,928 @@ func TestTransaction_recover(t *testing.T) {
 		}
 	}
 }
+
+func TestTransaction_dropFile(t *testing.T) {
+	testDir, err := MakeTestDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+
+	fm, lm, err := newTestFileManagerAndLogManager(testDir, 400)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bm, err := newBufferManager(fm, lm, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lockTab := newLockTable()
+
+	ctx := context.Background()
+	txNumC := runTransactionNumIssuer(ctx)
+
+	t.Run("a file remains when a transaction is rolled back", func(t *testing.T) {
+		dbFilePath, err := MakeTestTableFile(testDir, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		dbFileName := filepath.Base(dbFilePath)
+
+		tx, err := newTransaction(ctx, <-txNumC, fm, lm, bm, lockTab, DefaultEncoding, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blk, err := tx.AllocBlock(dbFileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tx.Pin(blk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tx.DropFile(dbFileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tx.Rollback()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = os.Stat(dbFilePath)
+		if err != nil {
+			t.Fatalf("a file must remain: %v", err)
+		}
+	})
+
+	t.Run("a file is removed when a transaction commits", func(t *testing.T) {
+		dbFilePath, err := MakeTestTableFile(testDir, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		dbFileName := filepath.Base(dbFilePath)
+
+		tx, err := newTransaction(ctx, <-txNumC, fm, lm, bm, lockTab, DefaultEncoding, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blk, err := tx.AllocBlock(dbFileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tx.Pin(blk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tx.WriteInt64(blk.Hash, 100, 1993, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tx.DropFile(dbFileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tx.Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = os.Stat(dbFilePath)
+		if !os.IsNotExist(err) {
+			t.Fatalf("a file must be removed: %v", err)
+		}
+		c, err := fm.blockCount(dbFileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c != 0 {
+			t.Fatalf("a dropped file must have no blocks: got: %v", c)
+		}
+	})
+
+	t.Run("recovery applies a file operation that a committed transaction didn't finish", func(t *testing.T) {
+		dbFilePath, err := MakeTestTableFile(testDir, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		dbFileName := filepath.Base(dbFilePath)
+
+		tx, err := newTransaction(ctx, <-txNumC, fm, lm, bm, lockTab, DefaultEncoding, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tx.DropFile(dbFileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Simulate a crash that occurs after the commit log record is written.
+		err = tx.rm.commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+		tx.cm.release()
+
+		_, err = os.Stat(dbFilePath)
+		if err != nil {
+			t.Fatalf("a file must remain until the transaction finishes committing: %v", err)
+		}
+
+		tx, err = newTransaction(ctx, <-txNumC, fm, lm, bm, newLockTable(), DefaultEncoding, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tx.Recover()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = os.Stat(dbFilePath)
+		if !os.IsNotExist(err) {
+			t.Fatalf("a file must be removed: %v", err)
+		}
+	})
+
+	t.Run("a transaction cannot drop a file while another transaction has its blocks pinned", func(t *testing.T) {
+		dbFilePath, err := MakeTestTableFile(testDir, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		dbFileName := filepath.Base(dbFilePath)
+
+		tx1, err := newTransaction(ctx, <-txNumC, fm, lm, bm, lockTab, DefaultEncoding, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tx1.Commit()
+		blk, err := tx1.AllocBlock(dbFileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tx1.Pin(blk)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tx2, err := newTransaction(ctx, <-txNumC, fm, lm, bm, lockTab, DefaultEncoding, nil, WithLockTimeout(100*time.Millisecond))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tx2.Rollback()
+		err = tx2.DropFile(dbFileName)
+		if !errors.Is(err, ErrLockWaitTimeout) {
+			t.Fatalf("unexpected error: want: %v, got: %v", ErrLockWaitTimeout, err)
+		}
+	})
+
+	t.Run("a transaction cannot drop or truncate a file while another transaction reads its blocks", func(t *testing.T) {
+		dbFilePath, err := MakeTestTableFile(testDir, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		dbFileName := filepath.Base(dbFilePath)
+		var blk *BlockID
+		{
+			tx, err := newTransaction(ctx, <-txNumC, fm, lm, bm, lockTab, DefaultEncoding, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			blk, err = tx.AllocBlock(dbFileName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = tx.Commit()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		reader, err := newTransaction(ctx, <-txNumC, fm, lm, bm, lockTab, DefaultEncoding, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = reader.Pin(blk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = reader.ReadInt64(blk.Hash, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, op := range []func(tx *Transaction) error{
+			func(tx *Transaction) error { return tx.DropFile(dbFileName) },
+			func(tx *Transaction) error { return tx.TruncateFile(dbFileName, 0) },
+		} {
+			tx, err := newTransaction(ctx, <-txNumC, fm, lm, bm, lockTab, DefaultEncoding, nil, WithLockTimeout(100*time.Millisecond))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = op(tx)
+			if !errors.Is(err, ErrLockWaitTimeout) {
+				t.Fatalf("unexpected error: want: %v, got: %v", ErrLockWaitTimeout, err)
+			}
+			err = tx.Rollback()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// Once the reader finishes, a file operation waiting for the lock proceeds.
+		tx, err := newTransaction(ctx, <-txNumC, fm, lm, bm, lockTab, DefaultEncoding, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			reader.Commit()
+		}()
+		err = tx.DropFile(dbFileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tx.Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = os.Stat(dbFilePath)
+		if !os.IsNotExist(err) {
+			t.Fatalf("a file must be removed: %v", err)
+		}
+	})
+
+	t.Run("a file operation that fails to be applied stays pending until the file is used", func(t *testing.T) {
+		dbFilePath, err := MakeTestTableFile(testDir, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		dbFileName := filepath.Base(dbFilePath)
+		var blk *BlockID
+		{
+			tx, err := newTransaction(ctx, <-txNumC, fm, lm, bm, lockTab, DefaultEncoding, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			blk, err = tx.AllocBlock(dbFileName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = tx.Commit()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// A pin that no transaction holds prevents the file from being removed.
+		buf, err := bm.pin(ctx, blk)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tx, err := newTransaction(ctx, <-txNumC, fm, lm, bm, lockTab, DefaultEncoding, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tx.DropFile(dbFileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tx.Commit()
+		if err != nil {
+			t.Fatalf("a committed transaction must not fail: %v", err)
+		}
+		_, err = os.Stat(dbFilePath)
+		if err != nil {
+			t.Fatalf("a file must remain while a file operation is pending: %v", err)
+		}
+
+		// The file cannot be used until the pending operation is applied.
+		other, err := newTransaction(ctx, <-txNumC, fm, lm, bm, lockTab, DefaultEncoding, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = other.BlockCount(dbFileName)
+		if err == nil {
+			t.Fatal("a file having a pending file operation must not be used")
+		}
+		err = other.Rollback()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = bm.unpin(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		other, err = newTransaction(ctx, <-txNumC, fm, lm, bm, lockTab, DefaultEncoding, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := other.BlockCount(dbFileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c != 0 {
+			t.Fatalf("unexpected block count: want: %v, got: %v", 0, c)
+		}
+		err = other.Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = os.Stat(dbFilePath)
+		if !os.IsNotExist(err) {
+			t.Fatalf("a file must be removed: %v", err)
+		}
+	})
+}
+
+func TestTransaction_truncateFile(t *testing.T) {
+	testDir, err := MakeTestDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+
+	fm, lm, err := newTestFileManagerAndLogManager(testDir, 400)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var dbFileName string
+	{
+		dbFilePath, err := MakeTestTableFile(testDir, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		dbFileName = filepath.Base(dbFilePath)
+	}
+
+	bm, err := newBufferManager(fm, lm, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lockTab := newLockTable()
+
+	ctx := context.Background()
+	txNumC := runTransactionNumIssuer(ctx)
+
+	{
+		tx, err := newTransaction(ctx, <-txNumC, fm, lm, bm, lockTab, DefaultEncoding, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 3; i++ {
+			_, err := tx.AllocBlock(dbFileName)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = tx.Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	{
+		tx, err := newTransaction(ctx, <-txNumC, fm, lm, bm, lockTab, DefaultEncoding, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tx.TruncateFile(dbFileName, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tx.Rollback()
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := fm.blockCount(dbFileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c != 3 {
+			t.Fatalf("unexpected block count: want: %v, got: %v", 3, c)
+		}
+	}
+
+	{
+		tx, err := newTransaction(ctx, <-txNumC, fm, lm, bm, lockTab, DefaultEncoding, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tx.TruncateFile(dbFileName, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tx.Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := fm.blockCount(dbFileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c != 1 {
+			t.Fatalf("unexpected block count: want: %v, got: %v", 1, c)
+		}
+	}
+
+	// A later transaction extends the truncated file. Recovery must not truncate the file again.
+	{
+		tx, err := newTransaction(ctx, <-txNumC, fm, lm, bm, lockTab, DefaultEncoding, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2; i++ {
+			blk, err := tx.AllocBlock(dbFileName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = tx.Pin(blk)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = tx.WriteInt64(blk.Hash, 100, int64(blk.BlkNum), true)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = tx.Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tx, err = newTransaction(ctx, <-txNumC, fm, lm, bm, newLockTable(), DefaultEncoding, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tx.Recover()
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := fm.blockCount(dbFileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c != 3 {
+			t.Fatalf("unexpected block count: want: %v, got: %v", 3, c)
+		}
+		blk := NewBlockID(dbFileName, 2)
+		err = tx.Pin(blk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, err := tx.ReadInt64(blk.Hash, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != 2 {
+			t.Fatalf("unexpected value was read: want: %v, got: %v", 2, v)
+		}
+		err = tx.Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestTransaction_timeout(t *testing.T) {
+	testDir, err := MakeTestDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+
+	fm, lm, err := newTestFileManagerAndLogManager(testDir, 400)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dbFileName string
+	{
+		dbFilePath, err := MakeTestTableFile(testDir, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		dbFileName = filepath.Base(dbFilePath)
+	}
+	bm, err := newBufferManager(fm, lm, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lockTab := newLockTable()
+	ctx := context.Background()
+	txNumC := runTransactionNumIssuer(ctx)
+
+	tx1, err := newTransaction(ctx, <-txNumC, fm, lm, bm, lockTab, DefaultEncoding, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blk, err := tx1.AllocBlock(dbFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx1.Pin(blk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx1.WriteInt64(blk.Hash, 0, 100, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("a read fails with ErrLockWaitTimeout when a lock isn't released within a lock timeout", func(t *testing.T) {
+		tx2, err := newTransaction(ctx, <-txNumC, fm, lm, bm, lockTab, DefaultEncoding, nil, WithLockTimeout(50*time.Millisecond))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tx2.Rollback()
+		err = tx2.Pin(blk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = tx2.ReadInt64(blk.Hash, 0)
+		if !errors.Is(err, ErrLockWaitTimeout) {
+			t.Fatalf("expected error didn't occur: want: %v, got: %v", ErrLockWaitTimeout, err)
+		}
+	})
+
+	t.Run("a call through WithContext honors the cancellation of its context", func(t *testing.T) {
+		tx2, err := newTransaction(ctx, <-txNumC, fm, lm, bm, lockTab, DefaultEncoding, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tx2.Rollback()
+		err = tx2.Pin(blk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		callCtx, cancel := context.WithCancel(ctx)
+		cancel()
+		_, err = tx2.WithContext(callCtx).ReadInt64(blk.Hash, 0)
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected error didn't occur: want: %v, got: %v", context.Canceled, err)
+		}
+	})
+
+	t.Run("a pin fails with ErrBufferPoolExhausted when all buffers remain pinned within a pin timeout", func(t *testing.T) {
+		tx2, err := newTransaction(ctx, <-txNumC, fm, lm, bm, lockTab, DefaultEncoding, nil, WithPinTimeout(50*time.Millisecond))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tx2.Rollback()
+		// tx1 holds the lock for allocating blocks of `dbFileName`, so we use another file.
+		dbFilePath, err := MakeTestTableFile(testDir, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; ; i++ {
+			blk, err := tx2.AllocBlock(filepath.Base(dbFilePath))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = tx2.Pin(blk)
+			if err == nil {
+				continue
+			}
+			if !errors.Is(err, ErrBufferPoolExhausted) {
+				t.Fatalf("expected error didn't occur: want: %v, got: %v", ErrBufferPoolExhausted, err)
+			}
+			if i != 4 {
+				t.Fatalf("unexpected number of pinned buffers: want: %v, got: %v", 4, i)
+			}
+			break
+		}
+	})
+
+	err = tx1.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStorage_NewReadOnlyTransaction(t *testing.T) {
+	testDir, err := MakeTestDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+
+	logFilePath, err := MakeTestLogFile(testDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbFilePath, err := MakeTestTableFile(testDir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbFileName := filepath.Base(dbFilePath)
+
+	st, err := InitStorage(context.Background(), TestConfig(&StorageConfig{
+		DirPath:     testDir,
+		LogFileName: filepath.Base(logFilePath),
+		BlkSize:     400,
+		BufSize:     5,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var blk *BlockID
+	{
+		tx, err := st.NewTransaction(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		blk, err = tx.AllocBlock(dbFileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tx.Pin(blk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tx.WriteInt64(blk.Hash, 0, 100, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tx.Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("a read-only transaction writes no log record", func(t *testing.T) {
+		before := st.Stats().Log
+		tx, err := st.NewReadOnlyTransaction(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !tx.ReadOnly() {
+			t.Fatal("a transaction must be read-only")
+		}
+		err = tx.Pin(blk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, err := tx.ReadInt64(blk.Hash, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != 100 {
+			t.Fatalf("unexpected value: want: %v, got: %v", 100, v)
+		}
+		err = tx.Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+		after := st.Stats().Log
+		if after.Appends != before.Appends || after.Flushes != before.Flushes {
+			t.Fatalf("unexpected log stats: before: %+v, after: %+v", before, after)
+		}
+	})
+
+	t.Run("a read-only transaction rejects modifications", func(t *testing.T) {
+		tx, err := st.NewReadOnlyTransaction(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tx.Rollback()
+		err = tx.Pin(blk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range []func() error{
+			func() error { return tx.WriteInt64(blk.Hash, 0, 200, true) },
+			func() error { return tx.WriteUint64(blk.Hash, 0, 200, true) },
+			func() error { return tx.WriteString(blk.Hash, 0, "foo", true) },
+			func() error {
+				_, err := tx.AllocBlock(dbFileName)
+				return err
+			},
+			func() error { return tx.DropFile(dbFileName) },
+			func() error { return tx.TruncateFile(dbFileName, 0) },
+			func() error { return tx.Recover() },
+		} {
+			err := f()
+			if !errors.Is(err, ErrReadOnlyTransaction) {
+				t.Fatalf("expected error didn't occur: want: %v, got: %v", ErrReadOnlyTransaction, err)
+			}
+		}
+	})
+
+	t.Run("a read-only transaction reading uncommitted data doesn't wait for an exclusive lock", func(t *testing.T) {
+		writer, err := st.NewTransaction(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer writer.Rollback()
+		err = writer.Pin(blk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = writer.WriteInt64(blk.Hash, 0, 200, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		{
+			tx, err := st.NewReadOnlyTransaction(context.Background(), WithLockTimeout(10*time.Millisecond))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = tx.Pin(blk)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = tx.ReadInt64(blk.Hash, 0)
+			if !errors.Is(err, ErrLockWaitTimeout) {
+				t.Fatalf("expected error didn't occur: want: %v, got: %v", ErrLockWaitTimeout, err)
+			}
+			err = tx.Rollback()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		before := st.Stats().Lock
+		tx, err := st.NewReadOnlyTransaction(context.Background(), WithReadUncommitted())
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tx.Pin(blk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, err := tx.ReadInt64(blk.Hash, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != 200 {
+			t.Fatalf("unexpected value: want: %v, got: %v", 200, v)
+		}
+		err = tx.Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The only shared lock the transaction takes is the one on the file it pins.
+		after := st.Stats().Lock
+		if after.SharedAcquired != before.SharedAcquired+1 || after.Waits != before.Waits {
+			t.Fatalf("unexpected lock stats: before: %+v, after: %+v", before, after)
+		}
+	})
+
+	t.Run("a transaction reading uncommitted data locks the files it pins", func(t *testing.T) {
+		tx, err := st.NewReadOnlyTransaction(context.Background(), WithReadUncommitted())
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tx.Pin(blk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dropper, err := st.NewTransaction(context.Background(), WithLockTimeout(10*time.Millisecond))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = dropper.DropFile(dbFileName)
+		if !errors.Is(err, ErrLockWaitTimeout) {
+			t.Fatalf("expected error didn't occur: want: %v, got: %v", ErrLockWaitTimeout, err)
+		}
+		err = dropper.Rollback()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tx.Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("a transaction that can modify a database ignores WithReadUncommitted", func(t *testing.T) {
+		tx, err := st.NewTransaction(context.Background(), WithReadUncommitted())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tx.Rollback()
+		if tx.ReadOnly() || tx.opts.readUncommitted {
+			t.Fatalf("unexpected options: %+v", tx.opts)
+		}
+	})
+
+	t.Run("a read-only storage begins only read-only transactions", func(t *testing.T) {
+		config := TestConfig(&StorageConfig{
+			DirPath:     testDir,
+			LogFileName: filepath.Base(logFilePath),
+			BlkSize:     400,
+			BufSize:     5,
+			ReadOnly:    true,
+		})
+		rst, err := InitStorage(context.Background(), config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rst.Close()
+		_, err = rst.NewTransaction(context.Background())
+		if !errors.Is(err, ErrReadOnlyStorage) {
+			t.Fatalf("expected error didn't occur: want: %v, got: %v", ErrReadOnlyStorage, err)
+		}
+		tx, err := rst.NewReadOnlyTransaction(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tx.Pin(blk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, err := tx.ReadInt64(blk.Hash, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != 100 {
+			t.Fatalf("unexpected value: want: %v, got: %v", 100, v)
+		}
+		err = tx.Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func BenchmarkStorage_readOnlyTransaction(b *testing.B) {
+	testDir, err := MakeTestDir()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+
+	logFilePath, err := MakeTestLogFile(testDir)
+	if err != nil {
+		b.Fatal(err)
+	}
+	dbFilePath, err := MakeTestTableFile(testDir, "")
+	if err != nil {
+		b.Fatal(err)
+	}
+	dbFileName := filepath.Base(dbFilePath)
+
+	st, err := InitStorage(context.Background(), TestConfig(&StorageConfig{
+		DirPath:     testDir,
+		LogFileName: filepath.Base(logFilePath),
+		BlkSize:     400,
+		BufSize:     5,
+	}))
+	if err != nil {
+		b.Fatal(err)
+	}
+	var blk *BlockID
+	{
+		tx, err := st.NewTransaction(context.Background())
+		if err != nil {
+			b.Fatal(err)
+		}
+		blk, err = tx.AllocBlock(dbFileName)
+		if err != nil {
+			b.Fatal(err)
+		}
+		err = tx.Commit()
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	for _, c := range []struct {
+		name  string
+		newTx func(ctx context.Context, opts ...TransactionOption) (*Transaction, error)
+	}{
+		{"read-write", st.NewTransaction},
+		{"read-only", st.NewReadOnlyTransaction},
+	} {
+		b.Run(c.name, func(b *testing.B) {
+			before := st.Stats().Log
+			for i := 0; i < b.N; i++ {
+				tx, err := c.newTx(context.Background())
+				if err != nil {
+					b.Fatal(err)
+				}
+				err = tx.Pin(blk)
+				if err != nil {
+					b.Fatal(err)
+				}
+				_, err = tx.ReadInt64(blk.Hash, 0)
+				if err != nil {
+					b.Fatal(err)
+				}
+				err = tx.Commit()
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+			after := st.Stats().Log
+			b.ReportMetric(float64(after.Flushes-before.Flushes)/float64(b.N), "flushes/op")
+			b.ReportMetric(float64(after.AppendedBytes-before.AppendedBytes)/float64(b.N), "logbytes/op")
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// runBackgroundWriter starts a goroutine that writes modified, unpinned buffers out to a disk every `interval` so that
+// transactions rarely have to write a buffer when they evict it. The goroutine stops when `ctx` is done, and then
+// the returned channel is closed.
+func runBackgroundWriter(ctx context.Context, bm *bufferManager, interval time.Duration, maxPages int) <-chan struct{} {
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				_, err := bm.flushUnpinned(maxPages)
+				if err != nil {
+					bm.ev.backgroundWriteFailed(err)
+				}
+			}
+		}
+	}()
+
+	return done
+}
+
+// flushUnpinned writes at most `max` modified, unpinned buffers out to a disk and returns the number of the written
+// buffers. When `max` is zero or negative, this function writes all such buffers. Pinned buffers are skipped because
+// their transactions are likely to modify them again. Like eviction, writing a buffer flushes the log up to
+// the buffer's LSN first, so the log always reaches a disk before the block it describes.
+func (m *bufferManager) flushUnpinned(max int) (int, error) {
+	n := 0
+	for i := 0; ; i++ {
+		if max > 0 && n >= max {
+			return n, nil
+		}
+
+		// We release the lock between buffers so that transactions don't wait for a whole round.
+		m.mu.Lock()
+		if i >= len(m.pool) {
+			m.mu.Unlock()
+			return n, nil
+		}
+		buf := m.pool[i]
+		if m.pinned(buf) {
+			m.mu.Unlock()
+			continue
+		}
+		written := false
+		err := m.flushIf(buf, func() bool {
+			written = buf.modified
+			return written
+		})
+		m.mu.Unlock()
+		if err != nil {
+			return n, err
+		}
+		if !written {
+			continue
+		}
+		atomic.AddUint64(&m.stats.backgroundWrites, 1)
+		n++
+	}
+}
@@ -0,0 +1,201 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBufferManager_flushUnpinned(t *testing.T) {
+	testDir, err := MakeTestDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+
+	fm, lm, err := newTestFileManagerAndLogManager(testDir, 400)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dbFileName string
+	{
+		dbFilePath, err := MakeTestTableFile(testDir, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		dbFileName = filepath.Base(dbFilePath)
+	}
+	bm, err := newBufferManager(fm, lm, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	txNumC := runTransactionNumIssuer(ctx)
+
+	tx, err := newTransaction(ctx, <-txNumC, fm, lm, bm, newLockTable(), DefaultEncoding, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var blks []*BlockID
+	for i := 0; i < 2; i++ {
+		blk, err := tx.AllocBlock(dbFileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tx.Pin(blk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tx.WriteInt64(blk.Hash, 0, int64(100+i), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blks = append(blks, blk)
+	}
+	// Only the first block is unpinned.
+	err = tx.Unpin(blks[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := bm.flushUnpinned(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("unexpected number of written buffers: want: %v, got: %v", 1, n)
+	}
+	// The log must reach a disk before the block it describes.
+	if lm.lastSavedLSN != lm.latestLSN {
+		t.Fatalf("the log must be flushed: latest LSN: %v, last saved LSN: %v", lm.latestLSN, lm.lastSavedLSN)
+	}
+	for i, blk := range blks {
+		p, err := newPage(400)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = fm.read(blk, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, _, err := DefaultEncoding.readInt64(p, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := int64(0)
+		if i == 0 {
+			want = 100
+		}
+		if v != want {
+			t.Fatalf("unexpected value on a disk: block: %v, want: %v, got: %v", blk.BlkNum, want, v)
+		}
+	}
+
+	// A written buffer is clean, so the next round writes nothing.
+	n, err = bm.flushUnpinned(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Fatalf("unexpected number of written buffers: want: %v, got: %v", 0, n)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStorage_backgroundWriter(t *testing.T) {
+	testDir, err := MakeTestDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+
+	logFilePath, err := MakeTestLogFile(testDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbFilePath, err := MakeTestTableFile(testDir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbFileName := filepath.Base(dbFilePath)
+
+	st, err := InitStorage(context.Background(), TestConfig(&StorageConfig{
+		DirPath:        testDir,
+		LogFileName:    filepath.Base(logFilePath),
+		BlkSize:        400,
+		BufSize:        5,
+		WriterInterval: 5 * time.Millisecond,
+		WriterMaxPages: 1,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := st.NewTransaction(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// We keep the blocks pinned until all of them are modified so that they don't evict each other.
+	var blks []*BlockID
+	for i := 0; i < 3; i++ {
+		blk, err := tx.AllocBlock(dbFileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tx.Pin(blk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tx.WriteInt64(blk.Hash, 0, 100, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blks = append(blks, blk)
+	}
+	for _, blk := range blks {
+		err := tx.Unpin(blk)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for st.Stats().Buffer.BackgroundWrites < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("the background writer didn't write buffers: %+v", st.Stats().Buffer)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	written := st.Stats().File.BlocksWritten
+
+	// The background writer has already written the buffers, so committing writes only the log block.
+	err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := st.Stats().File.BlocksWritten; w != written+1 {
+		t.Fatalf("committing must write only the log block: want: %v, got: %v", written+1, w)
+	}
+
+	err = st.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = st.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := st.Stats().File.OpenFiles; n != 0 {
+		t.Fatalf("unexpected number of open files: want: %v, got: %v", 0, n)
+	}
+	_, err = st.NewTransaction(context.Background())
+	if err == nil {
+		t.Fatal("a closed storage must not begin a transaction")
+	}
+}
@@ -0,0 +1,279 @@
+package table
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/nihei9/simple-db/storage"
+)
+
+// ErrSubscriptionOverflow means that a subscriber fell behind and a change feed dropped the subscription.
+var ErrSubscriptionOverflow = errors.New("a subscriber fell behind a change feed")
+
+type ChangeKind string
+
+const (
+	ChangeKindInsert ChangeKind = "insert"
+	ChangeKindUpdate ChangeKind = "update"
+	ChangeKindDelete ChangeKind = "delete"
+)
+
+// Change is a committed modification of a record. Old holds the values of the fields before the transaction
+// modified the record, and New holds the values when the transaction committed. Old is nil for an insert, and New
+// is nil for a delete. The values are int64, uint64, or string according to the types of the fields.
+type Change struct {
+	Table    string
+	RecordID RecordID
+	Kind     ChangeKind
+	Old      map[string]interface{}
+	New      map[string]interface{}
+}
+
+// ChangeFeed delivers committed modifications of records to subscribers. While a table has subscribers, table
+// scanners write a change record describing each modification of the table to the recovery log, whichever scanner
+// makes it. When a transaction commits, the storage reads the change records of the transaction from the log after
+// the commit record reaches a disk, and the feed delivers the changes. The modifications of a rolled-back
+// transaction are never delivered.
+//
+// A feed combines the modifications a transaction makes to the same record into a change. For example, a record
+// that a transaction inserts and then updates is delivered as an insert holding the updated values.
+type ChangeFeed struct {
+	listeners *storage.ChangeListeners
+	mu        sync.Mutex
+	subs      map[string]map[*Subscription]struct{}
+	// cancels holds the functions removing the listeners of the tables having subscribers.
+	cancels map[string]func()
+}
+
+// NewChangeFeed returns a feed delivering the changes that the transactions of a storage log. Pass
+// storage.Storage.ChangeListeners or storage.Transaction.ChangeListeners.
+func NewChangeFeed(listeners *storage.ChangeListeners) *ChangeFeed {
+	return &ChangeFeed{
+		listeners: listeners,
+		subs:      map[string]map[*Subscription]struct{}{},
+		cancels:   map[string]func(){},
+	}
+}
+
+// Subscription receives the changes of a table in the order transactions committed. A subscription holds up to
+// `size` changes that haven't been received. When a subscriber falls behind further, the feed closes the channel
+// and Err returns ErrSubscriptionOverflow, so the subscriber must read the table again to catch up. Committing
+// never waits for subscribers.
+type Subscription struct {
+	feed      *ChangeFeed
+	tableName string
+	c         chan *Change
+	err       error
+	closed    bool
+}
+
+// Subscribe starts delivering the changes of a table `tableName`. Transactions that begin writing the table after
+// this function returns log their changes.
+func (f *ChangeFeed) Subscribe(tableName string, size int) (*Subscription, error) {
+	if size <= 0 {
+		return nil, fmt.Errorf("a subscription size must be greater than 0: %v", size)
+	}
+	sub := &Subscription{
+		feed:      f,
+		tableName: tableName,
+		c:         make(chan *Change, size),
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.subs[tableName] == nil {
+		f.subs[tableName] = map[*Subscription]struct{}{}
+		f.cancels[tableName] = f.listeners.Listen(tableName, func(payloads [][]byte) {
+			f.publish(tableName, payloads)
+		})
+	}
+	f.subs[tableName][sub] = struct{}{}
+	return sub, nil
+}
+
+// Changes returns the channel delivering the changes. The feed closes the channel when the subscription closes.
+func (s *Subscription) Changes() <-chan *Change {
+	return s.c
+}
+
+// Err returns the reason the feed closed the subscription. Err returns nil while the subscription is active, or
+// when the subscriber closed it.
+func (s *Subscription) Err() error {
+	s.feed.mu.Lock()
+	defer s.feed.mu.Unlock()
+	return s.err
+}
+
+// Close stops delivering the changes.
+func (s *Subscription) Close() {
+	s.feed.mu.Lock()
+	defer s.feed.mu.Unlock()
+	s.feed.unsubscribe(s, nil)
+}
+
+// unsubscribe closes a subscription. The caller must hold the lock.
+func (f *ChangeFeed) unsubscribe(sub *Subscription, err error) {
+	if sub.closed {
+		return
+	}
+	sub.closed = true
+	sub.err = err
+	close(sub.c)
+	delete(f.subs[sub.tableName], sub)
+	if len(f.subs[sub.tableName]) == 0 {
+		delete(f.subs, sub.tableName)
+		f.cancels[sub.tableName]()
+		delete(f.cancels, sub.tableName)
+	}
+}
+
+// loggedChange is the payload of a change record. It describes a single modification of a record.
+type loggedChange struct {
+	Kind    ChangeKind
+	BlkNum  int
+	SlotNum int
+	Old     map[string]interface{}
+	New     map[string]interface{}
+}
+
+// publish combines the modifications that a committed transaction made to a table into changes and delivers them.
+func (f *ChangeFeed) publish(tableName string, payloads [][]byte) {
+	var changes []*Change
+	// latest maps a record to its change unless the change is a delete, so that the following modifications of
+	// the record are combined into the change.
+	latest := map[RecordID]*Change{}
+	for _, payload := range payloads {
+		lc := &loggedChange{}
+		err := gob.NewDecoder(bytes.NewReader(payload)).Decode(lc)
+		if err != nil {
+			// A change record that cannot be decoded would make the subscribers miss a change, so they must
+			// read the table again.
+			f.mu.Lock()
+			for sub := range f.subs[tableName] {
+				f.unsubscribe(sub, fmt.Errorf("failed to decode a change record: %w", err))
+			}
+			f.mu.Unlock()
+			return
+		}
+		rid := RecordID{
+			blkNum:  lc.BlkNum,
+			slotNum: slotNum(lc.SlotNum),
+		}
+
+		if c, ok := latest[rid]; ok {
+			switch lc.Kind {
+			case ChangeKindUpdate:
+				c.New = lc.New
+			case ChangeKindDelete:
+				delete(latest, rid)
+				if c.Kind == ChangeKindInsert {
+					// The record never existed outside the transaction.
+					c.Kind = ""
+					continue
+				}
+				c.Kind = ChangeKindDelete
+				c.New = nil
+			}
+			continue
+		}
+
+		c := &Change{
+			Table:    tableName,
+			RecordID: rid,
+			Kind:     lc.Kind,
+			Old:      lc.Old,
+			New:      lc.New,
+		}
+		changes = append(changes, c)
+		if lc.Kind != ChangeKindDelete {
+			latest[rid] = c
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, c := range changes {
+		if c.Kind == "" {
+			continue
+		}
+		for sub := range f.subs[c.Table] {
+			select {
+			case sub.c <- c:
+			default:
+				f.unsubscribe(sub, ErrSubscriptionOverflow)
+			}
+		}
+	}
+}
+
+// readRecord returns the values of all fields of the current record.
+func (s *TableScanner) readRecord() (map[string]interface{}, error) {
+	vals := map[string]interface{}{}
+	for _, f := range s.layout.Schema.fields {
+		var v interface{}
+		var err error
+		switch f.Ty {
+		case FieldTypeInt64:
+			v, err = s.ReadInt64(f.name)
+		case FieldTypeUint64:
+			v, err = s.ReadUint64(f.name)
+		case FieldTypeString:
+			v, err = s.ReadString(f.name)
+		default:
+			return nil, fmt.Errorf("unsupported field type: %v", f.Ty)
+		}
+		if err != nil {
+			return nil, err
+		}
+		vals[f.name] = v
+	}
+	return vals, nil
+}
+
+// currentRecordID returns the ID of the current record.
+func (s *TableScanner) currentRecordID() RecordID {
+	return RecordID{
+		blkNum:  s.recPage.blk.BlkNum,
+		slotNum: s.currentSlot,
+	}
+}
+
+// logChange writes a change record describing a modification of the current record to the log.
+func (s *TableScanner) logChange(kind ChangeKind, old map[string]interface{}, new map[string]interface{}) error {
+	rid := s.currentRecordID()
+	var b bytes.Buffer
+	err := gob.NewEncoder(&b).Encode(&loggedChange{
+		Kind:    kind,
+		BlkNum:  rid.blkNum,
+		SlotNum: int(rid.slotNum),
+		Old:     old,
+		New:     new,
+	})
+	if err != nil {
+		return err
+	}
+	return s.tx.LogChange(s.tableName, b.Bytes())
+}
+
+// recordWrite writes a change record for a modification of a field of the current record when the table has
+// subscribers. `write` modifies the field.
+func (s *TableScanner) recordWrite(write func() error) error {
+	if !s.tx.CapturesChanges(s.tableName) {
+		return write()
+	}
+	old, err := s.readRecord()
+	if err != nil {
+		return err
+	}
+	err = write()
+	if err != nil {
+		return err
+	}
+	new, err := s.readRecord()
+	if err != nil {
+		return err
+	}
+	return s.logChange(ChangeKindUpdate, old, new)
+}
@@ -0,0 +1,237 @@
+package table
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/nihei9/simple-db/storage"
+)
+
+func TestChangeFeed(t *testing.T) {
+	testDir, err := os.MkdirTemp("", "simple-db-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+
+	var logFileName string
+	var tmpTableName string
+	{
+		logFilePath, dbFilePath, err := makeTestLogFileAndDBFile(testDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		logFileName = filepath.Base(logFilePath)
+		tmpTableName = strings.TrimSuffix(filepath.Base(dbFilePath), ".tbl")
+	}
+
+	ctx := context.Background()
+	st, err := storage.InitStorage(ctx, storage.TestConfig(&storage.StorageConfig{
+		DirPath:     testDir,
+		LogFileName: logFileName,
+		BlkSize:     400,
+		BufSize:     10,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	sc := NewShcema()
+	sc.Add("A", NewInt64Field())
+	sc.Add("B", NewStringField(10))
+	la := NewLayout(sc)
+
+	feed := NewChangeFeed(st.ChangeListeners())
+	sub, err := feed.Subscribe(tmpTableName, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	// run runs `f` in a transaction and returns the changes the feed delivered.
+	run := func(t *testing.T, f func(ts *TableScanner) error, commit bool) []*Change {
+		t.Helper()
+		tx, err := st.NewTransaction(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ts, err := NewTableScanner(tx, tmpTableName, la)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = f(ts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ts.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(sub.Changes()) > 0 {
+			t.Fatal("a feed must not deliver changes before a transaction commits")
+		}
+		if commit {
+			err = tx.Commit()
+		} else {
+			err = tx.Rollback()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		var changes []*Change
+		for len(sub.Changes()) > 0 {
+			changes = append(changes, <-sub.Changes())
+		}
+		return changes
+	}
+	insert := func(ts *TableScanner, a int64, b string) error {
+		err := ts.Insert()
+		if err != nil {
+			return err
+		}
+		err = ts.WriteInt64("A", a)
+		if err != nil {
+			return err
+		}
+		return ts.WriteString("B", b)
+	}
+	// find moves a scanner to the record having `a`.
+	find := func(ts *TableScanner, a int64) error {
+		err := ts.BeforeFirst()
+		if err != nil {
+			return err
+		}
+		for {
+			ok, err := ts.Next()
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return errors.New("a record was not found")
+			}
+			v, err := ts.ReadInt64("A")
+			if err != nil {
+				return err
+			}
+			if v == a {
+				return nil
+			}
+		}
+	}
+
+	var rids []RecordID
+	t.Run("a feed delivers inserts holding the values at the commit", func(t *testing.T) {
+		changes := run(t, func(ts *TableScanner) error {
+			for _, a := range []int64{1, 2} {
+				err := insert(ts, a, "x")
+				if err != nil {
+					return err
+				}
+				rid, _ := ts.RecordID()
+				rids = append(rids, *rid)
+			}
+			err := find(ts, 1)
+			if err != nil {
+				return err
+			}
+			return ts.WriteString("B", "y")
+		}, true)
+		want := []*Change{
+			{Table: tmpTableName, RecordID: rids[0], Kind: ChangeKindInsert, New: map[string]interface{}{"A": int64(1), "B": "y"}},
+			{Table: tmpTableName, RecordID: rids[1], Kind: ChangeKindInsert, New: map[string]interface{}{"A": int64(2), "B": "x"}},
+		}
+		if !reflect.DeepEqual(changes, want) {
+			t.Fatalf("unexpected changes: want: %+v, got: %+v", want, changes)
+		}
+	})
+
+	t.Run("a feed doesn't deliver rolled-back modifications", func(t *testing.T) {
+		changes := run(t, func(ts *TableScanner) error {
+			err := find(ts, 2)
+			if err != nil {
+				return err
+			}
+			err = ts.WriteInt64("A", 200)
+			if err != nil {
+				return err
+			}
+			return insert(ts, 3, "z")
+		}, false)
+		if len(changes) != 0 {
+			t.Fatalf("unexpected changes: %+v", changes)
+		}
+	})
+
+	t.Run("a feed delivers updates and deletes holding the values before the transaction", func(t *testing.T) {
+		changes := run(t, func(ts *TableScanner) error {
+			err := find(ts, 2)
+			if err != nil {
+				return err
+			}
+			err = ts.WriteInt64("A", 20)
+			if err != nil {
+				return err
+			}
+			err = ts.WriteString("B", "w")
+			if err != nil {
+				return err
+			}
+			err = find(ts, 1)
+			if err != nil {
+				return err
+			}
+			err = ts.WriteInt64("A", 10)
+			if err != nil {
+				return err
+			}
+			err = ts.Delete()
+			if err != nil {
+				return err
+			}
+			// A record inserted and deleted in the same transaction never appears.
+			err = insert(ts, 4, "v")
+			if err != nil {
+				return err
+			}
+			return ts.Delete()
+		}, true)
+		want := []*Change{
+			{Table: tmpTableName, RecordID: rids[1], Kind: ChangeKindUpdate, Old: map[string]interface{}{"A": int64(2), "B": "x"}, New: map[string]interface{}{"A": int64(20), "B": "w"}},
+			{Table: tmpTableName, RecordID: rids[0], Kind: ChangeKindDelete, Old: map[string]interface{}{"A": int64(1), "B": "y"}},
+		}
+		if !reflect.DeepEqual(changes, want) {
+			t.Fatalf("unexpected changes: want: %+v, got: %+v", want, changes)
+		}
+	})
+
+	t.Run("a feed drops a subscriber that falls behind", func(t *testing.T) {
+		slow, err := feed.Subscribe(tmpTableName, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer slow.Close()
+		run(t, func(ts *TableScanner) error {
+			for _, a := range []int64{5, 6} {
+				err := insert(ts, a, "u")
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		}, true)
+		if !errors.Is(slow.Err(), ErrSubscriptionOverflow) {
+			t.Fatalf("unexpected error: want: %v, got: %v", ErrSubscriptionOverflow, slow.Err())
+		}
+		<-slow.Changes()
+		_, ok := <-slow.Changes()
+		if ok {
+			t.Fatal("a dropped subscription must close its channel")
+		}
+	})
+}
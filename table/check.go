@@ -0,0 +1,528 @@
+package table
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/nihei9/simple-db/storage"
+)
+
+// ProblemKind classifies a problem CheckDatabase finds.
+type ProblemKind string
+
+const (
+	// ProblemCatalog means that the table_catalog or the field_catalog is inconsistent.
+	ProblemCatalog ProblemKind = "catalog"
+	// ProblemMissingFile means that a table in the table_catalog has no file.
+	ProblemMissingFile ProblemKind = "missing_file"
+	// ProblemUnreadableBlock means that a block cannot be read. In an encrypted database, a block that fails
+	// authentication is unreadable.
+	ProblemUnreadableBlock ProblemKind = "unreadable_block"
+	// ProblemPageHeader means that the header of a record page doesn't decode or is out of range.
+	ProblemPageHeader ProblemKind = "page_header"
+	// ProblemSlot means that an entry of a slot directory doesn't decode or points outside the records area.
+	ProblemSlot ProblemKind = "slot"
+	// ProblemField means that a field of a record doesn't decode or points outside the records area.
+	ProblemField ProblemKind = "field"
+	// ProblemOverflow means that an overflow chain holding a string cannot be read.
+	ProblemOverflow ProblemKind = "overflow"
+	// ProblemLog means that a log block or a log record cannot be read.
+	ProblemLog ProblemKind = "log"
+)
+
+// Problem is an inconsistency CheckDatabase finds. The fields that don't apply to a problem are omitted from its
+// JSON form.
+type Problem struct {
+	Kind    ProblemKind `json:"kind"`
+	Table   string      `json:"table,omitempty"`
+	Field   string      `json:"field,omitempty"`
+	File    string      `json:"file,omitempty"`
+	BlkNum  *int        `json:"block,omitempty"`
+	Slot    *int        `json:"slot,omitempty"`
+	Offset  *int        `json:"offset,omitempty"`
+	Message string      `json:"message"`
+}
+
+// CheckReport is the result of CheckDatabase.
+type CheckReport struct {
+	Tables     int        `json:"tables"`
+	Blocks     int        `json:"blocks"`
+	Records    int        `json:"records"`
+	LogBlocks  int        `json:"log_blocks"`
+	LogRecords int        `json:"log_records"`
+	Problems   []*Problem `json:"problems"`
+}
+
+// OK reports whether the check found no problem.
+func (r *CheckReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+// CheckDatabase checks the consistency of a database and reports all problems it finds. It checks that:
+//   - every table in the table_catalog has a file and field_catalog rows matching its slot size,
+//   - every field_catalog row belongs to a table in the table_catalog,
+//   - every block of a table file can be read,
+//   - the headers and the slot directories of record pages decode and stay within their pages,
+//   - the fields of records decode, and their strings are within their pages or in readable overflow chains, and
+//   - every log record decodes.
+//
+// CheckDatabase opens the database with StorageConfig.ReadOnly, so it creates, modifies, and removes no file, and it
+// fails for a directory that isn't a database. It doesn't recover the database either. Run it against a database that
+// was shut down cleanly; the modifications of transactions that were running at a crash may look inconsistent.
+func CheckDatabase(ctx context.Context, config *storage.StorageConfig) (*CheckReport, error) {
+	readOnlyConfig := *config
+	readOnlyConfig.ReadOnly = true
+	st, err := storage.InitStorage(ctx, &readOnlyConfig)
+	if err != nil {
+		return nil, err
+	}
+	defer st.Close()
+
+	r := &CheckReport{
+		Problems: []*Problem{},
+	}
+
+	logRes, err := st.CheckLog()
+	if err != nil {
+		return nil, err
+	}
+	r.LogBlocks = logRes.Blocks
+	r.LogRecords = logRes.Records
+	for _, p := range logRes.Problems {
+		blkNum := p.BlkNum
+		prob := &Problem{
+			Kind:    ProblemLog,
+			File:    config.LogFileName,
+			BlkNum:  &blkNum,
+			Message: p.Message,
+		}
+		if p.Offset >= 0 {
+			offset := p.Offset
+			prob.Offset = &offset
+		}
+		r.Problems = append(r.Problems, prob)
+	}
+
+	tx, err := st.NewReadOnlyTransaction(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c := &checker{
+		st: st,
+		tx: tx,
+		r:  r,
+	}
+	err = c.checkTables()
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+type checker struct {
+	st *storage.Storage
+	tx *storage.Transaction
+	r  *CheckReport
+}
+
+func (c *checker) report(p *Problem) {
+	c.r.Problems = append(c.r.Problems, p)
+}
+
+// catalogEntry is a table the catalogs describe.
+type catalogEntry struct {
+	name     string
+	slotSize int
+	layout   *Layout
+}
+
+func (c *checker) checkTables() error {
+	tm, err := newTableManager(false, c.tx)
+	if err != nil {
+		return err
+	}
+	entries, err := c.readCatalogs(tm)
+	if err != nil {
+		return err
+	}
+	c.r.Tables = len(entries)
+	for _, e := range entries {
+		if e.layout == nil {
+			continue
+		}
+		err := c.checkTable(e)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readCatalogs reads the table_catalog and the field_catalog and checks that they agree with each other. A table
+// whose fields are inconsistent has no layout, so its file isn't checked.
+func (c *checker) readCatalogs(tm *tableManager) ([]*catalogEntry, error) {
+	// Without the catalogs, the check cannot find any table.
+	for _, name := range []string{"table_catalog", "field_catalog"} {
+		ok, err := c.st.FileExists(fmt.Sprintf("%v.tbl", name))
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			c.report(&Problem{
+				Kind:    ProblemMissingFile,
+				Table:   name,
+				File:    fmt.Sprintf("%v.tbl", name),
+				Message: "a catalog file doesn't exist",
+			})
+			return nil, nil
+		}
+	}
+
+	var entries []*catalogEntry
+	byName := map[string]*catalogEntry{}
+	{
+		tabCat, err := NewTableScanner(c.tx, "table_catalog", tm.tabCatLayout)
+		if err != nil {
+			return nil, err
+		}
+		defer tabCat.Close()
+		for {
+			ok, err := tabCat.Next()
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				break
+			}
+			name, err := tabCat.ReadString("table_name")
+			if err != nil {
+				return nil, err
+			}
+			slotSize, err := tabCat.ReadInt64("slot_size")
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := byName[name]; ok {
+				c.report(&Problem{
+					Kind:    ProblemCatalog,
+					Table:   name,
+					Message: "a table appears in the table_catalog more than once",
+				})
+				continue
+			}
+			e := &catalogEntry{
+				name:     name,
+				slotSize: int(slotSize),
+			}
+			entries = append(entries, e)
+			byName[name] = e
+		}
+	}
+
+	type fieldEntry struct {
+		name   string
+		ty     FieldType
+		length int
+		offset int
+	}
+	fields := map[string][]*fieldEntry{}
+	{
+		fldCat, err := NewTableScanner(c.tx, "field_catalog", tm.fldCatLayout)
+		if err != nil {
+			return nil, err
+		}
+		defer fldCat.Close()
+		for {
+			ok, err := fldCat.Next()
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				break
+			}
+			tabName, err := fldCat.ReadString("table_name")
+			if err != nil {
+				return nil, err
+			}
+			name, err := fldCat.ReadString("field_name")
+			if err != nil {
+				return nil, err
+			}
+			ty, err := fldCat.ReadString("type")
+			if err != nil {
+				return nil, err
+			}
+			length, err := fldCat.ReadInt64("length")
+			if err != nil {
+				return nil, err
+			}
+			offset, err := fldCat.ReadInt64("offset")
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := byName[tabName]; !ok {
+				c.report(&Problem{
+					Kind:    ProblemCatalog,
+					Table:   tabName,
+					Field:   name,
+					Message: "a field belongs to a table that isn't in the table_catalog",
+				})
+				continue
+			}
+			fields[tabName] = append(fields[tabName], &fieldEntry{
+				name:   name,
+				ty:     FieldType(ty),
+				length: int(length),
+				offset: int(offset),
+			})
+		}
+	}
+
+	intSize := c.tx.Encoding().Int64Size()
+	for _, e := range entries {
+		fs := fields[e.name]
+		if len(fs) == 0 {
+			c.report(&Problem{
+				Kind:    ProblemCatalog,
+				Table:   e.name,
+				Message: "a table has no field in the field_catalog",
+			})
+			continue
+		}
+		if e.slotSize != len(fs)*intSize {
+			c.report(&Problem{
+				Kind:    ProblemCatalog,
+				Table:   e.name,
+				Message: fmt.Sprintf("the slot size doesn't match the fields: slot size: %v byte, fields: %v", e.slotSize, len(fs)),
+			})
+			continue
+		}
+		sc := NewShcema()
+		offsets := map[string]int{}
+		used := map[int]string{}
+		valid := true
+		for _, f := range fs {
+			invalid := func(format string, a ...interface{}) {
+				c.report(&Problem{
+					Kind:    ProblemCatalog,
+					Table:   e.name,
+					Field:   f.name,
+					Message: fmt.Sprintf(format, a...),
+				})
+				valid = false
+			}
+			if _, ok := offsets[f.name]; ok {
+				invalid("a field appears in the field_catalog more than once")
+				continue
+			}
+			if f.offset < 0 || f.offset+intSize > e.slotSize || f.offset%intSize != 0 {
+				invalid("the offset of a field is invalid: %v", f.offset)
+				continue
+			}
+			if other, ok := used[f.offset]; ok {
+				invalid("a field shares its offset with another field: %v", other)
+				continue
+			}
+			var fld *Field
+			switch f.ty {
+			case FieldTypeInt64:
+				fld = NewInt64Field()
+			case FieldTypeUint64:
+				fld = NewUint64Field()
+			case FieldTypeString:
+				if f.length <= 0 {
+					invalid("the length of a string field must be >0: %v", f.length)
+					continue
+				}
+				fld = NewStringField(f.length)
+			default:
+				invalid("invalid field type: %v", f.ty)
+				continue
+			}
+			sc.Add(f.name, fld)
+			offsets[f.name] = f.offset
+			used[f.offset] = f.name
+		}
+		if !valid {
+			continue
+		}
+		tablespace, err := tm.findTablespace(c.tx, e.name)
+		if err != nil {
+			return nil, err
+		}
+		e.layout = &Layout{
+			Schema:     sc,
+			offsets:    offsets,
+			slotSize:   e.slotSize,
+			enc:        c.tx.Encoding(),
+			tablespace: tablespace,
+		}
+	}
+	return entries, nil
+}
+
+// checkTable checks the records of a table.
+func (c *checker) checkTable(e *catalogEntry) error {
+	fileName := storage.TablespaceFileName(e.layout.tablespace, fmt.Sprintf("%v.tbl", e.name))
+	ok, err := c.st.FileExists(fileName)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		c.report(&Problem{
+			Kind:    ProblemMissingFile,
+			Table:   e.name,
+			File:    fileName,
+			Message: "a table file doesn't exist",
+		})
+		return nil
+	}
+	blkCount, err := c.tx.BlockCount(fileName)
+	if err != nil {
+		return err
+	}
+	c.r.Blocks += blkCount
+	for blkNum := 0; blkNum < blkCount; blkNum++ {
+		blk := storage.NewBlockID(fileName, blkNum)
+		err := c.tx.Pin(blk)
+		if err != nil {
+			c.report(&Problem{
+				Kind:    ProblemUnreadableBlock,
+				Table:   e.name,
+				File:    fileName,
+				BlkNum:  intPtr(blkNum),
+				Message: err.Error(),
+			})
+			continue
+		}
+		c.checkRecordPage(e, &recordPage{
+			tx:     c.tx,
+			blk:    blk,
+			layout: e.layout,
+			ovf:    newOverflowFile(c.tx, fileName),
+		})
+		err = c.tx.Unpin(blk)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkRecordPage checks the header, the slot directory, and the records of a record page.
+func (c *checker) checkRecordPage(e *catalogEntry, p *recordPage) {
+	blkSize := c.tx.BlockSize()
+	problem := func(kind ProblemKind, format string, a ...interface{}) *Problem {
+		return &Problem{
+			Kind:    kind,
+			Table:   e.name,
+			File:    p.blk.FileName(),
+			BlkNum:  intPtr(p.blk.BlkNum),
+			Message: fmt.Sprintf(format, a...),
+		}
+	}
+
+	var hdr [recPageHdrFieldCount]int64
+	for i := range hdr {
+		v, err := p.readHeader(i)
+		if err != nil {
+			c.report(problem(ProblemPageHeader, "failed to decode a header field: field: %v: %v", i, err))
+			return
+		}
+		hdr[i] = v
+	}
+	slotCount := hdr[recPageHdrSlotCount]
+	freeSpaceEnd := hdr[recPageHdrFreeSpaceEnd]
+	fragmented := hdr[recPageHdrFragmentedBytes]
+	// A block that was allocated but never formatted is empty.
+	if slotCount == 0 && freeSpaceEnd == 0 && fragmented == 0 {
+		return
+	}
+	if slotCount < 0 || p.slotEntryOffset(slotNum(slotCount)) > blkSize {
+		c.report(problem(ProblemPageHeader, "the slot count is out of range: %v", slotCount))
+		return
+	}
+	if freeSpaceEnd < int64(p.slotEntryOffset(slotNum(slotCount))) || freeSpaceEnd > int64(blkSize) {
+		c.report(problem(ProblemPageHeader, "the end of the free space is out of range: %v", freeSpaceEnd))
+		return
+	}
+	if fragmented < 0 || fragmented > int64(blkSize)-freeSpaceEnd {
+		c.report(problem(ProblemPageHeader, "the number of fragmented bytes is out of range: %v", fragmented))
+	}
+
+	for s := 0; s < int(slotCount); s++ {
+		slotProblem := func(kind ProblemKind, field string, format string, a ...interface{}) {
+			prob := problem(kind, format, a...)
+			prob.Slot = intPtr(s)
+			prob.Field = field
+			c.report(prob)
+		}
+		recOffset, err := c.tx.ReadInt64(p.blk.Hash, p.slotEntryOffset(slotNum(s)))
+		if err != nil {
+			slotProblem(ProblemSlot, "", "failed to decode a slot: %v", err)
+			continue
+		}
+		if recOffset == 0 {
+			continue
+		}
+		if recOffset < freeSpaceEnd || recOffset+int64(e.slotSize) > int64(blkSize) {
+			slotProblem(ProblemSlot, "", "a slot points outside the records area: %v", recOffset)
+			continue
+		}
+		c.r.Records++
+		for _, name := range sortedFieldNames(e.layout) {
+			f, _ := e.layout.Schema.Field(name)
+			offset := int(recOffset) + e.layout.offsets[name]
+			switch f.Ty {
+			case FieldTypeInt64:
+				_, err = c.tx.ReadInt64(p.blk.Hash, offset)
+			case FieldTypeUint64:
+				_, err = c.tx.ReadUint64(p.blk.Hash, offset)
+			case FieldTypeString:
+				var dataOffset int64
+				dataOffset, err = c.tx.ReadInt64(p.blk.Hash, offset)
+				if err != nil {
+					break
+				}
+				if dataOffset < 0 {
+					_, err := p.ovf.read(-dataOffset)
+					if err != nil {
+						slotProblem(ProblemOverflow, name, "failed to read an overflow chain: block: %v: %v", -dataOffset, err)
+					}
+					continue
+				}
+				if dataOffset == 0 {
+					continue
+				}
+				if dataOffset < freeSpaceEnd || dataOffset >= int64(blkSize) {
+					slotProblem(ProblemField, name, "a string points outside the records area: %v", dataOffset)
+					continue
+				}
+				_, err = c.tx.ReadString(p.blk.Hash, int(dataOffset))
+			}
+			if err != nil {
+				slotProblem(ProblemField, name, "failed to decode a field: %v", err)
+			}
+		}
+	}
+}
+
+// sortedFieldNames returns the field names of a layout in the order of their offsets, so that a report lists
+// problems in a stable order.
+func sortedFieldNames(la *Layout) []string {
+	names := la.Schema.FieldNames()
+	sort.Slice(names, func(i, j int) bool {
+		return la.offsets[names[i]] < la.offsets[names[j]]
+	})
+	return names
+}
+
+func intPtr(v int) *int {
+	return &v
+}
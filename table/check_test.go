@@ -0,0 +1,363 @@
+package table
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/nihei9/simple-db/storage"
+)
+
+func TestCheckDatabase(t *testing.T) {
+	ctx := context.Background()
+	// makeDatabase makes a database having a table `customers`. A note of the first record is long enough to go to
+	// overflow pages.
+	makeDatabase := func(t *testing.T, key []byte) *storage.StorageConfig {
+		t.Helper()
+		testDir, err := storage.MakeTestDir()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			os.RemoveAll(testDir)
+		})
+		logFilePath, _, err := makeTestLogFileAndDBFile(testDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config := storage.TestConfig(&storage.StorageConfig{
+			DirPath:       testDir,
+			LogFileName:   filepath.Base(logFilePath),
+			BlkSize:       400,
+			BufSize:       10,
+			EncryptionKey: key,
+		})
+		st, err := storage.InitStorage(ctx, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer st.Close()
+		tx, err := st.NewTransaction(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mm, err := NewMetadataManager(true, tx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sc := NewShcema()
+		sc.Add("id", NewInt64Field())
+		sc.Add("name", NewStringField(16))
+		sc.Add("note", NewStringField(8))
+		err = mm.CreateTable(tx, "customers", sc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = mm.CreateTable(tx, "empty", sc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		la, err := mm.FindLayout(tx, "customers")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ts, err := NewTableScanner(tx, "customers", la)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 20; i++ {
+			err := ts.Insert()
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = ts.WriteInt64("id", int64(i))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = ts.WriteString("name", fmt.Sprintf("customer #%v", i))
+			if err != nil {
+				t.Fatal(err)
+			}
+			note := "ok"
+			if i == 0 {
+				note = strings.Repeat("long note ", 10)
+			}
+			err = ts.WriteString("note", note)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = ts.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tx.Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return config
+	}
+	// corrupt modifies a database through a committed transaction. `f` receives the first block of the customers
+	// table and the offset of the first record in the block.
+	corrupt := func(t *testing.T, config *storage.StorageConfig, f func(tx *storage.Transaction, mm *MetadataManager, p *recordPage, recOffset int)) {
+		t.Helper()
+		st, err := storage.InitStorage(ctx, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer st.Close()
+		tx, err := st.NewTransaction(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mm, err := NewMetadataManager(false, tx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		la, err := mm.FindLayout(tx, "customers")
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := newRecordPage(tx, storage.NewBlockID("customers.tbl", 0), la)
+		if err != nil {
+			t.Fatal(err)
+		}
+		recOffset, err := p.recordOffset(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f(tx, mm, p, recOffset)
+		err = tx.Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(t *testing.T, config *storage.StorageConfig) *CheckReport {
+		t.Helper()
+		r, err := CheckDatabase(ctx, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	expectProblem := func(t *testing.T, r *CheckReport, kind ProblemKind, table string, field string) {
+		t.Helper()
+		for _, p := range r.Problems {
+			if p.Kind == kind && p.Table == table && p.Field == field {
+				return
+			}
+		}
+		b, _ := json.Marshal(r.Problems)
+		t.Fatalf("an expected problem was not found: kind: %v, table: %v, field: %v, problems: %s", kind, table, field, b)
+	}
+
+	t.Run("a consistent database has no problem", func(t *testing.T) {
+		r := check(t, makeDatabase(t, nil))
+		if !r.OK() {
+			b, _ := json.Marshal(r.Problems)
+			t.Fatalf("unexpected problems: %s", b)
+		}
+		// The catalogs are tables too.
+		if r.Tables != 6 {
+			t.Fatalf("unexpected table count: want: %v, got: %v", 6, r.Tables)
+		}
+		if r.Records < 20 || r.Blocks == 0 || r.LogRecords == 0 {
+			t.Fatalf("unexpected counts: records: %v, blocks: %v, log records: %v", r.Records, r.Blocks, r.LogRecords)
+		}
+	})
+
+	t.Run("a problem report is machine-readable", func(t *testing.T) {
+		b, err := json.Marshal(&Problem{
+			Kind:    ProblemSlot,
+			Table:   "customers",
+			BlkNum:  intPtr(0),
+			Slot:    intPtr(3),
+			Message: "broken",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := `{"kind":"slot","table":"customers","block":0,"slot":3,"message":"broken"}`
+		if string(b) != want {
+			t.Fatalf("unexpected JSON: want: %v, got: %s", want, b)
+		}
+	})
+
+	tests := []struct {
+		caption string
+		corrupt func(t *testing.T, config *storage.StorageConfig)
+		kind    ProblemKind
+		table   string
+		field   string
+	}{
+		{
+			caption: "a table without its file",
+			corrupt: func(t *testing.T, config *storage.StorageConfig) {
+				err := os.Remove(filepath.Join(config.DirPath, "empty.tbl"))
+				if err != nil {
+					t.Fatal(err)
+				}
+			},
+			kind:  ProblemMissingFile,
+			table: "empty",
+		},
+		{
+			caption: "a field of a table that doesn't exist",
+			corrupt: func(t *testing.T, config *storage.StorageConfig) {
+				corrupt(t, config, func(tx *storage.Transaction, mm *MetadataManager, p *recordPage, recOffset int) {
+					fldCat, err := NewTableScanner(tx, "field_catalog", mm.tm.fldCatLayout)
+					if err != nil {
+						t.Fatal(err)
+					}
+					defer fldCat.Close()
+					err = fldCat.Insert()
+					if err != nil {
+						t.Fatal(err)
+					}
+					err = fldCat.WriteString("table_name", "ghost")
+					if err != nil {
+						t.Fatal(err)
+					}
+					err = fldCat.WriteString("field_name", "boo")
+					if err != nil {
+						t.Fatal(err)
+					}
+				})
+			},
+			kind:  ProblemCatalog,
+			table: "ghost",
+			field: "boo",
+		},
+		{
+			caption: "a slot pointing outside the records area",
+			corrupt: func(t *testing.T, config *storage.StorageConfig) {
+				corrupt(t, config, func(tx *storage.Transaction, mm *MetadataManager, p *recordPage, recOffset int) {
+					err := p.setSlot(1, 1, true)
+					if err != nil {
+						t.Fatal(err)
+					}
+				})
+			},
+			kind:  ProblemSlot,
+			table: "customers",
+		},
+		{
+			caption: "a string whose header doesn't decode",
+			corrupt: func(t *testing.T, config *storage.StorageConfig) {
+				corrupt(t, config, func(tx *storage.Transaction, mm *MetadataManager, p *recordPage, recOffset int) {
+					dataOffset, err := tx.ReadInt64(p.blk.Hash, recOffset+p.layout.offsets["name"])
+					if err != nil {
+						t.Fatal(err)
+					}
+					err = tx.WriteInt64(p.blk.Hash, int(dataOffset), 60000, true)
+					if err != nil {
+						t.Fatal(err)
+					}
+				})
+			},
+			kind:  ProblemField,
+			table: "customers",
+			field: "name",
+		},
+		{
+			caption: "a broken overflow chain",
+			corrupt: func(t *testing.T, config *storage.StorageConfig) {
+				corrupt(t, config, func(tx *storage.Transaction, mm *MetadataManager, p *recordPage, recOffset int) {
+					err := tx.WriteInt64(p.blk.Hash, recOffset+p.layout.offsets["note"], -1000, true)
+					if err != nil {
+						t.Fatal(err)
+					}
+				})
+			},
+			kind:  ProblemOverflow,
+			table: "customers",
+			field: "note",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.caption, func(t *testing.T) {
+			config := makeDatabase(t, nil)
+			tt.corrupt(t, config)
+			expectProblem(t, check(t, config), tt.kind, tt.table, tt.field)
+		})
+	}
+
+	t.Run("a check modifies no file", func(t *testing.T) {
+		config := makeDatabase(t, nil)
+		// A storage opened for writing removes temporary files that a previous run left.
+		err := os.WriteFile(filepath.Join(config.DirPath, storage.TempFilePrefix+"left"), []byte("temp"), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		snapshot := func(t *testing.T) map[string]string {
+			t.Helper()
+			entries, err := os.ReadDir(config.DirPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			files := map[string]string{}
+			for _, e := range entries {
+				b, err := os.ReadFile(filepath.Join(config.DirPath, e.Name()))
+				if err != nil {
+					t.Fatal(err)
+				}
+				files[e.Name()] = string(b)
+			}
+			return files
+		}
+		before := snapshot(t)
+		check(t, config)
+		after := snapshot(t)
+		if !reflect.DeepEqual(after, before) {
+			t.Fatal("a check must not create, modify, or remove files")
+		}
+	})
+
+	t.Run("a check fails for a directory that isn't a database", func(t *testing.T) {
+		testDir, err := storage.MakeTestDir()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(testDir)
+		for _, dirPath := range []string{testDir, filepath.Join(testDir, "missing")} {
+			_, err := CheckDatabase(ctx, &storage.StorageConfig{
+				DirPath:     dirPath,
+				LogFileName: "log",
+				BlkSize:     400,
+				BufSize:     10,
+			})
+			if err == nil {
+				t.Fatalf("a check must fail: %v", dirPath)
+			}
+		}
+		entries, err := os.ReadDir(testDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 0 {
+			t.Fatalf("a check must not create files: %v", entries)
+		}
+	})
+
+	t.Run("a block that fails authentication is unreadable", func(t *testing.T) {
+		config := makeDatabase(t, bytes.Repeat([]byte{0x5a}, 32))
+		path := filepath.Join(config.DirPath, "customers.tbl")
+		b, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b[len(b)-1] ^= 0x01
+		err = os.WriteFile(path, b, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := check(t, config)
+		expectProblem(t, r, ProblemUnreadableBlock, "customers", "")
+	})
+}
@@ -0,0 +1,176 @@
+package table
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nihei9/simple-db/storage"
+)
+
+// TestTableScanner_compression loads the same rows into a plain table and a compressed one and compares the sizes
+// of the files. The rows look like the ones a real application stores: short strings in fields declared long
+// enough for the longest value, and numbers much smaller than their fields.
+func TestTableScanner_compression(t *testing.T) {
+	if os.Getenv(storage.TestCompressionEnv) != "" {
+		t.Skipf("%v compresses both tables", storage.TestCompressionEnv)
+	}
+
+	type customer struct {
+		id      int64
+		name    string
+		email   string
+		city    string
+		balance uint64
+	}
+	cities := []string{"Tokyo", "Osaka", "Nagoya", "Sapporo", "Fukuoka", "Kobe", "Kyoto", "Sendai"}
+	firstNames := []string{"Haruto", "Yui", "Sota", "Hina", "Ren", "Aoi", "Minato", "Sakura"}
+	lastNames := []string{"Sato", "Suzuki", "Takahashi", "Tanaka", "Watanabe", "Ito", "Yamamoto", "Nakamura"}
+	customers := make([]*customer, 1000)
+	for i := range customers {
+		first := firstNames[i%len(firstNames)]
+		last := lastNames[(i/len(firstNames))%len(lastNames)]
+		customers[i] = &customer{
+			id:      int64(i + 1),
+			name:    fmt.Sprintf("%v %v", first, last),
+			email:   fmt.Sprintf("%v.%v%v@example.com", strings.ToLower(first), strings.ToLower(last), i),
+			city:    cities[(i*7)%len(cities)],
+			balance: uint64((i * 7919) % 100000),
+		}
+	}
+
+	sc := NewShcema()
+	sc.Add("id", NewInt64Field())
+	sc.Add("name", NewStringField(40))
+	sc.Add("email", NewStringField(64))
+	sc.Add("city", NewStringField(32))
+	sc.Add("balance", NewUint64Field())
+	la := NewLayout(sc)
+
+	// load loads the rows into a table and returns the number of bytes the table occupies on a disk.
+	load := func(t *testing.T, compress bool) int64 {
+		t.Helper()
+		testDir, err := os.MkdirTemp("", "simple-db-test-*")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(testDir)
+
+		logFilePath, dbFilePath, err := makeTestLogFileAndDBFile(testDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tableName := strings.TrimSuffix(filepath.Base(dbFilePath), ".tbl")
+
+		ctx := context.Background()
+		st, err := storage.InitStorage(ctx, storage.TestConfig(&storage.StorageConfig{
+			DirPath:        testDir,
+			LogFileName:    filepath.Base(logFilePath),
+			BlkSize:        4096,
+			BufSize:        16,
+			CompressTables: compress,
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer st.Close()
+
+		tx, err := st.NewTransaction(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ts, err := NewTableScanner(tx, tableName, la)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range customers {
+			err := ts.Insert()
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = ts.WriteInt64("id", c.id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = ts.WriteString("name", c.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = ts.WriteString("email", c.email)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = ts.WriteString("city", c.city)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = ts.WriteUint64("balance", c.balance)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = ts.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tx.Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Reads through the buffer manager don't depend on the format of the file.
+		tx, err = st.NewReadOnlyTransaction(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tx.Commit()
+		ts, err = NewTableScanner(tx, tableName, la)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ts.Close()
+		for _, c := range customers {
+			ok, err := ts.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ok {
+				t.Fatal("a record was not found")
+			}
+			id, err := ts.ReadInt64("id")
+			if err != nil {
+				t.Fatal(err)
+			}
+			email, err := ts.ReadString("email")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if id != c.id || email != c.email {
+				t.Fatalf("unexpected record: want: %v %v, got: %v %v", c.id, c.email, id, email)
+			}
+		}
+
+		var size int64
+		for _, name := range []string{dbFilePath, dbFilePath + ".pagemap"} {
+			s, err := os.Stat(name)
+			if err != nil {
+				if os.IsNotExist(err) {
+					continue
+				}
+				t.Fatal(err)
+			}
+			size += s.Size()
+		}
+		return size
+	}
+
+	plain := load(t, false)
+	compressed := load(t, true)
+	t.Logf("rows: %v, plain: %v byte, compressed: %v byte (%.1f%%)", len(customers), plain, compressed, float64(compressed)*100/float64(plain))
+	if compressed*2 > plain {
+		t.Fatalf("compression must save at least half of the space: plain: %v byte, compressed: %v byte", plain, compressed)
+	}
+}
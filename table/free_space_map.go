@@ -0,0 +1,162 @@
+package table
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/nihei9/simple-db/storage"
+)
+
+const (
+	fsmEntryNotFull int64 = 0
+	fsmEntryFull    int64 = 1
+)
+
+// freeSpaceMap records which blocks of a table are full. The map is kept in a side file and each entry is an int64
+// that corresponds to a block of the table file. An entry having 0 means that the block may have a free slot, and
+// an entry having 1 means that the block is full. Blocks that the map doesn't cover yet are also regarded as
+// candidates, so a table having no map file works fine.
+//
+// Entries are written without locks and undone with the records. A stale "not full" entry only costs a try.
+type freeSpaceMap struct {
+	tx            *storage.Transaction
+	fileName      string
+	tableFileName string
+	entrySize     int
+}
+
+func newFreeSpaceMap(tx *storage.Transaction, tableFileName string) *freeSpaceMap {
+	return &freeSpaceMap{
+		tx:            tx,
+		fileName:      fmt.Sprintf("%v.fsm", strings.TrimSuffix(tableFileName, ".tbl")),
+		tableFileName: tableFileName,
+		entrySize:     tx.Encoding().Int64Size(),
+	}
+}
+
+// findCandidate returns the number of a block that may have a free slot. When all blocks are full, the second
+// return value is `false`.
+func (m *freeSpaceMap) findCandidate() (int, bool, error) {
+	tabBlkCount, err := m.tx.BlockCount(m.tableFileName)
+	if err != nil {
+		return 0, false, err
+	}
+	fsmBlkCount, err := m.tx.HintBlockCount(m.fileName)
+	if err != nil {
+		return 0, false, err
+	}
+	entriesPerBlk := m.entriesPerBlock()
+	for fsmBlkNum := 0; fsmBlkNum < fsmBlkCount; fsmBlkNum++ {
+		if fsmBlkNum*entriesPerBlk >= tabBlkCount {
+			return 0, false, nil
+		}
+		blkNum, ok, err := m.findCandidateInBlock(fsmBlkNum, tabBlkCount)
+		if err != nil {
+			return 0, false, err
+		}
+		if ok {
+			return blkNum, true, nil
+		}
+	}
+	// The map doesn't cover the remaining blocks yet.
+	if fsmBlkCount*entriesPerBlk < tabBlkCount {
+		return fsmBlkCount * entriesPerBlk, true, nil
+	}
+	return 0, false, nil
+}
+
+func (m *freeSpaceMap) findCandidateInBlock(fsmBlkNum int, tabBlkCount int) (int, bool, error) {
+	blk := storage.NewBlockID(m.fileName, fsmBlkNum)
+	err := m.tx.Pin(blk)
+	if err != nil {
+		return 0, false, err
+	}
+	defer m.tx.Unpin(blk)
+
+	entriesPerBlk := m.entriesPerBlock()
+	for i := 0; i < entriesPerBlk; i++ {
+		blkNum := fsmBlkNum*entriesPerBlk + i
+		if blkNum >= tabBlkCount {
+			break
+		}
+		v, err := m.tx.ReadHintInt64(blk.Hash, i*m.entrySize)
+		if err != nil {
+			return 0, false, err
+		}
+		if v == fsmEntryNotFull {
+			return blkNum, true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+// markFull records whether a block of the table is full or not.
+func (m *freeSpaceMap) markFull(blkNum int, full bool) error {
+	if blkNum < 0 {
+		return fmt.Errorf("a negative block number is invalid: %v", blkNum)
+	}
+
+	entriesPerBlk := m.entriesPerBlock()
+	blk, err := m.extendTo(blkNum / entriesPerBlk)
+	if err != nil {
+		return err
+	}
+	err = m.tx.Pin(blk)
+	if err != nil {
+		return err
+	}
+	defer m.tx.Unpin(blk)
+
+	offset := (blkNum % entriesPerBlk) * m.entrySize
+	v := fsmEntryNotFull
+	if full {
+		v = fsmEntryFull
+	}
+	cur, err := m.tx.ReadHintInt64(blk.Hash, offset)
+	if err != nil {
+		return err
+	}
+	if cur == v {
+		return nil
+	}
+	return m.tx.WriteHintInt64(blk.Hash, offset, v)
+}
+
+// extendTo allocates and formats blocks of the map file until the file contains the block `fsmBlkNum`.
+func (m *freeSpaceMap) extendTo(fsmBlkNum int) (*storage.BlockID, error) {
+	c, err := m.tx.HintBlockCount(m.fileName)
+	if err != nil {
+		return nil, err
+	}
+	for ; c <= fsmBlkNum; c++ {
+		blk, err := m.tx.AllocHintBlock(m.fileName)
+		if err != nil {
+			return nil, err
+		}
+		err = m.format(blk)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return storage.NewBlockID(m.fileName, fsmBlkNum), nil
+}
+
+func (m *freeSpaceMap) format(blk *storage.BlockID) error {
+	err := m.tx.Pin(blk)
+	if err != nil {
+		return err
+	}
+	defer m.tx.Unpin(blk)
+
+	for i := 0; i < m.entriesPerBlock(); i++ {
+		err := m.tx.WriteHintInt64(blk.Hash, i*m.entrySize, fsmEntryNotFull)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *freeSpaceMap) entriesPerBlock() int {
+	return m.tx.BlockSize() / m.entrySize
+}
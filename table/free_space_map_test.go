@@ -0,0 +1,288 @@
+package table
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nihei9/simple-db/storage"
+)
+
+func TestFreeSpaceMap(t *testing.T) {
+	testDir, err := storage.MakeTestDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+
+	var logFileName string
+	var tmpTableName string
+	{
+		logFilePath, dbFilePath, err := makeTestLogFileAndDBFile(testDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		logFileName = filepath.Base(logFilePath)
+		tmpTableName = strings.TrimSuffix(filepath.Base(dbFilePath), ".tbl")
+	}
+
+	st, err := storage.InitStorage(context.Background(), storage.TestConfig(&storage.StorageConfig{
+		DirPath:     testDir,
+		LogFileName: logFileName,
+		BlkSize:     400,
+		BufSize:     10,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sc := NewShcema()
+	sc.Add("A", NewInt64Field())
+	la := NewLayout(sc)
+
+	// Fill some blocks.
+	{
+		tx, err := st.NewTransaction(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		ts, err := NewTableScanner(tx, tmpTableName, la)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 50; i++ {
+			err := ts.Insert()
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = ts.WriteInt64("A", int64(i))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = ts.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tx.Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var lastBlkNum int
+	{
+		tx, err := st.NewTransaction(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		lastBlkNum, err = tx.BlockCount(tmpTableName + ".tbl")
+		if err != nil {
+			t.Fatal(err)
+		}
+		lastBlkNum--
+		if lastBlkNum < 2 {
+			t.Fatalf("the test data must span three or more blocks: got: %v blocks", lastBlkNum+1)
+		}
+		fsm := newFreeSpaceMap(tx, tmpTableName+".tbl")
+		blkNum, ok, err := fsm.findCandidate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok || blkNum != lastBlkNum {
+			t.Fatalf("only the last block can be a candidate: want: %v, got: %v (%v)", lastBlkNum, blkNum, ok)
+		}
+		err = tx.Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deleteFirstRecord := func(tx *storage.Transaction) {
+		ts, err := NewTableScanner(tx, tmpTableName, la)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ts.Close()
+		ok, err := ts.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			t.Fatal("a record was not found")
+		}
+		err = ts.Delete()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	insertRecord := func(tx *storage.Transaction) *RecordID {
+		ts, err := NewTableScanner(tx, tmpTableName, la)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ts.Close()
+		// Insert from the last block so that the scanner must consult the free-space map.
+		err = ts.moveToBlock(lastBlkNum)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for {
+			err := ts.Insert()
+			if err != nil {
+				t.Fatal(err)
+			}
+			rid, ok := ts.RecordID()
+			if !ok {
+				t.Fatal("RecordID must return `true`")
+			}
+			if rid.blkNum != lastBlkNum {
+				return rid
+			}
+		}
+	}
+
+	t.Run("rolling back a deletion rolls back the entry of its block", func(t *testing.T) {
+		tx, err := st.NewTransaction(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		deleteFirstRecord(tx)
+		err = tx.Rollback()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tx, err = st.NewTransaction(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tx.Rollback()
+		fsm := newFreeSpaceMap(tx, tmpTableName+".tbl")
+		blkNum, ok, err := fsm.findCandidate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok && blkNum == 0 {
+			t.Fatal("the first block must not be a candidate")
+		}
+	})
+
+	t.Run("rolling back an insertion that filled a block rolls back the entry of the block", func(t *testing.T) {
+		tx, err := st.NewTransaction(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		insertRecord(tx)
+		fsm := newFreeSpaceMap(tx, tmpTableName+".tbl")
+		blkNum, ok, err := fsm.findCandidate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok && blkNum == lastBlkNum {
+			t.Fatal("an insertion must mark the full block full")
+		}
+		err = tx.Rollback()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tx, err = st.NewTransaction(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tx.Rollback()
+		fsm = newFreeSpaceMap(tx, tmpTableName+".tbl")
+		blkNum, ok, err = fsm.findCandidate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok || blkNum != lastBlkNum {
+			t.Fatalf("the last block must be a candidate again: want: %v, got: %v (%v)", lastBlkNum, blkNum, ok)
+		}
+	})
+
+	t.Run("an insertion jumps to a block having a free slot", func(t *testing.T) {
+		tx, err := st.NewTransaction(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		deleteFirstRecord(tx)
+		err = tx.Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tx, err = st.NewTransaction(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		rid := insertRecord(tx)
+		if rid.blkNum != 0 {
+			t.Fatalf("a record must be inserted into the first block: got: %v", rid.blkNum)
+		}
+		err = tx.Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("an update of the map doesn't block other transactions consulting it", func(t *testing.T) {
+		tx1, err := st.NewTransaction(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tx1.Rollback()
+		// At least one of the calls changes the entry.
+		fsm1 := newFreeSpaceMap(tx1, tmpTableName+".tbl")
+		for _, full := range []bool{true, false} {
+			err := fsm1.markFull(0, full)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		tx2, err := st.NewTransaction(context.Background(), storage.WithLockTimeout(100*time.Millisecond))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tx2.Rollback()
+		fsm := newFreeSpaceMap(tx2, tmpTableName+".tbl")
+		_, _, err = fsm.findCandidate()
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("an extension of the map doesn't block other transactions consulting or extending it", func(t *testing.T) {
+		tx1, err := st.NewTransaction(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tx1.Rollback()
+		fsm1 := newFreeSpaceMap(tx1, tmpTableName+".tbl")
+		err = fsm1.markFull(fsm1.entriesPerBlock()*2, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tx2, err := st.NewTransaction(context.Background(), storage.WithLockTimeout(100*time.Millisecond))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tx2.Rollback()
+		fsm2 := newFreeSpaceMap(tx2, tmpTableName+".tbl")
+		_, _, err = fsm2.findCandidate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = fsm2.markFull(fsm2.entriesPerBlock()*3, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
@@ -0,0 +1,195 @@
+package table
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/nihei9/simple-db/storage"
+)
+
+// PageDump is a decoded record page.
+type PageDump struct {
+	Table           string `json:"table"`
+	File            string `json:"file"`
+	BlkNum          int    `json:"block"`
+	SlotCount       int64  `json:"slot_count"`
+	FreeSpaceEnd    int64  `json:"free_space_end"`
+	FragmentedBytes int64  `json:"fragmented_bytes"`
+
+	Slots []*SlotDump `json:"slots"`
+
+	// Error is set when the header of a page cannot be decoded. A page having an error has no slot.
+	Error string `json:"error,omitempty"`
+}
+
+// SlotDump is an entry of a slot directory and the record it points to.
+type SlotDump struct {
+	Slot int  `json:"slot"`
+	Used bool `json:"used"`
+
+	// EntryOffset is the offset of the entry in its page, and RecordOffset is the value the entry holds.
+	EntryOffset  int   `json:"entry_offset"`
+	RecordOffset int64 `json:"record_offset"`
+
+	Fields []*FieldDump `json:"fields,omitempty"`
+	Error  string       `json:"error,omitempty"`
+}
+
+// FieldDump is a field of a record.
+type FieldDump struct {
+	Name string    `json:"name"`
+	Type FieldType `json:"type"`
+
+	// Offset is the offset of the field in its page. Raw is the integer stored at the offset; for a string
+	// field, it is the offset of the string data, or the number of the first overflow block with its sign
+	// inverted.
+	Offset int   `json:"offset"`
+	Raw    int64 `json:"raw"`
+
+	Value interface{} `json:"value,omitempty"`
+	Error string      `json:"error,omitempty"`
+}
+
+// InspectBlock decodes a block of a table using the layout the MetadataManager holds. It decodes the header, every
+// slot including free ones, and the fields of the records the used slots point to. Like CheckDatabase,
+// InspectBlock only reads the database, and a part of the page that cannot be decoded doesn't stop it; the dump
+// of the part holds an error instead.
+func InspectBlock(ctx context.Context, config *storage.StorageConfig, tableName string, blkNum int) (*PageDump, error) {
+	st, err := storage.InitStorage(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	defer st.Close()
+	tx, err := st.NewReadOnlyTransaction(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Commit()
+
+	mm, err := NewMetadataManager(false, tx)
+	if err != nil {
+		return nil, err
+	}
+	la, err := mm.FindLayout(tx, tableName)
+	if err != nil {
+		return nil, err
+	}
+	fileName := storage.TablespaceFileName(la.tablespace, fmt.Sprintf("%v.tbl", tableName))
+	ok, err := st.FileExists(fileName)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("a table file doesn't exist: %v", fileName)
+	}
+	blkCount, err := tx.BlockCount(fileName)
+	if err != nil {
+		return nil, err
+	}
+	if blkNum < 0 || blkNum >= blkCount {
+		return nil, fmt.Errorf("a block is out of range: block: %v, block count: %v", blkNum, blkCount)
+	}
+	p, err := newRecordPage(tx, storage.NewBlockID(fileName, blkNum), la)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Unpin(p.blk)
+	return inspectRecordPage(tableName, p), nil
+}
+
+func inspectRecordPage(tableName string, p *recordPage) *PageDump {
+	d := &PageDump{
+		Table:  tableName,
+		File:   p.blk.FileName(),
+		BlkNum: p.blk.BlkNum,
+		Slots:  []*SlotDump{},
+	}
+	var hdr [recPageHdrFieldCount]int64
+	for i := range hdr {
+		v, err := p.readHeader(i)
+		if err != nil {
+			d.Error = fmt.Sprintf("failed to decode a header field: field: %v: %v", i, err)
+			return d
+		}
+		hdr[i] = v
+	}
+	d.SlotCount = hdr[recPageHdrSlotCount]
+	d.FreeSpaceEnd = hdr[recPageHdrFreeSpaceEnd]
+	d.FragmentedBytes = hdr[recPageHdrFragmentedBytes]
+	blkSize := p.tx.BlockSize()
+	if d.SlotCount < 0 || p.slotEntryOffset(slotNum(d.SlotCount)) > blkSize {
+		d.Error = fmt.Sprintf("the slot count is out of range: %v", d.SlotCount)
+		return d
+	}
+
+	for s := 0; s < int(d.SlotCount); s++ {
+		sd := &SlotDump{
+			Slot:        s,
+			EntryOffset: p.slotEntryOffset(slotNum(s)),
+		}
+		d.Slots = append(d.Slots, sd)
+		recOffset, err := p.tx.ReadInt64(p.blk.Hash, sd.EntryOffset)
+		if err != nil {
+			sd.Error = fmt.Sprintf("failed to decode a slot: %v", err)
+			continue
+		}
+		sd.RecordOffset = recOffset
+		if recOffset == 0 {
+			continue
+		}
+		sd.Used = true
+		if recOffset < 0 || recOffset+int64(p.layout.slotSize) > int64(blkSize) {
+			sd.Error = fmt.Sprintf("a slot points outside the page: %v", recOffset)
+			continue
+		}
+		for _, name := range sortedFieldNames(p.layout) {
+			sd.Fields = append(sd.Fields, inspectField(p, int(recOffset), name))
+		}
+	}
+	return d
+}
+
+func inspectField(p *recordPage, recOffset int, name string) *FieldDump {
+	f, _ := p.layout.Schema.Field(name)
+	fd := &FieldDump{
+		Name:   name,
+		Type:   f.Ty,
+		Offset: recOffset + p.layout.offsets[name],
+	}
+	var err error
+	switch f.Ty {
+	case FieldTypeInt64:
+		var v int64
+		v, err = p.tx.ReadInt64(p.blk.Hash, fd.Offset)
+		fd.Raw = v
+		fd.Value = v
+	case FieldTypeUint64:
+		var v uint64
+		v, err = p.tx.ReadUint64(p.blk.Hash, fd.Offset)
+		fd.Raw = int64(v)
+		fd.Value = v
+	case FieldTypeString:
+		fd.Raw, err = p.tx.ReadInt64(p.blk.Hash, fd.Offset)
+		if err != nil {
+			break
+		}
+		var v string
+		switch {
+		case fd.Raw == 0:
+		case fd.Raw < 0:
+			v, err = p.ovf.read(-fd.Raw)
+		case fd.Raw >= int64(p.tx.BlockSize()):
+			err = fmt.Errorf("a string points outside the page: %v", fd.Raw)
+		default:
+			v, err = p.tx.ReadString(p.blk.Hash, int(fd.Raw))
+		}
+		if err == nil {
+			fd.Value = v
+		}
+	}
+	if err != nil {
+		fd.Value = nil
+		fd.Error = err.Error()
+	}
+	return fd
+}
@@ -0,0 +1,158 @@
+package table
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nihei9/simple-db/storage"
+)
+
+func TestInspectBlock(t *testing.T) {
+	ctx := context.Background()
+	testDir, err := storage.MakeTestDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+	logFilePath, _, err := makeTestLogFileAndDBFile(testDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := storage.TestConfig(&storage.StorageConfig{
+		DirPath:     testDir,
+		LogFileName: filepath.Base(logFilePath),
+		BlkSize:     400,
+		BufSize:     10,
+	})
+	longNote := strings.Repeat("long note ", 10)
+	{
+		st, err := storage.InitStorage(ctx, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tx, err := st.NewTransaction(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mm, err := NewMetadataManager(true, tx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sc := NewShcema()
+		sc.Add("id", NewInt64Field())
+		sc.Add("note", NewStringField(8))
+		err = mm.CreateTable(tx, "customers", sc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		la, err := mm.FindLayout(tx, "customers")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ts, err := NewTableScanner(tx, "customers", la)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, note := range []string{"a", "b", longNote} {
+			err := ts.Insert()
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = ts.WriteInt64("id", int64(i))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = ts.WriteString("note", note)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		// Leave a free slot between used ones.
+		err = ts.BeforeFirst()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = ts.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = ts.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ts.Delete()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ts.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tx.Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+		st.Close()
+	}
+
+	d, err := InspectBlock(ctx, config, "customers", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Error != "" {
+		t.Fatalf("unexpected error: %v", d.Error)
+	}
+	if d.File != "customers.tbl" || d.SlotCount != 3 || len(d.Slots) != 3 {
+		t.Fatalf("unexpected page: file: %v, slot count: %v, slots: %v", d.File, d.SlotCount, len(d.Slots))
+	}
+	if !d.Slots[0].Used || d.Slots[1].Used || !d.Slots[2].Used {
+		t.Fatalf("unexpected used flags: %v, %v, %v", d.Slots[0].Used, d.Slots[1].Used, d.Slots[2].Used)
+	}
+	if d.Slots[1].RecordOffset != 0 || len(d.Slots[1].Fields) != 0 {
+		t.Fatalf("a free slot must have no record: %+v", d.Slots[1])
+	}
+	tests := []struct {
+		slot   int
+		id     int64
+		note   string
+		inPage bool
+	}{
+		{slot: 0, id: 0, note: "a", inPage: true},
+		{slot: 2, id: 2, note: longNote, inPage: false},
+	}
+	for _, tt := range tests {
+		s := d.Slots[tt.slot]
+		if len(s.Fields) != 2 {
+			t.Fatalf("unexpected field count: want: %v, got: %v", 2, len(s.Fields))
+		}
+		id, note := s.Fields[0], s.Fields[1]
+		if id.Name != "id" || id.Value != tt.id || id.Offset != int(s.RecordOffset) {
+			t.Fatalf("unexpected field: %+v", id)
+		}
+		if note.Name != "note" || note.Value != tt.note || note.Error != "" {
+			t.Fatalf("unexpected field: %+v", note)
+		}
+		// A string in the page has the positive offset of its data, and a string in overflow pages has a negative
+		// block number.
+		if (note.Raw > 0) != tt.inPage {
+			t.Fatalf("unexpected raw value: %v", note.Raw)
+		}
+	}
+
+	t.Run("a block out of range is an error", func(t *testing.T) {
+		_, err := InspectBlock(ctx, config, "customers", 1000)
+		if err == nil {
+			t.Fatal("InspectBlock must fail")
+		}
+	})
+
+	t.Run("an unknown table is an error", func(t *testing.T) {
+		_, err := InspectBlock(ctx, config, "ghost", 0)
+		if err == nil {
+			t.Fatal("InspectBlock must fail")
+		}
+	})
+}
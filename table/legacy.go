@@ -0,0 +1,252 @@
+package table
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"unicode/utf8"
+
+	"github.com/nihei9/simple-db/storage"
+)
+
+// ErrLegacyDatabase means that a database is a legacy one using storage.EncodingLegacy. The table files of such
+// a database hold records in fixed-size slots, which a table scanner cannot read. Use MigrateDatabase to convert
+// the database into the current format.
+var ErrLegacyDatabase = errors.New("a database stores records in the legacy fixed-slot format; migrate it with MigrateDatabase")
+
+// legacyLayout is the layout of a table in a legacy database. A record occupies a slot of `slotSize` bytes, and
+// a slot begins with a flag that is 1 when the slot is used and 0 when it is free. Every block of a table file
+// holds as many slots as fit in it.
+type legacyLayout struct {
+	schema   *Schema
+	offsets  map[string]int
+	slotSize int
+}
+
+// newLegacyLayout computes the layout of a table in the same way as a legacy database: every value reserves
+// the maximum size a varint or a string of `length` characters occupies.
+func newLegacyLayout(sc *Schema) *legacyLayout {
+	offsets := map[string]int{}
+	pos := storage.CalcBytesNeeded(binary.MaxVarintLen64)
+	for _, f := range sc.fields {
+		offsets[f.name] = pos
+		switch f.Ty {
+		case FieldTypeInt64, FieldTypeUint64:
+			pos += storage.CalcBytesNeeded(binary.MaxVarintLen64)
+		case FieldTypeString:
+			pos += storage.CalcBytesNeeded(f.length * utf8.UTFMax)
+		}
+	}
+	return &legacyLayout{
+		schema:   sc,
+		offsets:  offsets,
+		slotSize: pos,
+	}
+}
+
+// legacyCatalogs reads the catalogs of a legacy database.
+type legacyCatalogs struct {
+	tx           *storage.Transaction
+	tabCatLayout *legacyLayout
+	fldCatLayout *legacyLayout
+}
+
+func newLegacyCatalogs(tx *storage.Transaction) *legacyCatalogs {
+	tabCatSchema := NewShcema()
+	tabCatSchema.Add("table_name", NewStringField(64))
+	tabCatSchema.Add("slot_size", NewInt64Field())
+
+	// A legacy database declares `type` as an int64 field but stores the name of a type as a string in it. Both
+	// take the same space, so the declaration determines the layout and the reader reads a string.
+	fldCatSchema := NewShcema()
+	fldCatSchema.Add("table_name", NewStringField(64))
+	fldCatSchema.Add("field_name", NewStringField(64))
+	fldCatSchema.Add("type", NewInt64Field())
+	fldCatSchema.Add("length", NewInt64Field())
+	fldCatSchema.Add("offset", NewInt64Field())
+
+	return &legacyCatalogs{
+		tx:           tx,
+		tabCatLayout: newLegacyLayout(tabCatSchema),
+		fldCatLayout: newLegacyLayout(fldCatSchema),
+	}
+}
+
+func (c *legacyCatalogs) tableNames() ([]string, error) {
+	var names []string
+	err := scanLegacyTable(c.tx, "table_catalog", c.tabCatLayout, func(rec *legacyRecord) error {
+		n, err := rec.ReadString("table_name")
+		if err != nil {
+			return err
+		}
+		names = append(names, n)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+func (c *legacyCatalogs) findLayout(tabName string) (*legacyLayout, error) {
+	slotSize := 0
+	err := scanLegacyTable(c.tx, "table_catalog", c.tabCatLayout, func(rec *legacyRecord) error {
+		n, err := rec.ReadString("table_name")
+		if err != nil {
+			return err
+		}
+		if n != tabName {
+			return nil
+		}
+		s, err := rec.ReadInt64("slot_size")
+		if err != nil {
+			return err
+		}
+		slotSize = int(s)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if slotSize <= 0 {
+		return nil, fmt.Errorf("a table was not found in the table_catalog: %v", tabName)
+	}
+
+	sc := NewShcema()
+	offsets := map[string]int{}
+	err = scanLegacyTable(c.tx, "field_catalog", c.fldCatLayout, func(rec *legacyRecord) error {
+		n, err := rec.ReadString("table_name")
+		if err != nil {
+			return err
+		}
+		if n != tabName {
+			return nil
+		}
+		name, err := rec.ReadString("field_name")
+		if err != nil {
+			return err
+		}
+		ty, err := rec.ReadString("type")
+		if err != nil {
+			return err
+		}
+		length, err := rec.ReadInt64("length")
+		if err != nil {
+			return err
+		}
+		offset, err := rec.ReadInt64("offset")
+		if err != nil {
+			return err
+		}
+
+		var fld *Field
+		switch FieldType(ty) {
+		case FieldTypeInt64:
+			fld = NewInt64Field()
+		case FieldTypeUint64:
+			fld = NewUint64Field()
+		case FieldTypeString:
+			fld = NewStringField(int(length))
+		default:
+			return fmt.Errorf("invalid field type: %v", ty)
+		}
+		sc.Add(name, fld)
+		offsets[name] = int(offset)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &legacyLayout{
+		schema:   sc,
+		offsets:  offsets,
+		slotSize: slotSize,
+	}, nil
+}
+
+// legacyRecord is a record in a slot of a legacy table file.
+type legacyRecord struct {
+	tx         *storage.Transaction
+	blk        *storage.BlockID
+	slotOffset int
+	layout     *legacyLayout
+}
+
+func (r *legacyRecord) offset(fieldName string) (int, error) {
+	o, ok := r.layout.offsets[fieldName]
+	if !ok {
+		return 0, fmt.Errorf("invalid field name: %v", fieldName)
+	}
+	return r.slotOffset + o, nil
+}
+
+func (r *legacyRecord) ReadInt64(fieldName string) (int64, error) {
+	offset, err := r.offset(fieldName)
+	if err != nil {
+		return 0, err
+	}
+	return r.tx.ReadInt64(r.blk.Hash, offset)
+}
+
+func (r *legacyRecord) ReadUint64(fieldName string) (uint64, error) {
+	offset, err := r.offset(fieldName)
+	if err != nil {
+		return 0, err
+	}
+	return r.tx.ReadUint64(r.blk.Hash, offset)
+}
+
+func (r *legacyRecord) ReadString(fieldName string) (string, error) {
+	offset, err := r.offset(fieldName)
+	if err != nil {
+		return "", err
+	}
+	return r.tx.ReadString(r.blk.Hash, offset)
+}
+
+// scanLegacyTable calls `f` with every used record of a table in a legacy database.
+func scanLegacyTable(tx *storage.Transaction, tabName string, la *legacyLayout, f func(rec *legacyRecord) error) error {
+	if la.slotSize <= 0 || la.slotSize > tx.BlockSize() {
+		return fmt.Errorf("a slot doesn't fit in a block: table: %v, slot size: %v byte", tabName, la.slotSize)
+	}
+	fileName := fmt.Sprintf("%v.tbl", tabName)
+	blkCount, err := tx.BlockCount(fileName)
+	if err != nil {
+		return err
+	}
+	for blkNum := 0; blkNum < blkCount; blkNum++ {
+		err := scanLegacyBlock(tx, storage.NewBlockID(fileName, blkNum), la, f)
+		if err != nil {
+			return fmt.Errorf("failed to read a block of a legacy table: table: %v, block: %v: %w", tabName, blkNum, err)
+		}
+	}
+	return nil
+}
+
+func scanLegacyBlock(tx *storage.Transaction, blk *storage.BlockID, la *legacyLayout, f func(rec *legacyRecord) error) error {
+	err := tx.Pin(blk)
+	if err != nil {
+		return err
+	}
+	defer tx.Unpin(blk)
+	for slotOffset := 0; slotOffset+la.slotSize <= tx.BlockSize(); slotOffset += la.slotSize {
+		flag, err := tx.ReadInt64(blk.Hash, slotOffset)
+		if err != nil {
+			return err
+		}
+		if flag != 1 {
+			continue
+		}
+		err = f(&legacyRecord{
+			tx:         tx,
+			blk:        blk,
+			slotOffset: slotOffset,
+			layout:     la,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -8,9 +8,10 @@ import (
 )
 
 type MetadataManager struct {
-	tm *tableManager
-	vm *viewManager
-	sm *statisticManager
+	tm   *tableManager
+	vm   *viewManager
+	sm   *statisticManager
+	feed *ChangeFeed
 }
 
 func NewMetadataManager(isNew bool, tx *storage.Transaction) (*MetadataManager, error) {
@@ -30,14 +31,30 @@ func NewMetadataManager(isNew bool, tx *storage.Transaction) (*MetadataManager,
 	}
 
 	return &MetadataManager{
-		tm: tm,
-		vm: vm,
-		sm: sm,
+		tm:   tm,
+		vm:   vm,
+		sm:   sm,
+		feed: NewChangeFeed(tx.ChangeListeners()),
 	}, nil
 }
 
+// ChangeFeed returns the change feed of the database.
+func (m *MetadataManager) ChangeFeed() *ChangeFeed {
+	return m.feed
+}
+
 func (m *MetadataManager) CreateTable(tx *storage.Transaction, tabName string, sc *Schema) error {
-	return m.tm.createTable(tx, tabName, sc)
+	return m.tm.createTable(tx, tabName, sc, storage.DefaultTablespace)
+}
+
+// CreateTableInTablespace creates a table whose file is in a tablespace. The catalog records the tablespace, so
+// the layout FindLayout returns leads table scanners to the file.
+func (m *MetadataManager) CreateTableInTablespace(tx *storage.Transaction, tabName string, sc *Schema, tablespace string) error {
+	err := storage.ValidateTablespaceName(tablespace)
+	if err != nil {
+		return err
+	}
+	return m.tm.createTable(tx, tabName, sc, tablespace)
 }
 
 func (m *MetadataManager) FindLayout(tx *storage.Transaction, tabName string) (*Layout, error) {
@@ -59,6 +76,11 @@ func (m *MetadataManager) TableStatistic(tx *storage.Transaction, tableName stri
 type tableManager struct {
 	tabCatLayout *Layout
 	fldCatLayout *Layout
+
+	// tsCatLayout is the layout of the tablespace_catalog, which records the tables that aren't in the default
+	// tablespace. A database made before tablespaces existed doesn't have the catalog file yet, and a missing file
+	// reads as an empty table, so all its tables are in the default tablespace.
+	tsCatLayout *Layout
 }
 
 func newTableManager(isNew bool, tx *storage.Transaction) (*tableManager, error) {
@@ -69,21 +91,30 @@ func newTableManager(isNew bool, tx *storage.Transaction) (*tableManager, error)
 	fldCatSchema := NewShcema()
 	fldCatSchema.Add("table_name", NewStringField(64))
 	fldCatSchema.Add("field_name", NewStringField(64))
-	fldCatSchema.Add("type", NewInt64Field())
+	fldCatSchema.Add("type", NewStringField(16))
 	fldCatSchema.Add("length", NewInt64Field())
 	fldCatSchema.Add("offset", NewInt64Field())
 
+	tsCatSchema := NewShcema()
+	tsCatSchema.Add("table_name", NewStringField(64))
+	tsCatSchema.Add("tablespace", NewStringField(64))
+
 	m := &tableManager{
-		tabCatLayout: NewLayout(tabCatSchema),
-		fldCatLayout: NewLayout(fldCatSchema),
+		tabCatLayout: NewLayoutWithEncoding(tabCatSchema, tx.Encoding()),
+		fldCatLayout: NewLayoutWithEncoding(fldCatSchema, tx.Encoding()),
+		tsCatLayout:  NewLayoutWithEncoding(tsCatSchema, tx.Encoding()),
 	}
 
 	if isNew {
-		err := m.createTable(tx, "table_catalog", tabCatSchema)
+		err := m.createTable(tx, "table_catalog", tabCatSchema, storage.DefaultTablespace)
 		if err != nil {
 			return nil, err
 		}
-		err = m.createTable(tx, "field_catalog", fldCatSchema)
+		err = m.createTable(tx, "field_catalog", fldCatSchema, storage.DefaultTablespace)
+		if err != nil {
+			return nil, err
+		}
+		err = m.createTable(tx, "tablespace_catalog", tsCatSchema, storage.DefaultTablespace)
 		if err != nil {
 			return nil, err
 		}
@@ -92,8 +123,8 @@ func newTableManager(isNew bool, tx *storage.Transaction) (*tableManager, error)
 	return m, nil
 }
 
-func (m *tableManager) createTable(tx *storage.Transaction, tabName string, sc *Schema) error {
-	la := NewLayout(sc)
+func (m *tableManager) createTable(tx *storage.Transaction, tabName string, sc *Schema, tablespace string) error {
+	la := NewLayoutWithEncoding(sc, tx.Encoding())
 
 	tabCat, err := NewTableScanner(tx, "table_catalog", m.tabCatLayout)
 	if err != nil {
@@ -147,9 +178,74 @@ func (m *tableManager) createTable(tx *storage.Transaction, tabName string, sc *
 		}
 	}
 
+	// Opening a scanner creates the table file, so every table in the catalog has its file even when it has no
+	// records.
+	la.tablespace = tablespace
+	tab, err := NewTableScanner(tx, tabName, la)
+	if err != nil {
+		return err
+	}
+	err = tab.Close()
+	if err != nil {
+		return err
+	}
+
+	if tablespace != storage.DefaultTablespace {
+		tsCat, err := NewTableScanner(tx, "tablespace_catalog", m.tsCatLayout)
+		if err != nil {
+			return err
+		}
+		defer tsCat.Close()
+		err = tsCat.Insert()
+		if err != nil {
+			return err
+		}
+		err = tsCat.WriteString("table_name", tabName)
+		if err != nil {
+			return err
+		}
+		err = tsCat.WriteString("tablespace", tablespace)
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
+// findTablespace returns the tablespace holding a table.
+func (m *tableManager) findTablespace(tx *storage.Transaction, tabName string) (string, error) {
+	// Opening a scanner on a missing file creates the file, which a read-only transaction cannot do.
+	c, err := tx.BlockCount("tablespace_catalog.tbl")
+	if err != nil {
+		return "", err
+	}
+	if c == 0 {
+		return storage.DefaultTablespace, nil
+	}
+	tsCat, err := NewTableScanner(tx, "tablespace_catalog", m.tsCatLayout)
+	if err != nil {
+		return "", err
+	}
+	defer tsCat.Close()
+	for {
+		ok, err := tsCat.Next()
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			return storage.DefaultTablespace, nil
+		}
+		n, err := tsCat.ReadString("table_name")
+		if err != nil {
+			return "", err
+		}
+		if n == tabName {
+			return tsCat.ReadString("tablespace")
+		}
+	}
+}
+
 func (m *tableManager) findLayout(tx *storage.Transaction, tabName string) (*Layout, error) {
 	var slotSize int
 	{
@@ -239,10 +335,17 @@ func (m *tableManager) findLayout(tx *storage.Transaction, tabName string) (*Lay
 		}
 	}
 
+	tablespace, err := m.findTablespace(tx, tabName)
+	if err != nil {
+		return nil, err
+	}
+
 	return &Layout{
-		Schema:   sc,
-		offsets:  offsets,
-		slotSize: slotSize,
+		Schema:     sc,
+		offsets:    offsets,
+		slotSize:   slotSize,
+		enc:        tx.Encoding(),
+		tablespace: tablespace,
 	}, nil
 }
 
@@ -255,7 +358,7 @@ func newViewManager(isNew bool, tx *storage.Transaction, tm *tableManager) (*vie
 		sc := NewShcema()
 		sc.Add("view_name", NewStringField(100))
 		sc.Add("view_def", NewStringField(100))
-		err := tm.createTable(tx, "view_catalog", sc)
+		err := tm.createTable(tx, "view_catalog", sc, storage.DefaultTablespace)
 		if err != nil {
 			return nil, err
 		}
@@ -412,10 +515,14 @@ func (m *statisticManager) refreshStatistics(tx *storage.Transaction) error {
 	return nil
 }
 
+// statisticScanRingSize is the number of buffers a scan for statistics uses.
+const statisticScanRingSize = 4
+
 func (m *statisticManager) calcTableStat(tx *storage.Transaction, tableName string, layout *Layout) (*TableStat, error) {
 	blkCount := 0
 	recCount := 0
-	tab, err := NewTableScanner(tx, tableName, layout)
+	// Calculating statistics scans all tables, so the scan must not evict blocks other transactions use.
+	tab, err := NewTableScanner(tx, tableName, layout, WithBufferRing(statisticScanRingSize))
 	if err != nil {
 		return nil, err
 	}
@@ -28,17 +28,17 @@ func TestMetadataManager_tableManager(t *testing.T) {
 		tmpDBName = strings.TrimSuffix(filepath.Base(dbFilePath), ".tbl")
 	}
 
-	st, err := storage.InitStorage(context.Background(), &storage.StorageConfig{
+	st, err := storage.InitStorage(context.Background(), storage.TestConfig(&storage.StorageConfig{
 		DirPath:     testDir,
 		LogFileName: logFileName,
 		BlkSize:     1000,
 		BufSize:     10,
-	})
+	}))
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	tx, err := st.NewTransaction()
+	tx, err := st.NewTransaction(context.Background())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -83,17 +83,17 @@ func TestMetadataManager_viewManager(t *testing.T) {
 		logFileName = filepath.Base(logFilePath)
 	}
 
-	st, err := storage.InitStorage(context.Background(), &storage.StorageConfig{
+	st, err := storage.InitStorage(context.Background(), storage.TestConfig(&storage.StorageConfig{
 		DirPath:     testDir,
 		LogFileName: logFileName,
 		BlkSize:     1000,
 		BufSize:     10,
-	})
+	}))
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	tx, err := st.NewTransaction()
+	tx, err := st.NewTransaction(context.Background())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -136,17 +136,17 @@ func TestMetadataManager_statisticManager(t *testing.T) {
 		tmpDBName = strings.TrimSuffix(filepath.Base(dbFilePath), ".tbl")
 	}
 
-	st, err := storage.InitStorage(context.Background(), &storage.StorageConfig{
+	st, err := storage.InitStorage(context.Background(), storage.TestConfig(&storage.StorageConfig{
 		DirPath:     testDir,
 		LogFileName: logFileName,
 		BlkSize:     1000,
 		BufSize:     10,
-	})
+	}))
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	tx, err := st.NewTransaction()
+	tx, err := st.NewTransaction(context.Background())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -171,7 +171,7 @@ func TestMetadataManager_statisticManager(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	tx, err = st.NewTransaction()
+	tx, err = st.NewTransaction(context.Background())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -205,7 +205,7 @@ func TestMetadataManager_statisticManager(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	tx, err = st.NewTransaction()
+	tx, err = st.NewTransaction(context.Background())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -222,3 +222,136 @@ func TestMetadataManager_statisticManager(t *testing.T) {
 		t.Fatalf("RecordCount must be >0")
 	}
 }
+
+func TestMetadataManager_tablespace(t *testing.T) {
+	testDir, err := storage.MakeTestDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+
+	logFilePath, _, err := makeTestLogFileAndDBFile(testDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fastDir := filepath.Join(testDir, "fast_disk")
+
+	ctx := context.Background()
+	open := func(t *testing.T) *storage.Storage {
+		t.Helper()
+		st, err := storage.InitStorage(ctx, storage.TestConfig(&storage.StorageConfig{
+			DirPath:     testDir,
+			LogFileName: filepath.Base(logFilePath),
+			BlkSize:     1000,
+			BufSize:     10,
+			Tablespaces: map[string]string{
+				"fast": fastDir,
+			},
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return st
+	}
+
+	sc := NewShcema()
+	sc.Add("A", NewInt64Field())
+
+	st := open(t)
+	{
+		tx, err := st.NewTransaction(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mm, err := NewMetadataManager(true, tx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = mm.CreateTableInTablespace(tx, "hot", sc, "fast")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = mm.CreateTable(tx, "cold", sc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = mm.CreateTableInTablespace(tx, "invalid", sc, "../fast")
+		if err == nil {
+			t.Fatal("an invalid tablespace name must be rejected")
+		}
+		for _, tabName := range []string{"hot", "cold"} {
+			la, err := mm.FindLayout(tx, tabName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ts, err := NewTableScanner(tx, tabName, la)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = ts.Insert()
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = ts.WriteInt64("A", 100)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ts.Close()
+		}
+		err = tx.Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = st.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{filepath.Join(fastDir, "hot.tbl"), filepath.Join(testDir, "cold.tbl")} {
+		_, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	st = open(t)
+	defer st.Close()
+	tx, err := st.NewTransaction(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Commit()
+	mm, err := NewMetadataManager(false, tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for tabName, tablespace := range map[string]string{"hot": "fast", "cold": storage.DefaultTablespace} {
+		la, err := mm.FindLayout(tx, tabName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if la.Tablespace() != tablespace {
+			t.Fatalf("unexpected tablespace: table: %v, want: %#v, got: %#v", tabName, tablespace, la.Tablespace())
+		}
+		ts, err := NewTableScanner(tx, tabName, la)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ok, err := ts.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			t.Fatalf("a record was not found: table: %v", tabName)
+		}
+		v, err := ts.ReadInt64("A")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != 100 {
+			t.Fatalf("unexpected value: table: %v, want: %v, got: %v", tabName, 100, v)
+		}
+		ts.Close()
+	}
+}
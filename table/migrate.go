@@ -0,0 +1,302 @@
+package table
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/nihei9/simple-db/storage"
+)
+
+// MigrateDatabase copies all tables and views of the database `src` into a new database `dst`. The new database uses
+// the encoding `dst.Encoding` specifies, so this function converts a database using another encoding, such as
+// storage.EncodingVarint, into the current one. It also reads a legacy database using storage.EncodingLegacy,
+// whose table files hold records in fixed-size slots. The directory of `dst` must be empty or must not exist.
+func MigrateDatabase(ctx context.Context, src *storage.StorageConfig, dst *storage.StorageConfig) error {
+	{
+		entries, err := os.ReadDir(dst.DirPath)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if len(entries) > 0 {
+			return fmt.Errorf("a destination directory must be empty: %v", dst.DirPath)
+		}
+	}
+
+	srcSt, err := storage.InitStorage(ctx, src)
+	if err != nil {
+		return err
+	}
+	defer srcSt.Close()
+	dstSt, err := storage.InitStorage(ctx, dst)
+	if err != nil {
+		return err
+	}
+	defer dstSt.Close()
+
+	srcTx, err := srcSt.NewTransaction(ctx)
+	if err != nil {
+		return err
+	}
+	dstTx, err := dstSt.NewTransaction(ctx)
+	if err != nil {
+		srcTx.Rollback()
+		return err
+	}
+	err = migrateDatabase(srcTx, dstTx)
+	if err != nil {
+		srcTx.Rollback()
+		dstTx.Rollback()
+		return err
+	}
+	err = dstTx.Commit()
+	if err != nil {
+		srcTx.Rollback()
+		return err
+	}
+	return srcTx.Commit()
+}
+
+func migrateDatabase(srcTx *storage.Transaction, dstTx *storage.Transaction) error {
+	err := srcTx.Recover()
+	if err != nil {
+		return err
+	}
+	dstMM, err := NewMetadataManager(true, dstTx)
+	if err != nil {
+		return err
+	}
+	if srcTx.Encoding() == storage.EncodingLegacy {
+		return migrateLegacyTables(srcTx, dstTx, dstMM)
+	}
+	return migrateTables(srcTx, dstTx, dstMM)
+}
+
+func migrateTables(srcTx *storage.Transaction, dstTx *storage.Transaction, dstMM *MetadataManager) error {
+	srcMM, err := NewMetadataManager(false, srcTx)
+	if err != nil {
+		return err
+	}
+	var tabNames []string
+	{
+		tabCat, err := NewTableScanner(srcTx, "table_catalog", srcMM.tm.tabCatLayout)
+		if err != nil {
+			return err
+		}
+		defer tabCat.Close()
+		for {
+			ok, err := tabCat.Next()
+			if err != nil {
+				return err
+			}
+			if !ok {
+				break
+			}
+			n, err := tabCat.ReadString("table_name")
+			if err != nil {
+				return err
+			}
+			tabNames = append(tabNames, n)
+		}
+	}
+
+	for _, tabName := range tabNames {
+		switch tabName {
+		case "table_catalog", "field_catalog", "tablespace_catalog":
+			// The metadata manager of the new database has already made them.
+			continue
+		case "view_catalog":
+			err := migrateViews(srcTx, srcMM, dstTx, dstMM)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		srcLayout, err := srcMM.FindLayout(srcTx, tabName)
+		if err != nil {
+			return err
+		}
+		err = dstMM.CreateTableInTablespace(dstTx, tabName, srcLayout.Schema, srcLayout.Tablespace())
+		if err != nil {
+			return err
+		}
+		dstLayout, err := dstMM.FindLayout(dstTx, tabName)
+		if err != nil {
+			return err
+		}
+		err = migrateRecords(srcTx, srcLayout, dstTx, dstLayout, tabName)
+		if err != nil {
+			return fmt.Errorf("failed to migrate a table: %v: %w", tabName, err)
+		}
+	}
+	return nil
+}
+
+func migrateRecords(srcTx *storage.Transaction, srcLayout *Layout, dstTx *storage.Transaction, dstLayout *Layout, tabName string) error {
+	srcTab, err := NewTableScanner(srcTx, tabName, srcLayout)
+	if err != nil {
+		return err
+	}
+	defer srcTab.Close()
+	dstTab, err := NewTableScanner(dstTx, tabName, dstLayout)
+	if err != nil {
+		return err
+	}
+	defer dstTab.Close()
+
+	for {
+		ok, err := srcTab.Next()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+		err = copyRecord(srcTab, srcLayout.Schema, dstTab)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// recordReader reads the fields of the current record of a table.
+type recordReader interface {
+	ReadInt64(fieldName string) (int64, error)
+	ReadUint64(fieldName string) (uint64, error)
+	ReadString(fieldName string) (string, error)
+}
+
+// copyRecord inserts a record into `dstTab` and copies the fields in a schema `sc` from `src` into it.
+func copyRecord(src recordReader, sc *Schema, dstTab *TableScanner) error {
+	err := dstTab.Insert()
+	if err != nil {
+		return err
+	}
+	for _, f := range sc.fields {
+		switch f.Ty {
+		case FieldTypeInt64:
+			v, err := src.ReadInt64(f.name)
+			if err != nil {
+				return err
+			}
+			err = dstTab.WriteInt64(f.name, v)
+			if err != nil {
+				return err
+			}
+		case FieldTypeUint64:
+			v, err := src.ReadUint64(f.name)
+			if err != nil {
+				return err
+			}
+			err = dstTab.WriteUint64(f.name, v)
+			if err != nil {
+				return err
+			}
+		case FieldTypeString:
+			v, err := src.ReadString(f.name)
+			if err != nil {
+				return err
+			}
+			err = dstTab.WriteString(f.name, v)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func migrateViews(srcTx *storage.Transaction, srcMM *MetadataManager, dstTx *storage.Transaction, dstMM *MetadataManager) error {
+	la, err := srcMM.FindLayout(srcTx, "view_catalog")
+	if err != nil {
+		return err
+	}
+	viewCat, err := NewTableScanner(srcTx, "view_catalog", la)
+	if err != nil {
+		return err
+	}
+	defer viewCat.Close()
+	for {
+		ok, err := viewCat.Next()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+		name, err := viewCat.ReadString("view_name")
+		if err != nil {
+			return err
+		}
+		def, err := viewCat.ReadString("view_def")
+		if err != nil {
+			return err
+		}
+		err = dstMM.CreateView(dstTx, name, def)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// migrateLegacyTables copies the tables and views of a legacy database. A legacy database has neither tablespaces
+// nor overflow pages, so every table goes to the default tablespace.
+func migrateLegacyTables(srcTx *storage.Transaction, dstTx *storage.Transaction, dstMM *MetadataManager) error {
+	cats := newLegacyCatalogs(srcTx)
+	tabNames, err := cats.tableNames()
+	if err != nil {
+		return err
+	}
+	for _, tabName := range tabNames {
+		if tabName == "table_catalog" || tabName == "field_catalog" {
+			continue
+		}
+		srcLayout, err := cats.findLayout(tabName)
+		if err != nil {
+			return err
+		}
+		if tabName == "view_catalog" {
+			err := scanLegacyTable(srcTx, tabName, srcLayout, func(rec *legacyRecord) error {
+				name, err := rec.ReadString("view_name")
+				if err != nil {
+					return err
+				}
+				def, err := rec.ReadString("view_def")
+				if err != nil {
+					return err
+				}
+				return dstMM.CreateView(dstTx, name, def)
+			})
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		err = dstMM.CreateTable(dstTx, tabName, srcLayout.schema)
+		if err != nil {
+			return err
+		}
+		dstLayout, err := dstMM.FindLayout(dstTx, tabName)
+		if err != nil {
+			return err
+		}
+		err = migrateLegacyRecords(srcTx, srcLayout, dstTx, dstLayout, tabName)
+		if err != nil {
+			return fmt.Errorf("failed to migrate a table: %v: %w", tabName, err)
+		}
+	}
+	return nil
+}
+
+func migrateLegacyRecords(srcTx *storage.Transaction, srcLayout *legacyLayout, dstTx *storage.Transaction, dstLayout *Layout, tabName string) error {
+	dstTab, err := NewTableScanner(dstTx, tabName, dstLayout)
+	if err != nil {
+		return err
+	}
+	defer dstTab.Close()
+	return scanLegacyTable(srcTx, tabName, srcLayout, func(rec *legacyRecord) error {
+		return copyRecord(rec, srcLayout.schema, dstTab)
+	})
+}
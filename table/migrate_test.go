@@ -0,0 +1,356 @@
+package table
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nihei9/simple-db/storage"
+)
+
+func TestMigrateDatabase(t *testing.T) {
+	testDir, err := storage.MakeTestDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+
+	srcDir := filepath.Join(testDir, "src")
+	dstDir := filepath.Join(testDir, "dst")
+	err = os.Mkdir(srcDir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var logFileName string
+	var tmpTableName string
+	{
+		logFilePath, dbFilePath, err := makeTestLogFileAndDBFile(srcDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		logFileName = filepath.Base(logFilePath)
+		tmpTableName = strings.TrimSuffix(filepath.Base(dbFilePath), ".tbl")
+	}
+
+	srcConfig := storage.TestConfig(&storage.StorageConfig{
+		DirPath:     srcDir,
+		LogFileName: logFileName,
+		BlkSize:     400,
+		BufSize:     10,
+		Encoding:    storage.EncodingVarint,
+	})
+	dstConfig := storage.TestConfig(&storage.StorageConfig{
+		DirPath:     dstDir,
+		LogFileName: logFileName,
+		BlkSize:     400,
+		BufSize:     10,
+	})
+
+	sc := NewShcema()
+	sc.Add("A", NewInt64Field())
+	sc.Add("B", NewUint64Field())
+	sc.Add("C", NewStringField(10))
+	const recCount = 100
+	largeVal := strings.Repeat("0123456789", 100)
+
+	// Make a database using the varint encoding.
+	{
+		st, err := storage.InitStorage(context.Background(), srcConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st.Encoding() != storage.EncodingVarint {
+			t.Fatalf("unexpected encoding: want: %v, got: %v", storage.EncodingVarint, st.Encoding())
+		}
+		tx, err := st.NewTransaction(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		mm, err := NewMetadataManager(true, tx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = mm.CreateTable(tx, tmpTableName, sc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = mm.CreateView(tx, "v", "select A from "+tmpTableName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		la, err := mm.FindLayout(tx, tmpTableName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ts, err := NewTableScanner(tx, tmpTableName, la)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < recCount; i++ {
+			err := ts.Insert()
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = ts.WriteInt64("A", int64(-i))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = ts.WriteUint64("B", uint64(i))
+			if err != nil {
+				t.Fatal(err)
+			}
+			c := "#" + strings.Repeat("x", i%10)
+			if i == 0 {
+				c = largeVal
+			}
+			err = ts.WriteString("C", c)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = ts.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tx.Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = MigrateDatabase(context.Background(), srcConfig, dstConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	st, err := storage.InitStorage(context.Background(), dstConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Encoding() != storage.DefaultEncoding {
+		t.Fatalf("unexpected encoding: want: %v, got: %v", storage.DefaultEncoding, st.Encoding())
+	}
+	tx, err := st.NewTransaction(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	mm, err := NewMetadataManager(false, tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	la, err := mm.FindLayout(tx, tmpTableName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts, err := NewTableScanner(tx, tmpTableName, la)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := 0
+	for {
+		ok, err := ts.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			break
+		}
+		a, err := ts.ReadInt64("A")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ts.ReadUint64("B")
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := ts.ReadString("C")
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectedC := "#" + strings.Repeat("x", i%10)
+		if i == 0 {
+			expectedC = largeVal
+		}
+		if a != int64(-i) || b != uint64(i) || c != expectedC {
+			t.Fatalf("unexpected record: want: (%v, %v, %v), got: (%v, %v, %v)", -i, i, expectedC, a, b, c)
+		}
+		i++
+	}
+	if i != recCount {
+		t.Fatalf("unexpected record count: want: %v, got: %v", recCount, i)
+	}
+	err = ts.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	viewDef, err := mm.FindViewDef(tx, "v")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if viewDef != "select A from "+tmpTableName {
+		t.Fatalf("unexpected view definition: %v", viewDef)
+	}
+	err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srcInfo, err := os.Stat(filepath.Join(srcDir, tmpTableName+".tbl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dstInfo, err := os.Stat(filepath.Join(dstDir, tmpTableName+".tbl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dstInfo.Size() >= srcInfo.Size() {
+		t.Fatalf("the fixed-width encoding must make a table file smaller: legacy: %v byte, migrated: %v byte", srcInfo.Size(), dstInfo.Size())
+	}
+}
+
+func TestMigrateDatabase_legacy(t *testing.T) {
+	testDir, err := storage.MakeTestDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+
+	// testdata/baseline is a database that a version before the encoding file was introduced wrote with a block
+	// size of 4096 bytes. It has a table `customers` holding records (-i, i*100, "customer #i") for i in 0-19,
+	// from which the records whose i is a multiple of 5 were deleted, and a view `rich`. A rolled-back insertion
+	// of a record (999, 0, "rolled back") follows them in the log. Work on a copy because recovery writes the log.
+	srcDir := filepath.Join(testDir, "src")
+	dstDir := filepath.Join(testDir, "dst")
+	err = os.Mkdir(srcDir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(filepath.Join("testdata", "baseline"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		b, err := os.ReadFile(filepath.Join("testdata", "baseline", e.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(filepath.Join(srcDir, e.Name()), b, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A legacy database is neither encrypted nor compressed.
+	srcConfig := &storage.StorageConfig{
+		DirPath:     srcDir,
+		LogFileName: "simpledb.log",
+		BlkSize:     4096,
+		BufSize:     10,
+	}
+	dstConfig := storage.TestConfig(&storage.StorageConfig{
+		DirPath:     dstDir,
+		LogFileName: "simpledb.log",
+		BlkSize:     4096,
+		BufSize:     10,
+	})
+
+	t.Run("a table scanner rejects a legacy database", func(t *testing.T) {
+		st, err := storage.InitStorage(context.Background(), srcConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer st.Close()
+		if st.Encoding() != storage.EncodingLegacy {
+			t.Fatalf("unexpected encoding: want: %v, got: %v", storage.EncodingLegacy, st.Encoding())
+		}
+		tx, err := st.NewTransaction(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tx.Rollback()
+		mm, err := NewMetadataManager(false, tx)
+		if err == nil {
+			_, err = mm.FindLayout(tx, "customers")
+		}
+		if !errors.Is(err, ErrLegacyDatabase) {
+			t.Fatalf("unexpected error: want: %v, got: %v", ErrLegacyDatabase, err)
+		}
+	})
+
+	t.Run("a migration reads the fixed-slot records of a legacy database", func(t *testing.T) {
+		err := MigrateDatabase(context.Background(), srcConfig, dstConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		st, err := storage.InitStorage(context.Background(), dstConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer st.Close()
+		tx, err := st.NewTransaction(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tx.Commit()
+		mm, err := NewMetadataManager(false, tx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		la, err := mm.FindLayout(tx, "customers")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ts, err := NewTableScanner(tx, "customers", la)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ts.Close()
+		var got []string
+		for {
+			ok, err := ts.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ok {
+				break
+			}
+			id, err := ts.ReadInt64("id")
+			if err != nil {
+				t.Fatal(err)
+			}
+			balance, err := ts.ReadUint64("balance")
+			if err != nil {
+				t.Fatal(err)
+			}
+			name, err := ts.ReadString("name")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, fmt.Sprintf("(%v, %v, %v)", id, balance, name))
+		}
+		var want []string
+		for i := 0; i < 20; i++ {
+			if i%5 == 0 {
+				continue
+			}
+			want = append(want, fmt.Sprintf("(%v, %v, customer #%v)", -i, i*100, i))
+		}
+		if strings.Join(got, " ") != strings.Join(want, " ") {
+			t.Fatalf("unexpected records: want: %v, got: %v", want, got)
+		}
+
+		viewDef, err := mm.FindViewDef(tx, "rich")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if viewDef != "select id from customers where balance = 1000" {
+			t.Fatalf("unexpected view definition: %v", viewDef)
+		}
+	})
+}
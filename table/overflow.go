@@ -0,0 +1,251 @@
+package table
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/nihei9/simple-db/storage"
+)
+
+// overflowFile stores large string values in chains of blocks. Every table has its own overflow file.
+//
+// The first block of the file is a header block and holds the head of the free list, which chains blocks that
+// no value uses. The other blocks are overflow blocks and have the following form:
+//
+// ┌──────┬───────────────┐
+// │ Next │     Chunk     │
+// └──────┴───────────────┘
+//   - Next: The number of the next block in the chain. 0 means the block is the last one.
+//   - Chunk: A part of a value.
+//
+// The file is written through a transaction with logging, so rollback and recovery work for overflow values.
+type overflowFile struct {
+	tx       *storage.Transaction
+	fileName string
+}
+
+func newOverflowFile(tx *storage.Transaction, tableFileName string) *overflowFile {
+	return &overflowFile{
+		tx:       tx,
+		fileName: fmt.Sprintf("%v.ovf", strings.TrimSuffix(tableFileName, ".tbl")),
+	}
+}
+
+const ovfBlkNumNil int64 = 0
+
+// chunkSize returns the maximum number of bytes an overflow block can hold. A write of a chunk logs its before-image,
+// so a chunk is also limited to the size of an image that fits in a log record.
+func (f *overflowFile) chunkSize() (int, error) {
+	enc := f.tx.Encoding()
+	size := f.tx.BlockSize() - enc.Int64Size() - enc.StringSize(0)
+	maxImg, err := f.tx.MaxImageSize(f.fileName)
+	if err != nil {
+		return 0, err
+	}
+	// The length of a string takes more bytes as the string grows, so we subtract the size the length of the largest
+	// image takes.
+	if n := maxImg - (enc.StringSize(maxImg) - maxImg); n < size {
+		size = n
+	}
+	if size > enc.MaxStringSize() {
+		size = enc.MaxStringSize()
+	}
+	return size, nil
+}
+
+// write stores a value in a new chain and returns the number of the first block of the chain.
+func (f *overflowFile) write(val string) (int64, error) {
+	chunkSize, err := f.chunkSize()
+	if err != nil {
+		return 0, err
+	}
+	if chunkSize <= 0 {
+		return 0, fmt.Errorf("a block is too small to store overflow values: file: %v, block size: %v byte", f.fileName, f.tx.BlockSize())
+	}
+	var chunks []string
+	for len(val) > 0 {
+		n := chunkSize
+		if n > len(val) {
+			n = len(val)
+		}
+		chunks = append(chunks, val[:n])
+		val = val[n:]
+	}
+	if len(chunks) == 0 {
+		chunks = []string{""}
+	}
+
+	blkNums := make([]int64, len(chunks))
+	for i := range chunks {
+		blkNums[i], err = f.allocBlock()
+		if err != nil {
+			return 0, err
+		}
+	}
+	for i, chunk := range chunks {
+		next := ovfBlkNumNil
+		if i+1 < len(blkNums) {
+			next = blkNums[i+1]
+		}
+		err := f.writeBlock(blkNums[i], next, chunk)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return blkNums[0], nil
+}
+
+// read reads a value from a chain starting with `blkNum`.
+func (f *overflowFile) read(blkNum int64) (string, error) {
+	var b strings.Builder
+	for blkNum != ovfBlkNumNil {
+		blk := storage.NewBlockID(f.fileName, int(blkNum))
+		err := f.tx.Pin(blk)
+		if err != nil {
+			return "", err
+		}
+		next, err := f.tx.ReadInt64(blk.Hash, 0)
+		if err != nil {
+			f.tx.Unpin(blk)
+			return "", err
+		}
+		chunk, err := f.tx.ReadString(blk.Hash, f.tx.Encoding().Int64Size())
+		if err != nil {
+			f.tx.Unpin(blk)
+			return "", err
+		}
+		err = f.tx.Unpin(blk)
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(chunk)
+		blkNum = next
+	}
+	return b.String(), nil
+}
+
+// free returns all blocks of a chain starting with `blkNum` to the free list.
+func (f *overflowFile) free(blkNum int64) error {
+	last := blkNum
+	for {
+		next, err := f.readNext(last)
+		if err != nil {
+			return err
+		}
+		if next == ovfBlkNumNil {
+			break
+		}
+		last = next
+	}
+
+	hdr, err := f.header()
+	if err != nil {
+		return err
+	}
+	err = f.tx.Pin(hdr)
+	if err != nil {
+		return err
+	}
+	defer f.tx.Unpin(hdr)
+	head, err := f.tx.ReadInt64(hdr.Hash, 0)
+	if err != nil {
+		return err
+	}
+	err = f.writeNext(last, head)
+	if err != nil {
+		return err
+	}
+	return f.tx.WriteInt64(hdr.Hash, 0, blkNum, true)
+}
+
+// allocBlock takes a block from the free list. When the free list is empty, allocBlock extends the file.
+func (f *overflowFile) allocBlock() (int64, error) {
+	hdr, err := f.header()
+	if err != nil {
+		return 0, err
+	}
+	err = f.tx.Pin(hdr)
+	if err != nil {
+		return 0, err
+	}
+	defer f.tx.Unpin(hdr)
+	head, err := f.tx.ReadInt64(hdr.Hash, 0)
+	if err != nil {
+		return 0, err
+	}
+	if head == ovfBlkNumNil {
+		blk, err := f.tx.AllocBlock(f.fileName)
+		if err != nil {
+			return 0, err
+		}
+		return int64(blk.BlkNum), nil
+	}
+	next, err := f.readNext(head)
+	if err != nil {
+		return 0, err
+	}
+	err = f.tx.WriteInt64(hdr.Hash, 0, next, true)
+	if err != nil {
+		return 0, err
+	}
+	return head, nil
+}
+
+// header returns the header block. When the file is empty, header makes the header block.
+func (f *overflowFile) header() (*storage.BlockID, error) {
+	c, err := f.tx.BlockCount(f.fileName)
+	if err != nil {
+		return nil, err
+	}
+	if c > 0 {
+		return storage.NewBlockID(f.fileName, 0), nil
+	}
+	blk, err := f.tx.AllocBlock(f.fileName)
+	if err != nil {
+		return nil, err
+	}
+	err = f.tx.Pin(blk)
+	if err != nil {
+		return nil, err
+	}
+	defer f.tx.Unpin(blk)
+	err = f.tx.WriteInt64(blk.Hash, 0, ovfBlkNumNil, false)
+	if err != nil {
+		return nil, err
+	}
+	return blk, nil
+}
+
+func (f *overflowFile) readNext(blkNum int64) (int64, error) {
+	blk := storage.NewBlockID(f.fileName, int(blkNum))
+	err := f.tx.Pin(blk)
+	if err != nil {
+		return 0, err
+	}
+	defer f.tx.Unpin(blk)
+	return f.tx.ReadInt64(blk.Hash, 0)
+}
+
+func (f *overflowFile) writeNext(blkNum int64, next int64) error {
+	blk := storage.NewBlockID(f.fileName, int(blkNum))
+	err := f.tx.Pin(blk)
+	if err != nil {
+		return err
+	}
+	defer f.tx.Unpin(blk)
+	return f.tx.WriteInt64(blk.Hash, 0, next, true)
+}
+
+func (f *overflowFile) writeBlock(blkNum int64, next int64, chunk string) error {
+	blk := storage.NewBlockID(f.fileName, int(blkNum))
+	err := f.tx.Pin(blk)
+	if err != nil {
+		return err
+	}
+	defer f.tx.Unpin(blk)
+	err = f.tx.WriteInt64(blk.Hash, 0, next, true)
+	if err != nil {
+		return err
+	}
+	return f.tx.WriteString(blk.Hash, f.tx.Encoding().Int64Size(), chunk, true)
+}
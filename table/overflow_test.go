@@ -0,0 +1,235 @@
+package table
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nihei9/simple-db/storage"
+)
+
+func TestOverflowFile(t *testing.T) {
+	testDir, err := storage.MakeTestDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+
+	var logFileName string
+	var tmpTableName string
+	{
+		logFilePath, dbFilePath, err := makeTestLogFileAndDBFile(testDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		logFileName = filepath.Base(logFilePath)
+		tmpTableName = strings.TrimSuffix(filepath.Base(dbFilePath), ".tbl")
+	}
+	ovfFileName := tmpTableName + ".ovf"
+
+	st, err := storage.InitStorage(context.Background(), storage.TestConfig(&storage.StorageConfig{
+		DirPath:     testDir,
+		LogFileName: logFileName,
+		BlkSize:     400,
+		BufSize:     10,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sc := NewShcema()
+	sc.Add("A", NewInt64Field())
+	sc.Add("B", NewStringField(10))
+	la := NewLayout(sc)
+
+	largeVal1 := strings.Repeat("0123456789", 200)
+	largeVal2 := strings.Repeat("abcdefghij", 150)
+
+	readB := func(t *testing.T, tx *storage.Transaction) string {
+		ts, err := NewTableScanner(tx, tmpTableName, la)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ts.Close()
+		ok, err := ts.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			t.Fatal("a record was not found")
+		}
+		v, err := ts.ReadString("B")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+
+	writeB := func(t *testing.T, tx *storage.Transaction, val string) {
+		ts, err := NewTableScanner(tx, tmpTableName, la)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ts.Close()
+		ok, err := ts.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			t.Fatal("a record was not found")
+		}
+		err = ts.WriteString("B", val)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("a value larger than a block can be written and read", func(t *testing.T) {
+		tx, err := st.NewTransaction(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		ts, err := NewTableScanner(tx, tmpTableName, la)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ts.Insert()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ts.WriteInt64("A", 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ts.WriteString("B", largeVal1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ts.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tx.Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tx, err = st.NewTransaction(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v := readB(t, tx); v != largeVal1 {
+			t.Fatalf("unexpected value: want: %v byte, got: %v byte", len(largeVal1), len(v))
+		}
+		err = tx.Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("rollback restores a large value", func(t *testing.T) {
+		tx, err := st.NewTransaction(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeB(t, tx, largeVal2)
+		if v := readB(t, tx); v != largeVal2 {
+			t.Fatalf("unexpected value: want: %v byte, got: %v byte", len(largeVal2), len(v))
+		}
+		err = tx.Rollback()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tx, err = st.NewTransaction(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v := readB(t, tx); v != largeVal1 {
+			t.Fatalf("unexpected value: want: %v byte, got: %v byte", len(largeVal1), len(v))
+		}
+		err = tx.Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("a value of a table having a long name fits in log records", func(t *testing.T) {
+		// The log records of an overflow file hold its name, so a long name leaves less room for a chunk.
+		longTableName := strings.Repeat("t", 150)
+		tx, err := st.NewTransaction(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		ts, err := NewTableScanner(tx, longTableName, la)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ts.Insert()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ts.WriteString("B", largeVal1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ts.BeforeFirst()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ok, err := ts.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			t.Fatal("a record was not found")
+		}
+		v, err := ts.ReadString("B")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != largeVal1 {
+			t.Fatalf("unexpected value: want: %v byte, got: %v byte", len(largeVal1), len(v))
+		}
+		err = ts.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tx.Rollback()
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("overflow blocks that a value no longer uses are reused", func(t *testing.T) {
+		tx, err := st.NewTransaction(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		blkCount, err := tx.BlockCount(ovfFileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeB(t, tx, "short")
+		if v := readB(t, tx); v != "short" {
+			t.Fatalf("unexpected value: want: %v, got: %v", "short", v)
+		}
+		writeB(t, tx, largeVal2)
+		if v := readB(t, tx); v != largeVal2 {
+			t.Fatalf("unexpected value: want: %v byte, got: %v byte", len(largeVal2), len(v))
+		}
+		c, err := tx.BlockCount(ovfFileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c != blkCount {
+			t.Fatalf("the overflow file must not grow: want: %v blocks, got: %v blocks", blkCount, c)
+		}
+		err = tx.Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
@@ -1,7 +1,7 @@
 package table
 
 import (
-	"encoding/binary"
+	"errors"
 	"fmt"
 	"unicode/utf8"
 
@@ -89,27 +89,27 @@ func (s *Schema) FieldNames() []string {
 	return names
 }
 
+// Layout describes the fixed-length part of a record. It is valid only for databases using its encoding.
 type Layout struct {
 	Schema   *Schema
 	offsets  map[string]int
 	slotSize int
+	enc      storage.Encoding
+
+	tablespace string
 }
 
+// NewLayout returns a layout for databases using storage.DefaultEncoding.
 func NewLayout(schema *Schema) *Layout {
+	return NewLayoutWithEncoding(schema, storage.DefaultEncoding)
+}
+
+func NewLayoutWithEncoding(schema *Schema, enc storage.Encoding) *Layout {
 	offsets := map[string]int{}
-	pos := storage.CalcBytesNeeded(binary.MaxVarintLen64)
+	pos := 0
 	for _, f := range schema.fields {
 		offsets[f.name] = pos
-		var bytesNeeded int
-		switch f.Ty {
-		case FieldTypeInt64:
-			bytesNeeded = storage.CalcBytesNeeded(binary.MaxVarintLen64)
-		case FieldTypeUint64:
-			bytesNeeded = storage.CalcBytesNeeded(binary.MaxVarintLen64)
-		case FieldTypeString:
-			bytesNeeded = storage.CalcBytesNeeded(f.length * utf8.UTFMax)
-		}
-		pos += bytesNeeded
+		pos += enc.Int64Size()
 	}
 	slotSize := pos
 
@@ -117,9 +117,15 @@ func NewLayout(schema *Schema) *Layout {
 		Schema:   schema,
 		offsets:  offsets,
 		slotSize: slotSize,
+		enc:      enc,
 	}
 }
 
+// Tablespace returns the name of the tablespace holding a table having the layout.
+func (l *Layout) Tablespace() string {
+	return l.tablespace
+}
+
 func (l *Layout) offset(fieldName string) (int, error) {
 	v, ok := l.offsets[fieldName]
 	if !ok {
@@ -128,18 +134,54 @@ func (l *Layout) offset(fieldName string) (int, error) {
 	return v, nil
 }
 
+func (l *Layout) maxRecordSize(blkSize int) int {
+	size := l.slotSize
+	for _, f := range l.Schema.fields {
+		if f.Ty == FieldTypeString {
+			size += l.maxInlineStringSize(f.Field, blkSize)
+		}
+	}
+	return size
+}
+
+// maxInlineStringSize returns the maximum size of a string stored in a record page rather than overflow pages.
+func (l *Layout) maxInlineStringSize(f *Field, blkSize int) int {
+	size := l.enc.StringSize(f.length * utf8.UTFMax)
+	if limit := blkSize / 4; size > limit {
+		size = limit
+	}
+	return size
+}
+
 var errRecPageSlotOutOfRange = fmt.Errorf("a slot is out of range")
 
 type slotNum int
 
+const (
+	recPageHdrSlotCount = iota
+	recPageHdrFreeSpaceEnd
+	recPageHdrFragmentedBytes
+	recPageHdrFieldCount
+)
+
+// recordPage is a slotted page: a header, a slot directory, free space, and records growing toward the head.
+// A string field holds 0 when empty, the offset of its data, or the negated number of its first overflow block.
 type recordPage struct {
 	tx     *storage.Transaction
 	blk    *storage.BlockID
 	layout *Layout
+	ovf    *overflowFile
 }
 
 func newRecordPage(tx *storage.Transaction, blk *storage.BlockID, layout *Layout) (*recordPage, error) {
-	err := tx.Pin(blk)
+	return newRecordPageInRing(tx, blk, layout, nil)
+}
+
+func newRecordPageInRing(tx *storage.Transaction, blk *storage.BlockID, layout *Layout, ring *storage.BufferRing) (*recordPage, error) {
+	if layout.enc != tx.Encoding() {
+		return nil, fmt.Errorf("a layout doesn't match the encoding of the database: layout: %v, database: %v", layout.enc, tx.Encoding())
+	}
+	err := tx.PinInRing(blk, ring)
 	if err != nil {
 		return nil, err
 	}
@@ -148,11 +190,12 @@ func newRecordPage(tx *storage.Transaction, blk *storage.BlockID, layout *Layout
 		tx:     tx,
 		blk:    blk,
 		layout: layout,
+		ovf:    newOverflowFile(tx, blk.FileName()),
 	}, nil
 }
 
 func (p *recordPage) readInt64(slot slotNum, fieldName string) (int64, error) {
-	offset, err := p.offset(slot, fieldName)
+	offset, err := p.fieldOffset(slot, fieldName, FieldTypeInt64)
 	if err != nil {
 		return 0, err
 	}
@@ -160,7 +203,7 @@ func (p *recordPage) readInt64(slot slotNum, fieldName string) (int64, error) {
 }
 
 func (p *recordPage) readUint64(slot slotNum, fieldName string) (uint64, error) {
-	offset, err := p.offset(slot, fieldName)
+	offset, err := p.fieldOffset(slot, fieldName, FieldTypeUint64)
 	if err != nil {
 		return 0, err
 	}
@@ -168,15 +211,25 @@ func (p *recordPage) readUint64(slot slotNum, fieldName string) (uint64, error)
 }
 
 func (p *recordPage) readString(slot slotNum, fieldName string) (string, error) {
-	offset, err := p.offset(slot, fieldName)
+	offset, err := p.fieldOffset(slot, fieldName, FieldTypeString)
 	if err != nil {
 		return "", err
 	}
-	return p.tx.ReadString(p.blk.Hash, offset)
+	dataOffset, err := p.tx.ReadInt64(p.blk.Hash, offset)
+	if err != nil {
+		return "", err
+	}
+	if dataOffset == 0 {
+		return "", nil
+	}
+	if dataOffset < 0 {
+		return p.ovf.read(-dataOffset)
+	}
+	return p.tx.ReadString(p.blk.Hash, int(dataOffset))
 }
 
 func (p *recordPage) writeInt64(slot slotNum, fieldName string, val int64) error {
-	offset, err := p.offset(slot, fieldName)
+	offset, err := p.fieldOffset(slot, fieldName, FieldTypeInt64)
 	if err != nil {
 		return err
 	}
@@ -184,7 +237,7 @@ func (p *recordPage) writeInt64(slot slotNum, fieldName string, val int64) error
 }
 
 func (p *recordPage) writeUint64(slot slotNum, fieldName string, val uint64) error {
-	offset, err := p.offset(slot, fieldName)
+	offset, err := p.fieldOffset(slot, fieldName, FieldTypeUint64)
 	if err != nil {
 		return err
 	}
@@ -192,59 +245,122 @@ func (p *recordPage) writeUint64(slot slotNum, fieldName string, val uint64) err
 }
 
 func (p *recordPage) writeString(slot slotNum, fieldName string, val string) error {
-	offset, err := p.offset(slot, fieldName)
+	offset, err := p.fieldOffset(slot, fieldName, FieldTypeString)
 	if err != nil {
 		return err
 	}
-	return p.tx.WriteString(p.blk.Hash, offset, val, true)
-}
+	dataOffset, err := p.tx.ReadInt64(p.blk.Hash, offset)
+	if err != nil {
+		return err
+	}
+	var oldSize int
+	if dataOffset > 0 {
+		old, err := p.tx.ReadString(p.blk.Hash, int(dataOffset))
+		if err != nil {
+			return err
+		}
+		oldSize = p.layout.enc.StringSize(len(old))
+	}
+	newSize := p.layout.enc.StringSize(len(val))
+	f, _ := p.layout.Schema.Field(fieldName)
+	inline := newSize <= p.layout.maxInlineStringSize(f, p.tx.BlockSize())
 
-func (p *recordPage) delete(slot slotNum) error {
-	return p.setToFree(slot, true)
-}
+	if dataOffset > 0 && inline && newSize <= oldSize {
+		err := p.addFragmentedBytes(oldSize - newSize)
+		if err != nil {
+			return err
+		}
+		return p.tx.WriteString(p.blk.Hash, int(dataOffset), val, true)
+	}
 
-func (p *recordPage) format() error {
-	var slot slotNum = 0
-	for {
-		valid, err := p.validSlot(slot)
+	if dataOffset != 0 {
+		if dataOffset > 0 {
+			err = p.addFragmentedBytes(oldSize)
+		} else {
+			err = p.ovf.free(-dataOffset)
+		}
 		if err != nil {
 			return err
 		}
-		if !valid {
-			break
+		err = p.tx.WriteInt64(p.blk.Hash, offset, 0, true)
+		if err != nil {
+			return err
 		}
-		err = p.formatSlot(slot)
+	}
+	if val == "" {
+		return nil
+	}
+	if inline {
+		ok, err := p.ensureFreeSpace(newSize)
 		if err != nil {
 			return err
 		}
-		slot++
+		if ok {
+			newDataOffset, err := p.allocate(newSize, false)
+			if err != nil {
+				return err
+			}
+			// Compaction may have moved the record.
+			offset, err = p.fieldOffset(slot, fieldName, FieldTypeString)
+			if err != nil {
+				return err
+			}
+			err = p.tx.WriteString(p.blk.Hash, newDataOffset, val, true)
+			if err != nil {
+				return err
+			}
+			return p.tx.WriteInt64(p.blk.Hash, offset, int64(newDataOffset), true)
+		}
 	}
-	return nil
+
+	ovfBlkNum, err := p.ovf.write(val)
+	if err != nil {
+		return err
+	}
+	return p.tx.WriteInt64(p.blk.Hash, offset, -ovfBlkNum, true)
 }
 
-func (p *recordPage) formatSlot(slot slotNum) error {
-	err := p.setToFree(slot, false)
+func (p *recordPage) delete(slot slotNum) error {
+	recOffset, err := p.recordOffset(slot)
+	if err != nil {
+		return err
+	}
+	size, err := p.recordSize(recOffset)
 	if err != nil {
 		return err
 	}
 	for _, f := range p.layout.Schema.fields {
-		offset, err := p.offset(slot, f.name)
-		if err != nil {
-			return err
-		}
-		switch f.Ty {
-		case FieldTypeInt64:
-			err = p.tx.WriteInt64(p.blk.Hash, offset, 0, false)
-		case FieldTypeUint64:
-			err = p.tx.WriteUint64(p.blk.Hash, offset, 0, false)
-		case FieldTypeString:
-			err = p.tx.WriteString(p.blk.Hash, offset, "", false)
+		if f.Ty != FieldTypeString {
+			continue
 		}
+		dataOffset, err := p.tx.ReadInt64(p.blk.Hash, recOffset+p.layout.offsets[f.name])
 		if err != nil {
 			return err
 		}
+		if dataOffset < 0 {
+			err := p.ovf.free(-dataOffset)
+			if err != nil {
+				return err
+			}
+		}
 	}
-	return nil
+	err = p.addFragmentedBytes(size)
+	if err != nil {
+		return err
+	}
+	return p.setSlot(slot, 0, true)
+}
+
+func (p *recordPage) format() error {
+	err := p.writeHeader(recPageHdrSlotCount, 0, false)
+	if err != nil {
+		return err
+	}
+	err = p.writeHeader(recPageHdrFreeSpaceEnd, int64(p.tx.BlockSize()), false)
+	if err != nil {
+		return err
+	}
+	return p.writeHeader(recPageHdrFragmentedBytes, 0, false)
 }
 
 func (p *recordPage) insertAfter(slot slotNum) (slotNum, error) {
@@ -252,7 +368,49 @@ func (p *recordPage) insertAfter(slot slotNum) (slotNum, error) {
 	if err != nil {
 		return 0, err
 	}
-	err = p.setToUsed(newSlot, true)
+	slotCount, err := p.readHeader(recPageHdrSlotCount)
+	if err != nil {
+		return 0, err
+	}
+	appending := int64(newSlot) >= slotCount
+	dirGrowth := 0
+	if appending {
+		dirGrowth = p.layout.enc.Int64Size()
+	}
+
+	// Reserve room for strings of their maximum length, capped at the capacity of an empty page.
+	reserved := dirGrowth + p.layout.maxRecordSize(p.tx.BlockSize())
+	if c := p.tx.BlockSize() - p.slotEntryOffset(0); reserved > c {
+		reserved = c
+	}
+	ok, err := p.ensureFreeSpace(reserved)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		if slotCount == 0 {
+			return 0, fmt.Errorf("a record doesn't fit in a page: block size: %v byte, record size: %v byte", p.tx.BlockSize(), p.layout.slotSize)
+		}
+		return 0, errRecPageSlotOutOfRange
+	}
+
+	if appending {
+		err := p.writeHeader(recPageHdrSlotCount, slotCount+1, true)
+		if err != nil {
+			return 0, err
+		}
+	}
+	recOffset, err := p.allocate(p.layout.slotSize, false)
+	if err != nil {
+		return 0, err
+	}
+	for _, f := range p.layout.Schema.fields {
+		err := p.tx.WriteInt64(p.blk.Hash, recOffset+p.layout.offsets[f.name], 0, true)
+		if err != nil {
+			return 0, err
+		}
+	}
+	err = p.setSlot(newSlot, recOffset, true)
 	if err != nil {
 		return 0, err
 	}
@@ -260,7 +418,21 @@ func (p *recordPage) insertAfter(slot slotNum) (slotNum, error) {
 }
 
 func (p *recordPage) findFreeSlotAfter(slot slotNum) (slotNum, error) {
-	return p.findSlotAfter(slot, false)
+	s, err := p.findSlotAfter(slot, false)
+	if err == nil {
+		return s, nil
+	}
+	if !errors.Is(err, errRecPageSlotOutOfRange) {
+		return 0, err
+	}
+	slotCount, err := p.readHeader(recPageHdrSlotCount)
+	if err != nil {
+		return 0, err
+	}
+	if slot >= slotNum(slotCount) {
+		return 0, errRecPageSlotOutOfRange
+	}
+	return slotNum(slotCount), nil
 }
 
 func (p *recordPage) nextUsedSlotAfter(slot slotNum) (slotNum, error) {
@@ -268,74 +440,280 @@ func (p *recordPage) nextUsedSlotAfter(slot slotNum) (slotNum, error) {
 }
 
 func (p *recordPage) findSlotAfter(slot slotNum, used bool) (slotNum, error) {
-	s := slot + 1
-	for {
-		valid, err := p.validSlot(s)
+	slotCount, err := p.readHeader(recPageHdrSlotCount)
+	if err != nil {
+		return 0, err
+	}
+	for s := slot + 1; int64(s) < slotCount; s++ {
+		v, err := p.tx.ReadInt64(p.blk.Hash, p.slotEntryOffset(s))
 		if err != nil {
 			return 0, err
 		}
-		if !valid {
-			return 0, errRecPageSlotOutOfRange
+		if used == (v != 0) {
+			return s, nil
 		}
+	}
+	return 0, errRecPageSlotOutOfRange
+}
 
-		offset, err := p.offset(s, "")
+func (p *recordPage) ensureFreeSpace(size int) (bool, error) {
+	free, err := p.freeSpace()
+	if err != nil {
+		return false, err
+	}
+	if free >= size {
+		return true, nil
+	}
+	fragmented, err := p.readHeader(recPageHdrFragmentedBytes)
+	if err != nil {
+		return false, err
+	}
+	if free+int(fragmented) < size {
+		return false, nil
+	}
+	err = p.compact()
+	if err != nil {
+		return false, err
+	}
+	free, err = p.freeSpace()
+	if err != nil {
+		return false, err
+	}
+	return free >= size, nil
+}
+
+func (p *recordPage) allocate(size int, compactIfNeeded bool) (int, error) {
+	if compactIfNeeded {
+		ok, err := p.ensureFreeSpace(size)
 		if err != nil {
 			return 0, err
 		}
-		v, err := p.tx.ReadInt64(p.blk.Hash, offset)
+		if !ok {
+			return 0, fmt.Errorf("a page doesn't have free space enough: block: %v, requested size: %v byte", p.blk.BlkNum, size)
+		}
+	}
+	free, err := p.freeSpace()
+	if err != nil {
+		return 0, err
+	}
+	if free < size {
+		return 0, fmt.Errorf("a page doesn't have free space enough: block: %v, requested size: %v byte", p.blk.BlkNum, size)
+	}
+	end, err := p.readHeader(recPageHdrFreeSpaceEnd)
+	if err != nil {
+		return 0, err
+	}
+	offset := int(end) - size
+	err = p.writeHeader(recPageHdrFreeSpaceEnd, int64(offset), true)
+	if err != nil {
+		return 0, err
+	}
+	return offset, nil
+}
+
+func (p *recordPage) freeSpace() (int, error) {
+	slotCount, err := p.readHeader(recPageHdrSlotCount)
+	if err != nil {
+		return 0, err
+	}
+	end, err := p.readHeader(recPageHdrFreeSpaceEnd)
+	if err != nil {
+		return 0, err
+	}
+	return int(end) - p.slotEntryOffset(slotNum(slotCount)), nil
+}
+
+type compactedRecord struct {
+	slot      slotNum
+	int64s    map[string]int64
+	uint64s   map[string]uint64
+	strings   map[string]string
+	overflows map[string]int64
+}
+
+func (p *recordPage) compact() error {
+	slotCount, err := p.readHeader(recPageHdrSlotCount)
+	if err != nil {
+		return err
+	}
+	var recs []*compactedRecord
+	for s := slotNum(0); int64(s) < slotCount; s++ {
+		recOffset, err := p.tx.ReadInt64(p.blk.Hash, p.slotEntryOffset(s))
 		if err != nil {
-			return 0, err
+			return err
+		}
+		if recOffset == 0 {
+			continue
 		}
-		if used {
-			if v == 1 {
-				return s, nil
+		rec := &compactedRecord{
+			slot:      s,
+			int64s:    map[string]int64{},
+			uint64s:   map[string]uint64{},
+			strings:   map[string]string{},
+			overflows: map[string]int64{},
+		}
+		for _, f := range p.layout.Schema.fields {
+			var err error
+			switch f.Ty {
+			case FieldTypeInt64:
+				rec.int64s[f.name], err = p.readInt64(s, f.name)
+			case FieldTypeUint64:
+				rec.uint64s[f.name], err = p.readUint64(s, f.name)
+			case FieldTypeString:
+				var dataOffset int64
+				dataOffset, err = p.tx.ReadInt64(p.blk.Hash, int(recOffset)+p.layout.offsets[f.name])
+				if err != nil {
+					break
+				}
+				if dataOffset < 0 {
+					rec.overflows[f.name] = dataOffset
+					break
+				}
+				rec.strings[f.name], err = p.readString(s, f.name)
 			}
-		} else {
-			if v == 0 {
-				return s, nil
+			if err != nil {
+				return err
 			}
 		}
-
-		s++
+		recs = append(recs, rec)
 	}
-}
 
-func (p *recordPage) setToFree(slot slotNum, log bool) error {
-	offset, err := p.offset(slot, "")
+	err = p.writeHeader(recPageHdrFreeSpaceEnd, int64(p.tx.BlockSize()), true)
+	if err != nil {
+		return err
+	}
+	err = p.writeHeader(recPageHdrFragmentedBytes, 0, true)
 	if err != nil {
 		return err
 	}
-	return p.tx.WriteInt64(p.blk.Hash, offset, 0, log)
+	for _, rec := range recs {
+		recOffset, err := p.allocate(p.layout.slotSize, false)
+		if err != nil {
+			return err
+		}
+		for _, f := range p.layout.Schema.fields {
+			fldOffset := recOffset + p.layout.offsets[f.name]
+			var err error
+			switch f.Ty {
+			case FieldTypeInt64:
+				err = p.tx.WriteInt64(p.blk.Hash, fldOffset, rec.int64s[f.name], true)
+			case FieldTypeUint64:
+				err = p.tx.WriteUint64(p.blk.Hash, fldOffset, rec.uint64s[f.name], true)
+			case FieldTypeString:
+				if ref, ok := rec.overflows[f.name]; ok {
+					err = p.tx.WriteInt64(p.blk.Hash, fldOffset, ref, true)
+					break
+				}
+				var dataOffset int
+				if v := rec.strings[f.name]; v != "" {
+					dataOffset, err = p.allocate(p.layout.enc.StringSize(len(v)), false)
+					if err != nil {
+						return err
+					}
+					err = p.tx.WriteString(p.blk.Hash, dataOffset, v, true)
+					if err != nil {
+						return err
+					}
+				}
+				err = p.tx.WriteInt64(p.blk.Hash, fldOffset, int64(dataOffset), true)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		err = p.setSlot(rec.slot, recOffset, true)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func (p *recordPage) setToUsed(slot slotNum, log bool) error {
-	offset, err := p.offset(slot, "")
+func (p *recordPage) recordSize(recOffset int) (int, error) {
+	size := p.layout.slotSize
+	for _, f := range p.layout.Schema.fields {
+		if f.Ty != FieldTypeString {
+			continue
+		}
+		dataOffset, err := p.tx.ReadInt64(p.blk.Hash, recOffset+p.layout.offsets[f.name])
+		if err != nil {
+			return 0, err
+		}
+		if dataOffset <= 0 {
+			continue
+		}
+		v, err := p.tx.ReadString(p.blk.Hash, int(dataOffset))
+		if err != nil {
+			return 0, err
+		}
+		size += p.layout.enc.StringSize(len(v))
+	}
+	return size, nil
+}
+
+func (p *recordPage) addFragmentedBytes(n int) error {
+	if n == 0 {
+		return nil
+	}
+	v, err := p.readHeader(recPageHdrFragmentedBytes)
 	if err != nil {
 		return err
 	}
-	return p.tx.WriteInt64(p.blk.Hash, offset, 1, log)
+	return p.writeHeader(recPageHdrFragmentedBytes, v+int64(n), true)
 }
 
-func (p *recordPage) offset(slot slotNum, fieldName string) (int, error) {
+func (p *recordPage) setSlot(slot slotNum, recOffset int, log bool) error {
+	return p.tx.WriteInt64(p.blk.Hash, p.slotEntryOffset(slot), int64(recOffset), log)
+}
+
+func (p *recordPage) readHeader(field int) (int64, error) {
+	return p.tx.ReadInt64(p.blk.Hash, field*p.layout.enc.Int64Size())
+}
+
+func (p *recordPage) writeHeader(field int, val int64, log bool) error {
+	return p.tx.WriteInt64(p.blk.Hash, field*p.layout.enc.Int64Size(), val, log)
+}
+
+func (p *recordPage) slotEntryOffset(slot slotNum) int {
+	return (recPageHdrFieldCount + int(slot)) * p.layout.enc.Int64Size()
+}
+
+func (p *recordPage) recordOffset(slot slotNum) (int, error) {
 	if slot < 0 {
 		return 0, fmt.Errorf("a negative slot number is invalid: %v", slot)
 	}
-
-	slotOffset := int(slot) * p.layout.slotSize
-	if fieldName == "" {
-		return slotOffset, nil
+	slotCount, err := p.readHeader(recPageHdrSlotCount)
+	if err != nil {
+		return 0, err
 	}
-	fieldOffset, err := p.layout.offset(fieldName)
+	if int64(slot) >= slotCount {
+		return 0, fmt.Errorf("%w: slot: %v", errRecPageSlotOutOfRange, slot)
+	}
+	v, err := p.tx.ReadInt64(p.blk.Hash, p.slotEntryOffset(slot))
 	if err != nil {
 		return 0, err
 	}
-	return slotOffset + fieldOffset, nil
+	if v == 0 {
+		return 0, fmt.Errorf("a slot is free: %v", slot)
+	}
+	return int(v), nil
 }
 
-func (p *recordPage) validSlot(slot slotNum) (bool, error) {
-	offset, err := p.offset(slot+1, "")
+func (p *recordPage) fieldOffset(slot slotNum, fieldName string, ty FieldType) (int, error) {
+	f, ok := p.layout.Schema.Field(fieldName)
+	if !ok {
+		return 0, fmt.Errorf("invalid field name: %v", fieldName)
+	}
+	if f.Ty != ty {
+		return 0, fmt.Errorf("a field type mismatched: field: %v, want: %v, got: %v", fieldName, f.Ty, ty)
+	}
+	recOffset, err := p.recordOffset(slot)
 	if err != nil {
-		return false, err
+		return 0, err
+	}
+	fldOffset, err := p.layout.offset(fieldName)
+	if err != nil {
+		return 0, err
 	}
-	return offset <= p.tx.BlockSize(), nil
+	return recOffset + fldOffset, nil
 }
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/nihei9/simple-db/storage"
@@ -29,12 +30,12 @@ func TestRecordPage(t *testing.T) {
 		dbFileName = filepath.Base(dbFilePath)
 	}
 
-	st, err := storage.InitStorage(context.Background(), &storage.StorageConfig{
+	st, err := storage.InitStorage(context.Background(), storage.TestConfig(&storage.StorageConfig{
 		DirPath:     testDir,
 		LogFileName: logFileName,
 		BlkSize:     400,
 		BufSize:     10,
-	})
+	}))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -46,7 +47,7 @@ func TestRecordPage(t *testing.T) {
 
 	la := NewLayout(sc)
 
-	tx, err := st.NewTransaction()
+	tx, err := st.NewTransaction(context.Background())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -155,6 +156,134 @@ func TestRecordPage(t *testing.T) {
 	}
 }
 
+func TestRecordPage_variableLengthRecords(t *testing.T) {
+	testDir, err := storage.MakeTestDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+
+	var logFileName string
+	var dbFileName string
+	{
+		logFilePath, dbFilePath, err := makeTestLogFileAndDBFile(testDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		logFileName = filepath.Base(logFilePath)
+		dbFileName = filepath.Base(dbFilePath)
+	}
+
+	st, err := storage.InitStorage(context.Background(), storage.TestConfig(&storage.StorageConfig{
+		DirPath:     testDir,
+		LogFileName: logFileName,
+		BlkSize:     1000,
+		BufSize:     10,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sc := NewShcema()
+	sc.Add("A", NewInt64Field())
+	sc.Add("B", NewStringField(100))
+	la := NewLayout(sc)
+
+	tx, err := st.NewTransaction(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	blk, err := tx.AllocBlock(dbFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rp, err := newRecordPage(tx, blk, la)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = rp.format()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vals := map[slotNum]string{}
+	var slot slotNum = -1
+	for i := 0; ; i++ {
+		var err error
+		slot, err = rp.insertAfter(slot)
+		if err != nil {
+			if !errors.Is(err, errRecPageSlotOutOfRange) {
+				t.Fatal(err)
+			}
+			break
+		}
+		err = rp.writeInt64(slot, "A", int64(slot))
+		if err != nil {
+			t.Fatal(err)
+		}
+		v := fmt.Sprintf("#%v", i)
+		err = rp.writeString(slot, "B", v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		vals[slot] = v
+	}
+	// A record having a short string must occupy much less space than the maximum size of the record.
+	if len(vals)*la.maxRecordSize(rp.tx.BlockSize()) <= rp.tx.BlockSize() {
+		t.Fatalf("a page holds too few records: %v records", len(vals))
+	}
+
+	// Delete every other record and make the remaining strings longer. The page runs out of its free space,
+	// so compaction moves the records while the records keep their slot numbers.
+	for s := range vals {
+		if s%2 == 0 {
+			continue
+		}
+		err := rp.delete(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		delete(vals, s)
+	}
+	for s, v := range vals {
+		v = v + strings.Repeat("*", 98)
+		err := rp.writeString(s, "B", v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		vals[s] = v
+	}
+
+	for s, v := range vals {
+		a, err := rp.readInt64(s, "A")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a != int64(s) {
+			t.Fatalf("unexpected value was read: field: %v: want: %v, got: %v", "A", s, a)
+		}
+		b, err := rp.readString(s, "B")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b != v {
+			t.Fatalf("unexpected value was read: field: %v: want: %#v, got: %#v", "B", v, b)
+		}
+	}
+	fragmented, err := rp.readHeader(recPageHdrFragmentedBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fragmented >= int64(len(vals)*la.enc.StringSize(len("#0"))) {
+		t.Fatalf("the page must have been compacted: fragmented: %v byte", fragmented)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
 func makeTestLogFileAndDBFile(dir string) (string, string, error) {
 	logFile, err := storage.MakeTestLogFile(dir)
 	if err != nil {
@@ -12,20 +12,77 @@ type RecordID struct {
 	slotNum slotNum
 }
 
+func (id RecordID) BlockNumber() int {
+	return id.blkNum
+}
+
+func (id RecordID) SlotNumber() int {
+	return int(id.slotNum)
+}
+
+func (id RecordID) String() string {
+	return fmt.Sprintf("[%v, %v]", id.blkNum, id.slotNum)
+}
+
+// errTableScannerNoBlock means that a scanner has no block to read. A read-only transaction cannot allocate a block,
+// so a scanner that it opens on an empty table has none.
+var errTableScannerNoBlock = errors.New("a table scanner has no block because the table is empty")
+
 type TableScanner struct {
 	tx            *storage.Transaction
+	tableName     string
 	tableFileName string
 	layout        *Layout
 	recPage       *recordPage
 	currentSlot   slotNum
+	fsm           *freeSpaceMap
+
+	// ring is the buffer ring the scanner reads blocks into. When ring is nil, the scanner uses the whole pool.
+	ring *storage.BufferRing
+}
+
+type tableScannerOptions struct {
+	ringSize int
 }
 
-func NewTableScanner(tx *storage.Transaction, tableName string, layout *Layout) (*TableScanner, error) {
+type TableScannerOption func(o *tableScannerOptions)
+
+// WithBufferRing makes a scanner read blocks into a ring of `size` buffers instead of the whole buffer pool. Use this
+// option for a bulk scan of a large table so that the scan doesn't evict blocks other transactions use, such as
+// catalog blocks. A scanner using a ring doesn't read blocks ahead because that would fill the pool.
+func WithBufferRing(size int) TableScannerOption {
+	return func(o *tableScannerOptions) {
+		o.ringSize = size
+	}
+}
+
+func NewTableScanner(tx *storage.Transaction, tableName string, layout *Layout, opts ...TableScannerOption) (*TableScanner, error) {
+	if tx.Encoding() == storage.EncodingLegacy {
+		return nil, fmt.Errorf("failed to open a table: %v: %w", tableName, ErrLegacyDatabase)
+	}
+
+	o := &tableScannerOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	// The catalog records the tablespace of a table in its layout, and the storage resolves the directory of
+	// the file through the tablespace.
+	tableFileName := storage.TablespaceFileName(layout.tablespace, fmt.Sprintf("%v.tbl", tableName))
 	s := &TableScanner{
 		tx:            tx,
-		tableFileName: fmt.Sprintf("%v.tbl", tableName),
+		tableName:     tableName,
+		tableFileName: tableFileName,
 		layout:        layout,
 		currentSlot:   -1,
+		fsm:           newFreeSpaceMap(tx, tableFileName),
+	}
+	if o.ringSize > 0 {
+		ring, err := storage.NewBufferRing(o.ringSize)
+		if err != nil {
+			return nil, err
+		}
+		s.ring = ring
 	}
 
 	c, err := tx.BlockCount(s.tableFileName)
@@ -33,6 +90,10 @@ func NewTableScanner(tx *storage.Transaction, tableName string, layout *Layout)
 		return nil, err
 	}
 	if c == 0 {
+		// The scanner of a read-only transaction reports no records instead.
+		if tx.ReadOnly() {
+			return s, nil
+		}
 		err = s.moveToNewBlock()
 	} else {
 		err = s.moveToBlock(0)
@@ -52,10 +113,21 @@ func (s *TableScanner) Close() error {
 }
 
 func (s *TableScanner) BeforeFirst() error {
-	return s.moveToBlock(0)
+	if s.recPage == nil {
+		return nil
+	}
+	err := s.moveToBlock(0)
+	if err != nil {
+		return err
+	}
+	s.readAhead()
+	return nil
 }
 
 func (s *TableScanner) Next() (bool, error) {
+	if s.recPage == nil {
+		return false, nil
+	}
 	for {
 		nextSlot, err := s.recPage.nextUsedSlotAfter(s.currentSlot)
 		if err == nil {
@@ -75,6 +147,8 @@ func (s *TableScanner) Next() (bool, error) {
 			if err != nil {
 				return false, err
 			}
+			// The scanner reads the blocks in order, so we let the storage read the following blocks ahead.
+			s.readAhead()
 			continue
 		}
 		return false, err
@@ -82,57 +156,124 @@ func (s *TableScanner) Next() (bool, error) {
 }
 
 func (s *TableScanner) ReadInt64(fieldName string) (int64, error) {
+	if s.recPage == nil {
+		return 0, errTableScannerNoBlock
+	}
 	return s.recPage.readInt64(s.currentSlot, fieldName)
 }
 
 func (s *TableScanner) ReadUint64(fieldName string) (uint64, error) {
+	if s.recPage == nil {
+		return 0, errTableScannerNoBlock
+	}
 	return s.recPage.readUint64(s.currentSlot, fieldName)
 }
 
 func (s *TableScanner) ReadString(fieldName string) (string, error) {
+	if s.recPage == nil {
+		return "", errTableScannerNoBlock
+	}
 	return s.recPage.readString(s.currentSlot, fieldName)
 }
 
 func (s *TableScanner) WriteInt64(fieldName string, val int64) error {
-	return s.recPage.writeInt64(s.currentSlot, fieldName, val)
+	if s.recPage == nil {
+		return errTableScannerNoBlock
+	}
+	return s.recordWrite(func() error {
+		return s.recPage.writeInt64(s.currentSlot, fieldName, val)
+	})
 }
 
 func (s *TableScanner) WriteUint64(fieldName string, val uint64) error {
-	return s.recPage.writeUint64(s.currentSlot, fieldName, val)
+	if s.recPage == nil {
+		return errTableScannerNoBlock
+	}
+	return s.recordWrite(func() error {
+		return s.recPage.writeUint64(s.currentSlot, fieldName, val)
+	})
 }
 
 func (s *TableScanner) WriteString(fieldName string, val string) error {
-	return s.recPage.writeString(s.currentSlot, fieldName, val)
+	if s.recPage == nil {
+		return errTableScannerNoBlock
+	}
+	return s.recordWrite(func() error {
+		return s.recPage.writeString(s.currentSlot, fieldName, val)
+	})
 }
 
 func (s *TableScanner) Insert() error {
+	if s.recPage == nil {
+		return fmt.Errorf("failed to insert a record: %w", storage.ErrReadOnlyTransaction)
+	}
 	for {
 		newSlot, err := s.recPage.insertAfter(s.currentSlot)
 		if err == nil {
 			s.currentSlot = newSlot
-			return nil
-		}
-		if errors.Is(err, errRecPageSlotOutOfRange) {
-			last, err := s.atLastBlock()
-			if err != nil {
-				return err
-			}
-			if last {
-				err = s.moveToNewBlock()
-			} else {
-				err = s.moveToBlock(s.recPage.blk.BlkNum + 1)
+			if !s.tx.CapturesChanges(s.tableName) {
+				return nil
 			}
+			new, err := s.readRecord()
 			if err != nil {
 				return err
 			}
+			return s.logChange(ChangeKindInsert, nil, new)
+		}
+		if !errors.Is(err, errRecPageSlotOutOfRange) {
+			return err
+		}
+
+		// The current block may have free slots before the current slot, so we search the whole block
+		// before we regard it as full.
+		if s.currentSlot >= 0 {
+			s.currentSlot = -1
 			continue
 		}
-		return err
+		err = s.fsm.markFull(s.recPage.blk.BlkNum, true)
+		if err != nil {
+			return err
+		}
+
+		blkNum, ok, err := s.fsm.findCandidate()
+		if err != nil {
+			return err
+		}
+		if ok {
+			err = s.moveToBlock(blkNum)
+		} else {
+			err = s.moveToNewBlock()
+		}
+		if err != nil {
+			return err
+		}
 	}
 }
 
 func (s *TableScanner) Delete() error {
-	return s.recPage.delete(s.currentSlot)
+	if s.recPage == nil {
+		return errTableScannerNoBlock
+	}
+	var old map[string]interface{}
+	capturing := s.tx.CapturesChanges(s.tableName)
+	if capturing {
+		var err error
+		old, err = s.readRecord()
+		if err != nil {
+			return err
+		}
+	}
+	err := s.recPage.delete(s.currentSlot)
+	if err != nil {
+		return err
+	}
+	if capturing {
+		err := s.logChange(ChangeKindDelete, old, nil)
+		if err != nil {
+			return err
+		}
+	}
+	return s.fsm.markFull(s.recPage.blk.BlkNum, false)
 }
 
 func (s *TableScanner) contain(fieldName string) bool {
@@ -149,10 +290,8 @@ func (s *TableScanner) RecordID() (*RecordID, bool) {
 		return nil, false
 	}
 
-	return &RecordID{
-		blkNum:  s.recPage.blk.BlkNum,
-		slotNum: s.currentSlot,
-	}, true
+	rid := s.currentRecordID()
+	return &rid, true
 }
 
 func (s *TableScanner) moveToBlock(blkNum int) error {
@@ -162,7 +301,7 @@ func (s *TableScanner) moveToBlock(blkNum int) error {
 	}
 
 	blk := storage.NewBlockID(s.tableFileName, blkNum)
-	rp, err := newRecordPage(s.tx, blk, s.layout)
+	rp, err := newRecordPageInRing(s.tx, blk, s.layout, s.ring)
 	if err != nil {
 		return err
 	}
@@ -194,6 +333,13 @@ func (s *TableScanner) moveToNewBlock() error {
 	return nil
 }
 
+func (s *TableScanner) readAhead() {
+	if s.ring != nil {
+		return
+	}
+	s.tx.ReadAhead(s.recPage.blk)
+}
+
 func (s *TableScanner) atLastBlock() (bool, error) {
 	c, err := s.tx.BlockCount(s.tableFileName)
 	if err != nil {
@@ -2,6 +2,7 @@ package table
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -29,12 +30,12 @@ func TestTableScanner(t *testing.T) {
 		tmpTableName = strings.TrimSuffix(filepath.Base(dbFilePath), ".tbl")
 	}
 
-	st, err := storage.InitStorage(context.Background(), &storage.StorageConfig{
+	st, err := storage.InitStorage(context.Background(), storage.TestConfig(&storage.StorageConfig{
 		DirPath:     testDir,
 		LogFileName: logFileName,
 		BlkSize:     400,
 		BufSize:     10,
-	})
+	}))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -46,7 +47,7 @@ func TestTableScanner(t *testing.T) {
 
 	la := NewLayout(sc)
 
-	tx, err := st.NewTransaction()
+	tx, err := st.NewTransaction(context.Background())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -179,3 +180,369 @@ func TestTableScanner(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+// BenchmarkTableScanner_scan reports how many pins miss the buffer pool during a full scan. When the read-ahead
+// worker falls behind, the scan reads the next blocks itself, so misses drop whatever GOMAXPROCS is. Reading in
+// the background saves time only when GOMAXPROCS is greater than 1 (try -cpu 1,4) and blocks aren't in the page
+// cache of the OS.
+func BenchmarkTableScanner_scan(b *testing.B) {
+	for _, readAhead := range []int{0, 8, 32} {
+		b.Run(fmt.Sprintf("read-ahead %v blocks", readAhead), func(b *testing.B) {
+			benchmarkTableScannerScan(b, readAhead)
+		})
+	}
+}
+
+func benchmarkTableScannerScan(b *testing.B, readAhead int) {
+	testDir, err := os.MkdirTemp("", "simple-db-test-*")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+
+	var logFileName string
+	var tmpTableName string
+	{
+		logFilePath, dbFilePath, err := makeTestLogFileAndDBFile(testDir)
+		if err != nil {
+			b.Fatal(err)
+		}
+		logFileName = filepath.Base(logFilePath)
+		tmpTableName = strings.TrimSuffix(filepath.Base(dbFilePath), ".tbl")
+	}
+
+	st, err := storage.InitStorage(context.Background(), storage.TestConfig(&storage.StorageConfig{
+		DirPath:     testDir,
+		LogFileName: logFileName,
+		BlkSize:     4096,
+		BufSize:     64,
+		ReadAhead:   readAhead,
+	}))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer st.Close()
+
+	sc := NewShcema()
+	sc.Add("A", NewInt64Field())
+	sc.Add("B", NewStringField(100))
+	la := NewLayout(sc)
+
+	// The table is much larger than the buffer pool, so every scan reads all blocks from the disk.
+	{
+		tx, err := st.NewTransaction(context.Background())
+		if err != nil {
+			b.Fatal(err)
+		}
+		ts, err := NewTableScanner(tx, tmpTableName, la)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for i := 0; i < 20000; i++ {
+			err := ts.Insert()
+			if err != nil {
+				b.Fatal(err)
+			}
+			err = ts.WriteInt64("A", int64(i))
+			if err != nil {
+				b.Fatal(err)
+			}
+			err = ts.WriteString("B", strings.Repeat("x", 100))
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+		err = ts.Close()
+		if err != nil {
+			b.Fatal(err)
+		}
+		err = tx.Commit()
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	before := st.Stats().Buffer
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tx, err := st.NewReadOnlyTransaction(context.Background())
+		if err != nil {
+			b.Fatal(err)
+		}
+		ts, err := NewTableScanner(tx, tmpTableName, la)
+		if err != nil {
+			b.Fatal(err)
+		}
+		err = ts.BeforeFirst()
+		if err != nil {
+			b.Fatal(err)
+		}
+		for {
+			ok, err := ts.Next()
+			if err != nil {
+				b.Fatal(err)
+			}
+			if !ok {
+				break
+			}
+			_, err = ts.ReadInt64("A")
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+		err = ts.Close()
+		if err != nil {
+			b.Fatal(err)
+		}
+		err = tx.Commit()
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	after := st.Stats().Buffer
+	b.ReportMetric(float64(after.Misses-before.Misses)/float64(b.N), "misses/op")
+	b.ReportMetric(float64(after.ReadAheadHits-before.ReadAheadHits)/float64(b.N), "read-ahead-hits/op")
+}
+
+func TestTableScanner_readOnlyEmptyTable(t *testing.T) {
+	testDir, err := os.MkdirTemp("", "simple-db-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+
+	var logFileName string
+	var tmpTableName string
+	{
+		logFilePath, dbFilePath, err := makeTestLogFileAndDBFile(testDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		logFileName = filepath.Base(logFilePath)
+		tmpTableName = strings.TrimSuffix(filepath.Base(dbFilePath), ".tbl")
+	}
+
+	st, err := storage.InitStorage(context.Background(), storage.TestConfig(&storage.StorageConfig{
+		DirPath:     testDir,
+		LogFileName: logFileName,
+		BlkSize:     400,
+		BufSize:     10,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	sc := NewShcema()
+	sc.Add("A", NewInt64Field())
+	la := NewLayout(sc)
+
+	tx, err := st.NewReadOnlyTransaction(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Commit()
+	ts, err := NewTableScanner(tx, tmpTableName, la)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+
+	t.Run("a read-only scanner of an empty table reports no records", func(t *testing.T) {
+		err := ts.BeforeFirst()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ok, err := ts.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok {
+			t.Fatal("an empty table must have no records")
+		}
+		c, err := tx.BlockCount(ts.tableFileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c != 0 {
+			t.Fatalf("a read-only scanner must not allocate blocks: want: %v, got: %v", 0, c)
+		}
+	})
+
+	t.Run("a read-only scanner of an empty table fails to insert a record", func(t *testing.T) {
+		err := ts.Insert()
+		if !errors.Is(err, storage.ErrReadOnlyTransaction) {
+			t.Fatalf("unexpected error: want: %v, got: %v", storage.ErrReadOnlyTransaction, err)
+		}
+		_, err = ts.ReadInt64("A")
+		if err == nil {
+			t.Fatal("a scanner having no record must fail to read a value")
+		}
+	})
+}
+
+func TestTableScanner_bufferRing(t *testing.T) {
+	testDir, err := os.MkdirTemp("", "simple-db-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+
+	var logFileName string
+	var tmpTableName string
+	{
+		logFilePath, dbFilePath, err := makeTestLogFileAndDBFile(testDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		logFileName = filepath.Base(logFilePath)
+		tmpTableName = strings.TrimSuffix(filepath.Base(dbFilePath), ".tbl")
+	}
+
+	st, err := storage.InitStorage(context.Background(), storage.TestConfig(&storage.StorageConfig{
+		DirPath:     testDir,
+		LogFileName: logFileName,
+		BlkSize:     400,
+		BufSize:     20,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mm *MetadataManager
+	{
+		tx, err := st.NewTransaction(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		mm, err = NewMetadataManager(true, tx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sc := NewShcema()
+		sc.Add("A", NewInt64Field())
+		sc.Add("B", NewStringField(10))
+		err = mm.CreateTable(tx, tmpTableName, sc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		la, err := mm.FindLayout(tx, tmpTableName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The table has many more blocks than the pool has buffers.
+		ts, err := NewTableScanner(tx, tmpTableName, la)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 1000; i++ {
+			err := ts.Insert()
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = ts.WriteInt64("A", int64(i))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = ts.WriteString("B", fmt.Sprintf("#%v", i))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = ts.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tx.Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// We reopen the database so that the pool starts empty.
+	{
+		err := st.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		st, err = storage.InitStorage(context.Background(), storage.TestConfig(&storage.StorageConfig{
+			DirPath:     testDir,
+			LogFileName: logFileName,
+			BlkSize:     400,
+			BufSize:     20,
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tx, err := st.NewTransaction(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		mm, err = NewMetadataManager(false, tx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tx.Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// scan reads the catalog and then all records of the table. It returns how many pins missed the pool when
+	// the catalog was read again after the scan.
+	scan := func(t *testing.T, opts ...TableScannerOption) uint64 {
+		tx, err := st.NewReadOnlyTransaction(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tx.Commit()
+		la, err := mm.FindLayout(tx, tmpTableName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ts, err := NewTableScanner(tx, tmpTableName, la, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		for {
+			ok, err := ts.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ok {
+				break
+			}
+			n++
+		}
+		err = ts.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 1000 {
+			t.Fatalf("unexpected number of records: want: %v, got: %v", 1000, n)
+		}
+
+		misses := st.Stats().Buffer.Misses
+		_, err = mm.FindLayout(tx, tmpTableName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return st.Stats().Buffer.Misses - misses
+	}
+
+	t.Run("a scan using a buffer ring leaves catalog blocks in the pool", func(t *testing.T) {
+		misses := scan(t, WithBufferRing(2))
+		if misses != 0 {
+			t.Fatalf("catalog blocks must stay in the pool: misses: %v", misses)
+		}
+	})
+
+	t.Run("a scan using the whole pool evicts catalog blocks", func(t *testing.T) {
+		misses := scan(t)
+		if misses == 0 {
+			t.Fatal("catalog blocks must be evicted")
+		}
+	})
+}
@@ -0,0 +1,48 @@
+package table
+
+import (
+	"fmt"
+
+	"github.com/nihei9/simple-db/storage"
+)
+
+// TempTable is a table that lives only as long as the transaction that created it, such as a sort run,
+// a materialized intermediate result, or a partition of a hash join. A temporary table isn't in the catalogs, and
+// the transaction doesn't log its modifications. Its files are removed when the transaction ends.
+type TempTable struct {
+	tx        *storage.Transaction
+	tableName string
+	layout    *Layout
+}
+
+// NewTempTable creates an empty temporary table with a schema `sc` in a transaction `tx`.
+func NewTempTable(tx *storage.Transaction, sc *Schema) (*TempTable, error) {
+	tableName := tx.NewTempName()
+	// A table consists of a table file, a free space map, and an overflow file. The latter two are created on
+	// demand, but registering a file that never appears is harmless.
+	for _, ext := range []string{"tbl", "fsm", "ovf"} {
+		err := tx.RegisterTempFile(fmt.Sprintf("%v.%v", tableName, ext))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &TempTable{
+		tx:        tx,
+		tableName: tableName,
+		layout:    NewLayoutWithEncoding(sc, tx.Encoding()),
+	}, nil
+}
+
+// TableName returns the name of the table. The name is unique among the temporary tables in the database.
+func (t *TempTable) TableName() string {
+	return t.tableName
+}
+
+func (t *TempTable) Layout() *Layout {
+	return t.layout
+}
+
+// Open opens a scanner on the table. The scanner must be closed before the transaction ends.
+func (t *TempTable) Open(opts ...TableScannerOption) (*TableScanner, error) {
+	return NewTableScanner(t.tx, t.tableName, t.layout, opts...)
+}
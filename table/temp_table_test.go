@@ -0,0 +1,163 @@
+package table
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nihei9/simple-db/storage"
+)
+
+func TestTempTable(t *testing.T) {
+	testDir, err := storage.MakeTestDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+	logFilePath, _, err := makeTestLogFileAndDBFile(testDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	st, err := storage.InitStorage(ctx, storage.TestConfig(&storage.StorageConfig{
+		DirPath:     testDir,
+		LogFileName: filepath.Base(logFilePath),
+		BlkSize:     400,
+		BufSize:     10,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	sc := NewShcema()
+	sc.Add("id", NewInt64Field())
+	sc.Add("note", NewStringField(8))
+	longNote := strings.Repeat("long note ", 50)
+	// fill inserts records into a temporary table and reads them back. Records having long notes put the notes
+	// in overflow pages.
+	fill := func(t *testing.T, tt *TempTable) {
+		t.Helper()
+		ts, err := tt.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ts.Close()
+		for i := 0; i < 100; i++ {
+			err := ts.Insert()
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = ts.WriteInt64("id", int64(i))
+			if err != nil {
+				t.Fatal(err)
+			}
+			note := fmt.Sprintf("#%v", i)
+			if i%10 == 0 {
+				note = longNote
+			}
+			err = ts.WriteString("note", note)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = ts.BeforeFirst()
+		if err != nil {
+			t.Fatal(err)
+		}
+		count := 0
+		for {
+			ok, err := ts.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ok {
+				break
+			}
+			id, err := ts.ReadInt64("id")
+			if err != nil {
+				t.Fatal(err)
+			}
+			note, err := ts.ReadString("note")
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := fmt.Sprintf("#%v", id)
+			if id%10 == 0 {
+				want = longNote
+			}
+			if note != want {
+				t.Fatalf("unexpected note: want: %v, got: %v", want, note)
+			}
+			count++
+		}
+		if count != 100 {
+			t.Fatalf("unexpected record count: want: %v, got: %v", 100, count)
+		}
+	}
+	tempFiles := func(t *testing.T) []string {
+		t.Helper()
+		matches, err := filepath.Glob(filepath.Join(testDir, storage.TempFilePrefix+"*"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return matches
+	}
+
+	for _, commit := range []bool{true, false} {
+		t.Run(fmt.Sprintf("a transaction removes its temporary tables when it ends: commit: %v", commit), func(t *testing.T) {
+			tx, err := st.NewTransaction(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt1, err := NewTempTable(tx, sc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt2, err := NewTempTable(tx, sc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt1.TableName() == tt2.TableName() || !strings.HasPrefix(tt1.TableName(), storage.TempFilePrefix) {
+				t.Fatalf("unexpected table names: %v, %v", tt1.TableName(), tt2.TableName())
+			}
+			fill(t, tt1)
+			fill(t, tt2)
+			// Each table has a table file, a free space map, and an overflow file.
+			for _, tt := range []*TempTable{tt1, tt2} {
+				for _, ext := range []string{"tbl", "fsm", "ovf"} {
+					_, err := os.Stat(filepath.Join(testDir, fmt.Sprintf("%v.%v", tt.TableName(), ext)))
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			if commit {
+				err = tx.Commit()
+			} else {
+				err = tx.Rollback()
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if files := tempFiles(t); len(files) != 0 {
+				t.Fatalf("temporary files must be removed: %v", files)
+			}
+		})
+	}
+
+	t.Run("a read-only transaction cannot create a temporary table", func(t *testing.T) {
+		tx, err := st.NewReadOnlyTransaction(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tx.Commit()
+		_, err = NewTempTable(tx, sc)
+		if err == nil {
+			t.Fatal("NewTempTable must fail")
+		}
+	})
+}